@@ -0,0 +1,115 @@
+package server
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kailun2047/slowmo/proto"
+)
+
+const (
+	raceReportSeparator = "=================="
+	raceReportHeader    = "WARNING: DATA RACE"
+	// The race detector refers to the main goroutine by name rather than id.
+	mainGoroutineID = 1
+)
+
+var (
+	// e.g. "Previous write at 0x00c0000181c8 by main goroutine:"
+	raceAccessPattern = regexp.MustCompile(`^(?i:(previous )?(atomic )?(read|write)) at 0x([0-9a-f]+) by (?:main goroutine|goroutine (\d+)):$`)
+	// e.g. "Goroutine 8 (running) created at:"
+	raceGoroutinePattern = regexp.MustCompile(`^Goroutine (\d+) \((\w+)\) created at:$`)
+	// e.g. "/tmp/racy.go:11 +0x33"
+	raceFramePosPattern = regexp.MustCompile(`^(.+):(\d+)(?: \+0x[0-9a-f]+)?$`)
+)
+
+// raceReportParser extracts the data races reported by the race detector from
+// the output of a program, which may be split at any point across reads.
+type raceReportParser struct {
+	partialLine  string
+	sawSeparator bool
+	report       *proto.RaceReport // nil if not inside a report
+	callstack    *[]*proto.InterpretedPC
+	frameFunc    string // function of the frame whose position is yet to be seen
+}
+
+// feed consumes the next piece of the output and returns the reports completed
+// by it.
+func (p *raceReportParser) feed(out string) []*proto.RaceReport {
+	var reports []*proto.RaceReport
+	lines := strings.Split(p.partialLine+out, "\n")
+	p.partialLine = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		if report := p.parseLine(strings.TrimSpace(line)); report != nil {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+func (p *raceReportParser) parseLine(line string) *proto.RaceReport {
+	if p.report == nil {
+		if p.sawSeparator && line == raceReportHeader {
+			p.report = &proto.RaceReport{}
+		}
+		p.sawSeparator = line == raceReportSeparator
+		return nil
+	}
+	if line == raceReportSeparator {
+		report := p.report
+		p.report, p.callstack, p.frameFunc = nil, nil, ""
+		// The separator closing a report may also open the next one.
+		p.sawSeparator = true
+		return report
+	}
+
+	if m := raceAccessPattern.FindStringSubmatch(line); m != nil {
+		addr, _ := strconv.ParseUint(m[4], 16, 64)
+		goID := int64(mainGoroutineID)
+		if m[5] != "" {
+			goID, _ = strconv.ParseInt(m[5], 10, 64)
+		}
+		access := &proto.RaceAccess{
+			Write:  boolPtr(strings.EqualFold(m[3], "write")),
+			Atomic: boolPtr(m[2] != ""),
+			Addr:   &addr,
+			GoId:   &goID,
+		}
+		if m[1] != "" {
+			p.report.Previous = access
+		} else {
+			p.report.Current = access
+		}
+		p.callstack, p.frameFunc = &access.Callstack, ""
+	} else if m := raceGoroutinePattern.FindStringSubmatch(line); m != nil {
+		goID, _ := strconv.ParseInt(m[1], 10, 64)
+		goroutine := &proto.RaceGoroutine{
+			GoId:  &goID,
+			State: &m[2],
+		}
+		p.report.Goroutines = append(p.report.Goroutines, goroutine)
+		p.callstack, p.frameFunc = &goroutine.CreationCallstack, ""
+	} else if p.callstack == nil || line == "" {
+		// Lines outside of stacks (e.g. descriptions of the racing location)
+		// are not parsed, and an empty line ends the current stack.
+		p.callstack, p.frameFunc = nil, ""
+	} else if m := raceFramePosPattern.FindStringSubmatch(line); m != nil && p.frameFunc != "" {
+		lineNum, _ := strconv.ParseInt(m[2], 10, 32)
+		lineNum32, fn := int32(lineNum), p.frameFunc
+		*p.callstack = append(*p.callstack, &proto.InterpretedPC{
+			File: &m[1],
+			Line: &lineNum32,
+			Func: &fn,
+		})
+		p.frameFunc = ""
+	} else {
+		// e.g. "main.main.func1()"
+		p.frameFunc = strings.TrimSuffix(line, "()")
+	}
+	return nil
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kailun2047/slowmo/proto"
+)
+
+const testingRaceOutput = `before
+==================
+WARNING: DATA RACE
+Read at 0x00c0000181c8 by goroutine 8:
+  main.main.func1()
+      /tmp/racy.go:11 +0x33
+
+Previous write at 0x00c0000181c8 by main goroutine:
+  main.main()
+      /tmp/racy.go:13 +0x13c
+
+Goroutine 8 (running) created at:
+  main.main()
+      /tmp/racy.go:10 +0xfd
+==================
+==================
+WARNING: DATA RACE
+Atomic write at 0x00c0000181d0 by goroutine 9:
+  main.(*counter).inc()
+      /tmp/racy.go:20 +0x2a
+
+Previous read at 0x00c0000181d0 by goroutine 8:
+  main.main.func1()
+      /tmp/racy.go:11 +0x4f
+
+Goroutine 9 (running) created at:
+  main.main()
+      /tmp/racy.go:14 +0x1a4
+
+Goroutine 8 (finished) created at:
+  main.main()
+      /tmp/racy.go:10 +0xfd
+==================
+after
+Found 2 data race(s)
+`
+
+func testingFrame(fn string, line int32) *proto.InterpretedPC {
+	file := "/tmp/racy.go"
+	return &proto.InterpretedPC{
+		File: &file,
+		Line: &line,
+		Func: &fn,
+	}
+}
+
+func testingAccess(write, atomic bool, addr uint64, goID int64, callstack ...*proto.InterpretedPC) *proto.RaceAccess {
+	return &proto.RaceAccess{
+		Write:     &write,
+		Atomic:    &atomic,
+		Addr:      &addr,
+		GoId:      &goID,
+		Callstack: callstack,
+	}
+}
+
+func testingGoroutine(goID int64, state string, creationCallstack ...*proto.InterpretedPC) *proto.RaceGoroutine {
+	return &proto.RaceGoroutine{
+		GoId:              &goID,
+		State:             &state,
+		CreationCallstack: creationCallstack,
+	}
+}
+
+func TestRaceReportParser(t *testing.T) {
+	expected := []*proto.RaceReport{
+		{
+			Current:  testingAccess(false, false, 0xc0000181c8, 8, testingFrame("main.main.func1", 11)),
+			Previous: testingAccess(true, false, 0xc0000181c8, 1, testingFrame("main.main", 13)),
+			Goroutines: []*proto.RaceGoroutine{
+				testingGoroutine(8, "running", testingFrame("main.main", 10)),
+			},
+		},
+		{
+			Current:  testingAccess(true, true, 0xc0000181d0, 9, testingFrame("main.(*counter).inc", 20)),
+			Previous: testingAccess(false, false, 0xc0000181d0, 8, testingFrame("main.main.func1", 11)),
+			Goroutines: []*proto.RaceGoroutine{
+				testingGoroutine(9, "running", testingFrame("main.main", 14)),
+				testingGoroutine(8, "finished", testingFrame("main.main", 10)),
+			},
+		},
+	}
+
+	// The output is read in chunks of arbitrary sizes.
+	for _, chunkSize := range []int{len(testingRaceOutput), 64, 7, 1} {
+		var (
+			parser  raceReportParser
+			reports []*proto.RaceReport
+		)
+		for start := 0; start < len(testingRaceOutput); start += chunkSize {
+			end := min(start+chunkSize, len(testingRaceOutput))
+			reports = append(reports, parser.feed(testingRaceOutput[start:end])...)
+		}
+		if !reflect.DeepEqual(expected, reports) {
+			t.Errorf("Race reports with chunk size %d didn't match expectation (\nactual:\n%+v\nexpected:\n%+v\n)", chunkSize, reports, expected)
+		}
+	}
+}
@@ -55,9 +55,10 @@ func (server *ExecServer) Exec(req *proto.ExecRequest, stream grpc.ServerStreami
 		go func() {
 			defer close(finishCh)
 			var (
-				n       int
-				readErr error
-				buf     []byte = make([]byte, outputReaderLimit)
+				n          int
+				readErr    error
+				buf        []byte = make([]byte, outputReaderLimit)
+				raceParser raceReportParser
 			)
 			for readErr == nil {
 				n, readErr = pipeReader.Read(buf)
@@ -80,6 +81,20 @@ func (server *ExecServer) Exec(req *proto.ExecRequest, stream grpc.ServerStreami
 						cancelFunc()
 						return
 					}
+					// Race reports are only found in the output of programs
+					// built with the race detector.
+					for _, report := range raceParser.feed(out) {
+						sendErr = stream.Send(&proto.ExecResponse{
+							ExecOneof: &proto.ExecResponse_RaceReport{
+								RaceReport: report,
+							},
+						})
+						if sendErr != nil {
+							logging.Logger().Errorf("[exec server] Error when sending race report to stream: %v", sendErr)
+							cancelFunc()
+							return
+						}
+					}
 				}
 			}
 			if !errors.Is(readErr, io.EOF) {
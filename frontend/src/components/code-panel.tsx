@@ -80,6 +80,10 @@ function AceEditorWrapper() {
     const handleRunqStatusEvent = useBoundStore((state) => state.handleRunqStatusEvent);
     const initThreads = useBoundStore((state) => state.initThreads);
     const handleGoparkEvent = useBoundStore((state) => state.handleGoparkEvent);
+    const handleHandoffpEvent = useBoundStore((state) => state.handleHandoffpEvent);
+    const handlePreemptEvent = useBoundStore((state) => state.handlePreemptEvent);
+    const handleExitsyscallEvent = useBoundStore((state) => state.handleExitsyscallEvent);
+    const handleRunqStealEvent = useBoundStore((state) => state.handleRunqStealEvent);
     const handleGoreadyEvent = useBoundStore((state) => state.handleGoreadyEvent);
 
     const outputRequesting = useOutputStore((state) => state.outputRequesting);
@@ -302,6 +306,31 @@ function AceEditorWrapper() {
                 handleGoparkEvent(event.notificationOneof.goparkEvent);
                 break;
             }
+            case 'handoffpEvent': {
+                handleHandoffpEvent(event.notificationOneof.handoffpEvent);
+                break;
+            }
+            case 'preemptEvent': {
+                handlePreemptEvent(event.notificationOneof.preemptEvent);
+                break;
+            }
+            case 'exitsyscallEvent': {
+                handleExitsyscallEvent(event.notificationOneof.exitsyscallEvent);
+                break;
+            }
+            // The following events don't change the threads or the parked
+            // goroutines drawn, so they're not visualized yet.
+            case 'entersyscallEvent':
+            case 'netpollInjectEvent':
+            case 'timerEvent':
+            case 'gcPhaseEvent':
+            case 'stwEvent':
+            case 'mStateEvent':
+            case 'goexitEvent':
+            case 'panicEvent':
+            case 'raceDetectedEvent':
+                console.debug(`notification event type ${event.notificationOneof.oneofKind} not visualized`);
+                break;
             default:
                 console.warn(`unknown notification event type ${event.notificationOneof.oneofKind}`)
         }
@@ -321,6 +350,19 @@ function AceEditorWrapper() {
                 handleGoreadyEvent(event.structureStateOneof.goreadyEvent);
                 break;
             }
+            case 'runqStealEvent': {
+                handleRunqStealEvent(event.structureStateOneof.runqStealEvent);
+                break;
+            }
+            // Only the local runqs are drawn, so the other structures are not
+            // visualized yet.
+            case 'globalRunqStatusEvent':
+            case 'channelStateEvent':
+            case 'semaphoreStateEvent':
+            case 'timerHeapStatusEvent':
+            case 'idleListEvent':
+                console.debug(`structure state event type ${event.structureStateOneof.oneofKind} not visualized`);
+                break;
             default:
                 console.warn(`unknown structure state event type ${event.structureStateOneof.oneofKind}`);
         }
@@ -1,10 +1,10 @@
-import { ScheduleReason, type ExecuteEvent, type GoparkEvent, type GoreadyEvent, type ScheduleEvent } from '../../proto/slowmo';
+import { PreemptKind, ScheduleReason, type ExecuteEvent, type ExitsyscallEvent, type GoparkEvent, type GoreadyEvent, type HandoffpEvent, type PreemptEvent, type RunqStealEvent, type ScheduleEvent } from '../../proto/slowmo';
 import { useBoundStore, type BoundState } from './store';
 
 type SharedSliceTestInput = {
     testName: string;
     previousState: Partial<BoundState>;
-    event: ScheduleEvent | ExecuteEvent | GoparkEvent | GoreadyEvent;
+    event: ScheduleEvent | ExecuteEvent | GoparkEvent | GoreadyEvent | HandoffpEvent | PreemptEvent | ExitsyscallEvent | RunqStealEvent;
     handler: (event: any) => void;
     expectedState: Partial<BoundState>;
 };
@@ -14,6 +14,10 @@ describe('SharedSlice handle event', () => {
     const handleExecuteEvent = useBoundStore.getState().handleExecuteEvent;
     const handleGoparkEvent = useBoundStore.getState().handleGoparkEvent;
     const handleGoreadyEvent = useBoundStore.getState().handleGoreadyEvent;
+    const handleHandoffpEvent = useBoundStore.getState().handleHandoffpEvent;
+    const handlePreemptEvent = useBoundStore.getState().handlePreemptEvent;
+    const handleExitsyscallEvent = useBoundStore.getState().handleExitsyscallEvent;
+    const handleRunqStealEvent = useBoundStore.getState().handleRunqStealEvent;
     const inputs: SharedSliceTestInput[] = [
         {
             testName: 'M-P binding changes on schedule event (new M created)',
@@ -458,6 +462,295 @@ describe('SharedSlice handle event', () => {
                 ],
             },
         },
+        {
+            testName: 'P handed off from M in syscall to another M',
+            previousState: {
+                threads: [
+                    {
+                        mId: 0,
+                        isScheduling: false,
+                        p: {
+                            id: 0,
+                            runq: [],
+                        },
+                    },
+                    {
+                        mId: 1,
+                        isScheduling: false,
+                        p: {
+                            id: 1,
+                            runq: [],
+                        },
+                    },
+                ],
+            },
+            event: {
+                mId: BigInt(0),
+                procId: BigInt(1),
+                syscallMId: BigInt(1),
+                receivingMId: BigInt(2),
+            },
+            handler: handleHandoffpEvent,
+            expectedState: {
+                threads: [
+                    {
+                        mId: 0,
+                        isScheduling: false,
+                        p: {
+                            id: 0,
+                            runq: [],
+                        },
+                    },
+                    {
+                        mId: 1,
+                        isScheduling: false,
+                        p: undefined,
+                    },
+                    {
+                        mId: 2,
+                        isScheduling: false,
+                        p: {
+                            id: 1,
+                            runq: [],
+                        },
+                    },
+                ],
+            },
+        },
+        {
+            testName: 'P handed off from M in syscall to the idle list',
+            previousState: {
+                threads: [
+                    {
+                        mId: 0,
+                        isScheduling: false,
+                        p: {
+                            id: 0,
+                            runq: [],
+                        },
+                    },
+                    {
+                        mId: 1,
+                        isScheduling: false,
+                        p: {
+                            id: 1,
+                            runq: [],
+                        },
+                    },
+                ],
+            },
+            event: {
+                mId: BigInt(0),
+                procId: BigInt(1),
+                syscallMId: BigInt(1),
+            },
+            handler: handleHandoffpEvent,
+            expectedState: {
+                threads: [
+                    {
+                        mId: 0,
+                        isScheduling: false,
+                        p: {
+                            id: 0,
+                            runq: [],
+                        },
+                    },
+                    {
+                        mId: 1,
+                        isScheduling: false,
+                        p: undefined,
+                    },
+                    // The P is in the idle list, without an M bound.
+                    {
+                        isScheduling: false,
+                        p: {
+                            id: 1,
+                            runq: [],
+                        },
+                    },
+                ],
+            },
+        },
+        {
+            testName: 'Preempted goroutine stops executing',
+            previousState: {
+                threads: [
+                    {
+                        mId: 0,
+                        isScheduling: false,
+                        p: {
+                            id: 0,
+                            runq: [],
+                        },
+                        executing: {
+                            id: 1,
+                            entryFunc: 'main.main',
+                        },
+                    },
+                ],
+            },
+            event: {
+                mId: BigInt(0),
+                procId: BigInt(0),
+                preempted: {
+                    goId: BigInt(1),
+                },
+                kind: PreemptKind.PREEMPT_ASYNC,
+            },
+            handler: handlePreemptEvent,
+            expectedState: {
+                threads: [
+                    {
+                        mId: 0,
+                        isScheduling: false,
+                        p: {
+                            id: 0,
+                            runq: [],
+                        },
+                        executing: undefined,
+                    },
+                ],
+            },
+        },
+        {
+            testName: 'Idle P re-acquired on exitsyscall fast path',
+            previousState: {
+                threads: [
+                    {
+                        mId: 0,
+                        isScheduling: false,
+                        p: {
+                            id: 0,
+                            runq: [],
+                        },
+                    },
+                    {
+                        mId: 1,
+                        isScheduling: false,
+                        p: undefined,
+                    },
+                    {
+                        isScheduling: false,
+                        p: {
+                            id: 1,
+                            runq: [],
+                        },
+                    },
+                ],
+            },
+            event: {
+                mId: BigInt(1),
+                procId: BigInt(1),
+                fast: true,
+            },
+            handler: handleExitsyscallEvent,
+            expectedState: {
+                threads: [
+                    {
+                        mId: 0,
+                        isScheduling: false,
+                        p: {
+                            id: 0,
+                            runq: [],
+                        },
+                    },
+                    {
+                        mId: 1,
+                        isScheduling: false,
+                        p: {
+                            id: 1,
+                            runq: [],
+                        },
+                    },
+                ],
+            },
+        },
+        {
+            testName: 'Runqs updated on runq steal',
+            previousState: {
+                threads: [
+                    {
+                        mId: 0,
+                        isScheduling: false,
+                        p: {
+                            id: 0,
+                            runq: [
+                                {
+                                    id: 2,
+                                    entryFunc: 'main.main.func1',
+                                },
+                                {
+                                    id: 3,
+                                    entryFunc: 'main.main.func1',
+                                },
+                            ],
+                        },
+                    },
+                    {
+                        mId: 1,
+                        isScheduling: true,
+                        p: {
+                            id: 1,
+                            runq: [],
+                        },
+                    },
+                ],
+            },
+            event: {
+                mId: BigInt(1),
+                thiefProcId: BigInt(1),
+                victimProcId: BigInt(0),
+                numStolen: BigInt(1),
+                before: [],
+                after: [
+                    {
+                        procId: BigInt(0),
+                        mId: BigInt(0),
+                        runqEntries: [
+                            {
+                                goId: BigInt(3),
+                                executionContext: {
+                                    func: 'main.main.func1',
+                                },
+                            },
+                        ],
+                    },
+                    {
+                        procId: BigInt(1),
+                        mId: BigInt(1),
+                        runqEntries: [],
+                    },
+                ],
+            },
+            handler: handleRunqStealEvent,
+            expectedState: {
+                threads: [
+                    {
+                        mId: 0,
+                        isScheduling: false,
+                        p: {
+                            id: 0,
+                            runq: [
+                                {
+                                    id: 3,
+                                    entryFunc: 'main.main.func1',
+                                },
+                            ],
+                            runnext: undefined,
+                        },
+                    },
+                    {
+                        mId: 1,
+                        isScheduling: true,
+                        p: {
+                            id: 1,
+                            runq: [],
+                            runnext: undefined,
+                        },
+                    },
+                ],
+            },
+        },
     ];
     
     test.each(inputs)('$testName', ({previousState, event, handler, expectedState}) => {
@@ -1,5 +1,5 @@
 import { create as actualCreate, type ExtractState, type StateCreator } from "zustand";
-import { ExecuteEvent, GoparkEvent, GoreadyEvent, NewProcEvent, RunqStatusEvent, ScheduleEvent } from "../../proto/slowmo";
+import { ExecuteEvent, ExitsyscallEvent, GoparkEvent, GoreadyEvent, HandoffpEvent, NewProcEvent, PreemptEvent, PreemptKind, RunqStatusEvent, RunqStealEvent, ScheduleEvent } from "../../proto/slowmo";
 import { pickPastelColor, type HSL } from "../lib/color-picker";
 import {isNil} from 'lodash';
 
@@ -195,6 +195,10 @@ interface SharedSlice {
     handleRunqStatusEvent: (event: RunqStatusEvent) => void;
     handleGoparkEvent: (event: GoparkEvent) => void;
     handleGoreadyEvent: (event: GoreadyEvent) => void;
+    handleHandoffpEvent: (event: HandoffpEvent) => void;
+    handlePreemptEvent: (event: PreemptEvent) => void;
+    handleExitsyscallEvent: (event: ExitsyscallEvent) => void;
+    handleRunqStealEvent: (event: RunqStealEvent) => void;
     // updateStructures is used to render local/global structure state changes
     // for an individual event.
     updateStructures: (collectedStructures: Structure[]) => void;
@@ -399,6 +403,89 @@ const createSharedSlice: StateCreator<
         ]);
     },
 
+    handleHandoffpEvent: (event: HandoffpEvent) => {
+        const {procId, receivingMId} = event;
+        if (procId === undefined) {
+            throw new Error(`invalid handoffp event from mId ${event.mId}`);
+        }
+        // The P is taken from the M blocked in syscall (or otherwise giving
+        // it up) and bound to the receiving M. When there's no receiving M,
+        // the P is put on the idle list, i.e. left unbound like the idle Ps
+        // of initThreads.
+        if (!isNil(receivingMId)) {
+            const threads = checkAndApplyMPBindingChange(get().threads, Number(receivingMId), Number(procId));
+            set(() => ({
+                threads: [...threads],
+            }));
+            return;
+        }
+        const threads = get().threads;
+        const existingThread = threads.find((thread) => thread.p?.id === Number(procId));
+        if (existingThread === undefined) {
+            throw new Error(`no existing thread found for procId ${procId}`);
+        }
+        set(() => ({
+            threads: [
+                ...threads
+                    .map((thread) => thread === existingThread? {...thread, p: undefined}: thread)
+                    .filter((thread) => thread.mId !== undefined || thread.p !== undefined),
+                {isScheduling: false, p: existingThread.p},
+            ],
+        }));
+    },
+
+    handlePreemptEvent: (event: PreemptEvent) => {
+        const {mId, kind} = event;
+        if (mId === undefined) {
+            throw new Error(`invalid preempt event of kind ${kind}`);
+        }
+        // A preemption request only asks the goroutine to yield. The goroutine
+        // stops executing once it yields at a stack check or is interrupted by
+        // the preemption signal, and the M goes on to schedule another one.
+        if (kind === PreemptKind.PREEMPT_REQUEST) {
+            return;
+        }
+        get().updateStructures([
+            {
+                mId: Number(mId),
+                structureType: StructureType.Executing,
+                value: undefined,
+            },
+        ]);
+    },
+
+    handleExitsyscallEvent: (event: ExitsyscallEvent) => {
+        const {mId, procId} = event;
+        if (mId === undefined) {
+            throw new Error(`invalid exitsyscall event on procId ${procId}`);
+        }
+        // The M re-acquires a P on the fast path, which is either the one it
+        // entered the syscall with or an idle one. Otherwise it gives up the
+        // goroutine and gets a P once it schedules again.
+        if (isNil(procId)) {
+            return;
+        }
+        const threads = checkAndApplyMPBindingChange(get().threads, Number(mId), Number(procId));
+        set(() => ({
+            threads: [...threads],
+        }));
+    },
+
+    handleRunqStealEvent: (event: RunqStealEvent) => {
+        const {thiefProcId, victimProcId, after} = event;
+        if (thiefProcId === undefined || victimProcId === undefined) {
+            throw new Error(`invalid runqStealEvent (thief procId: ${thiefProcId}, victim procId: ${victimProcId})`);
+        }
+        get().updateStructures(after.map((runqEvent): Structure => {
+            const {mId, proc} = convertRunqStatusEvent(runqEvent);
+            return {
+                mId,
+                structureType: StructureType.LocalRunq,
+                value: proc,
+            };
+        }));
+    },
+
     updateStructures: (structs: Structure[]) => {
         const updatedState: Partial<ThreadsSlice & GlobalStructsSlice> = {};
 
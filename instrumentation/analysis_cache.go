@@ -0,0 +1,161 @@
+package instrumentation
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/kailun2047/slowmo/logging"
+)
+
+// analysisCacheVersion is bumped whenever the content of the cached analysis
+// changes, which invalidates the cache files written before.
+const analysisCacheVersion = 2
+
+// analysis holds the results of decoding the instructions and the line table
+// of a program, which only depend on the content of the program.
+type analysis struct {
+	Version        int                      `json:"version"`
+	BuildID        string                   `json:"build_id"`
+	StartOffsets   map[string]uint64        `json:"start_offsets"`
+	ReturnOffsets  map[string][]uint64      `json:"return_offsets"`
+	PackageOffsets map[string]SymbolOffsets `json:"package_offsets"`
+}
+
+// analysisCache memoizes the analysis of a program, which is persisted to a
+// file keyed by the build ID of the program if a cache directory is given.
+type analysisCache struct {
+	mu    sync.Mutex
+	path  string // empty if the analysis is not persisted
+	dirty bool
+	analysis
+}
+
+func newAnalysisCache(dir, buildID string) *analysisCache {
+	c := &analysisCache{
+		analysis: analysis{
+			Version:        analysisCacheVersion,
+			BuildID:        buildID,
+			StartOffsets:   make(map[string]uint64),
+			ReturnOffsets:  make(map[string][]uint64),
+			PackageOffsets: make(map[string]SymbolOffsets),
+		},
+	}
+	if dir == "" || buildID == "" {
+		return c
+	}
+	// Build IDs contain slashes, so they are hashed into file names.
+	sum := sha256.Sum256([]byte(buildID))
+	c.path = filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+
+	content, err := os.ReadFile(c.path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logging.Logger().Warnf("Failed to read analysis cache %s: %v", c.path, err)
+		}
+		return c
+	}
+	var cached analysis
+	if err := json.Unmarshal(content, &cached); err != nil {
+		logging.Logger().Warnf("Failed to parse analysis cache %s: %v", c.path, err)
+		return c
+	}
+	if cached.Version != analysisCacheVersion || cached.BuildID != buildID {
+		return c
+	}
+	for fnName, offset := range cached.StartOffsets {
+		c.StartOffsets[fnName] = offset
+	}
+	for fnName, offsets := range cached.ReturnOffsets {
+		c.ReturnOffsets[fnName] = offsets
+	}
+	for pkgName, offsets := range cached.PackageOffsets {
+		c.PackageOffsets[pkgName] = offsets
+	}
+	return c
+}
+
+// cachedAnalysis returns the value of key in m, which is computed and stored
+// on a cache miss. Errors are not cached.
+func cachedAnalysis[V any](c *analysisCache, m map[string]V, key string, compute func() (V, error)) (V, error) {
+	c.mu.Lock()
+	v, ok := m[key]
+	c.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+	v, err := compute()
+	if err != nil {
+		return v, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m[key] = v
+	c.dirty = true
+	return v, nil
+}
+
+func (c *analysisCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+	content, err := json.Marshal(&c.analysis)
+	if err != nil {
+		return fmt.Errorf("encode analysis: %w", err)
+	}
+	dir := filepath.Dir(c.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create analysis cache directory: %w", err)
+	}
+	// The file is renamed into place so that concurrent readers never see a
+	// partially written cache.
+	tmp, err := os.CreateTemp(dir, filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create analysis cache file: %w", err)
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write analysis cache %s: %w", c.path, err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// goBuildID returns the build ID recorded by the go linker, or an empty string
+// if the program has none.
+func goBuildID(exe *elf.File) string {
+	sec := exe.Section(".note.go.buildid")
+	if sec == nil {
+		return ""
+	}
+	data, err := sec.Data()
+	if err != nil || len(data) < 12 {
+		return ""
+	}
+	// The note consists of the sizes of its name and description and its
+	// type, followed by the name ("Go") and the description (the build ID),
+	// each padded to 4 bytes.
+	nameSize := exe.ByteOrder.Uint32(data)
+	descSize := exe.ByteOrder.Uint32(data[4:])
+	descStart := 12 + uint64(nameSize+3)&^3
+	if descStart+uint64(descSize) > uint64(len(data)) {
+		return ""
+	}
+	return string(data[descStart : descStart+uint64(descSize)])
+}
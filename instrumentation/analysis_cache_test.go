@@ -0,0 +1,60 @@
+package instrumentation
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestELFInterpreter_AnalysisCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	interpreter, err := NewELFInterpreter("./testdata/greet", WithAnalysisCacheDir(cacheDir))
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+	if interpreter.analysis.BuildID == "" {
+		t.Fatalf("Build ID not found in test program")
+	}
+	symOffsets, err := interpreter.GetInstrumentableOffsetsForPackage("main")
+	if err != nil {
+		t.Fatalf("Get offsets for package main: %v", err)
+	}
+	// The offsets returned are the caller's to modify.
+	symOffsets["main.main"][0]++
+	if again, err := interpreter.GetInstrumentableOffsetsForPackage("main"); err != nil || reflect.DeepEqual(again, symOffsets) {
+		t.Fatalf("Expected the analysis to be unaffected by the returned offsets, got %v (err: %v)", again, err)
+	}
+	symOffsets["main.main"][0]--
+	startOffset, err := interpreter.GetFunctionStartOffset("main.main")
+	if err != nil {
+		t.Fatalf("Get start offset for function main.main: %v", err)
+	}
+	if err := interpreter.SaveAnalysis(); err != nil {
+		t.Fatalf("Save analysis: %v", err)
+	}
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected a single cache file, got %v (err: %v)", entries, err)
+	}
+
+	// A later interpreter of the same program starts with the saved analysis.
+	cached, err := NewELFInterpreter("./testdata/greet", WithAnalysisCacheDir(cacheDir))
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+	if actual := cached.analysis.PackageOffsets["main"]; !reflect.DeepEqual(actual, symOffsets) {
+		t.Errorf("Expected cached offsets %v for package main, got %v", symOffsets, actual)
+	}
+	if actual, ok := cached.analysis.StartOffsets["main.main"]; !ok || actual != startOffset {
+		t.Errorf("Expected cached start offset %d for function main.main, got %d", startOffset, actual)
+	}
+
+	// Programs with a different build ID don't share the analysis.
+	other, err := NewELFInterpreter("./testdata/greet_inlined", WithAnalysisCacheDir(cacheDir))
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+	if len(other.analysis.PackageOffsets) != 0 {
+		t.Errorf("Expected no cached offsets for another program, got %v", other.analysis.PackageOffsets)
+	}
+}
@@ -0,0 +1,194 @@
+package instrumentation
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/arch/arm64/arm64asm"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// Arch is the instruction set architecture of the target program.
+type Arch int
+
+const (
+	ArchAMD64 Arch = iota
+	ArchARM64
+)
+
+const (
+	arm64InstLen = 4
+	// Encoding of the "unsigned lower or same" condition of B.cond, with
+	// which the stack-splitting prologue branches to morestack.
+	arm64CondLS = 0b1001
+	// Encodings of ADRP, ADD (immediate) of 64-bit registers, and the loads
+	// and stores of general registers with an unsigned immediate offset,
+	// which address global variables.
+	arm64OpADRP          = 0x90000000
+	arm64OpADDImm64      = 0x91000000
+	arm64OpLoadStoreUImm = 0x39000000
+
+	// Offsets of g.stackguard0 and g.stackguard1, against which the
+	// stack-splitting prologue compares the stack pointer. The latter is
+	// used by functions that only run on the system stack.
+	gFieldOffsetStackGuard0 = 16
+	gFieldOffsetStackGuard1 = 24
+)
+
+func archFromELFMachine(machine elf.Machine) (Arch, error) {
+	switch machine {
+	case elf.EM_X86_64:
+		return ArchAMD64, nil
+	case elf.EM_AARCH64:
+		return ArchARM64, nil
+	default:
+		return 0, fmt.Errorf("unsupported architecture %s", machine)
+	}
+}
+
+func (arch Arch) String() string {
+	switch arch {
+	case ArchAMD64:
+		return "amd64"
+	case ArchARM64:
+		return "arm64"
+	default:
+		return fmt.Sprintf("Arch(%d)", int(arch))
+	}
+}
+
+// instKind classifies the instructions the interpreter looks for when
+// deciding where to attach probes.
+type instKind int
+
+const (
+	instOther instKind = iota
+	instRet
+	// The stack-splitting prologue compares the stack pointer against the
+	// stack guard and then conditionally branches to morestack. Only the
+	// comparison is told apart from ordinary ones (e.g. bounds checks, which
+	// are followed by the same branch in optimized code).
+	instStackGuardCmp
+	instStackGuardBranch
+)
+
+// decodeInst returns the kind and the length of the instruction at the start
+// of buf.
+func (arch Arch) decodeInst(buf []byte) (instKind, int, error) {
+	switch arch {
+	case ArchARM64:
+		if len(buf) < arm64InstLen {
+			return instOther, 0, fmt.Errorf("truncated instruction")
+		}
+		inst, err := arm64asm.Decode(buf)
+		if err != nil {
+			// Instructions are fixed-size, so undecodable words (e.g. the
+			// padding at the end of a function) are simply skipped.
+			return instOther, arm64InstLen, nil
+		}
+		switch inst.Op {
+		case arm64asm.RET:
+			return instRet, arm64InstLen, nil
+		case arm64asm.CMP:
+			// The stack guard is loaded from g into R16 before it's compared.
+			if guard := inst.Args[1]; guard != nil && guard.String() == arm64asm.X16.String() {
+				return instStackGuardCmp, arm64InstLen, nil
+			}
+		case arm64asm.B:
+			if cond, ok := inst.Args[0].(arm64asm.Cond); ok && cond.Value == arm64CondLS {
+				return instStackGuardBranch, arm64InstLen, nil
+			}
+		}
+		return instOther, arm64InstLen, nil
+	default:
+		inst, err := x86asm.Decode(buf, 64)
+		if err != nil {
+			return instOther, 0, err
+		}
+		switch inst.Op {
+		case x86asm.RET:
+			return instRet, inst.Len, nil
+		case x86asm.CMP:
+			// The stack guard is read from g, which is in R14 in Go functions
+			// and loaded from TLS in assembly functions.
+			guard, ok := inst.Args[1].(x86asm.Mem)
+			isGuard := guard.Disp == gFieldOffsetStackGuard0 || guard.Disp == gFieldOffsetStackGuard1
+			if ok && isGuard && (guard.Base == x86asm.R14 || inst.Args[0] == x86asm.RSP) {
+				return instStackGuardCmp, inst.Len, nil
+			}
+		case x86asm.JBE:
+			return instStackGuardBranch, inst.Len, nil
+		}
+		return instOther, inst.Len, nil
+	}
+}
+
+// dataRefs returns the addresses referenced PC-relatively by the
+// instructions in buf, which start at pc, in the order of the instructions.
+// Go functions refer to global variables this way in both position-dependent
+// and position-independent executables.
+func (arch Arch) dataRefs(buf []byte, pc uint64) []uint64 {
+	var refs []uint64
+	switch arch {
+	case ArchARM64:
+		// A global variable is addressed by ADRP, which loads the 4KB page of
+		// the variable into a register, followed by an ADD or a load/store
+		// with the offset in the page.
+		var pages [32]uint64
+		var hasPage [32]bool
+		for offset := 0; offset+arm64InstLen <= len(buf); offset += arm64InstLen {
+			inst := binary.LittleEndian.Uint32(buf[offset:])
+			rd, rn := inst&0x1f, (inst>>5)&0x1f
+			switch {
+			case inst&0x9f000000 == arm64OpADRP:
+				imm := int64(inst>>29&0x3) | int64(inst>>5&0x7ffff)<<2
+				// Sign-extend the 21-bit page offset.
+				imm = imm << 43 >> 43
+				pages[rd] = (pc+uint64(offset))&^0xfff + uint64(imm<<12)
+				hasPage[rd] = true
+				continue
+			case inst&0xffc00000 == arm64OpADDImm64 && hasPage[rn]:
+				refs = append(refs, pages[rn]+uint64(inst>>10&0xfff))
+			case inst&0x3b000000 == arm64OpLoadStoreUImm && inst&(1<<26) == 0 && hasPage[rn]:
+				// The offset is scaled by the access size.
+				size := inst >> 30
+				refs = append(refs, pages[rn]+uint64(inst>>10&0xfff)<<size)
+			}
+			hasPage[rd] = false
+		}
+	default:
+		for offset := 0; offset < len(buf); {
+			inst, err := x86asm.Decode(buf[offset:], 64)
+			if err != nil {
+				break
+			}
+			offset += inst.Len
+			for _, arg := range inst.Args {
+				if mem, ok := arg.(x86asm.Mem); ok && mem.Base == x86asm.RIP {
+					refs = append(refs, pc+uint64(offset)+uint64(mem.Disp))
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// frameCFA returns the canonical frame address of the function whose frame
+// pointer is fp, where window is the content of the stack starting from sp.
+func (arch Arch) frameCFA(fp, sp uint64, window []byte, byteOrder binary.ByteOrder) (uint64, bool) {
+	switch arch {
+	case ArchARM64:
+		// The return address is saved in the callee's frame instead of being
+		// pushed by the call, and the caller's frame pointer saved at fp sits
+		// right below the caller's stack pointer, which is the CFA.
+		if fp < sp || fp+8 > sp+uint64(len(window)) {
+			return 0, false
+		}
+		return byteOrder.Uint64(window[fp-sp:]) + 8, true
+	default:
+		// The saved frame pointer and the return address sit between the
+		// frame pointer and the CFA.
+		return fp + 16, true
+	}
+}
@@ -0,0 +1,86 @@
+package instrumentation
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+func TestArch_FrameCFA(t *testing.T) {
+	const sp = 0xc000100000
+	window := make([]byte, 0x60)
+	// Frame pointer of the caller saved at fp by the arm64 prologue.
+	binary.LittleEndian.PutUint64(window[0x48:], sp+0x78)
+
+	inputs := []struct {
+		arch        Arch
+		fp          uint64
+		expectedCFA uint64
+		expectedOK  bool
+	}{
+		{arch: ArchAMD64, fp: sp + 0x48, expectedCFA: sp + 0x58, expectedOK: true},
+		{arch: ArchARM64, fp: sp + 0x48, expectedCFA: sp + 0x80, expectedOK: true},
+		// The saved frame pointer is out of the captured window.
+		{arch: ArchARM64, fp: sp + 0x60, expectedOK: false},
+	}
+	for _, input := range inputs {
+		cfa, ok := input.arch.frameCFA(input.fp, sp, window, binary.LittleEndian)
+		if ok != input.expectedOK || cfa != input.expectedCFA {
+			t.Errorf("%s with fp 0x%x: expected (0x%x, %t), got (0x%x, %t)", input.arch, input.fp, input.expectedCFA, input.expectedOK, cfa, ok)
+		}
+	}
+}
+
+func TestArch_DecodeInst(t *testing.T) {
+	inputs := []struct {
+		arch         Arch
+		inst         []byte
+		expectedKind instKind
+	}{
+		// CMPQ SP, 16(R14)
+		{arch: ArchAMD64, inst: []byte{0x49, 0x3b, 0x66, 0x10}, expectedKind: instStackGuardCmp},
+		// CMPQ SP, 24(R14) in functions running on the system stack.
+		{arch: ArchAMD64, inst: []byte{0x49, 0x3b, 0x66, 0x18}, expectedKind: instStackGuardCmp},
+		// CMPQ 0x40(SP), DX of a bounds check.
+		{arch: ArchAMD64, inst: []byte{0x48, 0x39, 0x54, 0x24, 0x40}, expectedKind: instOther},
+		// CMPQ SI, $0x14
+		{arch: ArchAMD64, inst: []byte{0x48, 0x83, 0xfe, 0x14}, expectedKind: instOther},
+		// JBE
+		{arch: ArchAMD64, inst: []byte{0x76, 0x05}, expectedKind: instStackGuardBranch},
+		// CMP R16, RSP
+		{arch: ArchARM64, inst: []byte{0xff, 0x63, 0x30, 0xeb}, expectedKind: instStackGuardCmp},
+		// CMP R1, R0
+		{arch: ArchARM64, inst: []byte{0x1f, 0x00, 0x01, 0xeb}, expectedKind: instOther},
+		// BLS
+		{arch: ArchARM64, inst: []byte{0xc9, 0x04, 0x00, 0x54}, expectedKind: instStackGuardBranch},
+	}
+	for _, input := range inputs {
+		kind, instLen, err := input.arch.decodeInst(input.inst)
+		if err != nil || kind != input.expectedKind || instLen != len(input.inst) {
+			t.Errorf("%s instruction %x: expected kind %d, got %d (length: %d, err: %v)", input.arch, input.inst, input.expectedKind, kind, instLen, err)
+		}
+	}
+}
+
+func TestArch_DataRefs(t *testing.T) {
+	inputs := []struct {
+		arch         Arch
+		insts        []byte
+		pc           uint64
+		expectedRefs []uint64
+	}{
+		// LEAQ 0x15dac0(IP), AX
+		{arch: ArchAMD64, insts: []byte{0x48, 0x8d, 0x05, 0xc0, 0xda, 0x15, 0x00}, pc: 0x414f79, expectedRefs: []uint64{0x572a40}},
+		// ADRP 1003520(PC), R0; ADD $436, R0, R0
+		{arch: ArchARM64, insts: []byte{0xa0, 0x07, 0x00, 0xb0, 0x00, 0xd0, 0x06, 0x91}, pc: 0x87be8, expectedRefs: []uint64{0x17c1b4}},
+		// ADRP 1470464(PC), R27; MOVD 3352(R27), R26
+		{arch: ArchARM64, insts: []byte{0x3b, 0x0b, 0x00, 0xf0, 0x7a, 0x8f, 0x46, 0xf9}, pc: 0x127c0, expectedRefs: []uint64{0x179d18}},
+		// MOVD ZR, R1 doesn't refer to the program data.
+		{arch: ArchARM64, insts: []byte{0xe1, 0x03, 0x1f, 0xaa}, pc: 0x87c00},
+	}
+	for _, input := range inputs {
+		if refs := input.arch.dataRefs(input.insts, input.pc); !slices.Equal(refs, input.expectedRefs) {
+			t.Errorf("%s instructions %x at 0x%x: expected references %x, got %x", input.arch, input.insts, input.pc, input.expectedRefs, refs)
+		}
+	}
+}
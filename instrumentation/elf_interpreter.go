@@ -1,50 +1,227 @@
 package instrumentation
 
 import (
+	"debug/buildinfo"
+	"debug/dwarf"
 	"debug/elf"
 	"debug/gosym"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"reflect"
+	"os"
 	"slices"
-	"unsafe"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/kailun2047/slowmo/logging"
-	"golang.org/x/arch/x86/x86asm"
 )
 
 const (
 	lnTabFieldNameFuncTabN  = "nfunctab"
 	lnTabFieldNameTextStart = "textStart"
+	lnTabFieldNamePCTab     = "pctab"
+	lnTabFieldNameQuantum   = "quantum"
 
 	// functab and funcdata are 2 parts of a single byte chunk, where functab
 	// acts as index and funcdata is the actual data (i.e. _func structures).
 	lnTabFieldNameFuncTab  = "functab"
 	lnTabFieldNameFuncData = "funcdata"
+	lnTabFieldNameFuncName = "funcnametab"
 
-	funcInfoFieldOffsetPCSP = 16
-	funcInfoFieldOffsetFlag = 41
+	funcTabFieldSize             = 4 // Size in bytes of a single functab field; 4 for go version >= 1.18
+	funcInfoFieldOffsetPCSP      = 16
+	funcInfoFieldOffsetPCFile    = 20
+	funcInfoFieldOffsetPCLn      = 24
+	funcInfoFieldOffsetNPCData   = 28
+	funcInfoFieldOffsetFlag      = 41
+	funcInfoFieldOffsetNFuncData = 43
+	// The _func structure is followed by the offsets of its pcdata tables in
+	// pctab and then the offsets of its funcdata relative to go:func.*.
+	funcInfoFieldOffsetPCData = 44
+
+	// Inline tree of a function, which is an array of runtime.inlinedCall
+	// indexed by the value of the function's InlTreeIndex pcdata table.
+	pcdataInlTreeIndex             = 2
+	funcdataInlTree                = 3
+	inlinedCallSize                = 16
+	inlinedCallFieldOffsetNameOff  = 4
+	inlinedCallFieldOffsetParentPC = 8
+	symNameGoFunc                  = "go:func.*"
+
+	// Layout of internal/abi.Type, whose name is stored as an offset relative
+	// to the start of type data (moduledata.types).
+	symNameTypes            = "runtime.types"
+	varNameFirstModuleData  = "runtime.firstmoduledata"
+	abiTypeFieldOffsetTFlag = 20
+	abiTypeFieldOffsetStr   = 40
+	abiTFlagExtraStar       = 1 << 1
+	abiNameMaxVarintLen     = 10
+
+	// A go string is a pointer to its bytes followed by its length.
+	goStringSize = 16
+
+	// DWARF location expression operations used by the Go compiler to place
+	// variables in the stack frame. The frame base of Go functions is the
+	// canonical frame address (CFA).
+	dwOpAddr         = 0x03
+	dwOpConsts       = 0x11
+	dwOpPlus         = 0x22
+	dwOpPlusUconst   = 0x23
+	dwOpFbreg        = 0x91
+	dwOpPiece        = 0x93
+	dwOpCallFrameCFA = 0x9c
+
+	// Kinds of DWARF 5 location list entries.
+	dwLLEEndOfList       = 0x00
+	dwLLEBaseAddressx    = 0x01
+	dwLLEStartxEndx      = 0x02
+	dwLLEStartxLength    = 0x03
+	dwLLEOffsetPair      = 0x04
+	dwLLEDefaultLocation = 0x05
+	dwLLEBaseAddress     = 0x06
+	dwLLEStartEnd        = 0x07
+	dwLLEStartLength     = 0x08
 )
 
+// VariableKind tells how the bytes of a variable are decoded.
+type VariableKind int
+
+const (
+	VariableKindInt VariableKind = iota
+	VariableKindUint
+	VariableKindBool
+	VariableKindString
+	VariableKindPointer
+)
+
+// VariableLocation is where a local variable or an argument of a function is
+// stored in the stack frame at a given PC.
+type VariableLocation struct {
+	Name      string
+	TypeName  string
+	Kind      VariableKind
+	Size      int64
+	CFAOffset int64 // relative to the canonical frame address of the function
+	IsArg     bool
+}
+
+// SourceFrame is a function in the source code that a PC belongs to, which is
+// either the function containing the PC or a function inlined into it.
+type SourceFrame struct {
+	File string
+	Line int
+	Func string
+}
+
+type dwarfSubprogram struct {
+	offset   dwarf.Offset // of the DW_TAG_subprogram entry
+	cuBase   uint64       // base address of location lists in the compile unit
+	addrBase int64        // offset of the compile unit's entries in .debug_addr
+	dwarf5   bool         // whether location lists are in .debug_loclists
+}
+
+// dwarfUnit tells the version of a unit in .debug_info, which decides the
+// format of the location lists it refers to but isn't exposed by debug/dwarf.
+type dwarfUnit struct {
+	end     dwarf.Offset
+	version uint16
+}
+
+type dwarfVariable struct {
+	VariableLocation
+	declLine int
+	ranges   []pcRangeLocation
+}
+
+// pcRangeLocation is the CFA offset of a variable for PC in [low, high).
+type pcRangeLocation struct {
+	low, high uint64
+	cfaOffset int64
+}
+
 type ELFInterpreter struct {
 	goSymTab *gosym.Table // gosym.Table.Syms is nil for go later than 1.3 so we need to consult symbols instead of goSymTab when we need to inspect symbols
 	goLnTab  *gosym.LineTable
-	symbols  []elf.Symbol
+	// Symbol name -> symbol, which is empty if the program is stripped (e.g.
+	// built with -ldflags=-s).
+	symbols map[string]elf.Symbol
+	// Function name -> function in the line table.
+	funcs    map[string]*gosym.Func
 	text     *elf.Section
+	sections []*elf.Section
+	progs    []*elf.Prog
+	entry    uint64
+	arch     Arch
+	// Go version the program is built with (e.g. go1.25.4), which is empty
+	// if the build info is not found.
+	goVersion string
+	// Start of the runtime type data, relative to which type names are
+	// stored. 0 if not found.
+	typesBase uint64
+	// Start of the function data, relative to which the funcdata of
+	// functions (e.g. inline trees) are stored. 0 if not found.
+	goFuncBase uint64
+	// Difference between the runtime addresses and the addresses in the ELF
+	// file, which is only nonzero for position-independent executables.
+	// Methods taking addresses seen in the running program (e.g. PCToLine)
+	// translate them with the load base, while the others work with
+	// addresses in the ELF file.
+	loadBase atomic.Uint64
 	// The byte order info is actually included as an unexported field in
 	// LineTable. Retrieve and store it in a dedicated field for convenience.
 	byteOrder binary.ByteOrder
+
+	// DWARF data is only available if the program is not built with -w.
+	dwarfData        *dwarf.Data
+	debugLoc         []byte
+	debugLocLists    []byte
+	debugAddr        []byte
+	dwarfSubprograms map[uint64]dwarfSubprogram // function entry PC -> subprogram
+	dwarfGlobals     map[string]uint64          // global variable name -> address
+	variablesMu      sync.Mutex
+	variables        map[uint64][]dwarfVariable // function entry PC -> variables, parsed on demand
+
+	lnTabDataOnce sync.Once
+	lnTabData     *lineTableData
+	lnTabDataErr  error
+
+	analysis *analysisCache
+}
+
+type ELFInterpreterOption func(*elfInterpreterConfig)
+
+type elfInterpreterConfig struct {
+	analysisCacheDir string
 }
 
-func NewELFInterpreter(prog string) *ELFInterpreter {
+// WithAnalysisCacheDir persists the analysis of the program (e.g. the offsets
+// to attach probes to) in dir, keyed by the build ID of the program, so that
+// it's reused by later interpreters of the same program.
+func WithAnalysisCacheDir(dir string) ELFInterpreterOption {
+	return func(config *elfInterpreterConfig) {
+		config.analysisCacheDir = dir
+	}
+}
+
+func NewELFInterpreter(prog string, opts ...ELFInterpreterOption) (*ELFInterpreter, error) {
+	var config elfInterpreterConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
 	exe, err := elf.Open(prog)
 	if err != nil {
-		logging.Logger().Fatal("Open ELF file: ", err)
+		return nil, fmt.Errorf("open ELF file: %w", err)
 	}
-	symbols, err := exe.Symbols()
+	arch, err := archFromELFMachine(exe.Machine)
 	if err != nil {
-		logging.Logger().Fatalf("Load ELF symbols for file %s: %v", prog, err)
+		return nil, fmt.Errorf("ELF file %s: %w", prog, err)
+	}
+	// Functions and global variables are looked up in the line table and
+	// DWARF data respectively if the symbol table is stripped.
+	symbols, err := exe.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, fmt.Errorf("load ELF symbols for file %s: %w", prog, err)
 	}
 	slices.SortFunc(symbols, func(a, b elf.Symbol) int {
 		if a.Value < b.Value {
@@ -53,201 +230,615 @@ func NewELFInterpreter(prog string) *ELFInterpreter {
 			return 1
 		}
 	})
-	lnTab, symTab := getGoSymbolTable(exe)
-	return &ELFInterpreter{
+	// The symbol with the lowest address wins if a name is taken by multiple
+	// symbols.
+	symbolsByName := make(map[string]elf.Symbol, len(symbols))
+	for _, symbol := range symbols {
+		if _, ok := symbolsByName[symbol.Name]; !ok {
+			symbolsByName[symbol.Name] = symbol
+		}
+	}
+	lnTab, symTab, err := getGoSymbolTable(exe)
+	if err != nil {
+		return nil, err
+	}
+	funcs := make(map[string]*gosym.Func, len(symTab.Funcs))
+	for i := range symTab.Funcs {
+		if _, ok := funcs[symTab.Funcs[i].Name]; !ok {
+			funcs[symTab.Funcs[i].Name] = &symTab.Funcs[i]
+		}
+	}
+	text, err := getSection(exe, ".text")
+	if err != nil {
+		return nil, err
+	}
+	var goVersion string
+	if info, err := buildinfo.ReadFile(prog); err == nil {
+		goVersion = info.GoVersion
+	}
+	ei := &ELFInterpreter{
 		goSymTab:  symTab,
 		goLnTab:   lnTab,
-		symbols:   symbols,
-		text:      getSection(exe, ".text"),
+		symbols:   symbolsByName,
+		funcs:     funcs,
+		text:      text,
+		sections:  exe.Sections,
+		progs:     exe.Progs,
+		entry:     exe.Entry,
+		arch:      arch,
+		goVersion: goVersion,
 		byteOrder: determineByteOrder(),
+		variables: make(map[uint64][]dwarfVariable),
+		analysis:  newAnalysisCache(config.analysisCacheDir, goBuildID(exe)),
 	}
+	ei.loadDWARF(exe)
+	ei.typesBase = ei.findModuleDataAddr(symNameTypes, "types")
+	ei.goFuncBase = ei.findModuleDataAddr(symNameGoFunc, "gofunc")
+	return ei, nil
 }
 
-func getGoSymbolTable(exe *elf.File) (*gosym.LineTable, *gosym.Table) {
-	textSeg := getSection(exe, ".text")
-	lnTabSeg := getSection(exe, ".gopclntab")
+// loadDWARF indexes the subprograms and global variables in DWARF data of the
+// program. Variables of a subprogram are only parsed when they are first
+// looked up.
+func (ei *ELFInterpreter) loadDWARF(exe *elf.File) {
+	data, err := exe.DWARF()
+	if err != nil {
+		logging.Logger().Warnf("Variables are not available without DWARF data: %v", err)
+		return
+	}
+	// Location lists are stored in .debug_loc in DWARF 4 (i.e. emitted by go
+	// earlier than 1.25), and in .debug_loclists in DWARF 5, where they refer
+	// to addresses in .debug_addr.
+	for _, sec := range []struct {
+		name string
+		data *[]byte
+	}{
+		{".debug_loc", &ei.debugLoc},
+		{".debug_loclists", &ei.debugLocLists},
+		{".debug_addr", &ei.debugAddr},
+	} {
+		if s := exe.Section(sec.name); s != nil {
+			if *sec.data, err = s.Data(); err != nil {
+				logging.Logger().Warnf("Read %s section: %v", sec.name, err)
+			}
+		}
+	}
+	var units []dwarfUnit
+	if sec := exe.Section(".debug_info"); sec != nil {
+		if info, err := sec.Data(); err == nil {
+			units = ei.readDWARFUnits(info)
+		}
+	}
+
+	subprograms := make(map[uint64]dwarfSubprogram)
+	globals := make(map[string]uint64)
+	var (
+		cuBase   uint64
+		addrBase int64
+		dwarf5   bool
+	)
+	reader := data.Reader()
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			logging.Logger().Warnf("Read DWARF entry: %v", err)
+			return
+		}
+		if entry == nil {
+			break
+		}
+		switch entry.Tag {
+		case dwarf.TagCompileUnit:
+			cuBase, _ = entry.Val(dwarf.AttrLowpc).(uint64)
+			addrBase, _ = entry.Val(dwarf.AttrAddrBase).(int64)
+			for len(units) > 0 && units[0].end <= entry.Offset {
+				units = units[1:]
+			}
+			dwarf5 = len(units) > 0 && units[0].version >= 5
+			continue
+		case dwarf.TagSubprogram:
+			if lowPC, ok := entry.Val(dwarf.AttrLowpc).(uint64); ok {
+				subprograms[lowPC] = dwarfSubprogram{offset: entry.Offset, cuBase: cuBase, addrBase: addrBase, dwarf5: dwarf5}
+			}
+		case dwarf.TagVariable:
+			name, _ := entry.Val(dwarf.AttrName).(string)
+			loc, _ := entry.Val(dwarf.AttrLocation).([]byte)
+			if len(loc) == 9 && loc[0] == dwOpAddr {
+				globals[name] = ei.byteOrder.Uint64(loc[1:])
+			}
+		}
+		if entry.Children {
+			reader.SkipChildren()
+		}
+	}
+	ei.dwarfData = data
+	ei.dwarfSubprograms = subprograms
+	ei.dwarfGlobals = globals
+}
+
+func getGoSymbolTable(exe *elf.File) (*gosym.LineTable, *gosym.Table, error) {
+	textSeg, err := getSection(exe, ".text")
+	if err != nil {
+		return nil, nil, err
+	}
+	lnTabSeg, err := getSection(exe, ".gopclntab")
+	if err != nil {
+		return nil, nil, err
+	}
 	lnTabData, err := lnTabSeg.Data()
 	if err != nil {
-		logging.Logger().Fatal("Read line table data: ", err)
+		return nil, nil, fmt.Errorf("%w: read line table data: %v", ErrDecode, err)
 	}
 
 	lnTab := gosym.NewLineTable(lnTabData, textSeg.Addr)
-	symTabSeg := getSection(exe, ".gosymtab")
-	symTabData, err := symTabSeg.Data()
-	if err != nil {
-		logging.Logger().Fatal("Read symbol table data: ", err)
+	// The symbol table is empty since go 1.3 and is left out entirely by
+	// newer linkers, in which case the line table is used alone.
+	var symTabData []byte
+	if symTabSeg := exe.Section(".gosymtab"); symTabSeg != nil {
+		symTabData, err = symTabSeg.Data()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: read symbol table data: %v", ErrDecode, err)
+		}
 	}
 	tab, err := gosym.NewTable(symTabData, lnTab)
 	if err != nil {
-		logging.Logger().Fatal("Create symbol table: ", err)
+		return nil, nil, fmt.Errorf("%w: create symbol table: %v", ErrDecode, err)
 	}
-	return lnTab, tab
+	return lnTab, tab, nil
 }
 
-func getSection(exe *elf.File, name string) *elf.Section {
+func getSection(exe *elf.File, name string) (*elf.Section, error) {
 	sec := exe.Section(name)
 	if sec == nil {
-		logging.Logger().Fatalf("Segment %s not found", name)
+		return nil, fmt.Errorf("%w: section %s", ErrSymbolNotFound, name)
 	}
-	return sec
+	return sec, nil
+}
+
+// Arch returns the architecture the target program is built for.
+func (ei *ELFInterpreter) Arch() Arch {
+	return ei.arch
+}
+
+// SetLoadBase sets where a position-independent target program is loaded,
+// i.e. the difference between its runtime addresses and the addresses in the
+// ELF file.
+func (ei *ELFInterpreter) SetLoadBase(base uint64) {
+	ei.loadBase.Store(base)
+}
+
+// ProcessLoadBase returns the load base of the target program, computed from
+// the memory mappings of the running process of pid.
+func (ei *ELFInterpreter) ProcessLoadBase(pid int) (uint64, error) {
+	// The lowest loaded segment is mapped at the start of the executable.
+	var lowest *elf.Prog
+	for _, prog := range ei.progs {
+		if prog.Type == elf.PT_LOAD && (lowest == nil || prog.Vaddr < lowest.Vaddr) {
+			lowest = prog
+		}
+	}
+	if lowest == nil {
+		return 0, fmt.Errorf("%w: loadable segment", ErrSymbolNotFound)
+	}
+	exePath, err := os.Readlink(ProcessExePath(pid))
+	if err != nil {
+		return 0, fmt.Errorf("resolve executable of process %d: %w", pid, err)
+	}
+	maps, err := os.ReadFile(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return 0, fmt.Errorf("read memory mappings of process %d: %w", pid, err)
+	}
+	// Each line is formatted as "start-end perms offset dev inode path".
+	for _, line := range strings.Split(string(maps), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[5] != exePath {
+			continue
+		}
+		var start, end, offset uint64
+		if _, err := fmt.Sscanf(fields[0], "%x-%x", &start, &end); err != nil {
+			continue
+		}
+		if _, err := fmt.Sscanf(fields[2], "%x", &offset); err != nil || offset != lowest.Off&^(lowest.Align-1) {
+			continue
+		}
+		return start - lowest.Vaddr&^(lowest.Align-1), nil
+	}
+	return 0, fmt.Errorf("%w: mapping of %s in process %d", ErrSymbolNotFound, exePath, pid)
+}
+
+// EntryPoint returns the address of the first instruction run by the
+// program.
+func (ei *ELFInterpreter) EntryPoint() uint64 {
+	return ei.entry
+}
+
+// EntryFunction returns the symbol of the function containing the entry
+// point, and the offset of the entry point in the function.
+func (ei *ELFInterpreter) EntryFunction() (string, uint64, error) {
+	fn := ei.goSymTab.PCToFunc(ei.entry)
+	if fn == nil {
+		return "", 0, fmt.Errorf("%w: function at entry point 0x%x", ErrSymbolNotFound, ei.entry)
+	}
+	symbol, ok := ei.ResolveFunctionSymbol(fn.Name)
+	if !ok {
+		return "", 0, fmt.Errorf("%w: function %s", ErrSymbolNotFound, fn.Name)
+	}
+	return symbol, ei.entry - fn.Entry, nil
+}
+
+// fileOffset returns the offset in the ELF file of the instruction at addr.
+func (ei *ELFInterpreter) fileOffset(addr uint64) (uint64, bool) {
+	for _, prog := range ei.progs {
+		if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_X != 0 && addr >= prog.Vaddr && addr < prog.Vaddr+prog.Filesz {
+			return addr - prog.Vaddr + prog.Off, true
+		}
+	}
+	return 0, false
 }
 
 func (ei *ELFInterpreter) PCToLine(pc uint64) (file string, line int, fn *gosym.Func) {
-	return ei.goSymTab.PCToLine(pc)
+	return ei.goSymTab.PCToLine(pc - ei.loadBase.Load())
+}
+
+// PCToFrames returns the source frames at pc, from the innermost function
+// inlined at pc to the function containing pc, or nil if pc is not in any
+// function. Only the function containing pc is returned if its inline tree
+// cannot be decoded.
+func (ei *ELFInterpreter) PCToFrames(pc uint64) []SourceFrame {
+	pc -= ei.loadBase.Load()
+	fn := ei.goSymTab.PCToFunc(pc)
+	if fn == nil {
+		return nil
+	}
+	calls, err := ei.inlinedCalls(fn.Entry, pc)
+	if err != nil {
+		logging.Logger().Debugf("Ignoring inlined calls at PC %x: %v", pc, err)
+		calls = nil
+	}
+	frames := make([]SourceFrame, 0, len(calls)+1)
+	// The position of each inlined call is the position of its parent PC in
+	// the function containing pc.
+	for _, call := range calls {
+		file, line, _ := ei.goSymTab.PCToLine(pc)
+		frames = append(frames, SourceFrame{File: file, Line: line, Func: call.name})
+		pc = call.parentPC
+	}
+	file, line, _ := ei.goSymTab.PCToLine(pc)
+	return append(frames, SourceFrame{File: file, Line: line, Func: fn.Name})
 }
 
 type SymbolOffsets = map[string][]uint64
 
-func (ei *ELFInterpreter) GetInstrumentableOffsetsForPackage(pkgName string) SymbolOffsets {
+func (ei *ELFInterpreter) GetInstrumentableOffsetsForPackage(pkgName string) (SymbolOffsets, error) {
+	symOffsets, err := cachedAnalysis(ei.analysis, ei.analysis.PackageOffsets, pkgName, func() (SymbolOffsets, error) {
+		return ei.instrumentableOffsetsForPackage(pkgName)
+	})
+	if symOffsets == nil {
+		return nil, err
+	}
+	// The offsets of each symbol are copied too, as they're shared with the
+	// cached analysis.
+	res := make(SymbolOffsets, len(symOffsets))
+	for sym, offsets := range symOffsets {
+		res[sym] = slices.Clone(offsets)
+	}
+	return res, err
+}
+
+func (ei *ELFInterpreter) instrumentableOffsetsForPackage(pkgName string) (SymbolOffsets, error) {
 	var symOffsets SymbolOffsets = make(map[string][]uint64)
 
 	for _, fn := range ei.goSymTab.Funcs {
 		if fn.PackageName() != pkgName {
 			continue
 		}
-		file, startLn, _ := ei.goSymTab.PCToLine(fn.Entry)
-		endLn := startLn
-
-		// Look for the max line number of target function. Termination
-		// condition is pc < fn.End because fn.End holds the entry PC value of
-		// the next function instead of the last PC value of our target
-		// function.
-		for pc := fn.Entry; pc < fn.End; pc++ {
-			curFile, curEndLn, curFn := ei.goSymTab.PCToLine(pc)
-			if curFn != nil && curFn.Name == fn.Name && curFile == file {
-				endLn = max(endLn, curEndLn)
-			}
+		// Assembly functions are listed without the ABI suffix in the line
+		// table.
+		fnSym, ok := ei.ResolveFunctionSymbol(fn.Name)
+		if !ok {
+			return nil, fmt.Errorf("%w: function %s", ErrSymbolNotFound, fn.Name)
 		}
-
-		// For starting line, skip the prologue.
-		startOffset, err := ei.GetFunctionStartOffset(fn.Name)
+		lines, err := ei.functionLines(fn.Entry)
+		if err != nil {
+			return nil, fmt.Errorf("find lines of function %s: %w", fn.Name, err)
+		}
+		// Inlined calls in optimized code run at the lines of the calls.
+		lines, err = ei.callSiteLines(fn.Entry, lines)
 		if err != nil {
-			logging.Logger().Fatalf("Fails to find start offset for function %s", fn.Name)
+			return nil, fmt.Errorf("find lines of inlined calls in function %s: %w", fn.Name, err)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+
+		// For starting line, skip the prologue. Functions small enough to
+		// run without a stack check (i.e. without the prologue) start at the
+		// entry.
+		startOffset, err := ei.GetFunctionStartOffset(fnSym)
+		if errors.Is(err, ErrPrologueNotFound) {
+			startOffset = 0
+		} else if err != nil {
+			return nil, fmt.Errorf("find start offset for function %s: %w", fn.Name, err)
 		}
-		symOffsets[fn.Name] = append(symOffsets[fn.Name], startOffset)
+		symOffsets[fnSym] = append(symOffsets[fnSym], startOffset)
 
+		// Only lines in the file of the function entry are considered, as the
+		// others are from line directives. The first PC of each line is where
+		// the line starts. Lines of optimized code are not contiguous, and
+		// the ones whose first PC precedes the end of the prologue are
+		// covered by the start of the function.
+		file, startLn := lines[0].file, lines[0].line
+		endLn := startLn
+		lineStartPCs := make(map[int32]uint64)
+		for _, lr := range lines {
+			if lr.file != file {
+				continue
+			}
+			endLn = max(endLn, lr.line)
+			if _, ok := lineStartPCs[lr.line]; !ok {
+				lineStartPCs[lr.line] = lr.start
+			}
+		}
 		for ln := startLn + 1; ln <= endLn; ln++ {
-			pc, curFn, err := ei.goSymTab.LineToPC(file, ln)
-			var unknownLnErr *gosym.UnknownLineError
-			if err != nil {
-				if !errors.As(err, &unknownLnErr) {
-					logging.Logger().Fatalf("getInstrumentablePCsForFunc: error finding PC for line %d in file %s: %v", ln, file, err)
-				}
-			} else if curFn != nil && curFn.Name == fn.Name {
-				symOffsets[curFn.Name] = append(symOffsets[curFn.Name], pc-curFn.Entry)
+			if pc, ok := lineStartPCs[ln]; ok && pc-fn.Entry > startOffset {
+				symOffsets[fnSym] = append(symOffsets[fnSym], pc-fn.Entry)
 			}
 		}
 	}
-	return symOffsets
+	if len(symOffsets) == 0 {
+		return nil, fmt.Errorf("%w: no function in package %s", ErrSymbolNotFound, pkgName)
+	}
+	return symOffsets, nil
 }
 
-func (ei *ELFInterpreter) getInstsFromTextSection(fnName string) ([]byte, error) {
-	var (
-		fnSym elf.Symbol
-		buf   []byte
-	)
-
-	for _, symbol := range ei.symbols {
-		if symbol.Name == fnName {
-			fnSym = symbol
-			break
+// lookupFunction returns the entry address and the end address (exclusive) of
+// function fnName, which is looked up in the ELF symbol table, or in the line
+// table if the symbol table is stripped.
+func (ei *ELFInterpreter) lookupFunction(fnName string) (uint64, uint64, bool) {
+	if symbol, ok := ei.symbols[fnName]; ok {
+		return symbol.Value, symbol.Value + symbol.Size, true
+	}
+	if len(ei.symbols) == 0 {
+		if fn, ok := ei.funcs[fnName]; ok {
+			return fn.Entry, fn.End, true
 		}
 	}
-	if len(fnSym.Name) == 0 {
-		return buf, fmt.Errorf("symbol table entry for function %s not found", fnName)
+	return 0, 0, false
+}
+
+// FunctionFileOffset returns the offset in the ELF file of the entry of
+// function fnName, which is where uprobes are attached to regardless of where
+// the program is loaded.
+func (ei *ELFInterpreter) FunctionFileOffset(fnName string) (uint64, error) {
+	entry, _, ok := ei.lookupFunction(fnName)
+	if !ok {
+		return 0, fmt.Errorf("%w: function %s", ErrSymbolNotFound, fnName)
+	}
+	offset, ok := ei.fileOffset(entry)
+	if !ok {
+		return 0, fmt.Errorf("%w: function %s outside of executable segments", ErrDecode, fnName)
+	}
+	return offset, nil
+}
+
+func (ei *ELFInterpreter) getInstsFromTextSection(fnName string) ([]byte, error) {
+	entry, end, ok := ei.lookupFunction(fnName)
+	if !ok {
+		return nil, fmt.Errorf("%w: function %s", ErrSymbolNotFound, fnName)
 	}
-	buf = make([]byte, fnSym.Size)
-	_, err := ei.text.ReadAt(buf, int64(fnSym.Value-ei.text.Addr))
+	buf := make([]byte, end-entry)
+	_, err := ei.text.ReadAt(buf, int64(entry-ei.text.Addr))
 	return buf, err
 }
 
+// ResolveFunctionSymbol returns the name under which function fnName is listed
+// in the ELF symbol table. Assembly (ABI0) functions may be listed with an
+// ".abi0" suffix to tell them apart from their ABIInternal wrappers, while
+// the line table of a stripped program lists them without the suffix.
+func (ei *ELFInterpreter) ResolveFunctionSymbol(fnName string) (string, bool) {
+	for _, candidate := range []string{fnName, fnName + ".abi0"} {
+		if _, _, ok := ei.lookupFunction(candidate); ok {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
 func (ei *ELFInterpreter) GetFunctionReturnOffset(fnName string) ([]uint64, error) {
+	retOffsets, err := cachedAnalysis(ei.analysis, ei.analysis.ReturnOffsets, fnName, func() ([]uint64, error) {
+		return ei.functionReturnOffset(fnName)
+	})
+	return slices.Clone(retOffsets), err
+}
+
+func (ei *ELFInterpreter) functionReturnOffset(fnName string) ([]uint64, error) {
 	retOffsets := []uint64{}
 	buf, err := ei.getInstsFromTextSection(fnName)
 	if err != nil {
 		return retOffsets, err
 	}
 	for offset := 0; offset < len(buf); {
-		inst, err := x86asm.Decode(buf[offset:], 64)
+		kind, instLen, err := ei.arch.decodeInst(buf[offset:])
 		if err != nil {
-			logging.Logger().Fatalf("Decode instruction for symbol %s at offset %d: %v", fnName, offset, err)
+			return nil, fmt.Errorf("%w: instruction for symbol %s at offset %d: %v", ErrDecode, fnName, offset, err)
 		}
-		if inst.Op == x86asm.RET {
+		if kind == instRet {
 			retOffsets = append(retOffsets, uint64(offset))
 		}
-		offset += inst.Len
+		offset += instLen
 	}
 	return retOffsets, nil
 }
 
-var prologueOpSequence = []x86asm.Op{x86asm.CMP, x86asm.JBE}
+var prologueInstSequence = []instKind{instStackGuardCmp, instStackGuardBranch}
 
 // Get the PC of the first instruction after the stack-splitting prologue in a
 // go function.
 func (ei *ELFInterpreter) GetFunctionStartOffset(fnName string) (uint64, error) {
+	return cachedAnalysis(ei.analysis, ei.analysis.StartOffsets, fnName, func() (uint64, error) {
+		return ei.functionStartOffset(fnName)
+	})
+}
+
+func (ei *ELFInterpreter) functionStartOffset(fnName string) (uint64, error) {
 	buf, err := ei.getInstsFromTextSection(fnName)
 	if err != nil {
 		return 0, err
 	}
 	offset, prologueIdxToMatch, nextSearchStart := 0, 0, 0
 	for offset < len(buf) {
-		inst, err := x86asm.Decode(buf[offset:], 64)
+		kind, instLen, err := ei.arch.decodeInst(buf[offset:])
 		if err != nil {
-			logging.Logger().Fatalf("Decode instruction for symbol %s at offset %d: %v", fnName, offset, err)
+			return 0, fmt.Errorf("%w: instruction for symbol %s at offset %d: %v", ErrDecode, fnName, offset, err)
 		}
 		if prologueIdxToMatch == 0 {
-			nextSearchStart = offset + inst.Len
+			nextSearchStart = offset + instLen
 		}
-		if inst.Op == prologueOpSequence[prologueIdxToMatch] {
+		if kind == prologueInstSequence[prologueIdxToMatch] {
 			prologueIdxToMatch++
-			offset += inst.Len
-			if prologueIdxToMatch == len(prologueOpSequence) {
+			offset += instLen
+			if prologueIdxToMatch == len(prologueInstSequence) {
 				break
 			}
 		} else {
+			// Restart the search right after the first instruction of the
+			// partial match.
 			offset = nextSearchStart
+			prologueIdxToMatch = 0
 		}
 	}
-	if prologueIdxToMatch < len(prologueOpSequence) {
-		logging.Logger().Fatalf("Prologue sequence not found in function %s", fnName)
+	if prologueIdxToMatch < len(prologueInstSequence) {
+		return 0, fmt.Errorf("%w: function %s", ErrPrologueNotFound, fnName)
 	}
 	return uint64(offset), nil
 }
 
-func (ei *ELFInterpreter) GetGlobalVariableAddr(varName string) uint64 {
-	var targetSym elf.Symbol
-	for _, sym := range ei.symbols {
-		if sym.Name == varName {
-			targetSym = sym
-			break
+// GetGlobalVariableAddr returns the address of global variable varName,
+// which is looked up in the ELF symbol table, or in DWARF data if the symbol
+// table is stripped. Runtime global variables of programs stripped of both are
+// located by the code referring to them.
+func (ei *ELFInterpreter) GetGlobalVariableAddr(varName string) (uint64, error) {
+	if sym, ok := ei.symbols[varName]; ok && sym.Value != 0 {
+		return sym.Value, nil
+	}
+	if len(ei.symbols) == 0 {
+		if ei.dwarfData == nil {
+			return ei.findRuntimeGlobal(varName)
 		}
+		if addr, ok := ei.dwarfGlobals[varName]; ok {
+			return addr, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: global variable %s", ErrSymbolNotFound, varName)
+}
+
+// findModuleDataAddr finds the start of a region of the program data (e.g.
+// the runtime type data), which is marked by linker symbol symName, or recorded
+// in field of the module data if the symbol table is stripped. 0 if not found.
+func (ei *ELFInterpreter) findModuleDataAddr(symName, field string) uint64 {
+	if sym, ok := ei.symbols[symName]; ok {
+		return sym.Value
+	}
+	moduleDataAddr, err := ei.GetGlobalVariableAddr(varNameFirstModuleData)
+	if err != nil {
+		return 0
 	}
-	if targetSym.Value == 0 {
-		logging.Logger().Fatalf("Global variable %s not found in target program", varName)
+	offsets, err := ei.resolveTargetOffsets([]targetsForPackage{
+		{
+			Package:       "runtime",
+			TargetOffsets: []targetOffset{{Struct: "moduledata", Fields: []string{field}}},
+		},
+	})
+	if err != nil {
+		logging.Logger().Warnf("Cannot find %s without the layout of module data: %v", symName, err)
+		return 0
 	}
-	return targetSym.Value
+	buf := make([]byte, 8)
+	if !ei.readAt(buf, moduleDataAddr+offsets["runtime_moduledata_"+field+"_offset"]) {
+		return 0
+	}
+	return ei.byteOrder.Uint64(buf)
 }
 
-func (ei *ELFInterpreter) ParseFuncTab() []instrumentorGoFuncInfo {
-	var (
-		res              []instrumentorGoFuncInfo
-		nfunctab         uint32
-		funcTab          []byte
-		funcData         []byte
-		funcTabFieldSize = 4 // Size in bytes of a single functab field; 4 for go version >= 1.18
-		textStart        uint64
-	)
-	lnTabV := reflect.ValueOf(ei.goLnTab).Elem()
-	nfunctab = uint32(lnTabV.FieldByName(lnTabFieldNameFuncTabN).Uint())
-	funcTabV := lnTabV.FieldByName(lnTabFieldNameFuncTab)
-	funcTab = *(*[]byte)(unsafe.Pointer(funcTabV.UnsafeAddr()))
-	funcDataV := lnTabV.FieldByName(lnTabFieldNameFuncData)
-	funcData = *(*[]byte)(unsafe.Pointer(funcDataV.UnsafeAddr()))
-	textStart = lnTabV.FieldByName(lnTabFieldNameTextStart).Uint()
-
-	for i := range nfunctab {
-		funcOff := uint64(ei.byteOrder.Uint32(funcTab[(2*i+1)*uint32(funcTabFieldSize):]))
-		funcInfoData := funcData[funcOff:] // The byte chunk of _func struct
+// TypeName returns the name of the runtime type descriptor at typeAddr (e.g.
+// the type word of an interface value), or false if it cannot be decoded.
+func (ei *ELFInterpreter) TypeName(typeAddr uint64) (string, bool) {
+	typesBase := ei.typesBase
+	typeAddr -= ei.loadBase.Load()
+	if typesBase == 0 || typeAddr < typesBase {
+		return "", false
+	}
+	typ := make([]byte, abiTypeFieldOffsetStr+4)
+	if !ei.readAt(typ, typeAddr) {
+		return "", false
+	}
+	tflag := typ[abiTypeFieldOffsetTFlag]
+	nameOff := int32(ei.byteOrder.Uint32(typ[abiTypeFieldOffsetStr:]))
+	nameAddr := typesBase + uint64(nameOff)
+
+	// The name is encoded as a flag byte followed by the varint-encoded length
+	// and the bytes of the name.
+	header := make([]byte, 1+abiNameMaxVarintLen)
+	if !ei.readAt(header, nameAddr) {
+		return "", false
+	}
+	nameLen, n := binary.Uvarint(header[1:])
+	if n <= 0 {
+		return "", false
+	}
+	name := make([]byte, nameLen)
+	if !ei.readAt(name, nameAddr+1+uint64(n)) {
+		return "", false
+	}
+	if tflag&abiTFlagExtraStar != 0 && len(name) > 0 {
+		name = name[1:]
+	}
+	return string(name), true
+}
+
+// readAt fills buf with the content of the loaded section at addr.
+func (ei *ELFInterpreter) readAt(buf []byte, addr uint64) bool {
+	for _, sec := range ei.sections {
+		if sec.Type == elf.SHT_NOBITS || addr < sec.Addr || addr+uint64(len(buf)) > sec.Addr+sec.Size {
+			continue
+		}
+		_, err := sec.ReadAt(buf, int64(addr-sec.Addr))
+		return err == nil
+	}
+	return false
+}
+
+// GetFunctionEntry returns the entry PC of function fnName, or false if the
+// function is not linked into the target program.
+func (ei *ELFInterpreter) GetFunctionEntry(fnName string) (uint64, bool) {
+	fn, ok := ei.funcs[fnName]
+	if !ok {
+		return 0, false
+	}
+	return fn.Entry, true
+}
+
+// GetFunctionRange returns the entry PC and the end PC (exclusive) of function
+// fnName, or false if the function is not linked into the target program.
+func (ei *ELFInterpreter) GetFunctionRange(fnName string) (uint64, uint64, bool) {
+	fn, ok := ei.funcs[fnName]
+	if !ok {
+		return 0, 0, false
+	}
+	return fn.Entry, fn.End, true
+}
+
+func (ei *ELFInterpreter) ParseFuncTab() ([]instrumentorGoFuncInfo, error) {
+	data, err := ei.loadLineTableData()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []instrumentorGoFuncInfo
+	for i := range data.nfunctab {
+		funcTabOff := (2*i + 1) * funcTabFieldSize
+		funcOff := uint64(ei.byteOrder.Uint32(data.funcTab[funcTabOff:]))
+		funcInfoData := data.funcData[funcOff:] // The byte chunk of _func struct
 
 		// Collect data from per-function information
 		// (https://github.com/golang/go/blob/go1.22.5/src/runtime/runtime2.go#L936).
@@ -255,11 +846,478 @@ func (ei *ELFInterpreter) ParseFuncTab() []instrumentorGoFuncInfo {
 		pcsp := ei.byteOrder.Uint32(funcInfoData[funcInfoFieldOffsetPCSP:])
 		flag := funcInfoData[funcInfoFieldOffsetFlag]
 		res = append(res, instrumentorGoFuncInfo{
-			EntryPc: textStart + entryOff,
+			EntryPc: data.textStart + entryOff,
 			Pcsp:    pcsp,
 			Flag:    flag,
 		})
 	}
 
-	return res
+	return res, nil
+}
+
+// SaveAnalysis persists the analysis of the program done so far if an
+// analysis cache directory is set.
+func (ei *ELFInterpreter) SaveAnalysis() error {
+	return ei.analysis.save()
+}
+
+// VariableLocations returns the locals and arguments of the function at pc
+// which are in scope and stored in the stack frame at pc. Variables in
+// registers and variables of kinds other than VariableKind are left out.
+func (ei *ELFInterpreter) VariableLocations(pc uint64) []VariableLocation {
+	pc -= ei.loadBase.Load()
+	fn := ei.goSymTab.PCToFunc(pc)
+	if fn == nil || ei.dwarfData == nil {
+		return nil
+	}
+	_, line, _ := ei.goSymTab.PCToLine(pc)
+
+	var locations []VariableLocation
+	for _, v := range ei.functionVariables(fn.Entry) {
+		// Locals declared later than the current line hold stale values.
+		if !v.IsArg && v.declLine > line {
+			continue
+		}
+		for _, r := range v.ranges {
+			if pc >= r.low && pc < r.high {
+				location := v.VariableLocation
+				location.CFAOffset = r.cfaOffset
+				locations = append(locations, location)
+				break
+			}
+		}
+	}
+	return locations
+}
+
+func (ei *ELFInterpreter) functionVariables(entryPC uint64) []dwarfVariable {
+	ei.variablesMu.Lock()
+	defer ei.variablesMu.Unlock()
+	if vars, ok := ei.variables[entryPC]; ok {
+		return vars
+	}
+	var vars []dwarfVariable
+	if subprogram, ok := ei.dwarfSubprograms[entryPC]; ok {
+		vars = ei.parseVariables(subprogram)
+	}
+	ei.variables[entryPC] = vars
+	return vars
+}
+
+func (ei *ELFInterpreter) parseVariables(subprogram dwarfSubprogram) []dwarfVariable {
+	reader := ei.dwarfData.Reader()
+	reader.Seek(subprogram.offset)
+	fnEntry, err := reader.Next()
+	if err != nil || fnEntry == nil || !fnEntry.Children {
+		return nil
+	}
+	if frameBase, _ := fnEntry.Val(dwarf.AttrFrameBase).([]byte); !slices.Equal(frameBase, []byte{dwOpCallFrameCFA}) {
+		return nil
+	}
+	fnRanges, err := ei.dwarfData.Ranges(fnEntry)
+	if err != nil {
+		return nil
+	}
+
+	var vars []dwarfVariable
+	// Variables declared in a lexical block are only in scope within the PC
+	// ranges of the block.
+	scopes := [][][2]uint64{fnRanges}
+	for len(scopes) > 0 {
+		entry, err := reader.Next()
+		if err != nil || entry == nil {
+			break
+		}
+		switch entry.Tag {
+		case 0:
+			scopes = scopes[:len(scopes)-1]
+			continue
+		case dwarf.TagLexDwarfBlock:
+			if entry.Children {
+				ranges, err := ei.dwarfData.Ranges(entry)
+				if err != nil {
+					reader.SkipChildren()
+					continue
+				}
+				scopes = append(scopes, ranges)
+			}
+			continue
+		case dwarf.TagVariable, dwarf.TagFormalParameter:
+			if v, ok := ei.parseVariable(entry, scopes[len(scopes)-1], subprogram); ok {
+				vars = append(vars, v)
+			}
+		}
+		if entry.Children {
+			reader.SkipChildren()
+		}
+	}
+	return vars
+}
+
+func (ei *ELFInterpreter) parseVariable(entry *dwarf.Entry, scope [][2]uint64, subprogram dwarfSubprogram) (dwarfVariable, bool) {
+	var v dwarfVariable
+	name, _ := entry.Val(dwarf.AttrName).(string)
+	// Skip compiler-generated temporaries and unnamed results.
+	if len(name) == 0 || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~") {
+		return v, false
+	}
+	typeOffset, ok := entry.Val(dwarf.AttrType).(dwarf.Offset)
+	if !ok {
+		return v, false
+	}
+	typ, err := ei.dwarfData.Type(typeOffset)
+	if err != nil {
+		return v, false
+	}
+	kind, ok := variableKind(typ)
+	if !ok {
+		return v, false
+	}
+	declLine, _ := entry.Val(dwarf.AttrDeclLine).(int64)
+	v = dwarfVariable{
+		VariableLocation: VariableLocation{
+			Name:     name,
+			TypeName: ei.dwarfTypeName(typeOffset, typ),
+			Kind:     kind,
+			Size:     typ.Size(),
+			IsArg:    entry.Tag == dwarf.TagFormalParameter,
+		},
+		declLine: int(declLine),
+	}
+
+	field := entry.AttrField(dwarf.AttrLocation)
+	if field == nil {
+		return v, false
+	}
+	switch field.Class {
+	case dwarf.ClassExprLoc:
+		offset, ok := cfaOffset(field.Val.([]byte))
+		if !ok {
+			return v, false
+		}
+		for _, r := range scope {
+			v.ranges = append(v.ranges, pcRangeLocation{low: r[0], high: r[1], cfaOffset: offset})
+		}
+	case dwarf.ClassLocListPtr:
+		if subprogram.dwarf5 {
+			v.ranges = ei.readLocLists(field.Val.(int64), subprogram.cuBase, subprogram.addrBase)
+		} else {
+			v.ranges = ei.readLocList(field.Val.(int64), subprogram.cuBase)
+		}
+	}
+	return v, len(v.ranges) > 0
+}
+
+// dwarfTypeName returns the Go name of a type (e.g. "*os.File"), which is
+// recorded by the compiler for every type but not always kept by debug/dwarf.
+func (ei *ELFInterpreter) dwarfTypeName(offset dwarf.Offset, typ dwarf.Type) string {
+	reader := ei.dwarfData.Reader()
+	reader.Seek(offset)
+	if entry, err := reader.Next(); err == nil && entry != nil {
+		if name, ok := entry.Val(dwarf.AttrName).(string); ok {
+			return name
+		}
+	}
+	return typ.String()
+}
+
+func variableKind(typ dwarf.Type) (VariableKind, bool) {
+	// Maps, channels and funcs are described as typedefs of pointers.
+	for {
+		typedef, ok := typ.(*dwarf.TypedefType)
+		if !ok {
+			break
+		}
+		typ = typedef.Type
+	}
+	switch t := typ.(type) {
+	case *dwarf.IntType:
+		return VariableKindInt, true
+	case *dwarf.UintType:
+		return VariableKindUint, true
+	case *dwarf.BoolType:
+		return VariableKindBool, true
+	case *dwarf.PtrType:
+		return VariableKindPointer, true
+	case *dwarf.StructType:
+		if t.StructName == "string" {
+			return VariableKindString, true
+		}
+	}
+	return 0, false
+}
+
+// readDWARFUnits walks the unit headers in .debug_info.
+func (ei *ELFInterpreter) readDWARFUnits(info []byte) []dwarfUnit {
+	var (
+		units []dwarfUnit
+		off   int
+	)
+	for off+4 <= len(info) {
+		length, headerLen := uint64(ei.byteOrder.Uint32(info[off:])), 4
+		// 64-bit DWARF format.
+		if length == 0xffffffff {
+			if off+12 > len(info) {
+				break
+			}
+			length, headerLen = ei.byteOrder.Uint64(info[off+4:]), 12
+		}
+		if off+headerLen+2 > len(info) || length > uint64(len(info)-off-headerLen) {
+			break
+		}
+		version := ei.byteOrder.Uint16(info[off+headerLen:])
+		off += headerLen + int(length)
+		units = append(units, dwarfUnit{end: dwarf.Offset(off), version: version})
+	}
+	return units
+}
+
+// readLocList reads the location list at offset off of .debug_loc and returns
+// the PC ranges where the variable is stored in the stack frame.
+func (ei *ELFInterpreter) readLocList(off int64, base uint64) []pcRangeLocation {
+	var ranges []pcRangeLocation
+	data := ei.debugLoc
+	for off >= 0 && off+16 <= int64(len(data)) {
+		begin, end := ei.byteOrder.Uint64(data[off:]), ei.byteOrder.Uint64(data[off+8:])
+		off += 16
+		if begin == 0 && end == 0 {
+			break
+		}
+		// Base address selection entry.
+		if begin == ^uint64(0) {
+			base = end
+			continue
+		}
+		if off+2 > int64(len(data)) {
+			break
+		}
+		exprLen := int64(ei.byteOrder.Uint16(data[off:]))
+		off += 2
+		if off+exprLen > int64(len(data)) {
+			break
+		}
+		if offset, ok := cfaOffset(data[off : off+exprLen]); ok {
+			ranges = append(ranges, pcRangeLocation{low: base + begin, high: base + end, cfaOffset: offset})
+		}
+		off += exprLen
+	}
+	return ranges
+}
+
+// readLocLists reads the location list at offset off of .debug_loclists (DWARF
+// 5) and returns the PC ranges where the variable is stored in the stack frame.
+func (ei *ELFInterpreter) readLocLists(off int64, base uint64, addrBase int64) []pcRangeLocation {
+	var ranges []pcRangeLocation
+	data := ei.debugLocLists
+	if off < 0 || off >= int64(len(data)) {
+		return nil
+	}
+	data = data[off:]
+	readULEB := func() (uint64, bool) {
+		n, size := binary.Uvarint(data)
+		if size <= 0 {
+			return 0, false
+		}
+		data = data[size:]
+		return n, true
+	}
+	readAddr := func() (uint64, bool) {
+		if len(data) < 8 {
+			return 0, false
+		}
+		addr := ei.byteOrder.Uint64(data)
+		data = data[8:]
+		return addr, true
+	}
+	readAddrx := func() (uint64, bool) {
+		idx, ok := readULEB()
+		if !ok {
+			return 0, false
+		}
+		pos := addrBase + int64(idx)*8
+		if pos < 0 || pos+8 > int64(len(ei.debugAddr)) {
+			return 0, false
+		}
+		return ei.byteOrder.Uint64(ei.debugAddr[pos:]), true
+	}
+
+	for len(data) > 0 {
+		kind := data[0]
+		data = data[1:]
+		var (
+			low, high uint64
+			ok        bool
+		)
+		switch kind {
+		case dwLLEEndOfList:
+			return ranges
+		case dwLLEBaseAddressx:
+			if base, ok = readAddrx(); !ok {
+				return ranges
+			}
+			continue
+		case dwLLEBaseAddress:
+			if base, ok = readAddr(); !ok {
+				return ranges
+			}
+			continue
+		case dwLLEStartxEndx:
+			if low, ok = readAddrx(); ok {
+				high, ok = readAddrx()
+			}
+		case dwLLEStartxLength:
+			if low, ok = readAddrx(); ok {
+				high, ok = readULEB()
+				high += low
+			}
+		case dwLLEOffsetPair:
+			if low, ok = readULEB(); ok {
+				high, ok = readULEB()
+				low, high = base+low, base+high
+			}
+		case dwLLEStartEnd:
+			if low, ok = readAddr(); ok {
+				high, ok = readAddr()
+			}
+		case dwLLEStartLength:
+			if low, ok = readAddr(); ok {
+				high, ok = readULEB()
+				high += low
+			}
+		case dwLLEDefaultLocation:
+			// Unbounded by PC ranges, which is never emitted by go.
+			ok = true
+		default:
+			return ranges
+		}
+		if !ok {
+			return ranges
+		}
+		exprLen, ok := readULEB()
+		if !ok || exprLen > uint64(len(data)) {
+			return ranges
+		}
+		if kind != dwLLEDefaultLocation {
+			if offset, ok := cfaOffset(data[:exprLen]); ok {
+				ranges = append(ranges, pcRangeLocation{low: low, high: high, cfaOffset: offset})
+			}
+		}
+		data = data[exprLen:]
+	}
+	return ranges
+}
+
+// cfaOffset evaluates a location expression and returns the offset of the
+// location relative to the CFA. A value split into pieces is only supported if
+// the pieces are contiguous in the stack frame.
+func cfaOffset(expr []byte) (int64, bool) {
+	var (
+		offset, start, next int64
+		located, pieced     bool
+	)
+	for len(expr) > 0 {
+		op := expr[0]
+		expr = expr[1:]
+		switch op {
+		case dwOpCallFrameCFA:
+			offset, located = 0, true
+		case dwOpFbreg:
+			n, size := readSLEB128(expr)
+			if size == 0 {
+				return 0, false
+			}
+			expr = expr[size:]
+			offset, located = n, true
+		case dwOpConsts:
+			n, size := readSLEB128(expr)
+			if size == 0 || !located || len(expr) <= size || expr[size] != dwOpPlus {
+				return 0, false
+			}
+			expr = expr[size+1:]
+			offset += n
+		case dwOpPlusUconst:
+			n, size := binary.Uvarint(expr)
+			if size <= 0 || !located {
+				return 0, false
+			}
+			expr = expr[size:]
+			offset += int64(n)
+		case dwOpPiece:
+			n, size := binary.Uvarint(expr)
+			if size <= 0 || !located || (pieced && offset != next) {
+				return 0, false
+			}
+			expr = expr[size:]
+			if !pieced {
+				start, pieced = offset, true
+			}
+			next, located = offset+int64(n), false
+		default:
+			return 0, false
+		}
+	}
+	if pieced {
+		return start, !located
+	}
+	return offset, located
+}
+
+func readSLEB128(buf []byte) (int64, int) {
+	var (
+		res   int64
+		shift uint
+	)
+	for i, b := range buf {
+		res |= int64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				res |= -1 << shift
+			}
+			return res, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// ReadString returns the content of a string whose bytes are in the loaded
+// sections of the program (e.g. a string literal).
+func (ei *ELFInterpreter) ReadString(addr, length uint64) (string, bool) {
+	return ei.readString(addr-ei.loadBase.Load(), length)
+}
+
+func (ei *ELFInterpreter) readString(addr, length uint64) (string, bool) {
+	buf := make([]byte, length)
+	if !ei.readAt(buf, addr) {
+		return "", false
+	}
+	return string(buf), true
+}
+
+// ReadStringArray returns the strings in the statically initialized global
+// array varName of the given length (e.g. runtime.waitReasonStrings).
+func (ei *ELFInterpreter) ReadStringArray(varName string, length uint64) ([]string, error) {
+	addr, err := ei.GetGlobalVariableAddr(varName)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, length)
+	header := make([]byte, goStringSize)
+	for i := range res {
+		elemAddr := addr + uint64(i)*goStringSize
+		if !ei.readAt(header, elemAddr) {
+			return nil, fmt.Errorf("%w: string header of %s[%d] at 0x%x", ErrDecode, varName, i, elemAddr)
+		}
+		strAddr, strLen := ei.byteOrder.Uint64(header), ei.byteOrder.Uint64(header[8:])
+		if strLen == 0 {
+			// The pointer of an empty string can be nil.
+			continue
+		}
+		str, ok := ei.readString(strAddr, strLen)
+		if !ok {
+			return nil, fmt.Errorf("%w: string content of %s[%d] at 0x%x", ErrDecode, varName, i, strAddr)
+		}
+		res[i] = str
+	}
+	return res, nil
 }
@@ -0,0 +1,125 @@
+package instrumentation
+
+import "testing"
+
+var benchmarkPrograms = []string{"greet", "greet_pie_stripped"}
+
+func benchmarkInterpreters(b *testing.B, f func(b *testing.B, interpreter *ELFInterpreter)) {
+	for _, prog := range benchmarkPrograms {
+		b.Run(prog, func(b *testing.B) {
+			interpreter, err := NewELFInterpreter("./testdata/" + prog)
+			if err != nil {
+				b.Fatalf("Create interpreter: %v", err)
+			}
+			b.ResetTimer()
+			f(b, interpreter)
+		})
+	}
+}
+
+func BenchmarkNewELFInterpreter(b *testing.B) {
+	for _, prog := range benchmarkPrograms {
+		b.Run(prog, func(b *testing.B) {
+			for range b.N {
+				if _, err := NewELFInterpreter("./testdata/" + prog); err != nil {
+					b.Fatalf("Create interpreter: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// The analysis is memoized by the interpreter, so a fresh interpreter is
+// created for each iteration outside of the timed section.
+func BenchmarkELFInterpreter_GetInstrumentableOffsetsForPackage(b *testing.B) {
+	for _, prog := range benchmarkPrograms {
+		for _, pkgName := range []string{"main", "fmt"} {
+			b.Run(prog+"/"+pkgName, func(b *testing.B) {
+				for range b.N {
+					b.StopTimer()
+					interpreter, err := NewELFInterpreter("./testdata/" + prog)
+					if err != nil {
+						b.Fatalf("Create interpreter: %v", err)
+					}
+					b.StartTimer()
+					if _, err := interpreter.GetInstrumentableOffsetsForPackage(pkgName); err != nil {
+						b.Fatalf("Get offsets for package %s: %v", pkgName, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkELFInterpreter_GetInstrumentableOffsetsForPackageCached(b *testing.B) {
+	cacheDir := b.TempDir()
+	for _, prog := range benchmarkPrograms {
+		b.Run(prog, func(b *testing.B) {
+			interpreter, err := NewELFInterpreter("./testdata/"+prog, WithAnalysisCacheDir(cacheDir))
+			if err != nil {
+				b.Fatalf("Create interpreter: %v", err)
+			}
+			if _, err := interpreter.GetInstrumentableOffsetsForPackage("fmt"); err != nil {
+				b.Fatalf("Get offsets for package fmt: %v", err)
+			}
+			if err := interpreter.SaveAnalysis(); err != nil {
+				b.Fatalf("Save analysis: %v", err)
+			}
+			b.ResetTimer()
+			for range b.N {
+				cached, err := NewELFInterpreter("./testdata/"+prog, WithAnalysisCacheDir(cacheDir))
+				if err != nil {
+					b.Fatalf("Create interpreter: %v", err)
+				}
+				if _, err := cached.GetInstrumentableOffsetsForPackage("fmt"); err != nil {
+					b.Fatalf("Get offsets for package fmt: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkELFInterpreter_GetFunctionStartOffset(b *testing.B) {
+	benchmarkInterpreters(b, func(b *testing.B, interpreter *ELFInterpreter) {
+		for range b.N {
+			if _, err := interpreter.GetFunctionStartOffset("runtime.schedule"); err != nil {
+				b.Fatalf("Get start offset: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkELFInterpreter_GetGlobalVariableAddr(b *testing.B) {
+	benchmarkInterpreters(b, func(b *testing.B, interpreter *ELFInterpreter) {
+		for range b.N {
+			if _, err := interpreter.GetGlobalVariableAddr("runtime.sched"); err != nil {
+				b.Fatalf("Get global variable address: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkELFInterpreter_ResolveFunctionSymbol(b *testing.B) {
+	benchmarkInterpreters(b, func(b *testing.B, interpreter *ELFInterpreter) {
+		for range b.N {
+			if _, ok := interpreter.ResolveFunctionSymbol("runtime.asyncPreempt"); !ok {
+				b.Fatalf("Function runtime.asyncPreempt not found")
+			}
+		}
+	})
+}
+
+func BenchmarkELFInterpreter_PCToLine(b *testing.B) {
+	benchmarkInterpreters(b, func(b *testing.B, interpreter *ELFInterpreter) {
+		entry, ok := interpreter.GetFunctionEntry("main.Greet")
+		if !ok {
+			b.Fatalf("Function main.Greet not found")
+		}
+		b.ResetTimer()
+		for range b.N {
+			if _, _, fn := interpreter.PCToLine(entry); fn == nil {
+				b.Fatalf("PC 0x%x not found", entry)
+			}
+		}
+	})
+}
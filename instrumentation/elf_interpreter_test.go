@@ -1,12 +1,26 @@
 package instrumentation
 
-import "testing"
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kailun2047/slowmo/logging"
+)
 
 func TestELFInterpreter_GetDelayableOffsetsForPackage(t *testing.T) {
 	exePath := "./testdata/greet"
-	interpreter := NewELFInterpreter(exePath)
+	interpreter, err := NewELFInterpreter(exePath)
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
 	pkgName := "main"
-	symOffsets := interpreter.GetInstrumentableOffsetsForPackage(pkgName)
+	symOffsets, err := interpreter.GetInstrumentableOffsetsForPackage(pkgName)
+	if err != nil {
+		t.Fatalf("Get offsets for package %s: %v", pkgName, err)
+	}
 
 	expectedOffsets := map[string][]uint64{
 		"main.Greet":                 {0xa, 0x22, 0xcb},
@@ -36,3 +50,334 @@ func TestELFInterpreter_GetDelayableOffsetsForPackage(t *testing.T) {
 		}
 	}
 }
+
+func TestELFInterpreter_OptimizedBuild(t *testing.T) {
+	logging.InitZapLogger("production")
+	exePath := "./testdata/greet_inlined"
+	interpreter, err := NewELFInterpreter(exePath)
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+	symOffsets, err := interpreter.GetInstrumentableOffsetsForPackage("main")
+	if err != nil {
+		t.Fatalf("Get offsets for package main: %v", err)
+	}
+	// Line 18 starts with main.Greet and main.salutation inlined into it.
+	expectedOffsets := SymbolOffsets{
+		"main.main": {0xa, 0x12, 0x88},
+	}
+	if !reflect.DeepEqual(symOffsets, expectedOffsets) {
+		t.Errorf("Offsets didn't match expectation (actual: %x, expected: %x)", symOffsets, expectedOffsets)
+	}
+
+	// The bounds checks of a function without the prologue are not taken
+	// for it.
+	if offset, err := interpreter.GetFunctionStartOffset("runtime.memmove"); !errors.Is(err, ErrPrologueNotFound) {
+		t.Errorf("Expected ErrPrologueNotFound for runtime.memmove, got offset 0x%x (err: %v)", offset, err)
+	}
+}
+
+func TestELFInterpreter_SymbolNotFound(t *testing.T) {
+	interpreter, err := NewELFInterpreter("./testdata/greet")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+
+	if _, err := interpreter.GetGlobalVariableAddr("main.nonexistent"); !errors.Is(err, ErrSymbolNotFound) {
+		t.Errorf("Global variable: expected ErrSymbolNotFound, got %v", err)
+	}
+	if _, err := interpreter.GetInstrumentableOffsetsForPackage("nonexistent"); !errors.Is(err, ErrSymbolNotFound) {
+		t.Errorf("Package: expected ErrSymbolNotFound, got %v", err)
+	}
+	if _, err := interpreter.GetFunctionReturnOffset("main.nonexistent"); !errors.Is(err, ErrSymbolNotFound) {
+		t.Errorf("Function: expected ErrSymbolNotFound, got %v", err)
+	}
+}
+
+func TestELFInterpreter_VariableLocations(t *testing.T) {
+	interpreter, err := NewELFInterpreter("./testdata/greet")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+
+	inputs := []struct {
+		fnName   string
+		offset   uint64
+		expected []VariableLocation
+	}{
+		{
+			// The argument is still in registers before being spilled.
+			fnName: "main.Greet",
+			offset: 0x2,
+		},
+		{
+			fnName: "main.Greet",
+			offset: 0x22,
+			expected: []VariableLocation{
+				{Name: "name", TypeName: "string", Kind: VariableKindString, Size: 16, CFAOffset: 0, IsArg: true},
+			},
+		},
+		{
+			fnName: "main.main",
+			offset: 0x413,
+			expected: []VariableLocation{
+				{Name: "&wg", TypeName: "*sync.WaitGroup", Kind: VariableKindPointer, Size: 8, CFAOffset: -24},
+				{Name: "f", TypeName: "*os.File", Kind: VariableKindPointer, Size: 8, CFAOffset: -312},
+				{Name: "startTime", TypeName: "int64", Kind: VariableKindInt, Size: 8, CFAOffset: -512},
+			},
+		},
+	}
+
+	for _, input := range inputs {
+		entry, ok := interpreter.GetFunctionEntry(input.fnName)
+		if !ok {
+			t.Fatalf("Function %s not found", input.fnName)
+		}
+		locations := interpreter.VariableLocations(entry + input.offset)
+		if !reflect.DeepEqual(locations, input.expected) {
+			t.Errorf("Variables of function %s at offset 0x%x: expected %+v, got %+v", input.fnName, input.offset, input.expected, locations)
+		}
+	}
+}
+
+func TestELFInterpreter_VariableLocationsDWARF5(t *testing.T) {
+	// Built by go later than 1.25, which emits location lists in
+	// .debug_loclists.
+	interpreter, err := NewELFInterpreter("./testdata/greet_inlined")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+
+	errLocations := []VariableLocation{
+		{Name: "err.data", TypeName: "*uint8", Kind: VariableKindPointer, Size: 8, CFAOffset: -32},
+		{Name: "err.itab", TypeName: "uintptr", Kind: VariableKindUint, Size: 8, CFAOffset: -56},
+	}
+	inputs := []struct {
+		offset   uint64
+		expected []VariableLocation
+	}{
+		{
+			// The receiver is still in registers before being spilled.
+			offset:   0x10,
+			expected: errLocations,
+		},
+		{
+			offset: 0x50,
+			expected: append([]VariableLocation{
+				{Name: "f", TypeName: "*os.File", Kind: VariableKindPointer, Size: 8, CFAOffset: 0, IsArg: true},
+			}, errLocations...),
+		},
+		{
+			// Back in registers for the return.
+			offset:   0x142,
+			expected: errLocations,
+		},
+	}
+
+	entry, ok := interpreter.GetFunctionEntry("os.(*File).Write")
+	if !ok {
+		t.Fatalf("Function os.(*File).Write not found")
+	}
+	for _, input := range inputs {
+		locations := interpreter.VariableLocations(entry + input.offset)
+		if !reflect.DeepEqual(locations, input.expected) {
+			t.Errorf("Variables at offset 0x%x: expected %+v, got %+v", input.offset, input.expected, locations)
+		}
+	}
+}
+
+func TestELFInterpreter_ReadStringArray(t *testing.T) {
+	interpreter, err := NewELFInterpreter("./testdata/greet")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+
+	reasons, err := interpreter.ReadStringArray("runtime.waitReasonStrings", 37)
+	if err != nil {
+		t.Fatalf("Read runtime.waitReasonStrings: %v", err)
+	}
+	if len(reasons) != 37 {
+		t.Fatalf("Expected 37 strings, got %d", len(reasons))
+	}
+	expected := map[int]string{
+		0:  "",
+		2:  "IO wait",
+		21: "sync.Mutex.Lock",
+		36: "coroutine",
+	}
+	for i, reason := range expected {
+		if reasons[i] != reason {
+			t.Errorf("Expected %q at index %d, got %q", reason, i, reasons[i])
+		}
+	}
+
+	if _, err := interpreter.ReadStringArray("main.nonexistent", 1); !errors.Is(err, ErrSymbolNotFound) {
+		t.Errorf("Expected ErrSymbolNotFound, got %v", err)
+	}
+}
+
+func TestELFInterpreter_ARM64(t *testing.T) {
+	interpreter, err := NewELFInterpreter("./testdata/greet_arm64")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+	if interpreter.Arch() != ArchARM64 {
+		t.Fatalf("Expected architecture %s, got %s", ArchARM64, interpreter.Arch())
+	}
+
+	inputs := []struct {
+		fnName             string
+		expectedStart      uint64
+		expectedRetOffsets []uint64
+	}{
+		{fnName: "main.Greet", expectedStart: 0xc, expectedRetOffsets: []uint64{0x54}},
+		{fnName: "main.main", expectedStart: 0xc, expectedRetOffsets: []uint64{0x9c}},
+	}
+	for _, input := range inputs {
+		start, err := interpreter.GetFunctionStartOffset(input.fnName)
+		if err != nil {
+			t.Fatalf("Get start offset for function %s: %v", input.fnName, err)
+		}
+		if start != input.expectedStart {
+			t.Errorf("Function %s: expected start offset 0x%x, got 0x%x", input.fnName, input.expectedStart, start)
+		}
+		retOffsets, err := interpreter.GetFunctionReturnOffset(input.fnName)
+		if err != nil {
+			t.Fatalf("Get return offsets for function %s: %v", input.fnName, err)
+		}
+		if !reflect.DeepEqual(retOffsets, input.expectedRetOffsets) {
+			t.Errorf("Function %s: expected return offsets %v, got %v", input.fnName, input.expectedRetOffsets, retOffsets)
+		}
+	}
+}
+
+func TestELFInterpreter_StrippedPIE(t *testing.T) {
+	logging.InitZapLogger("production")
+	interpreter, err := NewELFInterpreter("./testdata/greet_pie_stripped")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+
+	symbol, ok := interpreter.ResolveFunctionSymbol("main.Greet")
+	if !ok {
+		t.Fatalf("Function main.Greet not found")
+	}
+	start, err := interpreter.GetFunctionStartOffset(symbol)
+	if err != nil {
+		t.Fatalf("Get start offset for function %s: %v", symbol, err)
+	}
+	if start != 0x6 {
+		t.Errorf("Expected start offset 0x6, got 0x%x", start)
+	}
+	address, err := interpreter.FunctionFileOffset(symbol)
+	if err != nil {
+		t.Fatalf("Get file offset for function %s: %v", symbol, err)
+	}
+	if address != 0xb6700 {
+		t.Errorf("Expected file offset 0xb6700, got 0x%x", address)
+	}
+	if symbol, offset, err := interpreter.EntryFunction(); err != nil || symbol != "_rt0_amd64_linux" || offset != 0 {
+		t.Errorf("Expected entry point at _rt0_amd64_linux+0, got %s+0x%x (err: %v)", symbol, offset, err)
+	}
+
+	// Runtime globals are located by the code referring to them, and runtime
+	// offsets are the built-in ones of the go release.
+	schedAddr, err := interpreter.GetGlobalVariableAddr("runtime.sched")
+	if err != nil {
+		t.Fatalf("Get address of runtime.sched: %v", err)
+	}
+	if schedAddr != 0x5a5c60 {
+		t.Errorf("Expected runtime.sched at 0x5a5c60, got 0x%x", schedAddr)
+	}
+	offsets, err := interpreter.RuntimeOffsets()
+	if err != nil {
+		t.Fatalf("Resolve runtime offsets: %v", err)
+	}
+	reasons, err := interpreter.ReadStringArray("runtime.waitReasonStrings", offsets["runtime_waitreasonstrings_length"])
+	if err != nil {
+		t.Fatalf("Read runtime.waitReasonStrings: %v", err)
+	}
+	if len(reasons) < 2 || reasons[1] != "GC assist marking" {
+		t.Errorf("Expected wait reason 1 to be GC assist marking, got %v", reasons)
+	}
+
+	const loadBase = 0x7f0000000000
+	interpreter.SetLoadBase(loadBase)
+	entry := interpreter.EntryPoint()
+	if _, _, fn := interpreter.PCToLine(entry + loadBase); fn == nil || fn.Name != "_rt0_amd64_linux" {
+		t.Errorf("Expected entry point in _rt0_amd64_linux after relocation, got %v", fn)
+	}
+	if name, ok := interpreter.TypeName(interpreter.typesBase + 8 + loadBase); !ok || name != "*[1024]uintptr" {
+		t.Errorf("Expected type *[1024]uintptr after relocation, got %q", name)
+	}
+}
+
+func TestELFInterpreter_ProcessLoadBase(t *testing.T) {
+	logging.InitZapLogger("production")
+	exePath, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Find test executable: %v", err)
+	}
+	interpreter, err := NewELFInterpreter(exePath)
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+	loadBase, err := interpreter.ProcessLoadBase(os.Getpid())
+	if err != nil {
+		t.Fatalf("Get load base: %v", err)
+	}
+	interpreter.SetLoadBase(loadBase)
+
+	pc := uint64(reflect.ValueOf(TestELFInterpreter_ProcessLoadBase).Pointer())
+	if _, _, fn := interpreter.PCToLine(pc); fn == nil || fn.BaseName() != "TestELFInterpreter_ProcessLoadBase" {
+		t.Errorf("Expected PC 0x%x in TestELFInterpreter_ProcessLoadBase, got %v", pc, fn)
+	}
+}
+
+func TestELFInterpreter_PCToFrames(t *testing.T) {
+	logging.InitZapLogger("production")
+	exePath := "./testdata/greet_inlined"
+	interpreter, err := NewELFInterpreter(exePath)
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+	start, end, ok := interpreter.GetFunctionRange("main.main")
+	if !ok {
+		t.Fatalf("Function main.main not found")
+	}
+	if _, ok := interpreter.GetFunctionEntry("main.Greet"); ok {
+		t.Fatalf("Expected main.Greet to be inlined")
+	}
+
+	expected := []SourceFrame{
+		{File: "greet_inlined.go", Line: 10, Func: "main.salutation"},
+		{File: "greet_inlined.go", Line: 14, Func: "main.Greet"},
+		{File: "greet_inlined.go", Line: 18, Func: "main.main"},
+	}
+	found := false
+	for pc := start; pc < end && !found; pc++ {
+		frames := interpreter.PCToFrames(pc)
+		if len(frames) == 0 {
+			t.Fatalf("PC 0x%x of main.main not interpreted", pc)
+		}
+		if frames[len(frames)-1].Func != "main.main" {
+			t.Errorf("Expected PC 0x%x in main.main, got %+v", pc, frames)
+		}
+		if frames[0].Func != "main.salutation" {
+			continue
+		}
+		found = true
+		for i := range frames {
+			frames[i].File = filepath.Base(frames[i].File)
+		}
+		if !reflect.DeepEqual(frames, expected) {
+			t.Errorf("Frames at PC 0x%x didn't match expectation (actual: %+v, expected: %+v)", pc, frames, expected)
+		}
+	}
+	if !found {
+		t.Errorf("No PC found in main.salutation inlined into main.main")
+	}
+	if frames := interpreter.PCToFrames(start); len(frames) != 1 || frames[0].Func != "main.main" {
+		t.Errorf("Expected only main.main at its entry, got %+v", frames)
+	}
+}
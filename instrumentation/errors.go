@@ -0,0 +1,17 @@
+package instrumentation
+
+import "errors"
+
+// Errors caused by the target program being unusual (e.g. built without some
+// runtime functions, or with functions the instrumentation cannot handle), as
+// opposed to failures of the instrumentation itself.
+var (
+	ErrSymbolNotFound   = errors.New("symbol not found in target program")
+	ErrPrologueNotFound = errors.New("stack-splitting prologue not found")
+	ErrUnknownPC        = errors.New("unknown PC")
+	ErrDecode           = errors.New("decode error")
+	// ErrDWARFNotFound is returned for the runtime layouts of a program built
+	// without DWARF data (e.g. with -ldflags="-s -w") by a go release whose
+	// layouts are not built into the package.
+	ErrDWARFNotFound = errors.New("DWARF data not found in target program")
+)
@@ -2,13 +2,14 @@ package instrumentation
 
 import (
 	"bytes"
-	"debug/gosym"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"slices"
+	"strconv"
+	"sync"
 
 	"github.com/cilium/ebpf/ringbuf"
 	"github.com/kailun2047/slowmo/logging"
@@ -24,15 +25,33 @@ const (
 	EVENT_TYPE_NEWPROC eventType = iota
 	EVENT_TYPE_DELAY
 	EVENT_TYPE_RUNQ_STATUS
-	// EVENT_TYPE_RUNQ_STEAL
+	EVENT_TYPE_RUNQ_STEAL
 	// EVENT_TYPE_EXECUTE
-	EVENT_TYPE_GLOBAL_RUNQ_STATUS = iota + 2
-	// EVENT_TYPE_SEMTABLE_STATUS
-	EVENT_TYPE_SCHEDULE = iota + 3
+	EVENT_TYPE_GLOBAL_RUNQ_STATUS = iota + 1
+	EVENT_TYPE_SEMTABLE_STATUS
+	EVENT_TYPE_SCHEDULE
 	EVENT_TYPE_EXECUTE
 	EVENT_TYPE_GOPARK
 	EVENT_TYPE_GOREADY
 	EVENT_TYPE_GOREADY_RUNQ_STATUS
+	EVENT_TYPE_PREEMPT
+	EVENT_TYPE_ENTERSYSCALL
+	EVENT_TYPE_EXITSYSCALL
+	EVENT_TYPE_HANDOFFP
+	EVENT_TYPE_NETPOLL_READY
+	EVENT_TYPE_NETPOLL
+	EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS
+	EVENT_TYPE_CHAN_STATE
+	EVENT_TYPE_TIMER
+	EVENT_TYPE_TIMER_HEAP_STATUS
+	EVENT_TYPE_GC_PHASE
+	EVENT_TYPE_STW
+	EVENT_TYPE_M_STATE
+	EVENT_TYPE_IDLE_LIST
+	EVENT_TYPE_GOEXIT
+	EVENT_TYPE_PANIC
+	EVENT_TYPE_LOAD_BASE
+	EVENT_TYPE_RACE_DETECTED
 )
 
 type newprocEvent struct {
@@ -86,45 +105,185 @@ func (r *EventReader) interpretRunqEntry(entry runqEntry) *proto.RunqEntry {
 		return nil
 	}
 	goId := int64(entry.GoID)
-	return &proto.RunqEntry{
+	interpretedEntry := &proto.RunqEntry{
 		GoId:             &goId,
 		ExecutionContext: r.interpretPC(entry.PC),
 	}
+	// A goroutine first seen in a run queue has just been created. Run queue
+	// snapshots may lag behind other events, so they are not used to drive
+	// transitions of known goroutines.
+	if _, ok := r.goroutineLifetimes[goId]; !ok {
+		r.transitGoroutine(interpretedEntry, proto.GoroutineState_G_RUNNABLE)
+	}
+	return interpretedEntry
+}
+
+func (r *EventReader) interpretCallstack(callstack []uint64) []*proto.InterpretedPC {
+	var interpretedCallstack []*proto.InterpretedPC
+	for _, pc := range callstack {
+		interpretedCallstack = append(interpretedCallstack, r.interpretPC(pc))
+	}
+	return interpretedCallstack
+}
+
+// snapshotVariables decodes the locals and arguments which are stored in the
+// captured stack window at a delay point.
+func (r *EventReader) snapshotVariables(event delayEvent) []*proto.VariableSnapshot {
+	window := event.StackWindow[:min(event.StackWindowLen, stackWindowSize)]
+	cfa, ok := r.interpreter.Arch().frameCFA(event.FP, event.SP, window, r.byteOrder)
+	if !ok {
+		return nil
+	}
+	var snapshots []*proto.VariableSnapshot
+	for _, location := range r.interpreter.VariableLocations(event.PC) {
+		addr := cfa + uint64(location.CFAOffset)
+		if addr < event.SP || addr+uint64(location.Size) > event.SP+uint64(len(window)) {
+			continue
+		}
+		raw := window[addr-event.SP : addr-event.SP+uint64(location.Size)]
+		value, ok := r.decodeVariable(location.Kind, raw, event.SP, window)
+		if !ok {
+			continue
+		}
+		snapshots = append(snapshots, &proto.VariableSnapshot{
+			Name:       &location.Name,
+			Type:       &location.TypeName,
+			Kind:       proto.VariableKind(location.Kind),
+			Value:      &value,
+			IsArgument: &location.IsArg,
+		})
+	}
+	return snapshots
+}
+
+func (r *EventReader) decodeVariable(kind VariableKind, raw []byte, sp uint64, window []byte) (string, bool) {
+	var n uint64
+	switch len(raw) {
+	case 1:
+		n = uint64(raw[0])
+	case 2:
+		n = uint64(r.byteOrder.Uint16(raw))
+	case 4:
+		n = uint64(r.byteOrder.Uint32(raw))
+	case 8, 16:
+		n = r.byteOrder.Uint64(raw)
+	default:
+		return "", false
+	}
+	switch kind {
+	case VariableKindInt:
+		// Sign-extend values narrower than 64 bits.
+		shift := 64 - 8*len(raw)
+		return strconv.FormatInt(int64(n<<shift)>>shift, 10), true
+	case VariableKindUint:
+		return strconv.FormatUint(n, 10), true
+	case VariableKindBool:
+		return strconv.FormatBool(n != 0), true
+	case VariableKindPointer:
+		if n == 0 {
+			return "nil", true
+		}
+		return fmt.Sprintf("0x%x", n), true
+	case VariableKindString:
+		if len(raw) != 16 {
+			return "", false
+		}
+		length := r.byteOrder.Uint64(raw[8:])
+		if length == 0 {
+			return `""`, true
+		}
+		readLen := min(length, maxSnapshotStringLen)
+		var (
+			content string
+			ok      bool
+		)
+		if n >= sp && n+readLen <= sp+uint64(len(window)) {
+			content, ok = string(window[n-sp:n-sp+readLen]), true
+		} else {
+			content, ok = r.interpreter.ReadString(n, readLen)
+		}
+		if !ok {
+			return fmt.Sprintf("string(len=%d) at 0x%x", length, n), true
+		}
+		if readLen < length {
+			return strconv.Quote(content) + "...", true
+		}
+		return strconv.Quote(content), true
+	}
+	return "", false
 }
 
+// interpretPC maps pc to the innermost function inlined at pc, along with the
+// functions it is inlined into.
 func (r *EventReader) interpretPC(pc uint64) *proto.InterpretedPC {
-	file, line, fn := r.interpreter.PCToLine(pc)
-	if fn == nil {
+	frames := r.interpreter.PCToFrames(pc)
+	if len(frames) == 0 {
 		logging.Logger().Warnf("Cannot interpret PC %x", pc)
 		return &proto.InterpretedPC{}
 	}
-	ln := int32(line)
-	return &proto.InterpretedPC{
-		File: &file,
-		Func: &fn.Name,
+	ln := int32(frames[0].Line)
+	interpreted := &proto.InterpretedPC{
+		File: &frames[0].File,
+		Func: &frames[0].Func,
 		Line: &ln,
 	}
+	for _, caller := range frames[1:] {
+		callerLn := int32(caller.Line)
+		interpreted.InlinedCallers = append(interpreted.InlinedCallers, &proto.InlinedCall{
+			File: &caller.File,
+			Func: &caller.Func,
+			Line: &callerLn,
+		})
+	}
+	return interpreted
 }
 
 type delayEvent struct {
-	EType eventType
-	PC    uint64
-	GoID  uint64
-	MID   int64
+	EType          eventType
+	PC             uint64
+	GoID           uint64
+	MID            int64
+	Callstack      [maxStackTraceDepth]uint64
+	CallstackDepth int64 // 0 if stack unwinding is not enabled
+	SP             uint64
+	FP             uint64
+	StackWindowLen uint64
+	StackWindow    [stackWindowSize]byte // goroutine stack starting from SP
 }
 
+const (
+	// maxStackTraceDepth is the same as MAX_STACK_TRACE_DEPTH in instrumentor.
+	maxStackTraceDepth = 16
+	// stackWindowSize is the same as STACK_WINDOW_SIZE in instrumentor.
+	stackWindowSize = 1024
+	// Strings longer than maxSnapshotStringLen are truncated in variable
+	// snapshots.
+	maxSnapshotStringLen = 64
+)
+
 type scheduleEvent struct {
 	EType          eventType
 	MID            int64
-	Callstack      [8]uint64
+	Callstack      [maxStackTraceDepth]uint64
 	CallstackDepth int64
 	ProcID         int64 // -1 if not applicable
+	Reason         int64 // same value as the corresponding proto.ScheduleReason, or -1 if to be inferred from callstack
+	LockedGoID     int64 // only meaningful for proto.ScheduleReason_LOCKED_M
 }
 
 type globalRunqStatusEvent struct {
 	EType eventType
 	Size  int64
 	indexedRunqEntry
+	MID int64
+	// GroupingMID is set as the id of the triggering M when collecting
+	// globrunq as part of an execute event, and as a negative number when only
+	// collecting status of globrunq.
+	GroupingMID int64
+}
+
+func (event globalRunqStatusEvent) formGlobalRunqKey() string {
+	return fmt.Sprintf("%d:%d", event.GroupingMID, event.MID)
 }
 
 type executeEvent struct {
@@ -137,29 +296,248 @@ type executeEvent struct {
 }
 
 type executeEventBuffer struct {
-	event        executeEvent
-	runqStatuses []*proto.RunqStatusEvent
+	event          executeEvent
+	runqStatuses   []*proto.RunqStatusEvent
+	globrunqStatus *proto.GlobalRunqStatusEvent
+	timerHeaps     []*proto.TimerHeapStatusEvent
 }
 
 func (buf *executeEventBuffer) isCompleted() bool {
-	return len(buf.runqStatuses) == int(buf.event.NumP)
+	return len(buf.runqStatuses) == int(buf.event.NumP) && buf.globrunqStatus != nil && len(buf.timerHeaps) == int(buf.event.NumP)
 }
 
 type goparkEvent struct {
+	EType          eventType
+	MID            int64
+	Parked         runqEntry
+	WaitReason     [40]byte
+	FD             int64 // -1 if not parked by netpollblock
+	Callstack      [maxStackTraceDepth]uint64
+	CallstackDepth int64 // 0 if stack unwinding is not enabled
+}
+
+// waitReasonIOWait is the runtime's string of waitReasonIOWait, which is the
+// only wait reason a reported fd applies to.
+const waitReasonIOWait = "IO wait"
+
+type goreadyEvent struct {
+	EType eventType
+	MID   int64
+	GoID  uint64
+}
+
+type preemptEvent struct {
+	EType     eventType
+	MID       int64
+	ProcID    int64 // -1 if not applicable
+	Preempted runqEntry
+	Kind      uint64 // same value as the corresponding proto.PreemptKind
+}
+
+type syscallEvent struct {
+	EType     eventType
+	MID       int64
+	ProcID    int64 // -1 if not applicable
+	Syscaller runqEntry
+	// Variant is 1 if entering through entersyscallblock for
+	// EVENT_TYPE_ENTERSYSCALL, and 1 if exiting on the fast path for
+	// EVENT_TYPE_EXITSYSCALL.
+	Variant uint64
+}
+
+type handoffpEvent struct {
+	EType        eventType
+	MID          int64
+	ProcID       int64
+	ReceivingMID int64 // -1 if the P is put on the idle list
+}
+
+type netpollReadyEvent struct {
+	EType   eventType
+	MID     int64
+	FD      int64
+	Readied runqEntry
+}
+
+type netpollEvent struct {
 	EType      eventType
 	MID        int64
-	Parked     runqEntry
+	NumReadied int64
+	Readied    [16]runqEntry
+}
+
+const (
+	runqStealStageBefore uint64 = iota
+	runqStealStageAfter
+)
+
+type runqStealEvent struct {
+	EType        eventType
+	MID          int64
+	ThiefProcID  int64
+	VictimProcID int64
+	Stage        uint64
+	NumStolen    int64
+}
+
+// runqStealEventBuffer collects the runq statuses of both thief and victim P
+// reported after each stage of a steal.
+type runqStealEventBuffer struct {
+	event  runqStealEvent // header of the latest stage
+	before []*proto.RunqStatusEvent
+	after  []*proto.RunqStatusEvent
+}
+
+func (buf *runqStealEventBuffer) isCompleted() bool {
+	return buf.event.Stage == runqStealStageAfter && len(buf.after) == 2
+}
+
+type chanStateEvent struct {
+	EType    eventType
+	MID      int64
+	Op       uint64 // same value as the corresponding proto.ChannelOp
+	Operator runqEntry
+	ChanAddr uint64
+	DeclPC   uint64 // 0 if unknown
+	Qcount   uint64
+	Dataqsiz uint64
+	Sendx    uint64
+	Recvx    uint64
+	Closed   uint64
+	SendqLen int64
+	RecvqLen int64
+	Sendq    [8]runqEntry
+	Recvq    [8]runqEntry
+}
+
+type semaStateEvent struct {
+	EType      eventType
+	MID        int64
+	Op         uint64 // same value as the corresponding proto.SemaphoreOp
+	Goroutine  runqEntry
+	SemaAddr   uint64
+	MutexAddr  uint64 // 0 if not a mutex operation
+	MutexState int64
+	Handoff    uint64
 	WaitReason [40]byte
+	NumWaiters int64
+	Waiters    [8]runqEntry
 }
 
-type goreadyEvent struct {
+// Bits of sync.Mutex state.
+const (
+	mutexLocked = 1 << iota
+	mutexWoken
+	mutexStarving
+	mutexWaiterShift = iota
+)
+
+type timerEntry struct {
+	TimerAddr uint64
+	When      int64
+	Period    int64
+	FPC       uint64
+	GoID      int64 // -1 if the timer doesn't ready a goroutine by itself
+}
+
+type timerEvent struct {
+	EType  eventType
+	MID    int64
+	Kind   uint64 // same value as the corresponding proto.TimerEventKind
+	ProcID int64  // -1 if not applicable
+	Timer  timerEntry
+	Now    int64
+}
+
+type timerHeapStatusEvent struct {
+	EType eventType
+	// GroupingMID is set as the id of the triggering M when collecting timer
+	// heaps as part of an execute event, and as a negative number when only
+	// collecting status of an individual timer heap.
+	GroupingMID int64
+	ProcID      int64
+	NumTimers   int64
+	Timers      [6]timerEntry
+}
+
+type gcPhaseEvent struct {
+	EType      eventType
+	MID        int64
+	Kind       uint64 // same value as the corresponding proto.GCPhaseKind
+	Phase      uint64 // same value as the corresponding proto.GCPhase
+	ProcID     int64  // -1 if the M holds no P
+	Goroutine  runqEntry
+	WorkerMode uint64 // same value as the corresponding proto.GCMarkWorkerMode
+}
+
+type stwEvent struct {
+	EType  eventType
+	MID    int64
+	Stage  uint64 // same value as the corresponding proto.STWStage
+	Reason [40]byte
+}
+
+type mStateEvent struct {
+	EType      eventType
+	MID        int64
+	Kind       uint64 // same value as the corresponding proto.MStateKind
+	ProcID     int64  // -1 if not applicable
+	Spinning   uint64
+	LockedGoID int64 // only meaningful for proto.MStateKind_M_LOCK_OS_THREAD
+}
+
+type idleListEvent struct {
+	EType      eventType
+	MID        int64
+	NPIdle     int64
+	NMIdle     int64
+	NMSpinning int64
+	NumIdlePs  int64
+	IdlePs     [8]int64
+	NumIdleMs  int64
+	IdleMs     [8]int64
+}
+
+type goexitEvent struct {
+	EType   eventType
+	MID     int64
+	ProcID  int64 // -1 if the M holds no P
+	Exited  runqEntry
+	FinalPC uint64 // 0 if unknown
+}
+
+type panicEvent struct {
+	EType          eventType
+	MID            int64
+	Kind           uint64 // same value as the corresponding proto.PanicEventKind
+	Goroutine      runqEntry
+	TypeAddr       uint64 // 0 if not applicable
+	Callstack      [maxStackTraceDepth]uint64
+	CallstackDepth int64
+	Defers         [8]uint64
+	NumDefers      int64
+}
+
+// loadBaseEvent reports where a position-independent target program is
+// loaded, which is sent before any other event of the program.
+type loadBaseEvent struct {
+	EType eventType
+	Base  uint64
+}
+
+type raceDetectedEvent struct {
 	EType eventType
 	MID   int64
-	GoID  uint64
+	GoID  uint64 // 0 if the M runs no user goroutine
 }
 
 type pcInterpreter interface {
-	PCToLine(pc uint64) (file string, line int, fn *gosym.Func)
+	SetLoadBase(base uint64)
+	PCToFrames(pc uint64) []SourceFrame
+	TypeName(typeAddr uint64) (string, bool)
+	VariableLocations(pc uint64) []VariableLocation
+	ReadString(addr, length uint64) (string, bool)
+	Arch() Arch
 }
 
 type ringbufReadCloser interface {
@@ -175,8 +553,14 @@ type EventReader struct {
 	localRunqs            map[string][]runqEntry
 	bufferedExecuteEvents map[int64]*executeEventBuffer
 	bufferedGoreadyEvents map[int64]*proto.GoreadyEvent
-	globrunq              []runqEntry
+	bufferedStealEvents   map[int64]*runqStealEventBuffer
+	bufferedNetpollFDs    map[int64]map[uint64]int64 // M -> goid -> fd, reported when netpoll returns
+	syscallMs             map[int64]int64            // P -> M that entered a syscall holding it
+	globrunqs             map[string][]runqEntry
+	goroutineLifetimes    map[int64]*proto.GoroutineLifetime
 	ProbeEventCh          chan *proto.ProbeEvent
+	errMu                 sync.Mutex
+	err                   error
 }
 
 func NewEventReader(interpreter pcInterpreter, ringbufReader ringbufReadCloser) *EventReader {
@@ -188,6 +572,11 @@ func NewEventReader(interpreter pcInterpreter, ringbufReader ringbufReadCloser)
 		localRunqs:            make(map[string][]runqEntry),
 		bufferedExecuteEvents: make(map[int64]*executeEventBuffer),
 		bufferedGoreadyEvents: make(map[int64]*proto.GoreadyEvent),
+		bufferedStealEvents:   make(map[int64]*runqStealEventBuffer),
+		bufferedNetpollFDs:    make(map[int64]map[uint64]int64),
+		syscallMs:             make(map[int64]int64),
+		globrunqs:             make(map[string][]runqEntry),
+		goroutineLifetimes:    make(map[int64]*proto.GoroutineLifetime),
 		ProbeEventCh:          make(chan *proto.ProbeEvent),
 	}
 }
@@ -200,6 +589,22 @@ func (r *EventReader) Close() {
 	r.ringbufReader.Close()
 }
 
+// Err returns the first error that stopped the reader from producing probe
+// events. It should be checked after ProbeEventCh is closed.
+func (r *EventReader) Err() error {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	return r.err
+}
+
+func (r *EventReader) setErr(err error) {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
 func (r *EventReader) Start() {
 	go func() {
 		defer close(r.eventCh)
@@ -211,7 +616,8 @@ func (r *EventReader) Start() {
 					return
 				}
 				if !errors.Is(err, os.ErrDeadlineExceeded) {
-					logging.Logger().Fatal("Read ring buffer: ", err)
+					r.setErr(fmt.Errorf("read ring buffer: %w", err))
+					return
 				}
 			} else {
 				r.eventCh <- record
@@ -222,15 +628,22 @@ func (r *EventReader) Start() {
 	go func() {
 		defer close(r.ProbeEventCh)
 		for record := range r.eventCh {
+			// Keep draining the records after an error so that the ring
+			// buffer reader is never blocked, but stop interpreting them
+			// since the buffered states can no longer be trusted.
+			if r.Err() != nil {
+				continue
+			}
 			var etype eventType
 			bytesReader := bytes.NewReader(record.RawSample)
 			err := binary.Read(bytesReader, r.byteOrder, &etype)
 			if err != nil {
-				logging.Logger().Fatal("Decode event type: ", err)
+				r.setErr(fmt.Errorf("%w: event type: %v", ErrDecode, err))
+				continue
 			}
 			err = r.readEvent(bytesReader, etype)
 			if err != nil {
-				logging.Logger().Fatalf("Decode event type %v: %v", etype, err)
+				r.setErr(fmt.Errorf("event type %v: %w", etype, err))
 			}
 		}
 	}()
@@ -256,7 +669,8 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 		}
 		interpretedPC := r.interpretPC(event.PC)
 		if interpretedPC.Func == nil {
-			logging.Logger().Fatalf("Read newproc event: invalid PC %x", event.PC)
+			err = fmt.Errorf("%w: newproc event PC %x", ErrUnknownPC, event.PC)
+			break
 		}
 		creatorGoId := int64(event.CreatorGoID)
 		probeEvent = &proto.ProbeEvent{
@@ -280,7 +694,8 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 		}
 		interpretedPC := r.interpretPC(event.PC)
 		if interpretedPC.Func == nil {
-			logging.Logger().Fatalf("Read delay event: invalid PC %x", event.PC)
+			err = fmt.Errorf("%w: delay event PC %x", ErrUnknownPC, event.PC)
+			break
 		}
 		goId := int64(event.GoID)
 		probeEvent = &proto.ProbeEvent{
@@ -289,6 +704,8 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 					GoId:      &goId,
 					MId:       &event.MID,
 					CurrentPc: interpretedPC,
+					Callstack: r.interpretCallstack(event.Callstack[:event.CallstackDepth]),
+					Variables: r.snapshotVariables(event),
 				},
 			},
 		}
@@ -298,8 +715,8 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 		if err != nil {
 			break
 		}
-		probeEvent = r.interpretScheduleCallstack(event)
-	case EVENT_TYPE_RUNQ_STATUS, EVENT_TYPE_GOREADY_RUNQ_STATUS:
+		probeEvent, err = r.interpretScheduleCallstack(event)
+	case EVENT_TYPE_RUNQ_STATUS, EVENT_TYPE_GOREADY_RUNQ_STATUS, EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS:
 		var event runqStatusEvent
 		err = binary.Read(readSeeker, r.byteOrder, &event)
 		if err != nil {
@@ -324,7 +741,7 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 
 			if event.GroupingMID < 0 {
 				if event.EType == EVENT_TYPE_GOREADY_RUNQ_STATUS {
-					probeEvent = r.completeGoreadyEvent(event.MID, convertedEvent)
+					probeEvent, err = r.completeGoreadyEvent(event.MID, convertedEvent)
 				} else {
 					probeEvent = &proto.ProbeEvent{
 						ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
@@ -336,8 +753,16 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 						},
 					}
 				}
+			} else if event.EType == EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS {
+				probeEvent, err = r.tryCompleteRunqStealEvent(event.GroupingMID, convertedEvent)
 			} else {
-				probeEvent = r.tryCompleteExecuteEvent(event.GroupingMID, convertedEvent)
+				var buf *executeEventBuffer
+				buf, err = r.findBufferedExecuteEvent(event.GroupingMID)
+				if err != nil {
+					break
+				}
+				buf.runqStatuses = append(buf.runqStatuses, convertedEvent)
+				probeEvent = r.tryCompleteExecuteEvent(event.GroupingMID)
 			}
 		} else {
 			r.localRunqs[localRunqKey] = append(r.localRunqs[localRunqKey], event.RunqEntry)
@@ -348,11 +773,42 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 		if err != nil {
 			break
 		}
-		if event.RunqEntryIdx == uint64(event.Size) {
-			logging.Logger().Debugf("Global runq status: %v", r.interpretRunqEntries(r.globrunq))
-			r.globrunq = []runqEntry{}
+		globalRunqKey := event.formGlobalRunqKey()
+		if event.RunqEntryIdx != uint64(event.Size) {
+			r.globrunqs[globalRunqKey] = append(r.globrunqs[globalRunqKey], event.RunqEntry)
+			break
+		}
+		convertedEvent := &proto.GlobalRunqStatusEvent{
+			MId:         &event.MID,
+			RunqEntries: r.interpretRunqEntries(r.globrunqs[globalRunqKey]),
+		}
+		delete(r.globrunqs, globalRunqKey)
+		logging.Logger().Debugf("Global runq status: %v", convertedEvent.RunqEntries)
+		if event.GroupingMID < 0 {
+			// Keep any buffered execute event up to date in case of
+			// concurrency.
+			for _, buf := range r.bufferedExecuteEvents {
+				if buf.globrunqStatus != nil {
+					buf.globrunqStatus = convertedEvent
+				}
+			}
+			probeEvent = &proto.ProbeEvent{
+				ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+					StructureStateEvent: &proto.StructureStateEvent{
+						StructureStateOneof: &proto.StructureStateEvent_GlobalRunqStatusEvent{
+							GlobalRunqStatusEvent: convertedEvent,
+						},
+					},
+				},
+			}
 		} else {
-			r.globrunq = append(r.globrunq, event.RunqEntry)
+			var buf *executeEventBuffer
+			buf, err = r.findBufferedExecuteEvent(event.GroupingMID)
+			if err != nil {
+				break
+			}
+			buf.globrunqStatus = convertedEvent
+			probeEvent = r.tryCompleteExecuteEvent(event.GroupingMID)
 		}
 	case EVENT_TYPE_GOPARK:
 		var event goparkEvent
@@ -361,24 +817,29 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 			break
 		}
 		goID := int64(event.Parked.GoID)
-		nullByteIdx := slices.Index(event.WaitReason[:], 0)
-		if nullByteIdx == -1 {
-			err = fmt.Errorf("null byte not found in wait reason %s", event.WaitReason)
+		var waitReason string
+		waitReason, err = decodeWaitReason(event.WaitReason)
+		if err != nil {
 			break
 		}
-		waitReason := string(event.WaitReason[:nullByteIdx])
+		gopark := &proto.GoparkEvent{
+			MId: &event.MID,
+			Parked: &proto.RunqEntry{
+				GoId:             &goID,
+				ExecutionContext: r.interpretPC(event.Parked.PC),
+			},
+			WaitReason: &waitReason,
+			Callstack:  r.interpretCallstack(event.Callstack[:event.CallstackDepth]),
+		}
+		r.transitGoroutine(gopark.Parked, proto.GoroutineState_G_WAITING)
+		if event.FD >= 0 && waitReason == waitReasonIOWait {
+			gopark.Fd = &event.FD
+		}
 		probeEvent = &proto.ProbeEvent{
 			ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
 				NotificationEvent: &proto.NotificationEvent{
 					NotificationOneof: &proto.NotificationEvent_GoparkEvent{
-						GoparkEvent: &proto.GoparkEvent{
-							MId: &event.MID,
-							Parked: &proto.RunqEntry{
-								GoId:             &goID,
-								ExecutionContext: r.interpretPC(event.Parked.PC),
-							},
-							WaitReason: &waitReason,
-						},
+						GoparkEvent: gopark,
 					},
 				},
 			},
@@ -390,8 +851,8 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 			break
 		}
 		interpretedCallerPC := r.interpretPC(event.CallerPC)
-		if interpretedCallerPC.Func == nil || *interpretedCallerPC.Func != "runtime.schedule" {
-			logging.Logger().Infof("Execute event from non-target callsite (%s), skipping...", *interpretedCallerPC.Func)
+		if interpretedCallerPC.GetFunc() != "runtime.schedule" {
+			logging.Logger().Infof("Execute event from non-target callsite (%s), skipping...", interpretedCallerPC.GetFunc())
 			break
 		}
 		r.bufferedExecuteEvents[event.MID] = &executeEventBuffer{
@@ -408,10 +869,350 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 			MId:  &event.MID,
 			GoId: &goId,
 		}
+	case EVENT_TYPE_PREEMPT:
+		var event preemptEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		goId := int64(event.Preempted.GoID)
+		preempt := &proto.PreemptEvent{
+			MId: &event.MID,
+			Preempted: &proto.RunqEntry{
+				GoId:             &goId,
+				ExecutionContext: r.interpretPC(event.Preempted.PC),
+			},
+			Kind: proto.PreemptKind(event.Kind),
+		}
+		if event.ProcID >= 0 {
+			preempt.ProcId = &event.ProcID
+		}
+		if preempt.Kind != proto.PreemptKind_PREEMPT_REQUEST {
+			r.transitGoroutine(preempt.Preempted, proto.GoroutineState_G_RUNNABLE)
+		}
+		probeEvent = &proto.ProbeEvent{
+			ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+				NotificationEvent: &proto.NotificationEvent{
+					NotificationOneof: &proto.NotificationEvent_PreemptEvent{
+						PreemptEvent: preempt,
+					},
+				},
+			},
+		}
+	case EVENT_TYPE_ENTERSYSCALL, EVENT_TYPE_EXITSYSCALL:
+		var event syscallEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		probeEvent = r.convertSyscallEvent(event)
+	case EVENT_TYPE_HANDOFFP:
+		var event handoffpEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		handoffp := &proto.HandoffpEvent{
+			MId:    &event.MID,
+			ProcId: &event.ProcID,
+		}
+		if syscallMID, ok := r.syscallMs[event.ProcID]; ok {
+			handoffp.SyscallMId = &syscallMID
+			delete(r.syscallMs, event.ProcID)
+		}
+		if event.ReceivingMID >= 0 {
+			handoffp.ReceivingMId = &event.ReceivingMID
+		}
+		probeEvent = &proto.ProbeEvent{
+			ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+				NotificationEvent: &proto.NotificationEvent{
+					NotificationOneof: &proto.NotificationEvent_HandoffpEvent{
+						HandoffpEvent: handoffp,
+					},
+				},
+			},
+		}
+	case EVENT_TYPE_RUNQ_STEAL:
+		var event runqStealEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		buf := r.bufferedStealEvents[event.MID]
+		if buf == nil || event.Stage == runqStealStageBefore {
+			buf = &runqStealEventBuffer{}
+			r.bufferedStealEvents[event.MID] = buf
+		}
+		buf.event = event
+	case EVENT_TYPE_NETPOLL_READY:
+		var event netpollReadyEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		if _, ok := r.bufferedNetpollFDs[event.MID]; !ok {
+			r.bufferedNetpollFDs[event.MID] = make(map[uint64]int64)
+		}
+		r.bufferedNetpollFDs[event.MID][event.Readied.GoID] = event.FD
+	case EVENT_TYPE_NETPOLL:
+		var event netpollEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		probeEvent = r.completeNetpollEvent(event)
+	case EVENT_TYPE_CHAN_STATE:
+		var event chanStateEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		probeEvent = r.convertChanStateEvent(event)
+	case EVENT_TYPE_SEMTABLE_STATUS:
+		var event semaStateEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		probeEvent, err = r.convertSemaStateEvent(event)
+	case EVENT_TYPE_TIMER:
+		var event timerEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		timer := &proto.TimerEvent{
+			MId:   &event.MID,
+			Kind:  proto.TimerEventKind(event.Kind),
+			Timer: r.convertTimerEntry(event.Timer),
+		}
+		if event.ProcID >= 0 {
+			timer.ProcId = &event.ProcID
+		}
+		if timer.Kind == proto.TimerEventKind_TIMER_FIRE {
+			timer.Now = &event.Now
+		}
+		probeEvent = &proto.ProbeEvent{
+			ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+				NotificationEvent: &proto.NotificationEvent{
+					NotificationOneof: &proto.NotificationEvent_TimerEvent{
+						TimerEvent: timer,
+					},
+				},
+			},
+		}
+	case EVENT_TYPE_TIMER_HEAP_STATUS:
+		var event timerHeapStatusEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		convertedEvent := r.convertTimerHeapStatusEvent(event)
+		// Update any existing entry in buffered execute event in case of
+		// concurrency.
+		for _, buf := range r.bufferedExecuteEvents {
+			existingIdx := slices.IndexFunc(buf.timerHeaps, func(heap *proto.TimerHeapStatusEvent) bool {
+				return *heap.ProcId == *convertedEvent.ProcId
+			})
+			if existingIdx != -1 {
+				buf.timerHeaps[existingIdx] = convertedEvent
+			}
+		}
+		if event.GroupingMID < 0 {
+			probeEvent = &proto.ProbeEvent{
+				ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+					StructureStateEvent: &proto.StructureStateEvent{
+						StructureStateOneof: &proto.StructureStateEvent_TimerHeapStatusEvent{
+							TimerHeapStatusEvent: convertedEvent,
+						},
+					},
+				},
+			}
+		} else {
+			var buf *executeEventBuffer
+			buf, err = r.findBufferedExecuteEvent(event.GroupingMID)
+			if err != nil {
+				break
+			}
+			buf.timerHeaps = append(buf.timerHeaps, convertedEvent)
+			probeEvent = r.tryCompleteExecuteEvent(event.GroupingMID)
+		}
+	case EVENT_TYPE_GC_PHASE:
+		var event gcPhaseEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		gcPhase := &proto.GCPhaseEvent{
+			MId:        &event.MID,
+			Kind:       proto.GCPhaseKind(event.Kind),
+			Phase:      proto.GCPhase(event.Phase),
+			Goroutine:  r.interpretRunqEntry(event.Goroutine),
+			WorkerMode: proto.GCMarkWorkerMode(event.WorkerMode),
+		}
+		if event.ProcID >= 0 {
+			gcPhase.ProcId = &event.ProcID
+		}
+		probeEvent = &proto.ProbeEvent{
+			ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+				NotificationEvent: &proto.NotificationEvent{
+					NotificationOneof: &proto.NotificationEvent_GcPhaseEvent{
+						GcPhaseEvent: gcPhase,
+					},
+				},
+			},
+		}
+	case EVENT_TYPE_STW:
+		var (
+			event  stwEvent
+			reason string
+		)
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		reason, err = decodeWaitReason(event.Reason)
+		if err != nil {
+			break
+		}
+		probeEvent = &proto.ProbeEvent{
+			ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+				NotificationEvent: &proto.NotificationEvent{
+					NotificationOneof: &proto.NotificationEvent_StwEvent{
+						StwEvent: &proto.STWEvent{
+							MId:    &event.MID,
+							Stage:  proto.STWStage(event.Stage),
+							Reason: &reason,
+						},
+					},
+				},
+			},
+		}
+	case EVENT_TYPE_M_STATE:
+		var event mStateEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		spinning := event.Spinning != 0
+		mState := &proto.MStateEvent{
+			MId:      &event.MID,
+			Kind:     proto.MStateKind(event.Kind),
+			Spinning: &spinning,
+		}
+		if event.ProcID >= 0 {
+			mState.ProcId = &event.ProcID
+		}
+		if mState.Kind == proto.MStateKind_M_LOCK_OS_THREAD {
+			mState.LockedGoId = &event.LockedGoID
+		}
+		probeEvent = &proto.ProbeEvent{
+			ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+				NotificationEvent: &proto.NotificationEvent{
+					NotificationOneof: &proto.NotificationEvent_MStateEvent{
+						MStateEvent: mState,
+					},
+				},
+			},
+		}
+	case EVENT_TYPE_IDLE_LIST:
+		var event idleListEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		probeEvent = &proto.ProbeEvent{
+			ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+				StructureStateEvent: &proto.StructureStateEvent{
+					StructureStateOneof: &proto.StructureStateEvent_IdleListEvent{
+						IdleListEvent: &proto.IdleListEvent{
+							MId:           &event.MID,
+							IdleProcIds:   event.IdlePs[:event.NumIdlePs],
+							IdleMIds:      event.IdleMs[:event.NumIdleMs],
+							NumIdleProcs:  &event.NPIdle,
+							NumIdleMs:     &event.NMIdle,
+							NumSpinningMs: &event.NMSpinning,
+						},
+					},
+				},
+			},
+		}
+	case EVENT_TYPE_GOEXIT:
+		var event goexitEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		goId := int64(event.Exited.GoID)
+		exited := &proto.RunqEntry{
+			GoId:             &goId,
+			ExecutionContext: r.interpretPC(event.Exited.PC),
+		}
+		lifetime := r.transitGoroutine(exited, proto.GoroutineState_G_DEAD)
+		goexit := &proto.GoexitEvent{
+			MId:          &event.MID,
+			Exited:       exited,
+			NumScheduled: lifetime.NumRunning,
+		}
+		if event.ProcID >= 0 {
+			goexit.ProcId = &event.ProcID
+		}
+		if event.FinalPC != 0 {
+			goexit.FinalPc = r.interpretPC(event.FinalPC)
+		}
+		probeEvent = &proto.ProbeEvent{
+			ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+				NotificationEvent: &proto.NotificationEvent{
+					NotificationOneof: &proto.NotificationEvent_GoexitEvent{
+						GoexitEvent: goexit,
+					},
+				},
+			},
+		}
+	case EVENT_TYPE_PANIC:
+		var event panicEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		probeEvent = r.convertPanicEvent(event)
+	case EVENT_TYPE_LOAD_BASE:
+		var event loadBaseEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		logging.Logger().Debugf("Target program loaded at base 0x%x", event.Base)
+		r.interpreter.SetLoadBase(event.Base)
+	case EVENT_TYPE_RACE_DETECTED:
+		var event raceDetectedEvent
+		err = binary.Read(readSeeker, r.byteOrder, &event)
+		if err != nil {
+			break
+		}
+		raceDetected := &proto.RaceDetectedEvent{
+			MId: &event.MID,
+		}
+		if event.GoID != 0 {
+			goId := int64(event.GoID)
+			raceDetected.GoId = &goId
+		}
+		probeEvent = &proto.ProbeEvent{
+			ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+				NotificationEvent: &proto.NotificationEvent{
+					NotificationOneof: &proto.NotificationEvent_RaceDetectedEvent{
+						RaceDetectedEvent: raceDetected,
+					},
+				},
+			},
+		}
 	default:
 		err = fmt.Errorf("unrecognized event type")
 	}
 
+	if err != nil && !errors.Is(err, ErrUnknownPC) && !errors.Is(err, ErrDecode) {
+		err = fmt.Errorf("%w: %v", ErrDecode, err)
+	}
 	if probeEvent != nil {
 		logging.Logger().Debugf("Upon receiving event of type %v, probe event created: %+v", etype, probeEvent)
 		r.ProbeEventCh <- probeEvent
@@ -420,6 +1221,59 @@ func (r *EventReader) readEvent(readSeeker io.ReadSeeker, etype eventType) error
 	return err
 }
 
+// transitGoroutine records that the goroutine enters the given state, and
+// returns its lifetime so far.
+func (r *EventReader) transitGoroutine(entry *proto.RunqEntry, state proto.GoroutineState) *proto.GoroutineLifetime {
+	lifetime, ok := r.goroutineLifetimes[*entry.GoId]
+	if !ok {
+		lifetime = &proto.GoroutineLifetime{
+			GoId:        entry.GoId,
+			State:       proto.GoroutineState_G_CREATED,
+			NumRunnable: new(int64),
+			NumRunning:  new(int64),
+			NumWaiting:  new(int64),
+		}
+		r.goroutineLifetimes[*entry.GoId] = lifetime
+	}
+	if lifetime.StartPc == nil && entry.ExecutionContext != nil {
+		lifetime.StartPc = entry.ExecutionContext
+	}
+	if lifetime.State == state {
+		return lifetime
+	}
+	switch state {
+	case proto.GoroutineState_G_RUNNABLE:
+		*lifetime.NumRunnable++
+	case proto.GoroutineState_G_RUNNING:
+		*lifetime.NumRunning++
+	case proto.GoroutineState_G_WAITING:
+		*lifetime.NumWaiting++
+	}
+	lifetime.State = state
+	return lifetime
+}
+
+// LifetimeSummaryEvent summarizes the lifetime of all goroutines seen so far,
+// ordered by goid. It should only be called after ProbeEventCh is closed.
+func (r *EventReader) LifetimeSummaryEvent() *proto.ProbeEvent {
+	goIds := make([]int64, 0, len(r.goroutineLifetimes))
+	for goId := range r.goroutineLifetimes {
+		goIds = append(goIds, goId)
+	}
+	slices.Sort(goIds)
+	lifetimes := make([]*proto.GoroutineLifetime, 0, len(goIds))
+	for _, goId := range goIds {
+		lifetimes = append(lifetimes, r.goroutineLifetimes[goId])
+	}
+	return &proto.ProbeEvent{
+		ProbeEventOneof: &proto.ProbeEvent_LifetimeSummaryEvent{
+			LifetimeSummaryEvent: &proto.GoroutineLifetimeSummaryEvent{
+				Goroutines: lifetimes,
+			},
+		},
+	}
+}
+
 func (r *EventReader) convertRunqStatusEvent(event runqStatusEvent) *proto.RunqStatusEvent {
 	localRunqKey := event.formLocalRunqKey()
 	runnext := r.interpretRunqEntry(event.RunqEntry)
@@ -436,29 +1290,39 @@ func (r *EventReader) convertRunqStatusEvent(event runqStatusEvent) *proto.RunqS
 	return convertedEvent
 }
 
-func (r *EventReader) tryCompleteExecuteEvent(groupingMID int64, runqStatus *proto.RunqStatusEvent) *proto.ProbeEvent {
-	var probeEvent *proto.ProbeEvent
-
+func (r *EventReader) findBufferedExecuteEvent(groupingMID int64) (*executeEventBuffer, error) {
 	buf := r.bufferedExecuteEvents[groupingMID]
 	if buf == nil {
-		logging.Logger().Fatalf("No buffered execute event found for grouping mID %d", groupingMID)
+		return nil, fmt.Errorf("%w: no buffered execute event found for grouping mID %d", ErrDecode, groupingMID)
 	}
-	buf.runqStatuses = append(buf.runqStatuses, runqStatus)
+	return buf, nil
+}
+
+// tryCompleteExecuteEvent should only be called after the buffered execute
+// event of groupingMID is found.
+func (r *EventReader) tryCompleteExecuteEvent(groupingMID int64) *proto.ProbeEvent {
+	var probeEvent *proto.ProbeEvent
+
+	buf := r.bufferedExecuteEvents[groupingMID]
 	if buf.isCompleted() {
 		event := buf.event
 		goId := int64(event.Found.GoID)
+		found := &proto.RunqEntry{
+			GoId:             &goId,
+			ExecutionContext: r.interpretPC(event.Found.PC),
+		}
+		r.transitGoroutine(found, proto.GoroutineState_G_RUNNING)
 		probeEvent = &proto.ProbeEvent{
 			ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
 				StructureStateEvent: &proto.StructureStateEvent{
 					StructureStateOneof: &proto.StructureStateEvent_ExecuteEvent{
 						ExecuteEvent: &proto.ExecuteEvent{
-							MId: &event.MID,
-							Found: &proto.RunqEntry{
-								GoId:             &goId,
-								ExecutionContext: r.interpretPC(event.Found.PC),
-							},
-							ProcId: &event.ProcID,
-							Runqs:  buf.runqStatuses,
+							MId:        &event.MID,
+							Found:      found,
+							ProcId:     &event.ProcID,
+							Runqs:      buf.runqStatuses,
+							GlobalRunq: buf.globrunqStatus,
+							TimerHeaps: buf.timerHeaps,
 						},
 					},
 				},
@@ -469,12 +1333,46 @@ func (r *EventReader) tryCompleteExecuteEvent(groupingMID int64, runqStatus *pro
 	return probeEvent
 }
 
-func (r *EventReader) completeGoreadyEvent(mID int64, runqStatus *proto.RunqStatusEvent) *proto.ProbeEvent {
+func (r *EventReader) tryCompleteRunqStealEvent(mID int64, runqStatus *proto.RunqStatusEvent) (*proto.ProbeEvent, error) {
+	buf := r.bufferedStealEvents[mID]
+	if buf == nil {
+		return nil, fmt.Errorf("%w: no buffered runq steal event found for mID %d", ErrDecode, mID)
+	}
+	if buf.event.Stage == runqStealStageBefore {
+		buf.before = append(buf.before, runqStatus)
+	} else {
+		buf.after = append(buf.after, runqStatus)
+	}
+	if !buf.isCompleted() {
+		return nil, nil
+	}
+	delete(r.bufferedStealEvents, mID)
+	event := buf.event
+	return &proto.ProbeEvent{
+		ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+			StructureStateEvent: &proto.StructureStateEvent{
+				StructureStateOneof: &proto.StructureStateEvent_RunqStealEvent{
+					RunqStealEvent: &proto.RunqStealEvent{
+						MId:          &event.MID,
+						ThiefProcId:  &event.ThiefProcID,
+						VictimProcId: &event.VictimProcID,
+						NumStolen:    &event.NumStolen,
+						Before:       buf.before,
+						After:        buf.after,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func (r *EventReader) completeGoreadyEvent(mID int64, runqStatus *proto.RunqStatusEvent) (*proto.ProbeEvent, error) {
 	buf := r.bufferedGoreadyEvents[mID]
 	if buf == nil {
-		logging.Logger().Fatalf("No buffered goready event found for mID %d", mID)
+		return nil, fmt.Errorf("%w: no buffered goready event found for mID %d", ErrDecode, mID)
 	}
 	buf.Runq = runqStatus
+	r.transitGoroutine(&proto.RunqEntry{GoId: buf.GoId}, proto.GoroutineState_G_RUNNABLE)
 	return &proto.ProbeEvent{
 		ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
 			StructureStateEvent: &proto.StructureStateEvent{
@@ -483,20 +1381,259 @@ func (r *EventReader) completeGoreadyEvent(mID int64, runqStatus *proto.RunqStat
 				},
 			},
 		},
+	}, nil
+}
+
+func (r *EventReader) convertSyscallEvent(event syscallEvent) *proto.ProbeEvent {
+	var (
+		procId     *int64
+		notifEvent *proto.NotificationEvent
+		variant    = event.Variant != 0
+	)
+	if event.ProcID >= 0 {
+		procId = &event.ProcID
+	}
+	goId := int64(event.Syscaller.GoID)
+	syscaller := &proto.RunqEntry{
+		GoId:             &goId,
+		ExecutionContext: r.interpretPC(event.Syscaller.PC),
+	}
+	// The P is kept for the M through the syscall unless it's handed off.
+	if event.EType == EVENT_TYPE_ENTERSYSCALL && event.ProcID >= 0 {
+		r.syscallMs[event.ProcID] = event.MID
+	} else if event.EType == EVENT_TYPE_EXITSYSCALL {
+		for procID, mID := range r.syscallMs {
+			if mID == event.MID {
+				delete(r.syscallMs, procID)
+			}
+		}
+	}
+	if event.EType == EVENT_TYPE_ENTERSYSCALL {
+		notifEvent = &proto.NotificationEvent{
+			NotificationOneof: &proto.NotificationEvent_EntersyscallEvent{
+				EntersyscallEvent: &proto.EntersyscallEvent{
+					MId:       &event.MID,
+					ProcId:    procId,
+					Goroutine: syscaller,
+					Blocking:  &variant,
+				},
+			},
+		}
+	} else {
+		notifEvent = &proto.NotificationEvent{
+			NotificationOneof: &proto.NotificationEvent_ExitsyscallEvent{
+				ExitsyscallEvent: &proto.ExitsyscallEvent{
+					MId:       &event.MID,
+					ProcId:    procId,
+					Goroutine: syscaller,
+					Fast:      &variant,
+				},
+			},
+		}
+	}
+	return &proto.ProbeEvent{
+		ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+			NotificationEvent: notifEvent,
+		},
+	}
+}
+
+func (r *EventReader) completeNetpollEvent(event netpollEvent) *proto.ProbeEvent {
+	fds := r.bufferedNetpollFDs[event.MID]
+	readied := make([]*proto.NetpollReadied, 0, event.NumReadied)
+	for _, entry := range event.Readied[:event.NumReadied] {
+		netpollReadied := &proto.NetpollReadied{
+			Goroutine: r.interpretRunqEntry(entry),
+		}
+		if fd, ok := fds[entry.GoID]; ok {
+			netpollReadied.Fd = &fd
+		}
+		readied = append(readied, netpollReadied)
+	}
+	delete(r.bufferedNetpollFDs, event.MID)
+	return &proto.ProbeEvent{
+		ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+			NotificationEvent: &proto.NotificationEvent{
+				NotificationOneof: &proto.NotificationEvent_NetpollInjectEvent{
+					NetpollInjectEvent: &proto.NetpollInjectEvent{
+						MId:     &event.MID,
+						Readied: readied,
+					},
+				},
+			},
+		},
+	}
+}
+
+func (r *EventReader) convertChanStateEvent(event chanStateEvent) *proto.ProbeEvent {
+	goId := int64(event.Operator.GoID)
+	closed := event.Closed != 0
+	chanState := &proto.ChannelStateEvent{
+		MId: &event.MID,
+		Op:  proto.ChannelOp(event.Op),
+		Goroutine: &proto.RunqEntry{
+			GoId:             &goId,
+			ExecutionContext: r.interpretPC(event.Operator.PC),
+		},
+		ChanAddr: &event.ChanAddr,
+		Qcount:   &event.Qcount,
+		Dataqsiz: &event.Dataqsiz,
+		Sendx:    &event.Sendx,
+		Recvx:    &event.Recvx,
+		Closed:   &closed,
+		Sendq:    r.interpretRunqEntries(event.Sendq[:event.SendqLen]),
+		Recvq:    r.interpretRunqEntries(event.Recvq[:event.RecvqLen]),
+	}
+	if event.DeclPC != 0 {
+		chanState.DeclarationSite = r.interpretPC(event.DeclPC)
+	}
+	return &proto.ProbeEvent{
+		ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+			StructureStateEvent: &proto.StructureStateEvent{
+				StructureStateOneof: &proto.StructureStateEvent_ChannelStateEvent{
+					ChannelStateEvent: chanState,
+				},
+			},
+		},
+	}
+}
+
+func (r *EventReader) convertSemaStateEvent(event semaStateEvent) (*proto.ProbeEvent, error) {
+	goId := int64(event.Goroutine.GoID)
+	semaState := &proto.SemaphoreStateEvent{
+		MId: &event.MID,
+		Op:  proto.SemaphoreOp(event.Op),
+		Goroutine: &proto.RunqEntry{
+			GoId:             &goId,
+			ExecutionContext: r.interpretPC(event.Goroutine.PC),
+		},
+		SemaAddr: &event.SemaAddr,
+		Waiters:  r.interpretRunqEntries(event.Waiters[:event.NumWaiters]),
+	}
+	switch semaState.Op {
+	case proto.SemaphoreOp_MUTEX_LOCK, proto.SemaphoreOp_MUTEX_UNLOCK:
+		locked := event.MutexState&mutexLocked != 0
+		woken := event.MutexState&mutexWoken != 0
+		starving := event.MutexState&mutexStarving != 0
+		numWaiters := int32(event.MutexState >> mutexWaiterShift)
+		semaState.Mutex = &proto.MutexState{
+			MutexAddr:  &event.MutexAddr,
+			Locked:     &locked,
+			Woken:      &woken,
+			Starving:   &starving,
+			NumWaiters: &numWaiters,
+		}
+	case proto.SemaphoreOp_SEMACQUIRE:
+		waitReason, err := decodeWaitReason(event.WaitReason)
+		if err != nil {
+			return nil, err
+		}
+		semaState.WaitReason = &waitReason
+	case proto.SemaphoreOp_SEMRELEASE:
+		handoff := event.Handoff != 0
+		semaState.Handoff = &handoff
+	}
+	return &proto.ProbeEvent{
+		ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+			StructureStateEvent: &proto.StructureStateEvent{
+				StructureStateOneof: &proto.StructureStateEvent_SemaphoreStateEvent{
+					SemaphoreStateEvent: semaState,
+				},
+			},
+		},
+	}, nil
+}
+
+func (r *EventReader) convertTimerEntry(entry timerEntry) *proto.TimerEntry {
+	converted := &proto.TimerEntry{
+		TimerAddr: &entry.TimerAddr,
+		When:      &entry.When,
+		Period:    &entry.Period,
 	}
+	if entry.FPC != 0 {
+		converted.Callback = r.interpretPC(entry.FPC)
+	}
+	if entry.GoID >= 0 {
+		converted.GoId = &entry.GoID
+	}
+	return converted
 }
 
-func (r *EventReader) interpretScheduleCallstack(event scheduleEvent) (probeEvent *proto.ProbeEvent) {
+func (r *EventReader) convertTimerHeapStatusEvent(event timerHeapStatusEvent) *proto.TimerHeapStatusEvent {
+	converted := &proto.TimerHeapStatusEvent{
+		ProcId:    &event.ProcID,
+		NumTimers: &event.NumTimers,
+	}
+	for _, entry := range event.Timers[:min(event.NumTimers, int64(len(event.Timers)))] {
+		converted.Timers = append(converted.Timers, r.convertTimerEntry(entry))
+	}
+	return converted
+}
+
+func (r *EventReader) convertPanicEvent(event panicEvent) *proto.ProbeEvent {
+	goId := int64(event.Goroutine.GoID)
+	panicState := &proto.PanicEvent{
+		MId:  &event.MID,
+		Kind: proto.PanicEventKind(event.Kind),
+		Goroutine: &proto.RunqEntry{
+			GoId:             &goId,
+			ExecutionContext: r.interpretPC(event.Goroutine.PC),
+		},
+	}
+	if event.TypeAddr != 0 {
+		if typeName, ok := r.interpreter.TypeName(event.TypeAddr); ok {
+			panicState.ValueType = &typeName
+		} else {
+			logging.Logger().Warnf("Cannot interpret type at %x", event.TypeAddr)
+		}
+	}
+	panicState.Callstack = r.interpretCallstack(event.Callstack[:event.CallstackDepth])
+	panicState.Defers = r.interpretCallstack(event.Defers[:event.NumDefers])
+	switch panicState.Kind {
+	case proto.PanicEventKind_PANIC_RECOVERED:
+		recovered := true
+		panicState.Recovered = &recovered
+	case proto.PanicEventKind_PANIC_FATAL:
+		recovered := false
+		panicState.Recovered = &recovered
+	}
+	return &proto.ProbeEvent{
+		ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+			NotificationEvent: &proto.NotificationEvent{
+				NotificationOneof: &proto.NotificationEvent_PanicEvent{
+					PanicEvent: panicState,
+				},
+			},
+		},
+	}
+}
+
+func decodeWaitReason(raw [40]byte) (string, error) {
+	nullByteIdx := slices.Index(raw[:], 0)
+	if nullByteIdx == -1 {
+		return "", fmt.Errorf("null byte not found in wait reason %s", raw)
+	}
+	return string(raw[:nullByteIdx]), nil
+}
+
+func (r *EventReader) interpretScheduleCallstack(event scheduleEvent) (probeEvent *proto.ProbeEvent, err error) {
+	if event.CallstackDepth <= 0 {
+		return nil, fmt.Errorf("%w: empty schedule callstack", ErrDecode)
+	}
 	callstack := event.Callstack[:event.CallstackDepth]
 	interpretedCallstack := make([]*proto.InterpretedPC, len(callstack))
 	for i, pc := range callstack {
 		interpretedCallstack[i] = r.interpretPC(pc)
 	}
 	triggerFunc := interpretedCallstack[0].Func
-	if triggerFunc == nil || *triggerFunc != "runtime.schedule" {
-		logging.Logger().Fatalf("Invalid trigger func for PC %x", callstack[0])
+	reason := proto.ScheduleReason(event.Reason)
+	if event.Reason < 0 {
+		if triggerFunc == nil || *triggerFunc != "runtime.schedule" {
+			return nil, fmt.Errorf("%w: invalid trigger func for PC %x", ErrUnknownPC, callstack[0])
+		}
+		reason = findScheduleReason(interpretedCallstack)
 	}
-	logging.Logger().Debugf("%s called for MID %d, callstack: %+v, pc list: %v", *triggerFunc, event.MID, interpretedCallstack, callstack)
+	logging.Logger().Debugf("%s called for MID %d, callstack: %+v, pc list: %v", interpretedCallstack[0].GetFunc(), event.MID, interpretedCallstack, callstack)
 
 	probeEvent = &proto.ProbeEvent{
 		ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
@@ -504,7 +1641,7 @@ func (r *EventReader) interpretScheduleCallstack(event scheduleEvent) (probeEven
 				NotificationOneof: &proto.NotificationEvent_ScheduleEvent{
 					ScheduleEvent: &proto.ScheduleEvent{
 						MId:    &event.MID,
-						Reason: findScheduleReason(interpretedCallstack),
+						Reason: reason,
 					},
 				},
 			},
@@ -513,26 +1650,39 @@ func (r *EventReader) interpretScheduleCallstack(event scheduleEvent) (probeEven
 	if event.ProcID >= 0 {
 		probeEvent.GetNotificationEvent().GetScheduleEvent().ProcId = &event.ProcID
 	}
+	if reason == proto.ScheduleReason_LOCKED_M && event.LockedGoID >= 0 {
+		probeEvent.GetNotificationEvent().GetScheduleEvent().LockedGoId = &event.LockedGoID
+	}
 	return
 }
 
 var runtimeFuncToScheduleReason = map[string]proto.ScheduleReason{
-	"runtime.goexit": proto.ScheduleReason_GOEXIT,
-	"runtime.gopark": proto.ScheduleReason_GOPARK,
-	"runtime.mstart": proto.ScheduleReason_MSTART,
+	"runtime.goexit":           proto.ScheduleReason_GOEXIT,
+	"runtime.gopark":           proto.ScheduleReason_GOPARK,
+	"runtime.mstart":           proto.ScheduleReason_MSTART,
+	"runtime.gosched_m":        proto.ScheduleReason_GOSCHED,
+	"runtime.goschedguarded_m": proto.ScheduleReason_GOSCHED,
+	"runtime.gopreempt_m":      proto.ScheduleReason_PREEMPT,
+	"runtime.preemptPark":      proto.ScheduleReason_PREEMPT,
+	"runtime.exitsyscall0":     proto.ScheduleReason_SYSCALL,
 }
 
 func findScheduleReason(callstack []*proto.InterpretedPC) proto.ScheduleReason {
-	reason := proto.ScheduleReason_OTHER
 	for i := 1; i < len(callstack); i++ {
 		currFunc := callstack[i].Func
 		if currFunc == nil {
 			break
 		}
 		if r, ok := runtimeFuncToScheduleReason[*currFunc]; ok {
-			reason = r
-			break
+			return r
+		}
+		// The functions that lead to schedule may be inlined into their
+		// callers in an optimized runtime.
+		for _, caller := range callstack[i].InlinedCallers {
+			if r, ok := runtimeFuncToScheduleReason[caller.GetFunc()]; ok {
+				return r
+			}
 		}
 	}
-	return reason
+	return proto.ScheduleReason_OTHER
 }
@@ -2,8 +2,8 @@ package instrumentation
 
 import (
 	"bytes"
-	"debug/gosym"
 	"encoding/binary"
+	"errors"
 	"reflect"
 	"testing"
 
@@ -13,48 +13,152 @@ import (
 )
 
 var (
-	testingProcID0      int64 = 0
-	testingProcID1      int64 = 1
-	testingMID0         int64 = 0
-	testingMID1         int64 = 1
-	testingGoID2        int64 = 2
-	testingGoID3        int64 = 3
-	testingGoID4        int64 = 4
-	testingGoID5        int64 = 5
-	testingFile1              = "file1"
-	testingFile2              = "file2"
-	testingFile3              = "file3"
-	testingFile4              = "file4"
-	testingFileSchedule       = "proc.go"
-	testingLine1        int32 = 1
-	testingLine2        int32 = 2
-	testingLine3        int32 = 3
-	testingLine4        int32 = 4
-	testingLineSchedule int32 = 5
-	testingFunc1              = "func1"
-	testingFunc2              = "func2"
-	testingFunc3              = "func3"
-	testingFunc4              = "func4"
-	testingFuncSchedule       = "runtime.schedule"
+	testingProcID0      int64  = 0
+	testingProcID1      int64  = 1
+	testingMID0         int64  = 0
+	testingMID1         int64  = 1
+	testingMID2         int64  = 2
+	testingGoID2        int64  = 2
+	testingGoID3        int64  = 3
+	testingGoID4        int64  = 4
+	testingGoID5        int64  = 5
+	testingFile1               = "file1"
+	testingFile2               = "file2"
+	testingFile3               = "file3"
+	testingFile4               = "file4"
+	testingFileSchedule        = "proc.go"
+	testingLine1        int32  = 1
+	testingLine2        int32  = 2
+	testingLine3        int32  = 3
+	testingLine4        int32  = 4
+	testingLineSchedule int32  = 5
+	testingFunc1               = "func1"
+	testingFunc2               = "func2"
+	testingFunc3               = "func3"
+	testingFunc4               = "func4"
+	testingFuncSchedule        = "runtime.schedule"
+	testingFuncGosched         = "runtime.gosched_m"
+	testingLineGosched  int32  = 6
+	testingFuncPreempt         = "runtime.gopreempt_m"
+	testingFuncNewstack        = "runtime.newstack"
+	testingFalse               = false
+	testingFD           int64  = 7
+	testingNumStolen    int64  = 1
+	testingChanAddr     uint64 = 0xc000020000
+	testingChanCap      uint64 = 1
+	testingChanIdx      uint64 = 0
+	testingMutexAddr    uint64 = 0xc000030000
+	testingSemaAddr     uint64 = 0xc000030004
+	testingTrue                = true
+	testingMutexWaiters int32  = 1
+	testingNoTimers     int64  = 0
+	testingNumTimers    int64  = 1
+	testingTimerAddr    uint64 = 0xc000040000
+	testingTimerWhen    int64  = 1000
+	testingTimerNow     int64  = 1001
+	testingTimerPeriod  int64  = 0
+	testingSTWReasonStr        = "GC mark termination"
+	testingNumIdle      int64  = 1
+	testingNoIdle       int64  = 0
+	testingNumScheduled int64  = 0
+	testingTypeAddr     uint64 = 0x4b9000
+	testingTypeName            = "*errors.errorString"
+	testingStackAddr    uint64 = 0xc000100000
+	testingStringAddr   uint64 = 0x4a0000
+	testingSTWReason           = [40]byte{'G', 'C', ' ', 'm', 'a', 'r', 'k', ' ', 't', 'e', 'r', 'm', 'i', 'n', 'a', 't', 'i', 'o', 'n'}
+
+	testingWaitReasonIOWaitStr = waitReasonIOWait
+	testingWaitReasonIOWait    = [40]byte{'I', 'O', ' ', 'w', 'a', 'i', 't'}
 )
 
 var cannedPCs = map[uint64]struct {
-	fileName string
-	line     int
-	funcName string
+	fileName       string
+	line           int
+	funcName       string
+	inlinedCallers []SourceFrame
 }{
 	1: {fileName: testingFile1, line: int(testingLine1), funcName: testingFunc1},
 	2: {fileName: testingFile2, line: int(testingLine2), funcName: testingFunc2},
 	3: {fileName: testingFile3, line: int(testingLine3), funcName: testingFunc3},
 	4: {fileName: testingFile4, line: int(testingLine4), funcName: testingFunc4},
 	5: {fileName: testingFileSchedule, line: int(testingLineSchedule), funcName: testingFuncSchedule},
+	6: {fileName: testingFileSchedule, line: int(testingLineGosched), funcName: testingFuncGosched},
+	// testingFunc3 inlined into testingFunc1.
+	7: {
+		fileName:       testingFile3,
+		line:           int(testingLine3),
+		funcName:       testingFunc3,
+		inlinedCallers: []SourceFrame{{File: testingFile1, Line: int(testingLine1), Func: testingFunc1}},
+	},
+	// testingFunc4 inlined into runtime.gopreempt_m, which is inlined into
+	// runtime.newstack.
+	8: {
+		fileName: testingFile4,
+		line:     int(testingLine4),
+		funcName: testingFunc4,
+		inlinedCallers: []SourceFrame{
+			{File: testingFileSchedule, Line: int(testingLineGosched), Func: testingFuncPreempt},
+			{File: testingFileSchedule, Line: int(testingLineSchedule), Func: testingFuncNewstack},
+		},
+	},
+}
+
+type cannedPCInterpreter struct {
+	loadBase uint64
+}
+
+func (c *cannedPCInterpreter) SetLoadBase(base uint64) {
+	c.loadBase = base
+}
+
+var cannedTypes = map[uint64]string{
+	testingTypeAddr: testingTypeName,
+}
+
+func (c *cannedPCInterpreter) TypeName(typeAddr uint64) (string, bool) {
+	name, ok := cannedTypes[typeAddr]
+	return name, ok
+}
+
+// Variables of testingFunc4, whose CFA is at testingStackAddr+0x30.
+var cannedVariables = map[uint64][]VariableLocation{
+	4: {
+		{Name: "n", TypeName: "int", Kind: VariableKindInt, Size: 8, CFAOffset: -0x28},
+		{Name: "ok", TypeName: "bool", Kind: VariableKindBool, Size: 1, CFAOffset: -0x20},
+		{Name: "p", TypeName: "*main.node", Kind: VariableKindPointer, Size: 8, CFAOffset: -0x18},
+		{Name: "name", TypeName: "string", Kind: VariableKindString, Size: 16, CFAOffset: 0, IsArg: true},
+		{Name: "greeting", TypeName: "string", Kind: VariableKindString, Size: 16, CFAOffset: 0x10, IsArg: true},
+		{Name: "outOfWindow", TypeName: "int", Kind: VariableKindInt, Size: 8, CFAOffset: 0x1000},
+	},
+}
+
+var cannedStrings = map[uint64]string{
+	testingStringAddr: "hello",
+}
+
+func (c *cannedPCInterpreter) VariableLocations(pc uint64) []VariableLocation {
+	return cannedVariables[pc]
 }
 
-type cannedPCInterpreter struct{}
+func (c *cannedPCInterpreter) ReadString(addr, length uint64) (string, bool) {
+	str, ok := cannedStrings[addr]
+	if !ok || uint64(len(str)) < length {
+		return "", false
+	}
+	return str[:length], true
+}
+
+func (c *cannedPCInterpreter) Arch() Arch {
+	return ArchAMD64
+}
 
-func (c *cannedPCInterpreter) PCToLine(pc uint64) (file string, line int, fn *gosym.Func) {
-	canned := cannedPCs[pc]
-	return canned.fileName, canned.line, &gosym.Func{Sym: &gosym.Sym{Name: canned.funcName}}
+func (c *cannedPCInterpreter) PCToFrames(pc uint64) []SourceFrame {
+	canned, ok := cannedPCs[pc]
+	if !ok {
+		return nil
+	}
+	frame := SourceFrame{File: canned.fileName, Line: canned.line, Func: canned.funcName}
+	return append([]SourceFrame{frame}, canned.inlinedCallers...)
 }
 
 type cannedRingbufReader struct {
@@ -74,11 +178,32 @@ func (reader *cannedRingbufReader) Close() error {
 	return nil
 }
 
+func startCannedEventReader(byteOrder binary.ByteOrder, cannedEvents []any) *EventReader {
+	cannedRecords := make([]ringbuf.Record, len(cannedEvents))
+	buf := &bytes.Buffer{}
+	for i, event := range cannedEvents {
+		binary.Write(buf, byteOrder, event)
+		cannedRecords[i] = ringbuf.Record{
+			RawSample: make([]byte, buf.Len()),
+		}
+		copy(cannedRecords[i].RawSample, buf.Bytes())
+		buf.Reset()
+	}
+	interpreter := &cannedPCInterpreter{}
+	reader := &cannedRingbufReader{
+		cannedRecords: cannedRecords,
+	}
+	testingEventReader := NewEventReader(interpreter, reader)
+	testingEventReader.Start()
+	return testingEventReader
+}
+
 func TestEventReader(t *testing.T) {
 	inputs := []struct {
 		subtestName         string
 		cannedEvents        []any
 		expectedProbeEvents []*proto.ProbeEvent
+		expectedErr         error
 	}{
 		{
 			subtestName: "ConcurrentRunqStatusEventsFromDifferentCPUs",
@@ -379,6 +504,25 @@ func TestEventReader(t *testing.T) {
 						},
 					},
 				},
+				globalRunqStatusEvent{
+					EType: EVENT_TYPE_GLOBAL_RUNQ_STATUS,
+					Size:  0,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 0,
+					},
+					MID:         testingMID1,
+					GroupingMID: testingMID1,
+				},
+				timerHeapStatusEvent{
+					EType:       EVENT_TYPE_TIMER_HEAP_STATUS,
+					GroupingMID: testingMID1,
+					ProcID:      testingProcID0,
+				},
+				timerHeapStatusEvent{
+					EType:       EVENT_TYPE_TIMER_HEAP_STATUS,
+					GroupingMID: testingMID1,
+					ProcID:      testingProcID1,
+				},
 				runqStatusEvent{
 					EType:       EVENT_TYPE_RUNQ_STATUS,
 					ProcID:      testingProcID1,
@@ -393,6 +537,25 @@ func TestEventReader(t *testing.T) {
 						},
 					},
 				},
+				globalRunqStatusEvent{
+					EType: EVENT_TYPE_GLOBAL_RUNQ_STATUS,
+					Size:  0,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 0,
+					},
+					MID:         testingMID0,
+					GroupingMID: testingMID0,
+				},
+				timerHeapStatusEvent{
+					EType:       EVENT_TYPE_TIMER_HEAP_STATUS,
+					GroupingMID: testingMID0,
+					ProcID:      testingProcID0,
+				},
+				timerHeapStatusEvent{
+					EType:       EVENT_TYPE_TIMER_HEAP_STATUS,
+					GroupingMID: testingMID0,
+					ProcID:      testingProcID1,
+				},
 			},
 			expectedProbeEvents: []*proto.ProbeEvent{
 				{
@@ -424,6 +587,19 @@ func TestEventReader(t *testing.T) {
 											MId:         &testingMID1,
 										},
 									},
+									GlobalRunq: &proto.GlobalRunqStatusEvent{
+										MId: &testingMID1,
+									},
+									TimerHeaps: []*proto.TimerHeapStatusEvent{
+										{
+											ProcId:    &testingProcID0,
+											NumTimers: &testingNoTimers,
+										},
+										{
+											ProcId:    &testingProcID1,
+											NumTimers: &testingNoTimers,
+										},
+									},
 								},
 							},
 						},
@@ -458,6 +634,19 @@ func TestEventReader(t *testing.T) {
 											MId:         &testingMID1,
 										},
 									},
+									GlobalRunq: &proto.GlobalRunqStatusEvent{
+										MId: &testingMID0,
+									},
+									TimerHeaps: []*proto.TimerHeapStatusEvent{
+										{
+											ProcId:    &testingProcID0,
+											NumTimers: &testingNoTimers,
+										},
+										{
+											ProcId:    &testingProcID1,
+											NumTimers: &testingNoTimers,
+										},
+									},
 								},
 							},
 						},
@@ -566,6 +755,25 @@ func TestEventReader(t *testing.T) {
 						},
 					},
 				},
+				globalRunqStatusEvent{
+					EType: EVENT_TYPE_GLOBAL_RUNQ_STATUS,
+					Size:  0,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 0,
+					},
+					MID:         testingMID1,
+					GroupingMID: testingMID1,
+				},
+				timerHeapStatusEvent{
+					EType:       EVENT_TYPE_TIMER_HEAP_STATUS,
+					GroupingMID: testingMID1,
+					ProcID:      testingProcID0,
+				},
+				timerHeapStatusEvent{
+					EType:       EVENT_TYPE_TIMER_HEAP_STATUS,
+					GroupingMID: testingMID1,
+					ProcID:      testingProcID1,
+				},
 			},
 			expectedProbeEvents: []*proto.ProbeEvent{
 				{
@@ -644,6 +852,19 @@ func TestEventReader(t *testing.T) {
 											MId:         &testingMID1,
 										},
 									},
+									GlobalRunq: &proto.GlobalRunqStatusEvent{
+										MId: &testingMID1,
+									},
+									TimerHeaps: []*proto.TimerHeapStatusEvent{
+										{
+											ProcId:    &testingProcID0,
+											NumTimers: &testingNoTimers,
+										},
+										{
+											ProcId:    &testingProcID1,
+											NumTimers: &testingNoTimers,
+										},
+									},
 								},
 							},
 						},
@@ -743,6 +964,25 @@ func TestEventReader(t *testing.T) {
 						},
 					},
 				},
+				globalRunqStatusEvent{
+					EType: EVENT_TYPE_GLOBAL_RUNQ_STATUS,
+					Size:  0,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 0,
+					},
+					MID:         testingMID1,
+					GroupingMID: testingMID1,
+				},
+				timerHeapStatusEvent{
+					EType:       EVENT_TYPE_TIMER_HEAP_STATUS,
+					GroupingMID: testingMID1,
+					ProcID:      testingProcID0,
+				},
+				timerHeapStatusEvent{
+					EType:       EVENT_TYPE_TIMER_HEAP_STATUS,
+					GroupingMID: testingMID1,
+					ProcID:      testingProcID1,
+				},
 			},
 			expectedProbeEvents: []*proto.ProbeEvent{
 				{
@@ -824,6 +1064,19 @@ func TestEventReader(t *testing.T) {
 											MId:         &testingMID1,
 										},
 									},
+									GlobalRunq: &proto.GlobalRunqStatusEvent{
+										MId: &testingMID1,
+									},
+									TimerHeaps: []*proto.TimerHeapStatusEvent{
+										{
+											ProcId:    &testingProcID0,
+											NumTimers: &testingNoTimers,
+										},
+										{
+											ProcId:    &testingProcID1,
+											NumTimers: &testingNoTimers,
+										},
+									},
 								},
 							},
 						},
@@ -831,39 +1084,1562 @@ func TestEventReader(t *testing.T) {
 				},
 			},
 		},
-	}
-
-	logging.InitZapLogger("production")
-	byteOrder := determineByteOrder()
-	for _, input := range inputs {
-		t.Run(input.subtestName, func(t *testing.T) {
-			t.Parallel()
-			cannedRecords := make([]ringbuf.Record, len(input.cannedEvents))
-			buf := &bytes.Buffer{}
-			for i, event := range input.cannedEvents {
-				binary.Write(buf, byteOrder, event)
-				cannedRecords[i] = ringbuf.Record{
-					RawSample: make([]byte, buf.Len()),
-				}
-				copy(cannedRecords[i].RawSample, buf.Bytes())
-				buf.Reset()
-			}
-			interpreter := &cannedPCInterpreter{}
-			reader := &cannedRingbufReader{
-				cannedRecords: cannedRecords,
-			}
-			testingEventReader := NewEventReader(interpreter, reader)
-			testingEventReader.Start()
-			probeEventIdx := 0
-			for probeEvent := range testingEventReader.ProbeEventCh {
-				if !reflect.DeepEqual(input.expectedProbeEvents[probeEventIdx], probeEvent) {
-					t.Errorf("Probe event %d didn't match expectation (\nactual:\n%+v\nexpected:\n%+v\n)", probeEventIdx, probeEvent, input.expectedProbeEvents[probeEventIdx])
-				}
-				probeEventIdx++
-			}
-			if probeEventIdx != len(input.expectedProbeEvents) {
-				t.Errorf("Incorrect number of received probe events (actual: %d, expected: %d)", probeEventIdx, len(input.expectedProbeEvents))
-			}
-		})
+		{
+			subtestName: "Preempt",
+			cannedEvents: []any{
+				preemptEvent{
+					EType:  EVENT_TYPE_PREEMPT,
+					MID:    testingMID0,
+					ProcID: -1,
+					Preempted: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+					Kind: uint64(proto.PreemptKind_PREEMPT_REQUEST),
+				},
+				preemptEvent{
+					EType:  EVENT_TYPE_PREEMPT,
+					MID:    testingMID0,
+					ProcID: testingProcID1,
+					Preempted: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+					Kind: uint64(proto.PreemptKind_PREEMPT_ASYNC),
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_PreemptEvent{
+								PreemptEvent: &proto.PreemptEvent{
+									MId: &testingMID0,
+									Preempted: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									Kind: proto.PreemptKind_PREEMPT_REQUEST,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_PreemptEvent{
+								PreemptEvent: &proto.PreemptEvent{
+									MId:    &testingMID0,
+									ProcId: &testingProcID1,
+									Preempted: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									Kind: proto.PreemptKind_PREEMPT_ASYNC,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "SyscallWithHandoffp",
+			cannedEvents: []any{
+				syscallEvent{
+					EType:  EVENT_TYPE_ENTERSYSCALL,
+					MID:    testingMID0,
+					ProcID: testingProcID0,
+					Syscaller: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+				},
+				handoffpEvent{
+					EType:        EVENT_TYPE_HANDOFFP,
+					MID:          testingMID1,
+					ProcID:       testingProcID0,
+					ReceivingMID: testingMID2,
+				},
+				syscallEvent{
+					EType:  EVENT_TYPE_EXITSYSCALL,
+					MID:    testingMID0,
+					ProcID: -1,
+					Syscaller: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+				},
+				// P idled by a goroutine locked to the M rather than taken
+				// from a syscall.
+				handoffpEvent{
+					EType:        EVENT_TYPE_HANDOFFP,
+					MID:          testingMID1,
+					ProcID:       testingProcID1,
+					ReceivingMID: -1,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_EntersyscallEvent{
+								EntersyscallEvent: &proto.EntersyscallEvent{
+									MId:    &testingMID0,
+									ProcId: &testingProcID0,
+									Goroutine: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									Blocking: &testingFalse,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_HandoffpEvent{
+								HandoffpEvent: &proto.HandoffpEvent{
+									MId:          &testingMID1,
+									ProcId:       &testingProcID0,
+									SyscallMId:   &testingMID0,
+									ReceivingMId: &testingMID2,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_ExitsyscallEvent{
+								ExitsyscallEvent: &proto.ExitsyscallEvent{
+									MId: &testingMID0,
+									Goroutine: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									Fast: &testingFalse,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_HandoffpEvent{
+								HandoffpEvent: &proto.HandoffpEvent{
+									MId:    &testingMID1,
+									ProcId: &testingProcID1,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "NetpollInject",
+			cannedEvents: []any{
+				goparkEvent{
+					EType: EVENT_TYPE_GOPARK,
+					MID:   testingMID0,
+					Parked: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+					WaitReason: testingWaitReasonIOWait,
+					FD:         testingFD,
+				},
+				netpollReadyEvent{
+					EType: EVENT_TYPE_NETPOLL_READY,
+					MID:   testingMID1,
+					FD:    testingFD,
+					Readied: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+				},
+				netpollEvent{
+					EType:      EVENT_TYPE_NETPOLL,
+					MID:        testingMID1,
+					NumReadied: 2,
+					Readied: [16]runqEntry{
+						{PC: 1, GoID: uint64(testingGoID2)},
+						{PC: 2, GoID: uint64(testingGoID3)},
+					},
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_GoparkEvent{
+								GoparkEvent: &proto.GoparkEvent{
+									MId: &testingMID0,
+									Parked: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									WaitReason: &testingWaitReasonIOWaitStr,
+									Fd:         &testingFD,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_NetpollInjectEvent{
+								NetpollInjectEvent: &proto.NetpollInjectEvent{
+									MId: &testingMID1,
+									Readied: []*proto.NetpollReadied{
+										{
+											Goroutine: &proto.RunqEntry{
+												GoId: &testingGoID2,
+												ExecutionContext: &proto.InterpretedPC{
+													File: &testingFile1,
+													Line: &testingLine1,
+													Func: &testingFunc1,
+												},
+											},
+											Fd: &testingFD,
+										},
+										{
+											Goroutine: &proto.RunqEntry{
+												GoId: &testingGoID3,
+												ExecutionContext: &proto.InterpretedPC{
+													File: &testingFile2,
+													Line: &testingLine2,
+													Func: &testingFunc2,
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "RunqSteal",
+			cannedEvents: []any{
+				runqStealEvent{
+					EType:        EVENT_TYPE_RUNQ_STEAL,
+					MID:          testingMID1,
+					ThiefProcID:  testingProcID1,
+					VictimProcID: testingProcID0,
+					Stage:        runqStealStageBefore,
+					NumStolen:    0,
+				},
+				runqStatusEvent{
+					EType:       EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS,
+					ProcID:      testingProcID1,
+					Runqhead:    0,
+					Runqtail:    0,
+					MID:         testingMID1,
+					GroupingMID: testingMID1,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 0,
+						RunqEntry: runqEntry{
+							PC:   0,
+							GoID: 0,
+						},
+					},
+				},
+				runqStatusEvent{
+					EType:       EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS,
+					ProcID:      testingProcID0,
+					Runqhead:    0,
+					Runqtail:    2,
+					MID:         testingMID0,
+					GroupingMID: testingMID1,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 0,
+						RunqEntry: runqEntry{
+							PC:   1,
+							GoID: uint64(testingGoID2),
+						},
+					},
+				},
+				runqStatusEvent{
+					EType:       EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS,
+					ProcID:      testingProcID0,
+					Runqhead:    0,
+					Runqtail:    2,
+					MID:         testingMID0,
+					GroupingMID: testingMID1,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 1,
+						RunqEntry: runqEntry{
+							PC:   2,
+							GoID: uint64(testingGoID3),
+						},
+					},
+				},
+				runqStatusEvent{
+					EType:       EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS,
+					ProcID:      testingProcID0,
+					Runqhead:    0,
+					Runqtail:    2,
+					MID:         testingMID0,
+					GroupingMID: testingMID1,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 2,
+						RunqEntry: runqEntry{
+							PC:   0,
+							GoID: 0,
+						},
+					},
+				},
+				runqStealEvent{
+					EType:        EVENT_TYPE_RUNQ_STEAL,
+					MID:          testingMID1,
+					ThiefProcID:  testingProcID1,
+					VictimProcID: testingProcID0,
+					Stage:        runqStealStageAfter,
+					NumStolen:    1,
+				},
+				runqStatusEvent{
+					EType:       EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS,
+					ProcID:      testingProcID1,
+					Runqhead:    1,
+					Runqtail:    1,
+					MID:         testingMID1,
+					GroupingMID: testingMID1,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 1,
+						RunqEntry: runqEntry{
+							PC:   0,
+							GoID: 0,
+						},
+					},
+				},
+				runqStatusEvent{
+					EType:       EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS,
+					ProcID:      testingProcID0,
+					Runqhead:    1,
+					Runqtail:    2,
+					MID:         testingMID0,
+					GroupingMID: testingMID1,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 1,
+						RunqEntry: runqEntry{
+							PC:   2,
+							GoID: uint64(testingGoID3),
+						},
+					},
+				},
+				runqStatusEvent{
+					EType:       EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS,
+					ProcID:      testingProcID0,
+					Runqhead:    1,
+					Runqtail:    2,
+					MID:         testingMID0,
+					GroupingMID: testingMID1,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 2,
+						RunqEntry: runqEntry{
+							PC:   0,
+							GoID: 0,
+						},
+					},
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+						StructureStateEvent: &proto.StructureStateEvent{
+							StructureStateOneof: &proto.StructureStateEvent_RunqStealEvent{
+								RunqStealEvent: &proto.RunqStealEvent{
+									MId:          &testingMID1,
+									ThiefProcId:  &testingProcID1,
+									VictimProcId: &testingProcID0,
+									NumStolen:    &testingNumStolen,
+									Before: []*proto.RunqStatusEvent{
+										{
+											ProcId: &testingProcID1,
+											MId:    &testingMID1,
+										},
+										{
+											ProcId: &testingProcID0,
+											RunqEntries: []*proto.RunqEntry{
+												{
+													GoId: &testingGoID2,
+													ExecutionContext: &proto.InterpretedPC{
+														File: &testingFile1,
+														Line: &testingLine1,
+														Func: &testingFunc1,
+													},
+												},
+												{
+													GoId: &testingGoID3,
+													ExecutionContext: &proto.InterpretedPC{
+														File: &testingFile2,
+														Line: &testingLine2,
+														Func: &testingFunc2,
+													},
+												},
+											},
+											MId: &testingMID0,
+										},
+									},
+									After: []*proto.RunqStatusEvent{
+										{
+											ProcId: &testingProcID1,
+											MId:    &testingMID1,
+										},
+										{
+											ProcId: &testingProcID0,
+											RunqEntries: []*proto.RunqEntry{
+												{
+													GoId: &testingGoID3,
+													ExecutionContext: &proto.InterpretedPC{
+														File: &testingFile2,
+														Line: &testingLine2,
+														Func: &testingFunc2,
+													},
+												},
+											},
+											MId: &testingMID0,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "GlobalRunqStatus",
+			cannedEvents: []any{
+				globalRunqStatusEvent{
+					EType: EVENT_TYPE_GLOBAL_RUNQ_STATUS,
+					Size:  1,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 0,
+						RunqEntry: runqEntry{
+							PC:   1,
+							GoID: uint64(testingGoID2),
+						},
+					},
+					MID:         testingMID0,
+					GroupingMID: -1,
+				},
+				globalRunqStatusEvent{
+					EType: EVENT_TYPE_GLOBAL_RUNQ_STATUS,
+					Size:  1,
+					indexedRunqEntry: indexedRunqEntry{
+						RunqEntryIdx: 1,
+					},
+					MID:         testingMID0,
+					GroupingMID: -1,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+						StructureStateEvent: &proto.StructureStateEvent{
+							StructureStateOneof: &proto.StructureStateEvent_GlobalRunqStatusEvent{
+								GlobalRunqStatusEvent: &proto.GlobalRunqStatusEvent{
+									MId: &testingMID0,
+									RunqEntries: []*proto.RunqEntry{
+										{
+											GoId: &testingGoID2,
+											ExecutionContext: &proto.InterpretedPC{
+												File: &testingFile1,
+												Line: &testingLine1,
+												Func: &testingFunc1,
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "ChannelState",
+			cannedEvents: []any{
+				chanStateEvent{
+					EType: EVENT_TYPE_CHAN_STATE,
+					MID:   testingMID0,
+					Op:    uint64(proto.ChannelOp_CHAN_SEND),
+					Operator: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+					ChanAddr: testingChanAddr,
+					DeclPC:   4,
+					Qcount:   testingChanCap,
+					Dataqsiz: testingChanCap,
+					Sendx:    testingChanIdx,
+					Recvx:    testingChanIdx,
+					SendqLen: 1,
+					Sendq: [8]runqEntry{
+						{
+							PC:   3,
+							GoID: uint64(testingGoID3),
+						},
+					},
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+						StructureStateEvent: &proto.StructureStateEvent{
+							StructureStateOneof: &proto.StructureStateEvent_ChannelStateEvent{
+								ChannelStateEvent: &proto.ChannelStateEvent{
+									MId: &testingMID0,
+									Op:  proto.ChannelOp_CHAN_SEND,
+									Goroutine: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									ChanAddr: &testingChanAddr,
+									DeclarationSite: &proto.InterpretedPC{
+										File: &testingFile4,
+										Line: &testingLine4,
+										Func: &testingFunc4,
+									},
+									Qcount:   &testingChanCap,
+									Dataqsiz: &testingChanCap,
+									Sendx:    &testingChanIdx,
+									Recvx:    &testingChanIdx,
+									Closed:   &testingFalse,
+									Sendq: []*proto.RunqEntry{
+										{
+											GoId: &testingGoID3,
+											ExecutionContext: &proto.InterpretedPC{
+												File: &testingFile3,
+												Line: &testingLine3,
+												Func: &testingFunc3,
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "SemaphoreState",
+			cannedEvents: []any{
+				semaStateEvent{
+					EType: EVENT_TYPE_SEMTABLE_STATUS,
+					MID:   testingMID0,
+					Op:    uint64(proto.SemaphoreOp_MUTEX_UNLOCK),
+					Goroutine: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+					SemaAddr:   testingSemaAddr,
+					MutexAddr:  testingMutexAddr,
+					MutexState: mutexLocked | mutexStarving | 1<<mutexWaiterShift,
+					NumWaiters: 1,
+					Waiters: [8]runqEntry{
+						{
+							PC:   3,
+							GoID: uint64(testingGoID3),
+						},
+					},
+				},
+				semaStateEvent{
+					EType: EVENT_TYPE_SEMTABLE_STATUS,
+					MID:   testingMID0,
+					Op:    uint64(proto.SemaphoreOp_SEMRELEASE),
+					Goroutine: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+					SemaAddr:   testingSemaAddr,
+					Handoff:    1,
+					NumWaiters: 1,
+					Waiters: [8]runqEntry{
+						{
+							PC:   3,
+							GoID: uint64(testingGoID3),
+						},
+					},
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+						StructureStateEvent: &proto.StructureStateEvent{
+							StructureStateOneof: &proto.StructureStateEvent_SemaphoreStateEvent{
+								SemaphoreStateEvent: &proto.SemaphoreStateEvent{
+									MId: &testingMID0,
+									Op:  proto.SemaphoreOp_MUTEX_UNLOCK,
+									Goroutine: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									SemaAddr: &testingSemaAddr,
+									Waiters: []*proto.RunqEntry{
+										{
+											GoId: &testingGoID3,
+											ExecutionContext: &proto.InterpretedPC{
+												File: &testingFile3,
+												Line: &testingLine3,
+												Func: &testingFunc3,
+											},
+										},
+									},
+									Mutex: &proto.MutexState{
+										MutexAddr:  &testingMutexAddr,
+										Locked:     &testingTrue,
+										Woken:      &testingFalse,
+										Starving:   &testingTrue,
+										NumWaiters: &testingMutexWaiters,
+									},
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+						StructureStateEvent: &proto.StructureStateEvent{
+							StructureStateOneof: &proto.StructureStateEvent_SemaphoreStateEvent{
+								SemaphoreStateEvent: &proto.SemaphoreStateEvent{
+									MId: &testingMID0,
+									Op:  proto.SemaphoreOp_SEMRELEASE,
+									Goroutine: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									SemaAddr: &testingSemaAddr,
+									Waiters: []*proto.RunqEntry{
+										{
+											GoId: &testingGoID3,
+											ExecutionContext: &proto.InterpretedPC{
+												File: &testingFile3,
+												Line: &testingLine3,
+												Func: &testingFunc3,
+											},
+										},
+									},
+									Handoff: &testingTrue,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "Timer",
+			cannedEvents: []any{
+				timerEvent{
+					EType:  EVENT_TYPE_TIMER,
+					MID:    testingMID0,
+					Kind:   uint64(proto.TimerEventKind_TIMER_ADD),
+					ProcID: testingProcID0,
+					Timer: timerEntry{
+						TimerAddr: testingTimerAddr,
+						When:      testingTimerWhen,
+						FPC:       2,
+						GoID:      testingGoID3,
+					},
+				},
+				timerHeapStatusEvent{
+					EType:       EVENT_TYPE_TIMER_HEAP_STATUS,
+					GroupingMID: -1,
+					ProcID:      testingProcID0,
+					NumTimers:   testingNumTimers,
+					Timers: [6]timerEntry{
+						{
+							TimerAddr: testingTimerAddr,
+							When:      testingTimerWhen,
+							FPC:       2,
+							GoID:      testingGoID3,
+						},
+					},
+				},
+				timerEvent{
+					EType:  EVENT_TYPE_TIMER,
+					MID:    testingMID1,
+					Kind:   uint64(proto.TimerEventKind_TIMER_FIRE),
+					ProcID: testingProcID0,
+					Timer: timerEntry{
+						TimerAddr: testingTimerAddr,
+						When:      testingTimerWhen,
+						FPC:       2,
+						GoID:      testingGoID3,
+					},
+					Now: testingTimerNow,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_TimerEvent{
+								TimerEvent: &proto.TimerEvent{
+									MId:    &testingMID0,
+									Kind:   proto.TimerEventKind_TIMER_ADD,
+									ProcId: &testingProcID0,
+									Timer: &proto.TimerEntry{
+										TimerAddr: &testingTimerAddr,
+										When:      &testingTimerWhen,
+										Period:    &testingTimerPeriod,
+										Callback: &proto.InterpretedPC{
+											File: &testingFile2,
+											Line: &testingLine2,
+											Func: &testingFunc2,
+										},
+										GoId: &testingGoID3,
+									},
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+						StructureStateEvent: &proto.StructureStateEvent{
+							StructureStateOneof: &proto.StructureStateEvent_TimerHeapStatusEvent{
+								TimerHeapStatusEvent: &proto.TimerHeapStatusEvent{
+									ProcId:    &testingProcID0,
+									NumTimers: &testingNumTimers,
+									Timers: []*proto.TimerEntry{
+										{
+											TimerAddr: &testingTimerAddr,
+											When:      &testingTimerWhen,
+											Period:    &testingTimerPeriod,
+											Callback: &proto.InterpretedPC{
+												File: &testingFile2,
+												Line: &testingLine2,
+												Func: &testingFunc2,
+											},
+											GoId: &testingGoID3,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_TimerEvent{
+								TimerEvent: &proto.TimerEvent{
+									MId:    &testingMID1,
+									Kind:   proto.TimerEventKind_TIMER_FIRE,
+									ProcId: &testingProcID0,
+									Timer: &proto.TimerEntry{
+										TimerAddr: &testingTimerAddr,
+										When:      &testingTimerWhen,
+										Period:    &testingTimerPeriod,
+										Callback: &proto.InterpretedPC{
+											File: &testingFile2,
+											Line: &testingLine2,
+											Func: &testingFunc2,
+										},
+										GoId: &testingGoID3,
+									},
+									Now: &testingTimerNow,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "GCPhaseAndSTW",
+			cannedEvents: []any{
+				gcPhaseEvent{
+					EType:  EVENT_TYPE_GC_PHASE,
+					MID:    testingMID0,
+					Kind:   uint64(proto.GCPhaseKind_GC_MARK_WORKER_START),
+					Phase:  uint64(proto.GCPhase_GC_MARK),
+					ProcID: testingProcID1,
+					Goroutine: runqEntry{
+						PC:   3,
+						GoID: uint64(testingGoID4),
+					},
+					WorkerMode: uint64(proto.GCMarkWorkerMode_GC_MARK_WORKER_DEDICATED),
+				},
+				stwEvent{
+					EType:  EVENT_TYPE_STW,
+					MID:    testingMID1,
+					Stage:  uint64(proto.STWStage_STW_STOPPED),
+					Reason: testingSTWReason,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_GcPhaseEvent{
+								GcPhaseEvent: &proto.GCPhaseEvent{
+									MId:    &testingMID0,
+									Kind:   proto.GCPhaseKind_GC_MARK_WORKER_START,
+									Phase:  proto.GCPhase_GC_MARK,
+									ProcId: &testingProcID1,
+									Goroutine: &proto.RunqEntry{
+										GoId: &testingGoID4,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile3,
+											Line: &testingLine3,
+											Func: &testingFunc3,
+										},
+									},
+									WorkerMode: proto.GCMarkWorkerMode_GC_MARK_WORKER_DEDICATED,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_StwEvent{
+								StwEvent: &proto.STWEvent{
+									MId:    &testingMID1,
+									Stage:  proto.STWStage_STW_STOPPED,
+									Reason: &testingSTWReasonStr,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "MStateAndIdleList",
+			cannedEvents: []any{
+				mStateEvent{
+					EType:    EVENT_TYPE_M_STATE,
+					MID:      testingMID0,
+					Kind:     uint64(proto.MStateKind_M_START),
+					ProcID:   testingProcID1,
+					Spinning: 1,
+				},
+				idleListEvent{
+					EType:      EVENT_TYPE_IDLE_LIST,
+					MID:        testingMID0,
+					NPIdle:     testingNumIdle,
+					NMIdle:     testingNoIdle,
+					NMSpinning: testingNoIdle,
+					NumIdlePs:  1,
+					IdlePs:     [8]int64{testingProcID1},
+				},
+				mStateEvent{
+					EType:  EVENT_TYPE_M_STATE,
+					MID:    testingMID1,
+					Kind:   uint64(proto.MStateKind_M_STOP),
+					ProcID: -1,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_MStateEvent{
+								MStateEvent: &proto.MStateEvent{
+									MId:      &testingMID0,
+									Kind:     proto.MStateKind_M_START,
+									ProcId:   &testingProcID1,
+									Spinning: &testingTrue,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_StructureStateEvent{
+						StructureStateEvent: &proto.StructureStateEvent{
+							StructureStateOneof: &proto.StructureStateEvent_IdleListEvent{
+								IdleListEvent: &proto.IdleListEvent{
+									MId:           &testingMID0,
+									IdleProcIds:   []int64{testingProcID1},
+									IdleMIds:      []int64{},
+									NumIdleProcs:  &testingNumIdle,
+									NumIdleMs:     &testingNoIdle,
+									NumSpinningMs: &testingNoIdle,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_MStateEvent{
+								MStateEvent: &proto.MStateEvent{
+									MId:      &testingMID1,
+									Kind:     proto.MStateKind_M_STOP,
+									Spinning: &testingFalse,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "Goexit",
+			cannedEvents: []any{
+				goexitEvent{
+					EType:  EVENT_TYPE_GOEXIT,
+					MID:    testingMID0,
+					ProcID: testingProcID0,
+					Exited: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+					FinalPC: 2,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_GoexitEvent{
+								GoexitEvent: &proto.GoexitEvent{
+									MId:    &testingMID0,
+									ProcId: &testingProcID0,
+									Exited: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									FinalPc: &proto.InterpretedPC{
+										File: &testingFile2,
+										Line: &testingLine2,
+										Func: &testingFunc2,
+									},
+									NumScheduled: &testingNumScheduled,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "Panic",
+			cannedEvents: []any{
+				panicEvent{
+					EType: EVENT_TYPE_PANIC,
+					MID:   testingMID0,
+					Kind:  uint64(proto.PanicEventKind_PANIC_START),
+					Goroutine: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+					TypeAddr:       testingTypeAddr,
+					Callstack:      [maxStackTraceDepth]uint64{2, 1},
+					CallstackDepth: 2,
+					Defers:         [8]uint64{3},
+					NumDefers:      1,
+				},
+				panicEvent{
+					EType: EVENT_TYPE_PANIC,
+					MID:   testingMID0,
+					Kind:  uint64(proto.PanicEventKind_PANIC_RECOVERED),
+					Goroutine: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+					TypeAddr:       testingTypeAddr,
+					Callstack:      [maxStackTraceDepth]uint64{3},
+					CallstackDepth: 1,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_PanicEvent{
+								PanicEvent: &proto.PanicEvent{
+									MId:  &testingMID0,
+									Kind: proto.PanicEventKind_PANIC_START,
+									Goroutine: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									ValueType: &testingTypeName,
+									Callstack: []*proto.InterpretedPC{
+										{
+											File: &testingFile2,
+											Line: &testingLine2,
+											Func: &testingFunc2,
+										},
+										{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									Defers: []*proto.InterpretedPC{
+										{
+											File: &testingFile3,
+											Line: &testingLine3,
+											Func: &testingFunc3,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_PanicEvent{
+								PanicEvent: &proto.PanicEvent{
+									MId:  &testingMID0,
+									Kind: proto.PanicEventKind_PANIC_RECOVERED,
+									Goroutine: &proto.RunqEntry{
+										GoId: &testingGoID2,
+										ExecutionContext: &proto.InterpretedPC{
+											File: &testingFile1,
+											Line: &testingLine1,
+											Func: &testingFunc1,
+										},
+									},
+									ValueType: &testingTypeName,
+									Callstack: []*proto.InterpretedPC{
+										{
+											File: &testingFile3,
+											Line: &testingLine3,
+											Func: &testingFunc3,
+										},
+									},
+									Recovered: &testingTrue,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "ScheduleReason",
+			cannedEvents: []any{
+				scheduleEvent{
+					EType:          EVENT_TYPE_SCHEDULE,
+					MID:            testingMID0,
+					Callstack:      [maxStackTraceDepth]uint64{5, 6},
+					CallstackDepth: 2,
+					ProcID:         testingProcID0,
+					Reason:         -1,
+				},
+				scheduleEvent{
+					EType:          EVENT_TYPE_SCHEDULE,
+					MID:            testingMID1,
+					Callstack:      [maxStackTraceDepth]uint64{5},
+					CallstackDepth: 1,
+					ProcID:         testingProcID1,
+					Reason:         int64(proto.ScheduleReason_PREEMPT),
+				},
+				scheduleEvent{
+					EType:          EVENT_TYPE_SCHEDULE,
+					MID:            testingMID1,
+					Callstack:      [maxStackTraceDepth]uint64{1},
+					CallstackDepth: 1,
+					ProcID:         testingProcID1,
+					Reason:         int64(proto.ScheduleReason_LOCKED_M),
+					LockedGoID:     testingGoID3,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_ScheduleEvent{
+								ScheduleEvent: &proto.ScheduleEvent{
+									MId:    &testingMID0,
+									Reason: proto.ScheduleReason_GOSCHED,
+									ProcId: &testingProcID0,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_ScheduleEvent{
+								ScheduleEvent: &proto.ScheduleEvent{
+									MId:    &testingMID1,
+									Reason: proto.ScheduleReason_PREEMPT,
+									ProcId: &testingProcID1,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_ScheduleEvent{
+								ScheduleEvent: &proto.ScheduleEvent{
+									MId:        &testingMID1,
+									Reason:     proto.ScheduleReason_LOCKED_M,
+									ProcId:     &testingProcID1,
+									LockedGoId: &testingGoID3,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "ScheduleReasonOfInlinedFunc",
+			cannedEvents: []any{
+				scheduleEvent{
+					EType:          EVENT_TYPE_SCHEDULE,
+					MID:            testingMID0,
+					Callstack:      [maxStackTraceDepth]uint64{5, 8},
+					CallstackDepth: 2,
+					ProcID:         testingProcID0,
+					Reason:         -1,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_ScheduleEvent{
+								ScheduleEvent: &proto.ScheduleEvent{
+									MId:    &testingMID0,
+									Reason: proto.ScheduleReason_PREEMPT,
+									ProcId: &testingProcID0,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "DelayWithCallstack",
+			cannedEvents: []any{
+				delayEvent{
+					EType:          EVENT_TYPE_DELAY,
+					PC:             1,
+					GoID:           uint64(testingGoID2),
+					MID:            testingMID0,
+					Callstack:      [maxStackTraceDepth]uint64{1, 2},
+					CallstackDepth: 2,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_DelayEvent{
+						DelayEvent: &proto.DelayEvent{
+							GoId: &testingGoID2,
+							MId:  &testingMID0,
+							CurrentPc: &proto.InterpretedPC{
+								File: &testingFile1,
+								Line: &testingLine1,
+								Func: &testingFunc1,
+							},
+							Callstack: []*proto.InterpretedPC{
+								{
+									File: &testingFile1,
+									Line: &testingLine1,
+									Func: &testingFunc1,
+								},
+								{
+									File: &testingFile2,
+									Line: &testingLine2,
+									Func: &testingFunc2,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "DelayInInlinedFunc",
+			cannedEvents: []any{
+				delayEvent{
+					EType: EVENT_TYPE_DELAY,
+					PC:    7,
+					GoID:  uint64(testingGoID2),
+					MID:   testingMID0,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_DelayEvent{
+						DelayEvent: &proto.DelayEvent{
+							GoId: &testingGoID2,
+							MId:  &testingMID0,
+							CurrentPc: &proto.InterpretedPC{
+								File: &testingFile3,
+								Line: &testingLine3,
+								Func: &testingFunc3,
+								InlinedCallers: []*proto.InlinedCall{
+									{
+										File: &testingFile1,
+										Line: &testingLine1,
+										Func: &testingFunc1,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "DelayWithVariables",
+			cannedEvents: []any{
+				delayEvent{
+					EType:          EVENT_TYPE_DELAY,
+					PC:             4,
+					GoID:           uint64(testingGoID2),
+					MID:            testingMID0,
+					SP:             testingStackAddr,
+					FP:             testingStackAddr + 0x20,
+					StackWindowLen: 0x60,
+					StackWindow:    testingStackWindow(),
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_DelayEvent{
+						DelayEvent: &proto.DelayEvent{
+							GoId: &testingGoID2,
+							MId:  &testingMID0,
+							CurrentPc: &proto.InterpretedPC{
+								File: &testingFile4,
+								Line: &testingLine4,
+								Func: &testingFunc4,
+							},
+							Variables: []*proto.VariableSnapshot{
+								testingVariableSnapshot("n", "int", proto.VariableKind_VARIABLE_INT, "-3", false),
+								testingVariableSnapshot("ok", "bool", proto.VariableKind_VARIABLE_BOOL, "true", false),
+								testingVariableSnapshot("p", "*main.node", proto.VariableKind_VARIABLE_POINTER, "nil", false),
+								testingVariableSnapshot("name", "string", proto.VariableKind_VARIABLE_STRING, `"hi"`, true),
+								testingVariableSnapshot("greeting", "string", proto.VariableKind_VARIABLE_STRING, `"hello"`, true),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			// Each race report is sent once it's printed, including
+			// successive reports of the same goroutine.
+			subtestName: "RaceDetected",
+			cannedEvents: []any{
+				raceDetectedEvent{
+					EType: EVENT_TYPE_RACE_DETECTED,
+					MID:   testingMID0,
+					GoID:  uint64(testingGoID2),
+				},
+				raceDetectedEvent{
+					EType: EVENT_TYPE_RACE_DETECTED,
+					MID:   testingMID0,
+					GoID:  uint64(testingGoID2),
+				},
+				// Reported on an M without a user goroutine.
+				raceDetectedEvent{
+					EType: EVENT_TYPE_RACE_DETECTED,
+					MID:   testingMID1,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_RaceDetectedEvent{
+								RaceDetectedEvent: &proto.RaceDetectedEvent{
+									MId:  &testingMID0,
+									GoId: &testingGoID2,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_RaceDetectedEvent{
+								RaceDetectedEvent: &proto.RaceDetectedEvent{
+									MId:  &testingMID0,
+									GoId: &testingGoID2,
+								},
+							},
+						},
+					},
+				},
+				{
+					ProbeEventOneof: &proto.ProbeEvent_NotificationEvent{
+						NotificationEvent: &proto.NotificationEvent{
+							NotificationOneof: &proto.NotificationEvent_RaceDetectedEvent{
+								RaceDetectedEvent: &proto.RaceDetectedEvent{
+									MId: &testingMID1,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			// The execute event is skipped and the events following it are
+			// still interpreted.
+			subtestName: "ExecuteFromUnknownCallerPC",
+			cannedEvents: []any{
+				executeEvent{
+					EType: EVENT_TYPE_EXECUTE,
+					MID:   testingMID0,
+					Found: runqEntry{
+						PC:   1,
+						GoID: uint64(testingGoID2),
+					},
+					CallerPC: 0xdead,
+					ProcID:   testingProcID0,
+					NumP:     1,
+				},
+				delayEvent{
+					EType: EVENT_TYPE_DELAY,
+					PC:    1,
+					GoID:  uint64(testingGoID2),
+					MID:   testingMID0,
+				},
+			},
+			expectedProbeEvents: []*proto.ProbeEvent{
+				{
+					ProbeEventOneof: &proto.ProbeEvent_DelayEvent{
+						DelayEvent: &proto.DelayEvent{
+							GoId: &testingGoID2,
+							MId:  &testingMID0,
+							CurrentPc: &proto.InterpretedPC{
+								File: &testingFile1,
+								Line: &testingLine1,
+								Func: &testingFunc1,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			subtestName: "ScheduleWithUnknownTriggerFunc",
+			cannedEvents: []any{
+				scheduleEvent{
+					EType:          EVENT_TYPE_SCHEDULE,
+					MID:            testingMID0,
+					Callstack:      [maxStackTraceDepth]uint64{1},
+					CallstackDepth: 1,
+					ProcID:         testingProcID0,
+					Reason:         -1,
+				},
+			},
+			expectedErr: ErrUnknownPC,
+		},
+		{
+			// Events following the error are not interpreted.
+			subtestName: "GoreadyRunqStatusWithoutGoready",
+			cannedEvents: []any{
+				runqStatusEvent{
+					EType:       EVENT_TYPE_GOREADY_RUNQ_STATUS,
+					ProcID:      testingProcID0,
+					MID:         testingMID0,
+					GroupingMID: -1,
+				},
+				runqStatusEvent{
+					EType:       EVENT_TYPE_RUNQ_STATUS,
+					ProcID:      testingProcID0,
+					MID:         testingMID0,
+					GroupingMID: -1,
+				},
+			},
+			expectedErr: ErrDecode,
+		},
+	}
+
+	logging.InitZapLogger("production")
+	byteOrder := determineByteOrder()
+	for _, input := range inputs {
+		t.Run(input.subtestName, func(t *testing.T) {
+			t.Parallel()
+			testingEventReader := startCannedEventReader(byteOrder, input.cannedEvents)
+			probeEventIdx := 0
+			for probeEvent := range testingEventReader.ProbeEventCh {
+				if !reflect.DeepEqual(input.expectedProbeEvents[probeEventIdx], probeEvent) {
+					t.Errorf("Probe event %d didn't match expectation (\nactual:\n%+v\nexpected:\n%+v\n)", probeEventIdx, probeEvent, input.expectedProbeEvents[probeEventIdx])
+				}
+				probeEventIdx++
+			}
+			if probeEventIdx != len(input.expectedProbeEvents) {
+				t.Errorf("Incorrect number of received probe events (actual: %d, expected: %d)", probeEventIdx, len(input.expectedProbeEvents))
+			}
+			if err := testingEventReader.Err(); !errors.Is(err, input.expectedErr) {
+				t.Errorf("Unexpected reader error (actual: %v, expected: %v)", err, input.expectedErr)
+			}
+		})
+	}
+}
+
+func TestEventReader_LifetimeSummaryEvent(t *testing.T) {
+	var (
+		zero int64 = 0
+		one  int64 = 1
+	)
+
+	logging.InitZapLogger("production")
+	cannedEvents := []any{
+		goparkEvent{
+			EType: EVENT_TYPE_GOPARK,
+			MID:   testingMID0,
+			Parked: runqEntry{
+				PC:   1,
+				GoID: uint64(testingGoID3),
+			},
+			WaitReason: testingWaitReasonIOWait,
+			FD:         -1,
+		},
+		goexitEvent{
+			EType:  EVENT_TYPE_GOEXIT,
+			MID:    testingMID0,
+			ProcID: testingProcID0,
+			Exited: runqEntry{
+				PC:   1,
+				GoID: uint64(testingGoID2),
+			},
+		},
+	}
+	testingEventReader := startCannedEventReader(determineByteOrder(), cannedEvents)
+	for range testingEventReader.ProbeEventCh {
+	}
+	startPC := &proto.InterpretedPC{
+		File: &testingFile1,
+		Line: &testingLine1,
+		Func: &testingFunc1,
+	}
+	expected := &proto.ProbeEvent{
+		ProbeEventOneof: &proto.ProbeEvent_LifetimeSummaryEvent{
+			LifetimeSummaryEvent: &proto.GoroutineLifetimeSummaryEvent{
+				Goroutines: []*proto.GoroutineLifetime{
+					{
+						GoId:        &testingGoID2,
+						StartPc:     startPC,
+						State:       proto.GoroutineState_G_DEAD,
+						NumRunnable: &zero,
+						NumRunning:  &zero,
+						NumWaiting:  &zero,
+					},
+					{
+						GoId:        &testingGoID3,
+						StartPc:     startPC,
+						State:       proto.GoroutineState_G_WAITING,
+						NumRunnable: &zero,
+						NumRunning:  &zero,
+						NumWaiting:  &one,
+					},
+				},
+			},
+		},
+	}
+	if actual := testingEventReader.LifetimeSummaryEvent(); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Lifetime summary didn't match expectation (\nactual:\n%+v\nexpected:\n%+v\n)", actual, expected)
+	}
+}
+
+func TestEventReader_LoadBaseEvent(t *testing.T) {
+	logging.InitZapLogger("production")
+	const base = 0x7f0000000000
+	cannedEvents := []any{
+		loadBaseEvent{
+			EType: EVENT_TYPE_LOAD_BASE,
+			Base:  base,
+		},
+	}
+	testingEventReader := startCannedEventReader(determineByteOrder(), cannedEvents)
+	for event := range testingEventReader.ProbeEventCh {
+		t.Errorf("Unexpected probe event %+v", event)
+	}
+	if actual := testingEventReader.interpreter.(*cannedPCInterpreter).loadBase; actual != base {
+		t.Errorf("Load base didn't match expectation (actual: 0x%x, expected: 0x%x)", actual, base)
+	}
+}
+
+// testingStackWindow lays out the variables in cannedVariables, with the
+// content of the string argument "name" stored in the window as well.
+func testingStackWindow() [stackWindowSize]byte {
+	var window [stackWindowSize]byte
+	byteOrder := determineByteOrder()
+	byteOrder.PutUint64(window[0x08:], uint64(0xfffffffffffffffd))
+	window[0x10] = 1
+	byteOrder.PutUint64(window[0x30:], testingStackAddr+0x50)
+	byteOrder.PutUint64(window[0x38:], 2)
+	byteOrder.PutUint64(window[0x40:], testingStringAddr)
+	byteOrder.PutUint64(window[0x48:], 5)
+	copy(window[0x50:], "hi")
+	return window
+}
+
+func testingVariableSnapshot(name, typeName string, kind proto.VariableKind, value string, isArg bool) *proto.VariableSnapshot {
+	return &proto.VariableSnapshot{
+		Name:       &name,
+		Type:       &typeName,
+		Kind:       kind,
+		Value:      &value,
+		IsArgument: &isArg,
 	}
 }
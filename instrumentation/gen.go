@@ -1,3 +1,3 @@
 package instrumentation
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -tags linux instrumentor instrumentor.bpf.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -tags linux -target $GOARCH instrumentor instrumentor.bpf.c
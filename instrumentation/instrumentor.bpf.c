@@ -6,23 +6,47 @@
 
 char __license[] SEC("license") = "Dual MIT/GPL";
 
+// Registers of the Go internal ABI
+// (https://github.com/golang/go/blob/go1.22.5/src/cmd/compile/abi-internal.md).
+#if defined(__TARGET_ARCH_arm64)
+#define GO_PARAM1(x) ((x)->regs[0])
+#define GO_PARAM2(x) ((x)->regs[1])
+#define GO_PARAM3(x) ((x)->regs[2])
+#define GO_PARAM4(x) ((x)->regs[3])
+#define GO_PARAM5(x) ((x)->regs[4])
+#define GO_RET1(x) ((x)->regs[0])
+#define CURR_G_ADDR(x) ((x)->regs[28])
+#define CURR_PC(x) ((x)->pc)
+#define CURR_STACK_POINTER(x) ((char *)((x)->sp))
+#define CURR_FP(x) ((char *)((x)->regs[29]))
+#define CURR_LR(x) ((x)->regs[30])
+#else
 #define GO_PARAM1(x) ((x)->ax)
 #define GO_PARAM2(x) ((x)->bx)
 #define GO_PARAM3(x) ((x)->cx)
+#define GO_PARAM4(x) ((x)->di)
+#define GO_PARAM5(x) ((x)->si)
+#define GO_RET1(x) ((x)->ax)
 #define CURR_G_ADDR(x) ((x)->r14)
 #define CURR_PC(x) ((x)->ip)
 #define CURR_STACK_POINTER(x) ((char *)((x)->sp))
 #define CURR_FP(x) ((char *)((x)->bp))
+#endif
 #define MAX_LOOP_ITERS (1U << 23) // This is currently the max number of iterations permitted by eBPF loop.
 #define DELAY_NS 1e9
+#define MAX_STACK_TRACE_DEPTH 16
+#define STACK_WINDOW_SIZE 1024
 
 #define P_LOCAL_RUNQ_MAX_LEN 256
 #define GET_GOID_ADDR(g_addr) ((char *)(g_addr) + RUNTIME_G_GOID_OFFSET)
 #define GET_M_PTR_ADDR(g_addr) ((char *)(g_addr) + RUNTIME_G_M_OFFSET)
 #define GET_PC_ADDR(g_addr) ((char *)(g_addr) + RUNTIME_G_STARTPC_OFFSET)
 #define GET_SCHEDLINK_ADDR(g_addr) ((char *)(g_addr) + RUNTIME_G_SCHEDLINK_OFFSET)
+#define GET_G_STACK_HI_ADDR(g_addr) ((char *)(g_addr) + RUNTIME_G_STACK_OFFSET + RUNTIME_STACK_HI_OFFSET)
 #define GET_P_ADDR(m_addr) ((char *)(m_addr) + RUNTIME_M_P_OFFSET)
 #define GET_M_ID_ADDR(m_addr) ((char *)(m_addr) + RUNTIME_M_ID_OFFSET)
+#define GET_M_CURG_ADDR(m_addr) ((char *)(m_addr) + RUNTIME_M_CURG_OFFSET)
+#define GET_M_LOCKEDG_ADDR(m_addr) ((char *)(m_addr) + RUNTIME_M_LOCKEDG_OFFSET)
 #define GET_P_ID_ADDR(p_addr) ((char *)(p_addr) + RUNTIME_P_ID_OFFSET)
 #define GET_P_RUNQHEAD_ADDR(p_addr) ((char *)(p_addr) + RUNTIME_P_RUNQHEAD_OFFSET)
 #define GET_P_RUNQTAIL_ADDR(p_addr) ((char *)(p_addr) + RUNTIME_P_RUNQTAIL_OFFSET)
@@ -31,26 +55,62 @@ char __license[] SEC("license") = "Dual MIT/GPL";
 #define GET_P_M_PTR_ADDR(p_addr) ((char *)(p_addr) + RUNTIME_P_M_OFFSET)
 
 static int report_local_runq_status(uint64_t etype, uint64_t p_ptr_scalar, int64_t grouping_mid);
-static int64_t unwind_stack(char *curr_stack_addr, uint64_t pc, char *curr_fp, uint64_t callstack_pc_list[]);
+static int64_t get_procid(uint64_t p_ptr_scalar);
+static int64_t get_curr_mid(uint64_t g_ptr_scalar, uint64_t *m_ptr_scalar);
+static int report_timer_heap_status(uint64_t p_ptr_scalar, int64_t grouping_mid);
+static int64_t unwind_stack(char *curr_stack_addr, uint64_t pc, char *curr_fp, uint64_t callstack_pc_list[], int64_t max_depth);
 static long find_target_func(void *map, void *key, void *value, void *ctx);
 static bool check_delay_done(uint64_t ns_start);
 static void delay_helper(uint64_t delay_ns);
 
+// Returns the return address of the probed function, which is only valid at
+// function entry (before the frame is set up) or at a RET instruction.
+static __always_inline uint64_t get_caller_pc(struct pt_regs *ctx) {
+#if defined(__TARGET_ARCH_arm64)
+    // The return address stays in the link register until it's saved by the
+    // callee's prologue.
+    return CURR_LR(ctx);
+#else
+    // The return address is pushed onto the stack by the call.
+    uint64_t callerpc = 0;
+    bpf_probe_read_user(&callerpc, sizeof(uint64_t), CURR_STACK_POINTER(ctx));
+    return callerpc;
+#endif
+}
+
 // C and Go could have different memory layout (e.g. aligning rule) for the
 // "same" struct. uint64_t is used here to ensure consistent encoding/decoding
 // of binary data even though event type can be fit into type of smaller size.
 const uint64_t EVENT_TYPE_NEWPROC = 0;
 const uint64_t EVENT_TYPE_DELAY = 1;
 const uint64_t EVENT_TYPE_RUNQ_STATUS = 2;
-// const uint64_t EVENT_TYPE_RUNQ_STEAL = 3;
+const uint64_t EVENT_TYPE_RUNQ_STEAL = 3;
 // const uint64_t EVENT_TYPE_EXECUTE = 4;
 const uint64_t EVENT_TYPE_GLOBRUNQ_STATUS = 5;
-// const uint64_t EVENT_TYPE_SEMTABLE_STATUS = 6;
+const uint64_t EVENT_TYPE_SEMTABLE_STATUS = 6;
 const uint64_t EVENT_TYPE_SCHEDULE = 7;
 const uint64_t EVENT_TYPE_FOUND_RUNNABLE = 8;
 const uint64_t EVENT_TYPE_GOPARK = 9;
 const uint64_t EVENT_TYPE_GOREADY = 10;
 const uint64_t EVENT_TYPE_GOREADY_RUNQ_STATUS = 11;
+const uint64_t EVENT_TYPE_PREEMPT = 12;
+const uint64_t EVENT_TYPE_ENTERSYSCALL = 13;
+const uint64_t EVENT_TYPE_EXITSYSCALL = 14;
+const uint64_t EVENT_TYPE_HANDOFFP = 15;
+const uint64_t EVENT_TYPE_NETPOLL_READY = 16;
+const uint64_t EVENT_TYPE_NETPOLL = 17;
+const uint64_t EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS = 18;
+const uint64_t EVENT_TYPE_CHAN_STATE = 19;
+const uint64_t EVENT_TYPE_TIMER = 20;
+const uint64_t EVENT_TYPE_TIMER_HEAP_STATUS = 21;
+const uint64_t EVENT_TYPE_GC_PHASE = 22;
+const uint64_t EVENT_TYPE_STW = 23;
+const uint64_t EVENT_TYPE_M_STATE = 24;
+const uint64_t EVENT_TYPE_IDLE_LIST = 25;
+const uint64_t EVENT_TYPE_GOEXIT = 26;
+const uint64_t EVENT_TYPE_PANIC = 27;
+const uint64_t EVENT_TYPE_LOAD_BASE = 28;
+const uint64_t EVENT_TYPE_RACE_DETECTED = 29;
 
 // C-equivalent of Go runtime.funcval struct.
 struct funcval {
@@ -69,8 +129,29 @@ struct delay_event {
     uint64_t pc;
     uint64_t goid;
     int64_t mid;
+    uint64_t callstack[MAX_STACK_TRACE_DEPTH];
+    int64_t callstack_depth;
+    // The goroutine stack starting from sp, from which the userspace decodes
+    // local variables and arguments of the current function.
+    uint64_t sp;
+    uint64_t fp;
+    uint64_t stack_window_len;
+    uint8_t stack_window[STACK_WINDOW_SIZE];
 };
 
+// The delay event doesn't fit into the BPF stack, so it's assembled in a
+// per-CPU scratch buffer instead.
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, uint32_t);
+    __type(value, struct delay_event);
+    __uint(max_entries, 1);
+} delay_event_scratch SEC(".maps");
+
+// Max number of frames to unwind for the user goroutine on delay and gopark.
+// Unwinding is skipped when set to 0.
+volatile const uint64_t stack_trace_depth;
+
 struct runq_entry {
     // A zero PC indicate an empty entry.
     uint64_t pc;
@@ -96,6 +177,51 @@ struct {
     __uint(max_entries, 256 * 1024);
 } instrumentor_event SEC(".maps");
 
+// Difference between the runtime addresses and the addresses in the ELF file
+// of the target program, which is only nonzero for position-independent
+// executables. It's found by go_entry_point when the target program starts,
+// or written by the userspace when instrumenting a running process.
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, uint32_t);
+    __type(value, uint64_t);
+    __uint(max_entries, 1);
+} load_base SEC(".maps");
+
+static __always_inline uint64_t get_load_base() {
+    uint32_t key = 0;
+    uint64_t *base = bpf_map_lookup_elem(&load_base, &key);
+
+    return base ? *base : 0;
+}
+
+// Addresses of globals and functions assigned by the userspace are taken from
+// the ELF file, and need to be relocated before being compared with or read
+// from the running program.
+#define RUNTIME_ADDR(static_addr) ((static_addr) + get_load_base())
+
+// Address of the entry point in the ELF file.
+volatile const uint64_t entry_point_addr;
+
+struct load_base_event {
+    uint64_t etype;
+    uint64_t base;
+};
+
+// Attached to the entry point of the target program, which runs before any
+// other probe could fire.
+SEC("uprobe/go_entry_point")
+int BPF_UPROBE(go_entry_point) {
+    uint32_t key = 0;
+    struct load_base_event e;
+
+    e.etype = EVENT_TYPE_LOAD_BASE;
+    e.base = CURR_PC(ctx) - entry_point_addr;
+    bpf_map_update_elem(&load_base, &key, &e.base, BPF_ANY);
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+    return 0;
+}
+
 SEC("uprobe/go_newproc")
 int BPF_UPROBE(go_newproc) {
     struct newproc_event e;
@@ -174,15 +300,39 @@ static int report_local_runq_status(uint64_t etype, uint64_t p_ptr_scalar, int64
 
 SEC("uprobe/delay")
 int BPF_UPROBE(delay) {
-    struct delay_event e;
+    struct delay_event *e;
     char *m_ptr;
-    
-    e.etype = EVENT_TYPE_DELAY;
-    e.pc = CURR_PC(ctx);
-    bpf_probe_read_user(&e.goid, sizeof(uint64_t), GET_GOID_ADDR(CURR_G_ADDR(ctx)));
+    uint32_t scratch_key = 0;
+    uint64_t stack_hi, window_len;
+
+    e = bpf_map_lookup_elem(&delay_event_scratch, &scratch_key);
+    if (!e) {
+        return 0;
+    }
+    e->etype = EVENT_TYPE_DELAY;
+    e->pc = CURR_PC(ctx);
+    bpf_probe_read_user(&e->goid, sizeof(uint64_t), GET_GOID_ADDR(CURR_G_ADDR(ctx)));
     bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
-    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
-    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+    bpf_probe_read_user(&e->mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    e->callstack_depth = unwind_stack(CURR_STACK_POINTER(ctx), CURR_PC(ctx), CURR_FP(ctx), e->callstack, (int64_t)stack_trace_depth);
+    if (e->callstack_depth < 0) {
+        e->callstack_depth = 0;
+    }
+
+    // Copy the stack up to its upper bound so that the read doesn't run off
+    // the goroutine stack.
+    e->sp = (uint64_t)CURR_STACK_POINTER(ctx);
+    e->fp = (uint64_t)CURR_FP(ctx);
+    bpf_probe_read_user(&stack_hi, sizeof(uint64_t), GET_G_STACK_HI_ADDR(CURR_G_ADDR(ctx)));
+    window_len = stack_hi > e->sp ? stack_hi - e->sp : 0;
+    if (window_len > STACK_WINDOW_SIZE) {
+        window_len = STACK_WINDOW_SIZE;
+    }
+    if (bpf_probe_read_user(e->stack_window, window_len, (void *)e->sp) != 0) {
+        window_len = 0;
+    }
+    e->stack_window_len = window_len;
+    bpf_ringbuf_output(&instrumentor_event, e, sizeof(*e), 0);
 
     delay_helper(DELAY_NS);
 
@@ -225,8 +375,8 @@ int BPF_UPROBE(avoid_preempt) {
     int64_t allp_len, now = GO_PARAM1(ctx);
     int i;
 
-    bpf_probe_read_user(&allp_arr_addr, sizeof(char *), (char *)allp_slice_addr);
-    bpf_probe_read_user(&allp_len, sizeof(int64_t), (char *)(allp_slice_addr + SLICE_LEN_OFFSET));
+    bpf_probe_read_user(&allp_arr_addr, sizeof(char *), (char *)RUNTIME_ADDR(allp_slice_addr));
+    bpf_probe_read_user(&allp_len, sizeof(int64_t), (char *)(RUNTIME_ADDR(allp_slice_addr) + SLICE_LEN_OFFSET));
     bpf_for(i, 0, allp_len) {
         bpf_probe_read_user(&p, sizeof(char *), allp_arr_addr + sizeof(char *) * i);
         bpf_probe_write_user(p + P_SCHEDWHEN_OFFSET, &now, sizeof(int64_t));
@@ -246,29 +396,41 @@ volatile const uint64_t runtime_sched_addr;
 struct globrunq_status_event {
     uint64_t etype;
     // The globrunq is a linked structure instead of a fixed-cap array (as local
-    // runq is), but we have access to its size. So the userspace knows the
-    // event marks the end of globrunq when runq_entry_idx = size - 1.
+    // runq is), so it's walked once to find out its size (capped at
+    // MAX_GLOBRUNQ_SIZE). The userspace knows the event marks the end of
+    // globrunq when runq_entry_idx = size.
     int64_t size;
     uint64_t runq_entry_idx;
     struct runq_entry runq_entry;
+    int64_t mid;
+    int64_t grouping_mid; // -1 if only collecting status of globrunq
 };
 
-SEC("uprobe/go_globrunq_status")
-int BPF_UPROBE(go_globrunq_status) {
+static int report_globrunq_status(int64_t mid, int64_t grouping_mid) {
     char *g_ptr;
-    int64_t runq_size;
+    int64_t runq_size = 0;
     uint64_t runq_i;
     struct globrunq_status_event e;
 
-    bpf_probe_read_user(&g_ptr, sizeof(char *), SCHED_GET_RUNQ_HEAD_ADDR(runtime_sched_addr));
-
+    bpf_probe_read_user(&g_ptr, sizeof(char *), SCHED_GET_RUNQ_HEAD_ADDR(RUNTIME_ADDR(runtime_sched_addr)));
     bpf_for(runq_i, 0, MAX_GLOBRUNQ_SIZE) {
         if (!g_ptr) {
             break;
         }
+        runq_size++;
+        bpf_probe_read_user(&g_ptr, sizeof(char *), GET_SCHEDLINK_ADDR(g_ptr));
+    }
+
+    bpf_probe_read_user(&g_ptr, sizeof(char *), SCHED_GET_RUNQ_HEAD_ADDR(RUNTIME_ADDR(runtime_sched_addr)));
+    bpf_for(runq_i, 0, MAX_GLOBRUNQ_SIZE) {
+        if (!g_ptr || runq_i >= runq_size) {
+            break;
+        }
         e.etype = EVENT_TYPE_GLOBRUNQ_STATUS;
         e.size = runq_size;
         e.runq_entry_idx = runq_i;
+        e.mid = mid;
+        e.grouping_mid = grouping_mid;
         bpf_probe_read_user(&(e.runq_entry.goid), sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
         bpf_probe_read_user(&(e.runq_entry.pc), sizeof(uint64_t), GET_PC_ADDR(g_ptr));
         bpf_probe_read_user(&g_ptr, sizeof(char *), GET_SCHEDLINK_ADDR(g_ptr));
@@ -280,10 +442,24 @@ int BPF_UPROBE(go_globrunq_status) {
     e.size = runq_size;
     e.runq_entry_idx = runq_size;
     e.runq_entry.pc = 0;
+    e.mid = mid;
+    e.grouping_mid = grouping_mid;
     bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
     return 0;
 }
 
+// Attached to the returns of globrunqput and globrunqget, where sched.lock is
+// still held by the caller so the globrunq is consistent.
+SEC("uprobe/go_globrunq_status")
+int BPF_UPROBE(go_globrunq_status) {
+    char *m_ptr;
+    int64_t mid;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    return report_globrunq_status(mid, -1);
+}
+
 #define NUM_WAITREASON 60 // reserve space for more than the number of wait reasons in the latest go version
 #define WAITREASON_STRING_MAX_LEN 40
 #define GO_STRING_LEN_OFFSET 8
@@ -312,7 +488,7 @@ int BPF_UPROBE(get_waitreason_strings) {
     struct waitreason reason;
 
     bpf_for(i, 0, RUNTIME_WAITREASONSTRINGS_LENGTH) {
-        reason_strings_elem_ptr = (char *)(waitreason_strings_addr + GO_STRING_SIZE * i);
+        reason_strings_elem_ptr = (char *)(RUNTIME_ADDR(waitreason_strings_addr) + GO_STRING_SIZE * i);
         bpf_probe_read_user(&reason_str_ptr, sizeof(char *), reason_strings_elem_ptr);
         bpf_probe_read_user(&reason_str_len, sizeof(int64_t), GO_STRING_LEN_ADDR(reason_strings_elem_ptr));
         reason_str_len++; // count in the NUL byte
@@ -334,14 +510,29 @@ struct gopark_event {
     int64_t mid;
     struct runq_entry parked;
     char waitreason[WAITREASON_STRING_MAX_LEN];
+    int64_t fd; // -1 if not parked by netpollblock
+    // Callstack of the parked goroutine, starting from the caller of gopark.
+    uint64_t callstack[MAX_STACK_TRACE_DEPTH];
+    int64_t callstack_depth;
 };
 
+// The fd each goroutine is about to wait on, recorded by netpollblock and
+// consumed by the subsequent gopark.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, uint64_t);
+    __type(value, int64_t);
+    __uint(max_entries, 1024);
+} netpoll_waiting_fds SEC(".maps");
+
 SEC("uprobe/go_gopark")
 int BPF_UPROBE(go_gopark) {
     struct gopark_event e;
     char *m_ptr, *g_ptr;
     struct waitreason *reason_ptr;
     uint32_t waitreason_i;
+    int64_t *fd_ptr;
+    uint64_t callerpc;
 
     delay_helper(DELAY_NS);
 
@@ -358,6 +549,19 @@ int BPF_UPROBE(go_gopark) {
     bpf_probe_read_user(&e.parked.pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
     bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(g_ptr));
     bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    fd_ptr = bpf_map_lookup_elem(&netpoll_waiting_fds, &e.parked.goid);
+    if (!fd_ptr) {
+        e.fd = -1;
+    } else {
+        e.fd = *fd_ptr;
+        bpf_map_delete_elem(&netpoll_waiting_fds, &e.parked.goid);
+    }
+    // The frame pointer still belongs to the caller at function entry.
+    callerpc = get_caller_pc(ctx);
+    e.callstack_depth = unwind_stack(CURR_STACK_POINTER(ctx), callerpc, CURR_FP(ctx), e.callstack, (int64_t)stack_trace_depth);
+    if (e.callstack_depth < 0) {
+        e.callstack_depth = 0;
+    }
     bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
 
     return 0;
@@ -409,25 +613,50 @@ struct {
     __uint(max_entries, 8 * 1024);
 } go_functab SEC(".maps");
 
-#define MAX_STACK_TRACE_DEPTH 8
 #define GO_FUNC_FLAG_TOP_FRAME 1
 
+// Schedule reasons known in kernel space. The values are kept identical to
+// ScheduleReason in slowmo.proto so the userspace can convert them directly.
+// The reason is otherwise inferred from the callstack in userspace.
+const int64_t SCHEDULE_REASON_UNKNOWN = -1;
+const int64_t SCHEDULE_REASON_GOSCHED = 3;
+const int64_t SCHEDULE_REASON_PREEMPT = 4;
+const int64_t SCHEDULE_REASON_LOCKED_M = 6;
+const int64_t SCHEDULE_REASON_GC_STOP = 7;
+const int64_t SCHEDULE_REASON_STEAL_FAIL = 8;
+
+// Entry and end PC of runtime.findRunnable, which calls stopm after failing to
+// find any work (including by stealing from other Ps).
+volatile const uint64_t find_runnable_entry_pc;
+volatile const uint64_t find_runnable_end_pc;
+
 struct schedule_event {
     uint64_t etype;
     int64_t mid;
     uint64_t callstack[MAX_STACK_TRACE_DEPTH];
     int64_t callstack_depth;
     int64_t procid;
+    int64_t reason; // SCHEDULE_REASON_UNKNOWN if to be inferred from callstack
+    int64_t locked_goid; // only meaningful for SCHEDULE_REASON_LOCKED_M
 };
 
-SEC("uprobe/go_schedule")
-int BPF_UPROBE(go_schedule) {
+// Schedule reasons set by goschedImpl for the following call to schedule,
+// keyed by M id.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, int64_t);
+    __type(value, int64_t);
+    __uint(max_entries, 1 << 8);
+} schedule_reasons SEC(".maps");
+
+static int report_schedule(struct pt_regs *ctx, int64_t reason, uint64_t locked_g_ptr_scalar) {
     struct schedule_event e;
     char *m_ptr, *p_ptr;
     uint64_t pc_list[MAX_STACK_TRACE_DEPTH];
     int32_t i, procid32;
 
     e.etype = EVENT_TYPE_SCHEDULE;
+    e.reason = reason;
     bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
     bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
     bpf_probe_read_user(&p_ptr, sizeof(char *), GET_P_ADDR(m_ptr));
@@ -437,7 +666,12 @@ int BPF_UPROBE(go_schedule) {
         bpf_probe_read_user(&procid32, sizeof(int32_t), GET_P_ID_ADDR(p_ptr));
         e.procid = (int64_t)procid32;
     }
-    e.callstack_depth = unwind_stack(CURR_STACK_POINTER(ctx), CURR_PC(ctx), CURR_FP(ctx), pc_list);
+    if (!locked_g_ptr_scalar) {
+        e.locked_goid = -1;
+    } else {
+        bpf_probe_read_user(&e.locked_goid, sizeof(int64_t), GET_GOID_ADDR(locked_g_ptr_scalar));
+    }
+    e.callstack_depth = unwind_stack(CURR_STACK_POINTER(ctx), CURR_PC(ctx), CURR_FP(ctx), pc_list, MAX_STACK_TRACE_DEPTH);
     if (e.callstack_depth < 0) {
         bpf_printk("error unwinding callstack for pc %d", CURR_PC(ctx));
         return 1;
@@ -447,18 +681,100 @@ int BPF_UPROBE(go_schedule) {
     }
     bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
 
+    return 0;
+}
+
+SEC("uprobe/go_schedule")
+int BPF_UPROBE(go_schedule) {
+    char *m_ptr;
+    int64_t mid, reason = SCHEDULE_REASON_UNKNOWN, *reason_ptr;
+    int ret;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    reason_ptr = bpf_map_lookup_elem(&schedule_reasons, &mid);
+    if (reason_ptr) {
+        reason = *reason_ptr;
+        bpf_map_delete_elem(&schedule_reasons, &mid);
+    }
+    if ((ret = report_schedule(ctx, reason, 0))) {
+        return ret;
+    }
+
     delay_helper(DELAY_NS);
 
     return 0;
 }
 
-static int64_t unwind_stack(char *curr_stack_addr, uint64_t curr_pc, char *fp, uint64_t *callstack_pc_list) {
+// goschedImpl(gp *g, preempted bool) puts the current goroutine onto global
+// runq before calling schedule, either voluntarily (runtime.Gosched) or upon
+// preemption.
+SEC("uprobe/go_gosched_impl")
+int BPF_UPROBE(go_gosched_impl) {
+    char *m_ptr;
+    int64_t mid, reason;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    reason = (uint8_t)GO_PARAM2(ctx) ? SCHEDULE_REASON_PREEMPT : SCHEDULE_REASON_GOSCHED;
+    bpf_map_update_elem(&schedule_reasons, &mid, &reason, BPF_ANY);
+
+    return 0;
+}
+
+// The following probes report M giving up its P in the middle of schedule
+// (which restarts from the top later instead of being called again).
+
+// startlockedm(gp *g) hands off P to the M that gp is locked to, and stops the
+// current M.
+SEC("uprobe/go_startlockedm")
+int BPF_UPROBE(go_startlockedm) {
+    return report_schedule(ctx, SCHEDULE_REASON_LOCKED_M, GO_PARAM1(ctx));
+}
+
+// stoplockedm stops the current M until its locked goroutine is runnable.
+SEC("uprobe/go_stoplockedm")
+int BPF_UPROBE(go_stoplockedm) {
+    char *m_ptr, *lockedg_ptr;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&lockedg_ptr, sizeof(char *), GET_M_LOCKEDG_ADDR(m_ptr));
+    return report_schedule(ctx, SCHEDULE_REASON_LOCKED_M, (uint64_t)lockedg_ptr);
+}
+
+SEC("uprobe/go_gcstopm")
+int BPF_UPROBE(go_gcstopm) {
+    return report_schedule(ctx, SCHEDULE_REASON_GC_STOP, 0);
+}
+
+// Attached to the entry of stopm, and only reports when stopm is called by
+// findRunnable.
+SEC("uprobe/go_find_runnable_stopm")
+int BPF_UPROBE(go_find_runnable_stopm) {
+    uint64_t callerpc;
+
+    callerpc = get_caller_pc(ctx) - get_load_base();
+    if (callerpc < find_runnable_entry_pc || callerpc >= find_runnable_end_pc) {
+        return 0;
+    }
+    return report_schedule(ctx, SCHEDULE_REASON_STEAL_FAIL, 0);
+}
+
+// Unwinds at most max_depth frames (capped by MAX_STACK_TRACE_DEPTH) into
+// callstack_pc_list and returns the number of unwound frames.
+static int64_t unwind_stack(char *curr_stack_addr, uint64_t curr_pc, char *fp, uint64_t *callstack_pc_list, int64_t max_depth) {
     int i;
     long go_functab_idx;
+    uint64_t static_pc;
     struct go_func_info *func_info;
 
     bpf_for(i, 0, MAX_STACK_TRACE_DEPTH) {
-        go_functab_idx = bpf_for_each_map_elem(&go_functab, &find_target_func, &curr_pc, 0) - 2;
+        if (i >= max_depth) {
+            return i;
+        }
+        // Entries of the functab are taken from the ELF file.
+        static_pc = curr_pc - get_load_base();
+        go_functab_idx = bpf_for_each_map_elem(&go_functab, &find_target_func, &static_pc, 0) - 2;
         func_info = bpf_map_lookup_elem(&go_functab, &go_functab_idx);
         if (!func_info) {
             bpf_printk("pc %d not covered by any func in functab", curr_pc);
@@ -471,7 +787,8 @@ static int64_t unwind_stack(char *curr_stack_addr, uint64_t curr_pc, char *fp, u
 
         // Frame pointer points to the stack address where the caller(if any)'s
         // RBP is pushed on. The return address is pushed before the caller's
-        // RBP is pushed onto stack.
+        // RBP is pushed onto stack. On arm64 the prologue saves the link
+        // register and the caller's frame pointer in the same layout.
         bpf_probe_read_user(&curr_pc, sizeof(char *), fp + sizeof(char *));
         bpf_probe_read_user(&fp, sizeof(uint64_t), fp);
         if (curr_pc == 0) {
@@ -521,12 +838,12 @@ int BPF_UPROBE(go_execute) {
 
     bpf_probe_read_user(&e.found.goid, sizeof(uint64_t), GET_GOID_ADDR(GO_PARAM1(ctx)));
     bpf_probe_read_user(&e.found.pc, sizeof(uint64_t), GET_PC_ADDR(GO_PARAM1(ctx)));
-    bpf_probe_read_user(&e.callerpc, sizeof(uint64_t), CURR_STACK_POINTER(ctx));
-    bpf_probe_read_user(&e.nump, sizeof(uint64_t), (char *)(allp_slice_addr + SLICE_LEN_OFFSET));
+    e.callerpc = get_caller_pc(ctx);
+    bpf_probe_read_user(&e.nump, sizeof(uint64_t), (char *)(RUNTIME_ADDR(allp_slice_addr) + SLICE_LEN_OFFSET));
     bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
 
-    bpf_probe_read_user(&allp_arr_addr, sizeof(char *), (char *)allp_slice_addr);
-    bpf_probe_read_user(&allp_len, sizeof(int64_t), (char *)(allp_slice_addr + SLICE_LEN_OFFSET));
+    bpf_probe_read_user(&allp_arr_addr, sizeof(char *), (char *)RUNTIME_ADDR(allp_slice_addr));
+    bpf_probe_read_user(&allp_len, sizeof(int64_t), (char *)(RUNTIME_ADDR(allp_slice_addr) + SLICE_LEN_OFFSET));
     bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
     bpf_for(i, 0, allp_len) {
         bpf_probe_read_user(&p_ptr, sizeof(char *), allp_arr_addr + sizeof(char *) * i);
@@ -534,8 +851,1680 @@ int BPF_UPROBE(go_execute) {
             return ret;
         }
     }
+    if ((ret = report_globrunq_status(e.mid, e.mid))) {
+        return ret;
+    }
+    bpf_for(i, 0, allp_len) {
+        bpf_probe_read_user(&p_ptr, sizeof(char *), allp_arr_addr + sizeof(char *) * i);
+        if ((ret = report_timer_heap_status((uint64_t)p_ptr, e.mid))) {
+            return ret;
+        }
+    }
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+// Preemption kinds. The values are kept identical to PreemptKind in
+// slowmo.proto so the userspace can convert them directly.
+const uint64_t PREEMPT_KIND_REQUEST = 0;
+const uint64_t PREEMPT_KIND_SYNC = 1;
+const uint64_t PREEMPT_KIND_ASYNC = 2;
+
+struct preempt_event {
+    uint64_t etype;
+    int64_t mid;
+    int64_t procid;
+    struct runq_entry preempted;
+    uint64_t kind;
+};
+
+// Goroutines that have been interrupted by a preemption signal and are on
+// their way to runtime.gopreempt_m. Both sync and async preemption end up in
+// gopreempt_m, so this is what tells the two apart.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, uint64_t);
+    __type(value, uint8_t);
+    __uint(max_entries, 1024);
+} async_preempted_goids SEC(".maps");
+
+SEC("uprobe/go_preemptone")
+int BPF_UPROBE(go_preemptone) {
+    struct preempt_event e;
+    char *p_ptr = (char *)GO_PARAM1(ctx), *m_ptr, *g_ptr;
+    int32_t procid32;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_P_M_PTR_ADDR(p_ptr));
+    if (!m_ptr) {
+        return 0;
+    }
+    bpf_probe_read_user(&g_ptr, sizeof(char *), GET_M_CURG_ADDR(m_ptr));
+    if (!g_ptr) {
+        return 0;
+    }
+
+    e.etype = EVENT_TYPE_PREEMPT;
+    e.kind = PREEMPT_KIND_REQUEST;
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    bpf_probe_read_user(&procid32, sizeof(int32_t), GET_P_ID_ADDR(p_ptr));
+    e.procid = (int64_t)procid32;
+    bpf_probe_read_user(&e.preempted.goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+    bpf_probe_read_user(&e.preempted.pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+
+    // No delay here: preemptone is called by sysmon while holding allpLock.
+    return 0;
+}
+
+// The preemption signal is handled by doSigPreempt, which only injects a call
+// to runtime.asyncPreempt if the goroutine is at an async safe point. Probing
+// asyncPreempt rather than doSigPreempt thus skips the signals that don't
+// preempt anything.
+SEC("uprobe/go_async_preempt")
+int BPF_UPROBE(go_async_preempt) {
+    uint64_t goid;
+    uint8_t async = 1;
+
+    // runtime.asyncPreempt is injected at an async safe point of Go code, so
+    // the current g register still holds the interrupted goroutine.
+    bpf_probe_read_user(&goid, sizeof(uint64_t), GET_GOID_ADDR(CURR_G_ADDR(ctx)));
+    bpf_map_update_elem(&async_preempted_goids, &goid, &async, BPF_ANY);
+
+    return 0;
+}
+
+// asyncPreempt parks the goroutine with preemptPark instead of gopreempt_m if
+// it's asked to stop (e.g. for GC stack scanning), which is not reported as a
+// preemption. The goroutine is forgotten so that its next preemption is not
+// mistaken as an async one.
+SEC("uprobe/go_preempt_park")
+int BPF_UPROBE(go_preempt_park) {
+    uint64_t goid;
+
+    bpf_probe_read_user(&goid, sizeof(uint64_t), GET_GOID_ADDR(GO_PARAM1(ctx)));
+    bpf_map_delete_elem(&async_preempted_goids, &goid);
+
+    return 0;
+}
+
+SEC("uprobe/go_gopreempt_m")
+int BPF_UPROBE(go_gopreempt_m) {
+    struct preempt_event e;
+    char *m_ptr, *p_ptr, *g_ptr = (char *)GO_PARAM1(ctx);
+    int32_t procid32;
+
+    e.etype = EVENT_TYPE_PREEMPT;
+    bpf_probe_read_user(&e.preempted.goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+    bpf_probe_read_user(&e.preempted.pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+    if (bpf_map_lookup_elem(&async_preempted_goids, &e.preempted.goid)) {
+        e.kind = PREEMPT_KIND_ASYNC;
+        bpf_map_delete_elem(&async_preempted_goids, &e.preempted.goid);
+    } else {
+        e.kind = PREEMPT_KIND_SYNC;
+    }
+    // gopreempt_m runs on g0 (via mcall or newstack), whose M is the one the
+    // preempted goroutine was running on.
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    bpf_probe_read_user(&p_ptr, sizeof(char *), GET_P_ADDR(m_ptr));
+    if (!p_ptr) {
+        e.procid = -1;
+    } else {
+        bpf_probe_read_user(&procid32, sizeof(int32_t), GET_P_ID_ADDR(p_ptr));
+        e.procid = (int64_t)procid32;
+    }
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+struct syscall_event {
+    uint64_t etype;
+    int64_t mid;
+    int64_t procid; // -1 if M holds no P
+    struct runq_entry syscaller;
+    // For entersyscall: 1 if entered through entersyscallblock.
+    // For exitsyscall: 1 if P is re-acquired on the fast path.
+    uint64_t variant;
+};
+
+static void report_syscall_event(uint64_t etype, uint64_t g_ptr_scalar, uint64_t m_ptr_scalar, uint64_t variant) {
+    struct syscall_event e;
+    char *g_ptr = (char *)g_ptr_scalar, *m_ptr = (char *)m_ptr_scalar, *p_ptr;
+    int32_t procid32;
+
+    e.etype = etype;
+    e.variant = variant;
+    bpf_probe_read_user(&e.syscaller.goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+    bpf_probe_read_user(&e.syscaller.pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    bpf_probe_read_user(&p_ptr, sizeof(char *), GET_P_ADDR(m_ptr));
+    if (!p_ptr) {
+        e.procid = -1;
+    } else {
+        bpf_probe_read_user(&procid32, sizeof(int32_t), GET_P_ID_ADDR(p_ptr));
+        e.procid = (int64_t)procid32;
+    }
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+}
+
+// Syscalls are frequent (e.g. every write to stdout) and on the common path the
+// goroutine keeps its P, so entering and fast-exiting a syscall is reported
+// without delay.
+SEC("uprobe/go_entersyscall")
+int BPF_UPROBE(go_entersyscall) {
+    char *m_ptr;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    report_syscall_event(EVENT_TYPE_ENTERSYSCALL, CURR_G_ADDR(ctx), (uint64_t)m_ptr, 0);
+
+    return 0;
+}
+
+SEC("uprobe/go_entersyscallblock")
+int BPF_UPROBE(go_entersyscallblock) {
+    char *m_ptr;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    report_syscall_event(EVENT_TYPE_ENTERSYSCALL, CURR_G_ADDR(ctx), (uint64_t)m_ptr, 1);
+
+    return 0;
+}
+
+SEC("uprobe/go_exitsyscallfast_return")
+int BPF_UPROBE(go_exitsyscallfast_return) {
+    char *m_ptr;
+
+    // exitsyscallfast returns false when no P can be re-acquired, in which
+    // case exitsyscall falls back to exitsyscall0 and reports from there.
+    if (!(GO_RET1(ctx) & 0xff)) {
+        return 0;
+    }
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    report_syscall_event(EVENT_TYPE_EXITSYSCALL, CURR_G_ADDR(ctx), (uint64_t)m_ptr, 1);
+
+    return 0;
+}
+
+SEC("uprobe/go_exitsyscall0")
+int BPF_UPROBE(go_exitsyscall0) {
+    char *m_ptr;
+
+    // exitsyscall0 runs on g0 (via mcall) with the syscalling goroutine as
+    // its parameter.
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    report_syscall_event(EVENT_TYPE_EXITSYSCALL, GO_PARAM1(ctx), (uint64_t)m_ptr, 0);
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+struct handoffp_event {
+    uint64_t etype;
+    int64_t mid;
+    int64_t procid;
+    int64_t receiving_mid; // -1 if the P is put on the idle list
+};
+
+#define GET_M_NEXTP_ADDR(m_addr) ((char *)(m_addr) + RUNTIME_M_NEXTP_OFFSET)
+
+// P being handed off by each M (keyed by M id) until handoffp returns, along
+// with the M started to run it, if any.
+struct handoff_ctx {
+    uint64_t p_ptr;
+    int64_t receiving_mid;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, int64_t);
+    __type(value, struct handoff_ctx);
+    __uint(max_entries, 1 << 10);
+} handoff_ctxs SEC(".maps");
+
+SEC("uprobe/go_handoffp")
+int BPF_UPROBE(go_handoffp) {
+    struct handoff_ctx hctx;
+    uint64_t m_ptr;
+    int64_t mid = get_curr_mid(CURR_G_ADDR(ctx), &m_ptr);
+
+    hctx.p_ptr = GO_PARAM1(ctx);
+    hctx.receiving_mid = -1;
+    bpf_map_update_elem(&handoff_ctxs, &mid, &hctx, BPF_ANY);
+
+    return 0;
+}
+
+// handoffp either starts an M to run the P (through startm, which wakes an idle
+// M or creates a new one) or puts the P on the idle list, so the event is
+// reported when it returns.
+SEC("uprobe/go_handoffp_return")
+int BPF_UPROBE(go_handoffp_return) {
+    struct handoffp_event e;
+    struct handoff_ctx *hctx;
+    uint64_t m_ptr;
+
+    e.etype = EVENT_TYPE_HANDOFFP;
+    e.mid = get_curr_mid(CURR_G_ADDR(ctx), &m_ptr);
+    hctx = bpf_map_lookup_elem(&handoff_ctxs, &e.mid);
+    if (!hctx) {
+        return 0;
+    }
+    e.procid = get_procid(hctx->p_ptr);
+    e.receiving_mid = hctx->receiving_mid;
+    bpf_map_delete_elem(&handoff_ctxs, &e.mid);
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
 
     delay_helper(DELAY_NS);
 
     return 0;
-}
\ No newline at end of file
+}
+
+// Records receiving_mid as the M to receive the P being handed off by the M
+// with id mid, if p_ptr is that P.
+static void record_handoff_receiver(int64_t mid, uint64_t p_ptr, int64_t receiving_mid) {
+    struct handoff_ctx *hctx = bpf_map_lookup_elem(&handoff_ctxs, &mid);
+
+    if (hctx && hctx->p_ptr == p_ptr) {
+        hctx->receiving_mid = receiving_mid;
+    }
+}
+
+// notewakeup(n *note) is how startm wakes an idle M, after setting the P for
+// it to run as its nextp. n points to the park field of the M.
+SEC("uprobe/go_notewakeup")
+int BPF_UPROBE(go_notewakeup) {
+    uint64_t m_ptr, nextp;
+    char *nmp = (char *)GO_PARAM1(ctx) - RUNTIME_M_PARK_OFFSET;
+    int64_t mid = get_curr_mid(CURR_G_ADDR(ctx), &m_ptr), nmid;
+
+    if (!bpf_map_lookup_elem(&handoff_ctxs, &mid)) {
+        return 0;
+    }
+    bpf_probe_read_user(&nextp, sizeof(uint64_t), GET_M_NEXTP_ADDR(nmp));
+    bpf_probe_read_user(&nmid, sizeof(int64_t), GET_M_ID_ADDR(nmp));
+    record_handoff_receiver(mid, nextp, nmid);
+
+    return 0;
+}
+
+#define GET_POLLDESC_FD_ADDR(pd_addr) ((char *)(pd_addr) + RUNTIME_POLLDESC_FD_OFFSET)
+#define GET_POLLDESC_RG_ADDR(pd_addr) ((char *)(pd_addr) + RUNTIME_POLLDESC_RG_OFFSET)
+#define GET_POLLDESC_WG_ADDR(pd_addr) ((char *)(pd_addr) + RUNTIME_POLLDESC_WG_OFFSET)
+#define POLLDESC_PDWAIT 2 // pollDesc.rg/wg values up to pdWait are states rather than g pointers
+#define NETPOLL_MODE_READ 'r'
+#define NETPOLL_MODE_WRITE 'w'
+#define MAX_NETPOLL_READIED 16
+
+SEC("uprobe/go_netpollblock")
+int BPF_UPROBE(go_netpollblock) {
+    uint64_t goid;
+    int64_t fd;
+
+    bpf_probe_read_user(&goid, sizeof(uint64_t), GET_GOID_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&fd, sizeof(int64_t), GET_POLLDESC_FD_ADDR(GO_PARAM1(ctx)));
+    bpf_map_update_elem(&netpoll_waiting_fds, &goid, &fd, BPF_ANY);
+
+    return 0;
+}
+
+struct netpoll_ready_event {
+    uint64_t etype;
+    int64_t mid;
+    int64_t fd;
+    struct runq_entry readied;
+};
+
+static void report_netpoll_ready(uint64_t g_ptr_scalar, int64_t mid, int64_t fd) {
+    struct netpoll_ready_event e;
+    char *g_ptr = (char *)g_ptr_scalar;
+
+    if (g_ptr_scalar <= POLLDESC_PDWAIT) {
+        return;
+    }
+    e.etype = EVENT_TYPE_NETPOLL_READY;
+    e.mid = mid;
+    e.fd = fd;
+    bpf_probe_read_user(&e.readied.goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+    bpf_probe_read_user(&e.readied.pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+}
+
+SEC("uprobe/go_netpollready")
+int BPF_UPROBE(go_netpollready) {
+    char *m_ptr, *pd_ptr = (char *)GO_PARAM2(ctx);
+    int32_t mode = (int32_t)GO_PARAM3(ctx);
+    int64_t mid, fd;
+    uint64_t rg = 0, wg = 0;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    bpf_probe_read_user(&fd, sizeof(int64_t), GET_POLLDESC_FD_ADDR(pd_ptr));
+    // Mode is 'r', 'w' or 'r'+'w'.
+    if (mode == NETPOLL_MODE_READ || mode == NETPOLL_MODE_READ + NETPOLL_MODE_WRITE) {
+        bpf_probe_read_user(&rg, sizeof(uint64_t), GET_POLLDESC_RG_ADDR(pd_ptr));
+    }
+    if (mode == NETPOLL_MODE_WRITE || mode == NETPOLL_MODE_READ + NETPOLL_MODE_WRITE) {
+        bpf_probe_read_user(&wg, sizeof(uint64_t), GET_POLLDESC_WG_ADDR(pd_ptr));
+    }
+    report_netpoll_ready(rg, mid, fd);
+    report_netpoll_ready(wg, mid, fd);
+
+    return 0;
+}
+
+struct netpoll_event {
+    uint64_t etype;
+    int64_t mid;
+    int64_t num_readied;
+    struct runq_entry readied[MAX_NETPOLL_READIED];
+};
+
+SEC("uprobe/go_netpoll_return")
+int BPF_UPROBE(go_netpoll_return) {
+    struct netpoll_event e;
+    char *m_ptr, *g_ptr = (char *)GO_RET1(ctx); // gList.head of the returned list
+    uint32_t i;
+
+    if (!g_ptr) {
+        return 0;
+    }
+    e.etype = EVENT_TYPE_NETPOLL;
+    e.num_readied = 0;
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    bpf_for(i, 0, MAX_NETPOLL_READIED) {
+        if (!g_ptr) {
+            break;
+        }
+        bpf_probe_read_user(&e.readied[i].goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+        bpf_probe_read_user(&e.readied[i].pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+        bpf_probe_read_user(&g_ptr, sizeof(char *), GET_SCHEDLINK_ADDR(g_ptr));
+        e.num_readied++;
+    }
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+#define RUNQ_STEAL_STAGE_BEFORE 0
+#define RUNQ_STEAL_STAGE_AFTER 1
+
+// A runq steal event is followed by the runq statuses of the thief P and then
+// the victim P, reported with EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS and grouped by
+// the thief's M.
+struct runq_steal_event {
+    uint64_t etype;
+    int64_t mid;
+    int64_t thief_procid;
+    int64_t victim_procid;
+    uint64_t stage;
+    int64_t num_stolen; // only meaningful for RUNQ_STEAL_STAGE_AFTER
+};
+
+struct runq_steal_ctx {
+    uint64_t thief_p_ptr;
+    uint64_t victim_p_ptr;
+    int64_t thief_procid;
+    int64_t victim_procid;
+    int64_t num_stolen;
+};
+
+// In-flight runqsteal calls keyed by the id of the M performing the steal.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, int64_t);
+    __type(value, struct runq_steal_ctx);
+    __uint(max_entries, 64);
+} runq_steal_ctxs SEC(".maps");
+
+static void report_runq_steal(int64_t mid, struct runq_steal_ctx *steal_ctx, uint64_t stage) {
+    struct runq_steal_event e;
+
+    e.etype = EVENT_TYPE_RUNQ_STEAL;
+    e.mid = mid;
+    e.thief_procid = steal_ctx->thief_procid;
+    e.victim_procid = steal_ctx->victim_procid;
+    e.stage = stage;
+    e.num_stolen = steal_ctx->num_stolen;
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+    report_local_runq_status(EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS, steal_ctx->thief_p_ptr, mid);
+    report_local_runq_status(EVENT_TYPE_RUNQ_STEAL_RUNQ_STATUS, steal_ctx->victim_p_ptr, mid);
+}
+
+SEC("uprobe/go_runqsteal")
+int BPF_UPROBE(go_runqsteal) {
+    struct runq_steal_ctx steal_ctx;
+    char *m_ptr, *runnext_g_ptr, *victim_p_ptr = (char *)GO_PARAM2(ctx);
+    uint32_t runqhead, runqtail;
+    int32_t procid32;
+    int64_t mid;
+    bool steal_runnext = GO_PARAM3(ctx) & 0xff;
+
+    // Most steal attempts target an empty runq. Skip them to avoid flooding
+    // the userspace.
+    bpf_probe_read_user(&runqhead, sizeof(uint32_t), GET_P_RUNQHEAD_ADDR(victim_p_ptr));
+    bpf_probe_read_user(&runqtail, sizeof(uint32_t), GET_P_RUNQTAIL_ADDR(victim_p_ptr));
+    bpf_probe_read_user(&runnext_g_ptr, sizeof(char *), GET_P_RUNNEXT_ADDR(victim_p_ptr));
+    if (runqtail == runqhead && !(steal_runnext && runnext_g_ptr)) {
+        return 0;
+    }
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    steal_ctx.thief_p_ptr = GO_PARAM1(ctx);
+    steal_ctx.victim_p_ptr = GO_PARAM2(ctx);
+    bpf_probe_read_user(&procid32, sizeof(int32_t), GET_P_ID_ADDR(GO_PARAM1(ctx)));
+    steal_ctx.thief_procid = (int64_t)procid32;
+    bpf_probe_read_user(&procid32, sizeof(int32_t), GET_P_ID_ADDR(victim_p_ptr));
+    steal_ctx.victim_procid = (int64_t)procid32;
+    steal_ctx.num_stolen = 0;
+    bpf_map_update_elem(&runq_steal_ctxs, &mid, &steal_ctx, BPF_ANY);
+    report_runq_steal(mid, &steal_ctx, RUNQ_STEAL_STAGE_BEFORE);
+
+    return 0;
+}
+
+SEC("uprobe/go_runqgrab_return")
+int BPF_UPROBE(go_runqgrab_return) {
+    struct runq_steal_ctx *steal_ctx;
+    char *m_ptr;
+    int64_t mid;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    steal_ctx = bpf_map_lookup_elem(&runq_steal_ctxs, &mid);
+    if (!steal_ctx) {
+        return 0;
+    }
+    steal_ctx->num_stolen = (uint32_t)GO_RET1(ctx);
+
+    return 0;
+}
+
+SEC("uprobe/go_runqsteal_return")
+int BPF_UPROBE(go_runqsteal_return) {
+    struct runq_steal_ctx *steal_ctx;
+    char *m_ptr;
+    int64_t mid;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    steal_ctx = bpf_map_lookup_elem(&runq_steal_ctxs, &mid);
+    if (!steal_ctx) {
+        return 0;
+    }
+    report_runq_steal(mid, steal_ctx, RUNQ_STEAL_STAGE_AFTER);
+    bpf_map_delete_elem(&runq_steal_ctxs, &mid);
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+#define GET_HCHAN_QCOUNT_ADDR(c_addr) ((char *)(c_addr) + RUNTIME_HCHAN_QCOUNT_OFFSET)
+#define GET_HCHAN_DATAQSIZ_ADDR(c_addr) ((char *)(c_addr) + RUNTIME_HCHAN_DATAQSIZ_OFFSET)
+#define GET_HCHAN_CLOSED_ADDR(c_addr) ((char *)(c_addr) + RUNTIME_HCHAN_CLOSED_OFFSET)
+#define GET_HCHAN_SENDX_ADDR(c_addr) ((char *)(c_addr) + RUNTIME_HCHAN_SENDX_OFFSET)
+#define GET_HCHAN_RECVX_ADDR(c_addr) ((char *)(c_addr) + RUNTIME_HCHAN_RECVX_OFFSET)
+#define GET_HCHAN_SENDQ_FIRST_ADDR(c_addr) ((char *)(c_addr) + RUNTIME_HCHAN_SENDQ_OFFSET + RUNTIME_WAITQ_FIRST_OFFSET)
+#define GET_HCHAN_RECVQ_FIRST_ADDR(c_addr) ((char *)(c_addr) + RUNTIME_HCHAN_RECVQ_OFFSET + RUNTIME_WAITQ_FIRST_OFFSET)
+#define GET_SUDOG_G_ADDR(sg_addr) ((char *)(sg_addr) + RUNTIME_SUDOG_G_OFFSET)
+#define GET_SUDOG_NEXT_ADDR(sg_addr) ((char *)(sg_addr) + RUNTIME_SUDOG_NEXT_OFFSET)
+#define MAX_CHAN_WAITQ_LEN 8
+#define SCASE_SIZE 16 // runtime.scase is {c *hchan; elem unsafe.Pointer}
+#define MAX_SELECT_CASES 8
+
+// Channel operations. The values are kept identical to ChannelOp in
+// slowmo.proto so the userspace can convert them directly.
+const uint64_t CHAN_OP_SEND = 0;
+const uint64_t CHAN_OP_RECV = 1;
+const uint64_t CHAN_OP_CLOSE = 2;
+const uint64_t CHAN_OP_SELECT_SEND = 3;
+const uint64_t CHAN_OP_SELECT_RECV = 4;
+
+struct chan_state_event {
+    uint64_t etype;
+    int64_t mid;
+    uint64_t op;
+    struct runq_entry operator;
+    uint64_t chan_addr;
+    uint64_t decl_pc; // 0 if the channel is made before instrumentation
+    uint64_t qcount;
+    uint64_t dataqsiz;
+    uint64_t sendx;
+    uint64_t recvx;
+    uint64_t closed;
+    // Waiting goroutines beyond MAX_CHAN_WAITQ_LEN are not reported.
+    int64_t sendq_len;
+    int64_t recvq_len;
+    struct runq_entry sendq[MAX_CHAN_WAITQ_LEN];
+    struct runq_entry recvq[MAX_CHAN_WAITQ_LEN];
+};
+
+// PC right after the runtime.makechan call of each channel, keyed by the hchan
+// address, so that a channel can be identified by where it is made. The entry
+// is overwritten when a new channel is made at the address of a freed one, and
+// an LRU map is used so that channels made long ago are evicted instead of
+// new ones failing to be recorded. Entries are kept after closechan since a
+// closed channel can still be received from.
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, uint64_t);
+    __type(value, uint64_t);
+    __uint(max_entries, 1024);
+} chan_decl_pcs SEC(".maps");
+
+SEC("uprobe/go_makechan_return")
+int BPF_UPROBE(go_makechan_return) {
+    uint64_t c_addr = GO_RET1(ctx), callerpc;
+
+    // Probed at the RET instruction, where the return address is available.
+    callerpc = get_caller_pc(ctx);
+    bpf_map_update_elem(&chan_decl_pcs, &c_addr, &callerpc, BPF_ANY);
+
+    return 0;
+}
+
+static int64_t read_chan_waitq(char *sg_ptr, struct runq_entry waitq[]) {
+    char *g_ptr;
+    int64_t i;
+
+    bpf_for(i, 0, MAX_CHAN_WAITQ_LEN) {
+        if (!sg_ptr) {
+            break;
+        }
+        bpf_probe_read_user(&g_ptr, sizeof(char *), GET_SUDOG_G_ADDR(sg_ptr));
+        bpf_probe_read_user(&waitq[i].goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+        bpf_probe_read_user(&waitq[i].pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+        bpf_probe_read_user(&sg_ptr, sizeof(char *), GET_SUDOG_NEXT_ADDR(sg_ptr));
+    }
+    return i;
+}
+
+static void report_chan_state(uint64_t c_ptr_scalar, uint64_t op, uint64_t g_ptr_scalar) {
+    struct chan_state_event e;
+    char *c_ptr = (char *)c_ptr_scalar, *g_ptr = (char *)g_ptr_scalar, *m_ptr, *sg_ptr;
+    uint64_t *decl_pc;
+    uint32_t closed;
+
+    e.etype = EVENT_TYPE_CHAN_STATE;
+    e.op = op;
+    e.chan_addr = c_ptr_scalar;
+    decl_pc = bpf_map_lookup_elem(&chan_decl_pcs, &c_ptr_scalar);
+    e.decl_pc = decl_pc ? *decl_pc : 0;
+    bpf_probe_read_user(&e.operator.goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+    bpf_probe_read_user(&e.operator.pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(g_ptr));
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+
+    bpf_probe_read_user(&e.qcount, sizeof(uint64_t), GET_HCHAN_QCOUNT_ADDR(c_ptr));
+    bpf_probe_read_user(&e.dataqsiz, sizeof(uint64_t), GET_HCHAN_DATAQSIZ_ADDR(c_ptr));
+    bpf_probe_read_user(&e.sendx, sizeof(uint64_t), GET_HCHAN_SENDX_ADDR(c_ptr));
+    bpf_probe_read_user(&e.recvx, sizeof(uint64_t), GET_HCHAN_RECVX_ADDR(c_ptr));
+    bpf_probe_read_user(&closed, sizeof(uint32_t), GET_HCHAN_CLOSED_ADDR(c_ptr));
+    e.closed = closed;
+    bpf_probe_read_user(&sg_ptr, sizeof(char *), GET_HCHAN_SENDQ_FIRST_ADDR(c_ptr));
+    e.sendq_len = read_chan_waitq(sg_ptr, e.sendq);
+    bpf_probe_read_user(&sg_ptr, sizeof(char *), GET_HCHAN_RECVQ_FIRST_ADDR(c_ptr));
+    e.recvq_len = read_chan_waitq(sg_ptr, e.recvq);
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+}
+
+// The channel state is reported before the operation takes effect (and
+// without holding the channel lock, so it is only a best-effort snapshot). The
+// outcome of the operation is observed through the subsequent gopark or
+// goready.
+SEC("uprobe/go_chansend")
+int BPF_UPROBE(go_chansend) {
+    if (!GO_PARAM1(ctx)) {
+        return 0;
+    }
+    report_chan_state(GO_PARAM1(ctx), CHAN_OP_SEND, CURR_G_ADDR(ctx));
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+SEC("uprobe/go_chanrecv")
+int BPF_UPROBE(go_chanrecv) {
+    if (!GO_PARAM1(ctx)) {
+        return 0;
+    }
+    report_chan_state(GO_PARAM1(ctx), CHAN_OP_RECV, CURR_G_ADDR(ctx));
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+SEC("uprobe/go_closechan")
+int BPF_UPROBE(go_closechan) {
+    if (!GO_PARAM1(ctx)) {
+        return 0;
+    }
+    report_chan_state(GO_PARAM1(ctx), CHAN_OP_CLOSE, CURR_G_ADDR(ctx));
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+SEC("uprobe/go_selectgo")
+int BPF_UPROBE(go_selectgo) {
+    char *cas0 = (char *)GO_PARAM1(ctx), *c_ptr;
+    int64_t nsends = GO_PARAM4(ctx), ncases = GO_PARAM4(ctx) + GO_PARAM5(ctx);
+    uint32_t i;
+
+    // Send cases come first in cas0, followed by receive cases. Cases on nil
+    // channels are not reported.
+    bpf_for(i, 0, MAX_SELECT_CASES) {
+        if (i >= ncases) {
+            break;
+        }
+        bpf_probe_read_user(&c_ptr, sizeof(char *), cas0 + SCASE_SIZE * i);
+        if (!c_ptr) {
+            continue;
+        }
+        report_chan_state((uint64_t)c_ptr, i < nsends ? CHAN_OP_SELECT_SEND : CHAN_OP_SELECT_RECV, CURR_G_ADDR(ctx));
+    }
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+// Each semTable entry is a semaRoot padded to cpu.CacheLinePadSize, which
+// differs between architectures (e.g. 128 on arm64).
+#define GET_SEMTAB_ROOT_ADDR(sema_addr) (RUNTIME_ADDR(semtable_addr) + (((sema_addr) >> 3) % RUNTIME_SEMTABLE_LENGTH) * RUNTIME_SEMTABLE_ELEM_SIZE)
+#define GET_SEMAROOT_TREAP_ADDR(root_addr) ((char *)(root_addr) + RUNTIME_SEMAROOT_TREAP_OFFSET)
+#define GET_SUDOG_PREV_ADDR(sg_addr) ((char *)(sg_addr) + RUNTIME_SUDOG_PREV_OFFSET)
+#define GET_SUDOG_ELEM_ADDR(sg_addr) ((char *)(sg_addr) + RUNTIME_SUDOG_ELEM_OFFSET)
+#define GET_SUDOG_WAITLINK_ADDR(sg_addr) ((char *)(sg_addr) + RUNTIME_SUDOG_WAITLINK_OFFSET)
+#define MAX_SEMA_TREAP_DEPTH 32
+#define MAX_SEMA_WAITERS 8
+// sync.Mutex wraps internal/sync.Mutex since go1.24. The offsets are left 0
+// if the sync package is not linked into the target program, in which case
+// the mutex probes are not attached either.
+#define GET_MUTEX_STATE_ADDR(mutex_addr) ((char *)(mutex_addr) + SYNC_MUTEX_MU_OFFSET + INTERNAL_SYNC_MUTEX_STATE_OFFSET)
+#define GET_MUTEX_SEMA_ADDR(mutex_addr) ((uint64_t)(mutex_addr) + SYNC_MUTEX_MU_OFFSET + INTERNAL_SYNC_MUTEX_SEMA_OFFSET)
+
+// Semaphore operations. The values are kept identical to SemaphoreOp in
+// slowmo.proto so the userspace can convert them directly.
+const uint64_t SEMA_OP_MUTEX_LOCK = 0;
+const uint64_t SEMA_OP_MUTEX_UNLOCK = 1;
+const uint64_t SEMA_OP_SEMACQUIRE = 2;
+const uint64_t SEMA_OP_SEMRELEASE = 3;
+
+volatile const uint64_t semtable_addr;
+
+struct sema_state_event {
+    uint64_t etype;
+    int64_t mid;
+    uint64_t op;
+    struct runq_entry goroutine;
+    uint64_t sema_addr;
+    uint64_t mutex_addr; // 0 if not a mutex operation
+    int64_t mutex_state; // raw sync.Mutex state, only meaningful for mutex operations
+    uint64_t handoff; // only meaningful for SEMA_OP_SEMRELEASE
+    char waitreason[WAITREASON_STRING_MAX_LEN]; // only meaningful for SEMA_OP_SEMACQUIRE
+    // Waiters beyond MAX_SEMA_WAITERS are not reported.
+    int64_t num_waiters;
+    struct runq_entry waiters[MAX_SEMA_WAITERS];
+};
+
+// Find the goroutines waiting on sema_addr in the semTable. Waiters on the
+// same address are chained by sudog.waitlink from the treap node of the
+// address, in the order they would be woken up.
+static int64_t read_sema_waiters(uint64_t sema_addr, struct runq_entry waiters[]) {
+    char *root_addr, *sg_ptr, *g_ptr;
+    uint64_t elem;
+    int64_t i;
+    bool found = false;
+
+    root_addr = (char *)GET_SEMTAB_ROOT_ADDR(sema_addr);
+    bpf_probe_read_user(&sg_ptr, sizeof(char *), GET_SEMAROOT_TREAP_ADDR(root_addr));
+    bpf_for(i, 0, MAX_SEMA_TREAP_DEPTH) {
+        if (!sg_ptr) {
+            break;
+        }
+        bpf_probe_read_user(&elem, sizeof(uint64_t), GET_SUDOG_ELEM_ADDR(sg_ptr));
+        if (elem == sema_addr) {
+            found = true;
+            break;
+        }
+        if (sema_addr < elem) {
+            bpf_probe_read_user(&sg_ptr, sizeof(char *), GET_SUDOG_PREV_ADDR(sg_ptr));
+        } else {
+            bpf_probe_read_user(&sg_ptr, sizeof(char *), GET_SUDOG_NEXT_ADDR(sg_ptr));
+        }
+    }
+    if (!found) {
+        return 0;
+    }
+
+    bpf_for(i, 0, MAX_SEMA_WAITERS) {
+        if (!sg_ptr) {
+            break;
+        }
+        bpf_probe_read_user(&g_ptr, sizeof(char *), GET_SUDOG_G_ADDR(sg_ptr));
+        bpf_probe_read_user(&waiters[i].goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+        bpf_probe_read_user(&waiters[i].pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+        bpf_probe_read_user(&sg_ptr, sizeof(char *), GET_SUDOG_WAITLINK_ADDR(sg_ptr));
+    }
+    return i;
+}
+
+static void report_sema_state(uint64_t op, uint64_t g_ptr_scalar, uint64_t sema_addr, uint64_t mutex_addr, uint64_t handoff, uint32_t waitreason_i) {
+    struct sema_state_event e;
+    char *g_ptr = (char *)g_ptr_scalar, *m_ptr;
+    struct waitreason *reason_ptr;
+    int32_t mutex_state32;
+
+    e.etype = EVENT_TYPE_SEMTABLE_STATUS;
+    e.op = op;
+    e.sema_addr = sema_addr;
+    e.mutex_addr = mutex_addr;
+    e.handoff = handoff;
+    if (!mutex_addr) {
+        e.mutex_state = 0;
+    } else {
+        bpf_probe_read_user(&mutex_state32, sizeof(int32_t), GET_MUTEX_STATE_ADDR(mutex_addr));
+        e.mutex_state = (int64_t)mutex_state32;
+    }
+    reason_ptr = bpf_map_lookup_elem(&waitreason_strings, &waitreason_i);
+    if (!reason_ptr) {
+        e.waitreason[0] = 0;
+    } else {
+        bpf_probe_read_kernel_str(&e.waitreason, sizeof(e.waitreason), reason_ptr);
+    }
+    bpf_probe_read_user(&e.goroutine.goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+    bpf_probe_read_user(&e.goroutine.pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(g_ptr));
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    e.num_waiters = read_sema_waiters(sema_addr, e.waiters);
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+}
+
+SEC("uprobe/go_mutex_lock")
+int BPF_UPROBE(go_mutex_lock) {
+    uint64_t mutex_addr = GO_PARAM1(ctx);
+
+    report_sema_state(SEMA_OP_MUTEX_LOCK, CURR_G_ADDR(ctx), GET_MUTEX_SEMA_ADDR(mutex_addr), mutex_addr, 0, 0);
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+SEC("uprobe/go_mutex_unlock")
+int BPF_UPROBE(go_mutex_unlock) {
+    uint64_t mutex_addr = GO_PARAM1(ctx);
+
+    report_sema_state(SEMA_OP_MUTEX_UNLOCK, CURR_G_ADDR(ctx), GET_MUTEX_SEMA_ADDR(mutex_addr), mutex_addr, 0, 0);
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+// semacquire1 and semrelease1 are reached when a mutex (or any other
+// semaphore-based primitive) is contended. They are reported before the
+// semTable is updated, and the blocking or waking up that follows is observed
+// through gopark or goready, so no delay is introduced here.
+SEC("uprobe/go_semacquire1")
+int BPF_UPROBE(go_semacquire1) {
+    // The wait reason is the 5th parameter of semacquire1.
+    report_sema_state(SEMA_OP_SEMACQUIRE, CURR_G_ADDR(ctx), GO_PARAM1(ctx), 0, 0, (uint8_t)GO_PARAM5(ctx));
+
+    return 0;
+}
+
+SEC("uprobe/go_semrelease1")
+int BPF_UPROBE(go_semrelease1) {
+    // With handoff set (e.g. unlocking a starving mutex), the semaphore is
+    // passed to the first waiter directly.
+    report_sema_state(SEMA_OP_SEMRELEASE, CURR_G_ADDR(ctx), GO_PARAM1(ctx), 0, GO_PARAM2(ctx) & 0xff, 0);
+
+    return 0;
+}
+
+#define GET_P_TIMERS_ADDR(p_addr) ((char *)(p_addr) + RUNTIME_P_TIMERS_OFFSET)
+#define GET_TIMERS_HEAP_ADDR(ts_addr) ((char *)(ts_addr) + RUNTIME_TIMERS_HEAP_OFFSET)
+#define GET_TIMERWHEN_TIMER_ADDR(tw_addr) ((char *)(tw_addr) + RUNTIME_TIMERWHEN_TIMER_OFFSET)
+#define GET_TIMER_WHEN_ADDR(t_addr) ((char *)(t_addr) + RUNTIME_TIMER_WHEN_OFFSET)
+#define GET_TIMER_PERIOD_ADDR(t_addr) ((char *)(t_addr) + RUNTIME_TIMER_PERIOD_OFFSET)
+#define GET_TIMER_F_ADDR(t_addr) ((char *)(t_addr) + RUNTIME_TIMER_F_OFFSET)
+#define GET_TIMER_ARG_ADDR(t_addr) ((char *)(t_addr) + RUNTIME_TIMER_ARG_OFFSET)
+#define GET_TIMER_TS_ADDR(t_addr) ((char *)(t_addr) + RUNTIME_TIMER_TS_OFFSET)
+#define EFACE_DATA_OFFSET 8
+#define TIMERWHEN_SIZE 16 // runtime.timerWhen is {timer *timer; when int64}
+#define MAX_REPORTED_TIMERS 6
+
+// Timer event kinds. The values are kept identical to TimerEventKind in
+// slowmo.proto so the userspace can convert them directly.
+const uint64_t TIMER_EVENT_KIND_ADD = 0;
+const uint64_t TIMER_EVENT_KIND_FIRE = 1;
+
+// Entry PC of runtime.goroutineReady, the callback of timers created by
+// time.Sleep, whose arg is the sleeping goroutine. 0 if the function is not
+// linked into the target program.
+volatile const uint64_t goroutine_ready_pc;
+
+struct timer_entry {
+    uint64_t timer_addr;
+    int64_t when;
+    int64_t period;
+    uint64_t f_pc;
+    int64_t goid; // -1 if the timer doesn't ready a goroutine by itself
+};
+
+struct timer_event {
+    uint64_t etype;
+    int64_t mid;
+    uint64_t kind;
+    int64_t procid; // -1 if the timer is not in any P's heap
+    struct timer_entry timer;
+    int64_t now; // only meaningful for TIMER_EVENT_KIND_FIRE
+};
+
+struct timer_heap_status_event {
+    uint64_t etype;
+    int64_t grouping_mid; // -1 if only collecting status of an individual timer heap
+    int64_t procid;
+    // Total number of timers in the heap. Only the first MAX_REPORTED_TIMERS
+    // (in heap order) are reported.
+    int64_t num_timers;
+    struct timer_entry timers[MAX_REPORTED_TIMERS];
+};
+
+static void read_timer(uint64_t t_ptr_scalar, struct timer_entry *entry) {
+    char *t_ptr = (char *)t_ptr_scalar, *fv_ptr, *g_ptr;
+
+    entry->timer_addr = t_ptr_scalar;
+    bpf_probe_read_user(&entry->when, sizeof(int64_t), GET_TIMER_WHEN_ADDR(t_ptr));
+    bpf_probe_read_user(&entry->period, sizeof(int64_t), GET_TIMER_PERIOD_ADDR(t_ptr));
+    bpf_probe_read_user(&fv_ptr, sizeof(char *), GET_TIMER_F_ADDR(t_ptr));
+    entry->f_pc = 0;
+    if (fv_ptr) {
+        bpf_probe_read_user(&entry->f_pc, sizeof(uint64_t), &((struct funcval *)fv_ptr)->fn);
+    }
+    entry->goid = -1;
+    if (goroutine_ready_pc && entry->f_pc == RUNTIME_ADDR(goroutine_ready_pc)) {
+        bpf_probe_read_user(&g_ptr, sizeof(char *), GET_TIMER_ARG_ADDR(t_ptr) + EFACE_DATA_OFFSET);
+        bpf_probe_read_user(&entry->goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+    }
+}
+
+// Timer heaps are embedded in P, so the owning P can be derived from the
+// address of the heap.
+static int64_t timers_procid(uint64_t ts_ptr_scalar) {
+    int32_t procid32;
+
+    if (!ts_ptr_scalar) {
+        return -1;
+    }
+    bpf_probe_read_user(&procid32, sizeof(int32_t), GET_P_ID_ADDR(ts_ptr_scalar - RUNTIME_P_TIMERS_OFFSET));
+    return (int64_t)procid32;
+}
+
+static void report_timer_event(uint64_t kind, uint64_t t_ptr_scalar, uint64_t ts_ptr_scalar, int64_t now, uint64_t g_ptr_scalar) {
+    struct timer_event e;
+    char *m_ptr;
+
+    e.etype = EVENT_TYPE_TIMER;
+    e.kind = kind;
+    e.now = now;
+    e.procid = timers_procid(ts_ptr_scalar);
+    read_timer(t_ptr_scalar, &e.timer);
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(g_ptr_scalar));
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+}
+
+static int report_timer_heap_status(uint64_t p_ptr_scalar, int64_t grouping_mid) {
+    struct timer_heap_status_event e;
+    char *heap_arr_addr, *heap_addr = GET_TIMERS_HEAP_ADDR(GET_P_TIMERS_ADDR(p_ptr_scalar)), *t_ptr;
+    int32_t procid32;
+    uint32_t i;
+
+    e.etype = EVENT_TYPE_TIMER_HEAP_STATUS;
+    e.grouping_mid = grouping_mid;
+    bpf_probe_read_user(&procid32, sizeof(int32_t), GET_P_ID_ADDR(p_ptr_scalar));
+    e.procid = (int64_t)procid32;
+    bpf_probe_read_user(&heap_arr_addr, sizeof(char *), heap_addr);
+    bpf_probe_read_user(&e.num_timers, sizeof(int64_t), heap_addr + SLICE_LEN_OFFSET);
+    bpf_for(i, 0, MAX_REPORTED_TIMERS) {
+        if (i >= e.num_timers) {
+            break;
+        }
+        bpf_probe_read_user(&t_ptr, sizeof(char *), GET_TIMERWHEN_TIMER_ADDR(heap_arr_addr + TIMERWHEN_SIZE * i));
+        read_timer((uint64_t)t_ptr, &e.timers[i]);
+    }
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+    return 0;
+}
+
+SEC("uprobe/go_timers_add_heap")
+int BPF_UPROBE(go_timers_add_heap) {
+    // The receiver (heap of the current P) and the timer being added.
+    report_timer_event(TIMER_EVENT_KIND_ADD, GO_PARAM2(ctx), GO_PARAM1(ctx), 0, CURR_G_ADDR(ctx));
+
+    return 0;
+}
+
+// Attached to (*timer).unlockAndRun, which is called by (*timers).run for each
+// expired timer. A timer created by time.Sleep readies the sleeping goroutine
+// from here, which is then reported as a goready.
+SEC("uprobe/go_timer_run")
+int BPF_UPROBE(go_timer_run) {
+    uint64_t ts_ptr;
+
+    bpf_probe_read_user(&ts_ptr, sizeof(uint64_t), GET_TIMER_TS_ADDR(GO_PARAM1(ctx)));
+    report_timer_event(TIMER_EVENT_KIND_FIRE, GO_PARAM1(ctx), ts_ptr, GO_PARAM2(ctx), CURR_G_ADDR(ctx));
+
+    return 0;
+}
+
+// Heaps being adjusted keyed by the id of the M adjusting it. Note that an M
+// can adjust the heap of other Ps (e.g. when stealing work).
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, int64_t);
+    __type(value, uint64_t);
+    __uint(max_entries, 64);
+} adjusting_timers SEC(".maps");
+
+SEC("uprobe/go_timers_adjust")
+int BPF_UPROBE(go_timers_adjust) {
+    char *m_ptr;
+    int64_t mid;
+    uint64_t ts_ptr = GO_PARAM1(ctx);
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    bpf_map_update_elem(&adjusting_timers, &mid, &ts_ptr, BPF_ANY);
+
+    return 0;
+}
+
+// Attached to the returns of (*timers).adjust, after timers modified (e.g. by
+// Reset or Stop) are moved to their new place in the heap.
+SEC("uprobe/go_timers_adjust_return")
+int BPF_UPROBE(go_timers_adjust_return) {
+    char *m_ptr;
+    int64_t mid;
+    uint64_t *ts_ptr;
+    int ret;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    ts_ptr = bpf_map_lookup_elem(&adjusting_timers, &mid);
+    if (!ts_ptr) {
+        return 0;
+    }
+    ret = report_timer_heap_status(*ts_ptr - RUNTIME_P_TIMERS_OFFSET, -1);
+    bpf_map_delete_elem(&adjusting_timers, &mid);
+    return ret;
+}
+
+#define GET_P_GC_MARK_WORKER_MODE_ADDR(p_addr) ((char *)(p_addr) + RUNTIME_P_GCMARKWORKERMODE_OFFSET)
+#define NUM_STWREASON 32 // reserve space for more than the number of stw reasons in the latest go version
+
+// GC phase event kinds. The values are kept identical to GCPhaseKind in
+// slowmo.proto so the userspace can convert them directly.
+const uint64_t GC_PHASE_KIND_START = 0;
+const uint64_t GC_PHASE_KIND_MARK_DONE = 1;
+const uint64_t GC_PHASE_KIND_MARK_WORKER_START = 2;
+const uint64_t GC_PHASE_KIND_MARK_WORKER_STOP = 3;
+const uint64_t GC_PHASE_KIND_ASSIST = 4;
+
+// STW stages. The values are kept identical to STWStage in slowmo.proto.
+const uint64_t STW_STAGE_STOPPING = 0;
+const uint64_t STW_STAGE_STOPPED = 1;
+const uint64_t STW_STAGE_STARTING = 2;
+
+volatile const uint64_t gcphase_addr;
+volatile const uint64_t stwreason_strings_addr;
+
+// Uses the same layout as waitreason_strings.
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, uint32_t);
+    __type(value, struct waitreason);
+    __uint(max_entries, NUM_STWREASON);
+} stwreason_strings SEC(".maps");
+
+// Reason of the ongoing stop-the-world, which is at most one at a time as
+// guarded by worldsema.
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, uint32_t);
+    __type(value, uint32_t);
+    __uint(max_entries, 1);
+} curr_stwreason SEC(".maps");
+
+SEC("uprobe/get_stwreason_strings")
+int BPF_UPROBE(get_stwreason_strings) {
+    uint32_t i;
+    int64_t reason_str_len;
+    int ret;
+    char *reason_strings_elem_ptr, *reason_str_ptr;
+    struct waitreason reason;
+
+    bpf_for(i, 0, RUNTIME_STWREASONSTRINGS_LENGTH) {
+        reason_strings_elem_ptr = (char *)(RUNTIME_ADDR(stwreason_strings_addr) + GO_STRING_SIZE * i);
+        bpf_probe_read_user(&reason_str_ptr, sizeof(char *), reason_strings_elem_ptr);
+        bpf_probe_read_user(&reason_str_len, sizeof(int64_t), GO_STRING_LEN_ADDR(reason_strings_elem_ptr));
+        reason_str_len++; // count in the NUL byte
+        if (reason_str_len > sizeof(reason.str)) {
+            reason_str_len = sizeof(reason.str);
+        }
+        bpf_probe_read_user_str(&reason.str, reason_str_len, reason_str_ptr);
+        ret = bpf_map_update_elem(&stwreason_strings, &i, &reason, BPF_EXIST);
+        if (ret) {
+            return ret;
+        }
+    }
+
+    return 0;
+}
+
+struct gc_phase_event {
+    uint64_t etype;
+    int64_t mid;
+    uint64_t kind;
+    uint64_t phase; // value of runtime.gcphase
+    int64_t procid; // -1 if M holds no P
+    struct runq_entry goroutine; // zero pc if not applicable
+    uint64_t worker_mode; // value of p.gcMarkWorkerMode
+};
+
+static void report_gc_phase(uint64_t kind, uint64_t g_ptr_scalar, uint64_t m_ptr_scalar) {
+    struct gc_phase_event e;
+    char *g_ptr = (char *)g_ptr_scalar, *m_ptr = (char *)m_ptr_scalar, *p_ptr;
+    uint32_t phase;
+    int32_t procid32;
+    int64_t worker_mode;
+
+    e.etype = EVENT_TYPE_GC_PHASE;
+    e.kind = kind;
+    bpf_probe_read_user(&phase, sizeof(uint32_t), (char *)RUNTIME_ADDR(gcphase_addr));
+    e.phase = phase;
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    bpf_probe_read_user(&p_ptr, sizeof(char *), GET_P_ADDR(m_ptr));
+    if (!p_ptr) {
+        e.procid = -1;
+        e.worker_mode = 0;
+    } else {
+        bpf_probe_read_user(&procid32, sizeof(int32_t), GET_P_ID_ADDR(p_ptr));
+        e.procid = (int64_t)procid32;
+        bpf_probe_read_user(&worker_mode, sizeof(int64_t), GET_P_GC_MARK_WORKER_MODE_ADDR(p_ptr));
+        e.worker_mode = worker_mode;
+    }
+    if (!g_ptr) {
+        e.goroutine.pc = 0;
+        e.goroutine.goid = 0;
+    } else {
+        bpf_probe_read_user(&e.goroutine.goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+        bpf_probe_read_user(&e.goroutine.pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+    }
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+}
+
+SEC("uprobe/go_gc_start")
+int BPF_UPROBE(go_gc_start) {
+    char *m_ptr;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    report_gc_phase(GC_PHASE_KIND_START, CURR_G_ADDR(ctx), (uint64_t)m_ptr);
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+// gcMarkDone is called whenever a mark worker or assist runs out of work, and
+// only transitions into mark termination when no work is left anywhere. The
+// attempt is reported along with the current phase.
+SEC("uprobe/go_gc_mark_done")
+int BPF_UPROBE(go_gc_mark_done) {
+    char *m_ptr;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    report_gc_phase(GC_PHASE_KIND_MARK_DONE, CURR_G_ADDR(ctx), (uint64_t)m_ptr);
+
+    return 0;
+}
+
+// A gcBgMarkWorker goroutine drains mark work through one of the
+// gcDrainMarkWorker* functions depending on its worker mode, which are
+// called on the system stack of the M running the worker.
+SEC("uprobe/go_gc_mark_worker_start")
+int BPF_UPROBE(go_gc_mark_worker_start) {
+    char *m_ptr, *g_ptr;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&g_ptr, sizeof(char *), GET_M_CURG_ADDR(m_ptr));
+    report_gc_phase(GC_PHASE_KIND_MARK_WORKER_START, (uint64_t)g_ptr, (uint64_t)m_ptr);
+
+    return 0;
+}
+
+SEC("uprobe/go_gc_mark_worker_stop")
+int BPF_UPROBE(go_gc_mark_worker_stop) {
+    char *m_ptr, *g_ptr;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&g_ptr, sizeof(char *), GET_M_CURG_ADDR(m_ptr));
+    report_gc_phase(GC_PHASE_KIND_MARK_WORKER_STOP, (uint64_t)g_ptr, (uint64_t)m_ptr);
+
+    return 0;
+}
+
+SEC("uprobe/go_gc_assist_alloc")
+int BPF_UPROBE(go_gc_assist_alloc) {
+    char *m_ptr;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    report_gc_phase(GC_PHASE_KIND_ASSIST, GO_PARAM1(ctx), (uint64_t)m_ptr);
+
+    return 0;
+}
+
+struct stw_event {
+    uint64_t etype;
+    int64_t mid;
+    uint64_t stage;
+    char reason[WAITREASON_STRING_MAX_LEN];
+};
+
+static void report_stw(uint64_t stage, uint64_t g_ptr_scalar) {
+    struct stw_event e;
+    char *m_ptr;
+    uint32_t zero = 0, *reason_i;
+    struct waitreason *reason_ptr = NULL;
+
+    e.etype = EVENT_TYPE_STW;
+    e.stage = stage;
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(g_ptr_scalar));
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    reason_i = bpf_map_lookup_elem(&curr_stwreason, &zero);
+    if (reason_i) {
+        reason_ptr = bpf_map_lookup_elem(&stwreason_strings, reason_i);
+    }
+    if (!reason_ptr) {
+        e.reason[0] = 0;
+    } else {
+        bpf_probe_read_kernel_str(&e.reason, sizeof(e.reason), reason_ptr);
+    }
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+}
+
+SEC("uprobe/go_stop_the_world")
+int BPF_UPROBE(go_stop_the_world) {
+    uint32_t zero = 0, reason_i = (uint8_t)GO_PARAM1(ctx);
+
+    bpf_map_update_elem(&curr_stwreason, &zero, &reason_i, BPF_ANY);
+    report_stw(STW_STAGE_STOPPING, CURR_G_ADDR(ctx));
+
+    return 0;
+}
+
+// Attached to the returns of stopTheWorldWithSema, where all Ps are stopped.
+SEC("uprobe/go_stop_the_world_return")
+int BPF_UPROBE(go_stop_the_world_return) {
+    report_stw(STW_STAGE_STOPPED, CURR_G_ADDR(ctx));
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+SEC("uprobe/go_start_the_world")
+int BPF_UPROBE(go_start_the_world) {
+    report_stw(STW_STAGE_STARTING, CURR_G_ADDR(ctx));
+
+    return 0;
+}
+
+#define SCHED_GET_PIDLE_ADDR(sched_addr) ((char *)(sched_addr) + RUNTIME_SCHEDT_PIDLE_OFFSET)
+#define SCHED_GET_NPIDLE_ADDR(sched_addr) ((char *)(sched_addr) + RUNTIME_SCHEDT_NPIDLE_OFFSET)
+#define SCHED_GET_MIDLE_ADDR(sched_addr) ((char *)(sched_addr) + RUNTIME_SCHEDT_MIDLE_OFFSET)
+#define SCHED_GET_NMIDLE_ADDR(sched_addr) ((char *)(sched_addr) + RUNTIME_SCHEDT_NMIDLE_OFFSET)
+#define SCHED_GET_NMSPINNING_ADDR(sched_addr) ((char *)(sched_addr) + RUNTIME_SCHEDT_NMSPINNING_OFFSET)
+#define GET_P_LINK_ADDR(p_addr) ((char *)(p_addr) + RUNTIME_P_LINK_OFFSET)
+#define GET_M_SCHEDLINK_ADDR(m_addr) ((char *)(m_addr) + RUNTIME_M_SCHEDLINK_OFFSET)
+#define GET_M_SPINNING_ADDR(m_addr) ((char *)(m_addr) + RUNTIME_M_SPINNING_OFFSET)
+#define MAX_IDLE_LIST_LEN 8
+
+// M state event kinds. The values are kept identical to MStateKind in
+// slowmo.proto so the userspace can convert them directly.
+const uint64_t M_STATE_KIND_NEW = 0;
+const uint64_t M_STATE_KIND_START = 1;
+const uint64_t M_STATE_KIND_STOP = 2;
+const uint64_t M_STATE_KIND_WAKEP = 3;
+const uint64_t M_STATE_KIND_SPIN = 4;
+const uint64_t M_STATE_KIND_RESET_SPIN = 5;
+const uint64_t M_STATE_KIND_LOCK_OS_THREAD = 6;
+
+struct m_state_event {
+    uint64_t etype;
+    int64_t mid;
+    uint64_t kind;
+    int64_t procid; // -1 if not applicable
+    uint64_t spinning;
+    int64_t locked_goid; // only meaningful for M_STATE_KIND_LOCK_OS_THREAD
+};
+
+struct idle_list_event {
+    uint64_t etype;
+    int64_t mid; // M triggering the report
+    int64_t npidle;
+    int64_t nmidle;
+    int64_t nmspinning;
+    int64_t num_idle_ps; // number of entries read into idle_ps
+    int64_t idle_ps[MAX_IDLE_LIST_LEN];
+    int64_t num_idle_ms; // number of entries read into idle_ms
+    int64_t idle_ms[MAX_IDLE_LIST_LEN];
+};
+
+static void report_idle_list(int64_t mid) {
+    struct idle_list_event e;
+    char *p_ptr, *m_ptr;
+    int32_t n32;
+    int i;
+
+    e.etype = EVENT_TYPE_IDLE_LIST;
+    e.mid = mid;
+    bpf_probe_read_user(&n32, sizeof(int32_t), SCHED_GET_NPIDLE_ADDR(RUNTIME_ADDR(runtime_sched_addr)));
+    e.npidle = n32;
+    bpf_probe_read_user(&n32, sizeof(int32_t), SCHED_GET_NMIDLE_ADDR(RUNTIME_ADDR(runtime_sched_addr)));
+    e.nmidle = n32;
+    bpf_probe_read_user(&n32, sizeof(int32_t), SCHED_GET_NMSPINNING_ADDR(RUNTIME_ADDR(runtime_sched_addr)));
+    e.nmspinning = n32;
+
+    e.num_idle_ps = 0;
+    bpf_probe_read_user(&p_ptr, sizeof(char *), SCHED_GET_PIDLE_ADDR(RUNTIME_ADDR(runtime_sched_addr)));
+    bpf_for(i, 0, MAX_IDLE_LIST_LEN) {
+        if (!p_ptr) {
+            break;
+        }
+        bpf_probe_read_user(&n32, sizeof(int32_t), GET_P_ID_ADDR(p_ptr));
+        e.idle_ps[i] = n32;
+        e.num_idle_ps++;
+        bpf_probe_read_user(&p_ptr, sizeof(char *), GET_P_LINK_ADDR(p_ptr));
+    }
+
+    e.num_idle_ms = 0;
+    bpf_probe_read_user(&m_ptr, sizeof(char *), SCHED_GET_MIDLE_ADDR(RUNTIME_ADDR(runtime_sched_addr)));
+    bpf_for(i, 0, MAX_IDLE_LIST_LEN) {
+        if (!m_ptr) {
+            break;
+        }
+        bpf_probe_read_user(&e.idle_ms[i], sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+        e.num_idle_ms++;
+        bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_SCHEDLINK_ADDR(m_ptr));
+    }
+
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+}
+
+// Reports the M state transition followed by the idle lists as observed when
+// the transition begins.
+static void report_m_state(uint64_t kind, int64_t mid, int64_t procid, uint64_t spinning, int64_t locked_goid) {
+    struct m_state_event e;
+
+    e.etype = EVENT_TYPE_M_STATE;
+    e.mid = mid;
+    e.kind = kind;
+    e.procid = procid;
+    e.spinning = spinning;
+    e.locked_goid = locked_goid;
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+    report_idle_list(mid);
+}
+
+static int64_t get_procid(uint64_t p_ptr_scalar) {
+    int32_t procid;
+
+    if (!p_ptr_scalar) {
+        return -1;
+    }
+    bpf_probe_read_user(&procid, sizeof(int32_t), GET_P_ID_ADDR(p_ptr_scalar));
+    return procid;
+}
+
+static int64_t get_curr_mid(uint64_t g_ptr_scalar, uint64_t *m_ptr_scalar) {
+    char *m_ptr;
+    int64_t mid;
+
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(g_ptr_scalar));
+    bpf_probe_read_user(&mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    *m_ptr_scalar = (uint64_t)m_ptr;
+    return mid;
+}
+
+// newm(fn func(), pp *p, id int64) creates a new M (and OS thread) with the
+// given id to run pp.
+SEC("uprobe/go_newm")
+int BPF_UPROBE(go_newm) {
+    uint64_t m_ptr;
+
+    record_handoff_receiver(get_curr_mid(CURR_G_ADDR(ctx), &m_ptr), GO_PARAM2(ctx), (int64_t)GO_PARAM3(ctx));
+    report_m_state(M_STATE_KIND_NEW, (int64_t)GO_PARAM3(ctx), get_procid(GO_PARAM2(ctx)), 0, -1);
+
+    return 0;
+}
+
+// startm(pp *p, spinning, lockheld bool) is called by the current M to have
+// an idle (or new) M run pp, or any idle P if pp is nil.
+SEC("uprobe/go_startm")
+int BPF_UPROBE(go_startm) {
+    uint64_t m_ptr;
+    int64_t mid = get_curr_mid(CURR_G_ADDR(ctx), &m_ptr);
+
+    report_m_state(M_STATE_KIND_START, mid, get_procid(GO_PARAM1(ctx)), (uint8_t)GO_PARAM2(ctx), -1);
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+SEC("uprobe/go_stopm")
+int BPF_UPROBE(go_stopm) {
+    uint64_t m_ptr;
+    uint8_t spinning;
+    int64_t mid = get_curr_mid(CURR_G_ADDR(ctx), &m_ptr);
+
+    bpf_probe_read_user(&spinning, sizeof(uint8_t), GET_M_SPINNING_ADDR(m_ptr));
+    report_m_state(M_STATE_KIND_STOP, mid, -1, spinning, -1);
+
+    delay_helper(DELAY_NS);
+
+    return 0;
+}
+
+SEC("uprobe/go_wakep")
+int BPF_UPROBE(go_wakep) {
+    uint64_t m_ptr;
+    uint8_t spinning;
+    int64_t mid = get_curr_mid(CURR_G_ADDR(ctx), &m_ptr);
+
+    bpf_probe_read_user(&spinning, sizeof(uint8_t), GET_M_SPINNING_ADDR(m_ptr));
+    report_m_state(M_STATE_KIND_WAKEP, mid, -1, spinning, -1);
+
+    return 0;
+}
+
+// mspinning is the start function of a new M started as spinning.
+SEC("uprobe/go_mspinning")
+int BPF_UPROBE(go_mspinning) {
+    uint64_t m_ptr;
+    int64_t mid = get_curr_mid(CURR_G_ADDR(ctx), &m_ptr);
+
+    report_m_state(M_STATE_KIND_SPIN, mid, -1, 1, -1);
+
+    return 0;
+}
+
+// resetspinning is called by a spinning M once it finds work to run.
+SEC("uprobe/go_resetspinning")
+int BPF_UPROBE(go_resetspinning) {
+    uint64_t m_ptr;
+    int64_t mid = get_curr_mid(CURR_G_ADDR(ctx), &m_ptr);
+
+    report_m_state(M_STATE_KIND_RESET_SPIN, mid, -1, 0, -1);
+
+    return 0;
+}
+
+struct goexit_event {
+    uint64_t etype;
+    int64_t mid;
+    int64_t procid; // -1 if M holds no P
+    struct runq_entry exited;
+    uint64_t final_pc; // PC that goexit1 is called from; 0 if unknown
+};
+
+// PC that each exiting goroutine calls goexit1 from, keyed by goid.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, uint64_t);
+    __type(value, uint64_t);
+    __uint(max_entries, 1 << 10);
+} goexit_pcs SEC(".maps");
+
+// goexit1 runs on the exiting goroutine before switching to g0 to call
+// goexit0.
+SEC("uprobe/go_goexit1")
+int BPF_UPROBE(go_goexit1) {
+    uint64_t goid, callerpc;
+
+    bpf_probe_read_user(&goid, sizeof(uint64_t), GET_GOID_ADDR(CURR_G_ADDR(ctx)));
+    callerpc = get_caller_pc(ctx);
+    bpf_map_update_elem(&goexit_pcs, &goid, &callerpc, BPF_ANY);
+
+    return 0;
+}
+
+SEC("uprobe/go_goexit0")
+int BPF_UPROBE(go_goexit0) {
+    struct goexit_event e;
+    char *gp = (char *)GO_PARAM1(ctx), *m_ptr, *p_ptr;
+    int32_t procid;
+    uint64_t *final_pc;
+
+    e.etype = EVENT_TYPE_GOEXIT;
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(CURR_G_ADDR(ctx)));
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    bpf_probe_read_user(&p_ptr, sizeof(char *), GET_P_ADDR(m_ptr));
+    if (!p_ptr) {
+        e.procid = -1;
+    } else {
+        bpf_probe_read_user(&procid, sizeof(int32_t), GET_P_ID_ADDR(p_ptr));
+        e.procid = procid;
+    }
+    bpf_probe_read_user(&e.exited.goid, sizeof(uint64_t), GET_GOID_ADDR(gp));
+    bpf_probe_read_user(&e.exited.pc, sizeof(uint64_t), GET_PC_ADDR(gp));
+    final_pc = bpf_map_lookup_elem(&goexit_pcs, &e.exited.goid);
+    if (!final_pc) {
+        e.final_pc = 0;
+    } else {
+        e.final_pc = *final_pc;
+        bpf_map_delete_elem(&goexit_pcs, &e.exited.goid);
+    }
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+
+    return 0;
+}
+
+#define GET_G_DEFER_ADDR(g_addr) ((char *)(g_addr) + RUNTIME_G__DEFER_OFFSET)
+#define GET_DEFER_FN_ADDR(d_addr) ((char *)(d_addr) + RUNTIME__DEFER_FN_OFFSET)
+#define GET_DEFER_LINK_ADDR(d_addr) ((char *)(d_addr) + RUNTIME__DEFER_LINK_OFFSET)
+#define GET_PANIC_ARG_ADDR(p_addr) ((char *)(p_addr) + RUNTIME__PANIC_ARG_OFFSET)
+#define MAX_DEFER_CHAIN_LEN 8
+
+// Panic event kinds. The values are kept identical to PanicEventKind in
+// slowmo.proto so the userspace can convert them directly.
+const uint64_t PANIC_KIND_START = 0;
+const uint64_t PANIC_KIND_RECOVERED = 1;
+const uint64_t PANIC_KIND_DEFER_RETURN = 2;
+const uint64_t PANIC_KIND_FATAL = 3;
+
+struct panic_event {
+    uint64_t etype;
+    int64_t mid;
+    uint64_t kind;
+    struct runq_entry goroutine;
+    uint64_t type_addr; // type word of the panic value; 0 if not applicable
+    uint64_t callstack[MAX_STACK_TRACE_DEPTH];
+    int64_t callstack_depth;
+    // PCs of the pending deferred calls, in the order they are going to run.
+    // Defers are never open-coded as the target is compiled without
+    // optimizations, so all of them are linked from g._defer.
+    uint64_t defers[MAX_DEFER_CHAIN_LEN];
+    int64_t num_defers;
+};
+
+// Reports a panic event from a probe at either the entry or a return of a
+// function, where the return address of the function is at the top of the
+// stack and the frame pointer still belongs to the caller.
+static int report_panic(struct pt_regs *ctx, uint64_t kind, uint64_t type_addr) {
+    struct panic_event e;
+    char *g_ptr = (char *)CURR_G_ADDR(ctx), *m_ptr, *d_ptr, *fn_ptr;
+    uint64_t pc_list[MAX_STACK_TRACE_DEPTH], callerpc;
+    int64_t i;
+
+    e.etype = EVENT_TYPE_PANIC;
+    e.kind = kind;
+    e.type_addr = type_addr;
+    bpf_probe_read_user(&m_ptr, sizeof(char *), GET_M_PTR_ADDR(g_ptr));
+    bpf_probe_read_user(&e.mid, sizeof(int64_t), GET_M_ID_ADDR(m_ptr));
+    bpf_probe_read_user(&e.goroutine.goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+    bpf_probe_read_user(&e.goroutine.pc, sizeof(uint64_t), GET_PC_ADDR(g_ptr));
+
+    callerpc = get_caller_pc(ctx);
+    e.callstack_depth = unwind_stack(CURR_STACK_POINTER(ctx), callerpc, CURR_FP(ctx), pc_list, MAX_STACK_TRACE_DEPTH);
+    if (e.callstack_depth < 0) {
+        bpf_printk("error unwinding callstack for pc %d", callerpc);
+        return 1;
+    }
+    bpf_for(i, 0, MAX_STACK_TRACE_DEPTH) {
+        e.callstack[i] = pc_list[i];
+    }
+
+    e.num_defers = 0;
+    bpf_probe_read_user(&d_ptr, sizeof(char *), GET_G_DEFER_ADDR(g_ptr));
+    bpf_for(i, 0, MAX_DEFER_CHAIN_LEN) {
+        if (!d_ptr) {
+            break;
+        }
+        bpf_probe_read_user(&fn_ptr, sizeof(char *), GET_DEFER_FN_ADDR(d_ptr));
+        if (!fn_ptr) {
+            e.defers[i] = 0;
+        } else {
+            bpf_probe_read_user(&e.defers[i], sizeof(uint64_t), &((struct funcval *)fn_ptr)->fn);
+        }
+        e.num_defers++;
+        bpf_probe_read_user(&d_ptr, sizeof(char *), GET_DEFER_LINK_ADDR(d_ptr));
+    }
+    bpf_ringbuf_output(&instrumentor_event, &e, sizeof(e), 0);
+
+    return 0;
+}
+
+SEC("uprobe/go_gopanic")
+int BPF_UPROBE(go_gopanic) {
+    int ret = report_panic(ctx, PANIC_KIND_START, GO_PARAM1(ctx));
+
+    delay_helper(DELAY_NS);
+
+    return ret;
+}
+
+// Attached to the returns of gorecover, which returns a nil interface unless
+// it actually stops a panic.
+SEC("uprobe/go_gorecover_return")
+int BPF_UPROBE(go_gorecover_return) {
+    uint64_t type_addr = GO_RET1(ctx);
+
+    if (!type_addr) {
+        return 0;
+    }
+    return report_panic(ctx, PANIC_KIND_RECOVERED, type_addr);
+}
+
+SEC("uprobe/go_deferreturn")
+int BPF_UPROBE(go_deferreturn) {
+    return report_panic(ctx, PANIC_KIND_DEFER_RETURN, 0);
+}
+
+// fatalpanic(msgs *_panic) is called when a panic is not recovered, right
+// before the program crashes.
+SEC("uprobe/go_fatalpanic")
+int BPF_UPROBE(go_fatalpanic) {
+    uint64_t type_addr = 0;
+    char *p_ptr = (char *)GO_PARAM1(ctx);
+
+    if (p_ptr) {
+        bpf_probe_read_user(&type_addr, sizeof(uint64_t), GET_PANIC_ARG_ADDR(p_ptr));
+    }
+    return report_panic(ctx, PANIC_KIND_FATAL, type_addr);
+}
+
+// dolockOSThread is called by both LockOSThread and the runtime-internal
+// lockOSThread to wire the current goroutine to the current M.
+SEC("uprobe/go_dolockosthread")
+int BPF_UPROBE(go_dolockosthread) {
+    uint64_t m_ptr;
+    int64_t goid, mid = get_curr_mid(CURR_G_ADDR(ctx), &m_ptr);
+
+    bpf_probe_read_user(&goid, sizeof(int64_t), GET_GOID_ADDR(CURR_G_ADDR(ctx)));
+    report_m_state(M_STATE_KIND_LOCK_OS_THREAD, mid, -1, 0, goid);
+
+    return 0;
+}
+
+struct race_detected_event {
+    uint64_t etype;
+    int64_t mid;
+    uint64_t goid; // 0 if the M runs no user goroutine
+};
+
+// The race detector calls back into the runtime to symbolize each frame of a
+// race report before printing it, on the M of the goroutine whose access
+// triggers the report. The callback runs on g0, so the racing goroutine is the
+// current one of the M. It's recorded by the thread the report is built on,
+// and reported once the report is printed.
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, uint64_t); // pid_tgid of the thread
+    __type(value, struct race_detected_event);
+    __uint(max_entries, 1024);
+} race_reports SEC(".maps");
+
+SEC("uprobe/go_race_symbolize_code")
+int BPF_UPROBE(go_race_symbolize_code) {
+    struct race_detected_event e;
+    uint64_t m_ptr, tid = bpf_get_current_pid_tgid();
+    char *g_ptr;
+
+    e.etype = EVENT_TYPE_RACE_DETECTED;
+    e.mid = get_curr_mid(CURR_G_ADDR(ctx), &m_ptr);
+    e.goid = 0;
+    bpf_probe_read_user(&g_ptr, sizeof(char *), GET_M_CURG_ADDR(m_ptr));
+    if (g_ptr) {
+        bpf_probe_read_user(&e.goid, sizeof(uint64_t), GET_GOID_ADDR(g_ptr));
+    }
+    // Overwritten by every frame, so that a report suppressed before being
+    // printed doesn't leave a stale goroutine behind.
+    bpf_map_update_elem(&race_reports, &tid, &e, BPF_ANY);
+
+    return 0;
+}
+
+// __tsan_on_report is a hook of the race detector runtime called once each
+// report is printed. It's C code, where the register of the current g is not
+// kept, hence the report is looked up by the thread.
+SEC("uprobe/go_race_on_report")
+int BPF_UPROBE(go_race_on_report) {
+    uint64_t tid = bpf_get_current_pid_tgid();
+    struct race_detected_event *e;
+
+    e = bpf_map_lookup_elem(&race_reports, &tid);
+    if (!e) {
+        return 0;
+    }
+    bpf_ringbuf_output(&instrumentor_event, e, sizeof(*e), 0);
+    bpf_map_delete_elem(&race_reports, &tid);
+
+    return 0;
+}
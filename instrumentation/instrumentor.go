@@ -3,7 +3,10 @@ package instrumentation
 import (
 	"errors"
 	"fmt"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
@@ -13,11 +16,38 @@ import (
 
 type Instrumentor struct {
 	interpreter *ELFInterpreter
-	targetExe   *link.Executable
-	bpfColl     *ebpf.Collection
+	// Sets up a uprobe in the target executable, which is replaced in tests
+	// since attaching uprobes requires privileges.
+	uprobe  func(symbol string, prog *ebpf.Program, opts *link.UprobeOptions) (link.Link, error)
+	bpfColl *ebpf.Collection
+	// Uprobes only fire in the process of pid if set, otherwise they fire in
+	// every process running the target executable.
+	pid      int
+	probesMu sync.Mutex
+	probes   []*attachedProbe
 }
 
-type InstrumentorOption func(*ELFInterpreter, *ebpf.CollectionSpec)
+// Probe describes a uprobe set up by the instrumentor.
+type Probe struct {
+	Symbol   string
+	Offset   uint64
+	BpfFn    string
+	Attached bool
+}
+
+type attachedProbe struct {
+	Probe
+	// The package and function of the spec that sets up the probe, where fn
+	// is empty for probes set up by a PackageSpec.
+	pkg string
+	fn  string
+	// Offset of the function in the executable file. Symbols are resolved by
+	// the interpreter since the symbol table might be stripped.
+	address uint64
+	link    link.Link // nil if detached
+}
+
+type InstrumentorOption func(*ELFInterpreter, *ebpf.CollectionSpec) error
 
 type GlobalVariableValue interface {
 	uint64
@@ -29,48 +59,90 @@ type GlobalVariable[T GlobalVariableValue] struct {
 }
 
 func WithGlobalVariable[T GlobalVariableValue](variable GlobalVariable[T]) InstrumentorOption {
-	return func(interpreter *ELFInterpreter, spec *ebpf.CollectionSpec) {
+	return func(interpreter *ELFInterpreter, spec *ebpf.CollectionSpec) error {
 		varSpec := spec.Variables[variable.NameInBPFProg]
 		if varSpec == nil {
-			logging.Logger().Fatalf("Global variable %s not found in loaded BPF specification", variable.NameInBPFProg)
+			return fmt.Errorf("global variable %s not found in loaded BPF specification", variable.NameInBPFProg)
 		}
-		varSpec.Set(variable.Value)
+		return varSpec.Set(variable.Value)
 	}
 }
 
-func NewInstrumentor(interpreter *ELFInterpreter, bpfProg, targetPath string, opts ...InstrumentorOption) *Instrumentor {
+func NewInstrumentor(interpreter *ELFInterpreter, bpfProg, targetPath string, opts ...InstrumentorOption) (*Instrumentor, error) {
+	// The BPF program is built for the architecture of the host.
+	if arch := interpreter.Arch(); arch.String() != runtime.GOARCH {
+		return nil, fmt.Errorf("target program built for %s cannot be instrumented on %s", arch, runtime.GOARCH)
+	}
 	if err := rlimit.RemoveMemlock(); err != nil {
-		logging.Logger().Fatal("RemoveMemlock: ", err)
+		return nil, fmt.Errorf("remove memlock: %w", err)
 	}
 	exe, err := link.OpenExecutable(targetPath)
 	if err != nil {
-		logging.Logger().Fatal("OpenExecutable for tracee: ", err)
+		return nil, fmt.Errorf("open executable for tracee: %w", err)
 	}
 	spec, err := ebpf.LoadCollectionSpec(bpfProg)
 	if err != nil {
-		logging.Logger().Fatal("LoadCollectionSpec: ", err)
+		return nil, fmt.Errorf("load collection spec: %w", err)
+	}
+	// Runtime struct layouts differ between go versions, so they are taken
+	// from the target program instead of being built into the BPF program.
+	runtimeOffsets, err := interpreter.RuntimeOffsets()
+	if err != nil {
+		return nil, fmt.Errorf("resolve runtime offsets: %w", err)
+	}
+	for name, value := range runtimeOffsets {
+		opts = append(opts, WithGlobalVariable(GlobalVariable[uint64]{NameInBPFProg: name, Value: value}))
 	}
 	for _, opt := range opts {
-		opt(interpreter, spec)
+		if err := opt(interpreter, spec); err != nil {
+			return nil, err
+		}
 	}
 	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
 		var verifierErr *ebpf.VerifierError
 		if errors.As(err, &verifierErr) {
-			logging.Logger().Fatalf("LoadCollection verifier error: %+v\n", verifierErr)
-		} else {
-			logging.Logger().Fatal("LoadCollection: ", err)
+			return nil, fmt.Errorf("load collection verifier error: %+v", verifierErr)
 		}
+		return nil, fmt.Errorf("load collection: %w", err)
 	}
 	return &Instrumentor{
 		interpreter: interpreter,
-		targetExe:   exe,
+		uprobe:      exe.Uprobe,
 		bpfColl:     coll,
+	}, nil
+}
+
+// ProcessExePath returns the path to the executable of the running process
+// of pid.
+func ProcessExePath(pid int) string {
+	return fmt.Sprintf("/proc/%d/exe", pid)
+}
+
+// NewProcessInstrumentor creates an instrumentor for the already running
+// process of pid, whose probes only fire in that process.
+func NewProcessInstrumentor(interpreter *ELFInterpreter, bpfProg string, pid int, opts ...InstrumentorOption) (*Instrumentor, error) {
+	in, err := NewInstrumentor(interpreter, bpfProg, ProcessExePath(pid), opts...)
+	if err != nil {
+		return nil, err
 	}
+	in.pid = pid
+	return in, nil
 }
 
-func (in *Instrumentor) Close() {
+// Close detaches all probes and releases the BPF collection.
+func (in *Instrumentor) Close() error {
+	in.probesMu.Lock()
+	defer in.probesMu.Unlock()
+	var errs []error
+	for _, probe := range in.probes {
+		if err := probe.detach(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	in.probes = nil
 	in.bpfColl.Close()
+	return errors.Join(errs...)
 }
 
 type FunctionAttachOffset int
@@ -78,13 +150,23 @@ type FunctionAttachOffset int
 const (
 	AttachOffsetEntry FunctionAttachOffset = iota
 	AttachOffsetReturns
+	// AttachOffsetRawEntry attaches to the very first instruction of the
+	// function. It's meant for functions without the stack-splitting prologue
+	// (e.g. assembly or nosplit functions).
+	AttachOffsetRawEntry
 )
 
 type FunctionSpec struct {
+	// TargetPkg is empty for functions not written in Go (e.g. of the race
+	// detector runtime).
 	TargetPkg    string
 	TargetFn     string
 	AttachOffset FunctionAttachOffset
 	BpfFns       []string
+	// Optional marks a function that might be dropped by the linker when the
+	// target program never reaches it (e.g. netpollblock for programs without
+	// any I/O), in which case instrumenting it is skipped.
+	Optional bool
 }
 
 type PackageSpec struct {
@@ -92,64 +174,212 @@ type PackageSpec struct {
 	BpfFns    []string
 }
 
-func (in *Instrumentor) InstrumentFunction(spec FunctionSpec) {
-	if spec.AttachOffset == AttachOffsetEntry {
-		in.instrumentFunctionEntry(spec.TargetPkg, spec.TargetFn, spec.BpfFns)
-	} else {
-		in.instrumentFunctionReturns(spec.TargetPkg, spec.TargetFn, spec.BpfFns)
+func (spec FunctionSpec) symbol() string {
+	if spec.TargetPkg == "" {
+		return spec.TargetFn
 	}
+	return strings.Join([]string{spec.TargetPkg, spec.TargetFn}, ".")
+}
+
+// ProbeSpec selects the probes set up by a FunctionSpec or a PackageSpec.
+type ProbeSpec interface {
+	selects(probe *attachedProbe) bool
 }
 
-func (in *Instrumentor) instrumentFunctionEntry(targetPkg, targetFn string, bpfFns []string) {
-	targetSym := strings.Join([]string{targetPkg, targetFn}, ".")
-	startOffset, err := in.interpreter.GetFunctionStartOffset(targetSym)
+func (spec FunctionSpec) selects(probe *attachedProbe) bool {
+	// Probes set up by a PackageSpec are recorded without the function.
+	return spec.TargetFn != "" && probe.pkg == spec.TargetPkg && probe.fn == spec.TargetFn && slices.Contains(spec.BpfFns, probe.BpfFn)
+}
+
+func (spec PackageSpec) selects(probe *attachedProbe) bool {
+	return probe.pkg == spec.TargetPkg && probe.fn == "" && slices.Contains(spec.BpfFns, probe.BpfFn)
+}
+
+func (probe *attachedProbe) detach() error {
+	if probe.link == nil {
+		return nil
+	}
+	err := probe.link.Close()
+	probe.link = nil
+	probe.Attached = false
 	if err != nil {
-		logging.Logger().Fatalf("Could not get start offset for target %s\n", targetSym)
+		return fmt.Errorf("detach uprobe %s at offset %d for %s: %w", probe.BpfFn, probe.Offset, probe.Symbol, err)
 	}
-	for _, bpfFn := range bpfFns {
-		_, err = in.targetExe.Uprobe(targetSym, in.bpfColl.Programs[bpfFn], &link.UprobeOptions{
-			Offset: startOffset,
-		})
-		if err != nil {
-			logging.Logger().Fatalf("Attach uprobe %s to entry for %s:%s: %v", bpfFn, targetPkg, targetFn, err)
+	return nil
+}
+
+// attach sets up the uprobe and records it for later detaching.
+func (in *Instrumentor) attach(pkg, fn, symbol string, offset uint64, bpfFn string) error {
+	address, err := in.interpreter.FunctionFileOffset(symbol)
+	if err != nil {
+		return fmt.Errorf("resolve address of %s: %w", symbol, err)
+	}
+	probe := &attachedProbe{
+		Probe: Probe{
+			Symbol: symbol,
+			Offset: offset,
+			BpfFn:  bpfFn,
+		},
+		pkg:     pkg,
+		fn:      fn,
+		address: address,
+	}
+	if err := in.reattach(probe); err != nil {
+		return err
+	}
+	in.probesMu.Lock()
+	defer in.probesMu.Unlock()
+	in.probes = append(in.probes, probe)
+	return nil
+}
+
+func (in *Instrumentor) reattach(probe *attachedProbe) error {
+	if probe.link != nil {
+		return nil
+	}
+	prog := in.bpfColl.Programs[probe.BpfFn]
+	if prog == nil {
+		return fmt.Errorf("BPF program %s not found in collection", probe.BpfFn)
+	}
+	l, err := in.uprobe(probe.Symbol, prog, &link.UprobeOptions{
+		Address: probe.address,
+		Offset:  probe.Offset,
+		PID:     in.pid,
+	})
+	if err != nil {
+		return fmt.Errorf("attach uprobe %s to offset %d for %s: %w", probe.BpfFn, probe.Offset, probe.Symbol, err)
+	}
+	probe.link = l
+	probe.Attached = true
+	return nil
+}
+
+// Detach detaches the probes set up by spec, which can be attached again by
+// Reattach. It's safe to call while the target program is running.
+func (in *Instrumentor) Detach(spec ProbeSpec) error {
+	in.probesMu.Lock()
+	defer in.probesMu.Unlock()
+	var errs []error
+	for _, probe := range in.probes {
+		if spec.selects(probe) {
+			if err := probe.detach(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reattach attaches the probes set up by spec that were detached by Detach.
+func (in *Instrumentor) Reattach(spec ProbeSpec) error {
+	in.probesMu.Lock()
+	defer in.probesMu.Unlock()
+	var errs []error
+	for _, probe := range in.probes {
+		if spec.selects(probe) {
+			if err := in.reattach(probe); err != nil {
+				errs = append(errs, err)
+			}
 		}
 	}
+	return errors.Join(errs...)
 }
 
-func (in *Instrumentor) instrumentFunctionReturns(targetPkg, targetFn string, bpfFns []string) {
-	targetSym := strings.Join([]string{targetPkg, targetFn}, ".")
-	retOffsets, err := in.interpreter.GetFunctionReturnOffset(targetSym)
+// Probes returns all probes set up by the instrumentor, in the order they
+// were attached, including the detached ones.
+func (in *Instrumentor) Probes() []Probe {
+	in.probesMu.Lock()
+	defer in.probesMu.Unlock()
+	probes := make([]Probe, len(in.probes))
+	for i, probe := range in.probes {
+		probes[i] = probe.Probe
+	}
+	return probes
+}
+
+func (in *Instrumentor) InstrumentFunction(spec FunctionSpec) error {
+	if spec.Optional {
+		if _, ok := in.interpreter.ResolveFunctionSymbol(spec.symbol()); !ok {
+			logging.Logger().Debugf("Optional function %s not found in target program, skipping...", spec.symbol())
+			return nil
+		}
+	}
+	targetSym, offsets, err := in.interpreter.ResolveFunctionSpec(spec)
 	if err != nil {
-		logging.Logger().Fatalf("Could not get return offsets for function %s\n", targetSym)
-	}
-	logging.Logger().Debugf("Return offsets for function %s to instrument: %+v", fmt.Sprintf("%s.%s", targetPkg, targetFn), retOffsets)
-	for _, offset := range retOffsets {
-		for _, bpfFn := range bpfFns {
-			_, err := in.targetExe.Uprobe(targetSym, in.bpfColl.Programs[bpfFn], &link.UprobeOptions{
-				Offset: offset,
-			})
-			if err != nil {
-				logging.Logger().Fatal("Attach go_newproc_return uprobe: ", err, ", offset: ", offset)
+		return err
+	}
+	for _, offset := range offsets {
+		for _, bpfFn := range spec.BpfFns {
+			if err := in.attach(spec.TargetPkg, spec.TargetFn, targetSym, offset, bpfFn); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
 }
 
-func (in *Instrumentor) InstrumentPackage(spec PackageSpec) {
-	pkgOffsets := in.interpreter.GetInstrumentableOffsetsForPackage(spec.TargetPkg)
+// ResolveFunctionSpec returns the symbol and the offsets in it that the probes
+// of spec are attached to.
+func (ei *ELFInterpreter) ResolveFunctionSpec(spec FunctionSpec) (string, []uint64, error) {
+	targetSym := spec.symbol()
+	switch spec.AttachOffset {
+	case AttachOffsetEntry:
+		startOffset, err := ei.GetFunctionStartOffset(targetSym)
+		if err != nil {
+			return "", nil, fmt.Errorf("get start offset for target %s: %w", targetSym, err)
+		}
+		return ei.resolveFunctionAt(targetSym, startOffset)
+	case AttachOffsetRawEntry:
+		return ei.resolveFunctionAt(targetSym, 0)
+	default:
+		retOffsets, err := ei.GetFunctionReturnOffset(targetSym)
+		if err != nil {
+			return "", nil, fmt.Errorf("get return offsets for function %s: %w", targetSym, err)
+		}
+		logging.Logger().Debugf("Return offsets for function %s to instrument: %+v", targetSym, retOffsets)
+		return targetSym, retOffsets, nil
+	}
+}
+
+func (ei *ELFInterpreter) resolveFunctionAt(fnName string, offset uint64) (string, []uint64, error) {
+	targetSym, ok := ei.ResolveFunctionSymbol(fnName)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: function %s", ErrSymbolNotFound, fnName)
+	}
+	return targetSym, []uint64{offset}, nil
+}
+
+// InstrumentEntryPoint attaches bpfFns to the first instruction run by the
+// target program, before any Go code is run.
+func (in *Instrumentor) InstrumentEntryPoint(bpfFns []string) error {
+	symbol, offset, err := in.interpreter.EntryFunction()
+	if err != nil {
+		return err
+	}
+	for _, bpfFn := range bpfFns {
+		if err := in.attach("", symbol, symbol, offset, bpfFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *Instrumentor) InstrumentPackage(spec PackageSpec) error {
+	pkgOffsets, err := in.interpreter.GetInstrumentableOffsetsForPackage(spec.TargetPkg)
+	if err != nil {
+		return err
+	}
 	logging.Logger().Debugf("Delayable offsets for package %s: %+v", spec.TargetPkg, pkgOffsets)
 	for fnSym, offsets := range pkgOffsets {
 		for _, offset := range offsets {
 			for _, bpfFn := range spec.BpfFns {
-				_, err := in.targetExe.Uprobe(fnSym, in.bpfColl.Programs[bpfFn], &link.UprobeOptions{
-					Offset: offset,
-				})
-				if err != nil {
-					logging.Logger().Fatal("Attach delay uprobe: ", err)
+				if err := in.attach(spec.TargetPkg, "", fnSym, offset, bpfFn); err != nil {
+					return err
 				}
 			}
 		}
 	}
+	return nil
 }
 
 func (in *Instrumentor) GetMap(name string) *ebpf.Map {
@@ -0,0 +1,136 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/kailun2047/slowmo/logging"
+)
+
+const testBpfFn = "test_probe"
+
+// fakeLink counts the uprobes that are detached.
+type fakeLink struct {
+	link.Link
+	closed *int
+}
+
+func (l *fakeLink) Close() error {
+	*l.closed++
+	return nil
+}
+
+func newTestInstrumentor(t *testing.T) (in *Instrumentor, attached, detached *int) {
+	logging.InitZapLogger("production")
+	interpreter, err := NewELFInterpreter("./testdata/greet")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+	attached, detached = new(int), new(int)
+	in = &Instrumentor{
+		interpreter: interpreter,
+		uprobe: func(string, *ebpf.Program, *link.UprobeOptions) (link.Link, error) {
+			*attached++
+			return &fakeLink{closed: detached}, nil
+		},
+		bpfColl: &ebpf.Collection{Programs: map[string]*ebpf.Program{testBpfFn: {}}},
+	}
+	// The function and the package probes share the BPF function, so they are
+	// only told apart by the spec.
+	if err := in.InstrumentFunction(FunctionSpec{TargetPkg: "main", TargetFn: "Greet", BpfFns: []string{testBpfFn}}); err != nil {
+		t.Fatalf("Instrument function main.Greet: %v", err)
+	}
+	if err := in.InstrumentPackage(PackageSpec{TargetPkg: "main", BpfFns: []string{testBpfFn}}); err != nil {
+		t.Fatalf("Instrument package main: %v", err)
+	}
+	return in, attached, detached
+}
+
+func TestInstrumentor_SpecSelects(t *testing.T) {
+	in, _, _ := newTestInstrumentor(t)
+
+	inputs := []struct {
+		spec        ProbeSpec
+		expectedFn  bool // selects the probe of main.Greet
+		expectedPkg bool // selects the probes of package main
+	}{
+		{spec: FunctionSpec{TargetPkg: "main", TargetFn: "Greet", BpfFns: []string{testBpfFn}}, expectedFn: true},
+		{spec: PackageSpec{TargetPkg: "main", BpfFns: []string{testBpfFn}}, expectedPkg: true},
+		// A function spec without the function doesn't stand for the package.
+		{spec: FunctionSpec{TargetPkg: "main", BpfFns: []string{testBpfFn}}},
+		{spec: FunctionSpec{TargetPkg: "main", TargetFn: "main", BpfFns: []string{testBpfFn}}},
+		{spec: FunctionSpec{TargetPkg: "main", TargetFn: "Greet", BpfFns: []string{"other_probe"}}},
+		{spec: PackageSpec{TargetPkg: "fmt", BpfFns: []string{testBpfFn}}},
+	}
+	for _, input := range inputs {
+		var selectedFn, selectedPkg bool
+		for _, probe := range in.probes {
+			if !input.spec.selects(probe) {
+				continue
+			}
+			if probe.fn != "" {
+				selectedFn = true
+			} else {
+				selectedPkg = true
+			}
+		}
+		if selectedFn != input.expectedFn || selectedPkg != input.expectedPkg {
+			t.Errorf("Spec %+v: expected to select function probe %t and package probes %t, got %t and %t", input.spec, input.expectedFn, input.expectedPkg, selectedFn, selectedPkg)
+		}
+	}
+}
+
+func TestInstrumentor_DetachReattach(t *testing.T) {
+	in, attached, detached := newTestInstrumentor(t)
+	numProbes := len(in.Probes())
+	if numProbes < 2 || *attached != numProbes {
+		t.Fatalf("Expected the function and the package to be instrumented, got %d probes with %d attached", numProbes, *attached)
+	}
+	fnSpec := FunctionSpec{TargetPkg: "main", TargetFn: "Greet", BpfFns: []string{testBpfFn}}
+
+	checkAttached := func(stage string, expectedFn bool) {
+		t.Helper()
+		// The function probe is attached first.
+		for i, probe := range in.Probes() {
+			isFn := i == 0
+			if isFn && probe.Attached != expectedFn {
+				t.Errorf("%s: expected function probe attached %t, got %t", stage, expectedFn, probe.Attached)
+			} else if !isFn && !probe.Attached {
+				t.Errorf("%s: expected package probe %+v to stay attached", stage, probe)
+			}
+		}
+	}
+
+	if err := in.Detach(fnSpec); err != nil {
+		t.Fatalf("Detach: %v", err)
+	}
+	if *detached != 1 {
+		t.Errorf("Expected 1 probe detached, got %d", *detached)
+	}
+	checkAttached("After Detach", false)
+
+	// Detaching again is a no-op.
+	if err := in.Detach(fnSpec); err != nil {
+		t.Fatalf("Detach again: %v", err)
+	}
+	if *detached != 1 {
+		t.Errorf("Expected detaching again to be a no-op, got %d probes detached", *detached)
+	}
+
+	if err := in.Reattach(fnSpec); err != nil {
+		t.Fatalf("Reattach: %v", err)
+	}
+	if *attached != numProbes+1 {
+		t.Errorf("Expected only the detached probe to be attached again, got %d attaches for %d probes", *attached, numProbes)
+	}
+	checkAttached("After Reattach", true)
+
+	// Probes still attached are left alone.
+	if err := in.Reattach(PackageSpec{TargetPkg: "main", BpfFns: []string{testBpfFn}}); err != nil {
+		t.Fatalf("Reattach package: %v", err)
+	}
+	if *attached != numProbes+1 {
+		t.Errorf("Expected reattaching attached probes to be a no-op, got %d attaches", *attached)
+	}
+}
@@ -0,0 +1,366 @@
+package instrumentation
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"unsafe"
+)
+
+// lineTableData holds the parts of the line table that are not exposed by
+// gosym, which are read from the unexported fields of gosym.LineTable.
+type lineTableData struct {
+	nfunctab  uint32
+	funcTab   []byte
+	funcData  []byte
+	pcTab     []byte
+	textStart uint64
+	quantum   uint32
+	// Null-terminated function names, which are referenced by their offsets.
+	funcNameTab []byte
+	// Function entry PC -> offset of the function's _func struct in funcData.
+	funcOffsets map[uint64]uint64
+}
+
+// lineRange maps the PCs in [start, end) of a function to a line in a file,
+// where file is the index of the file in the file table of the function's
+// compilation unit.
+type lineRange struct {
+	start uint64
+	end   uint64
+	file  int32
+	line  int32
+	// Index of the innermost call inlined at the PCs in the inline tree of
+	// the function, or -1 if the PCs are not in an inlined call.
+	inlIndex int32
+}
+
+// pcValue is a decoded entry of a pc-value table, which holds val for the PCs
+// up to end (exclusive) since the previous entry.
+type pcValue struct {
+	end uint64
+	val int32
+}
+
+func (ei *ELFInterpreter) loadLineTableData() (*lineTableData, error) {
+	ei.lnTabDataOnce.Do(func() {
+		lnTabV := reflect.ValueOf(ei.goLnTab).Elem()
+		for _, fieldName := range []string{lnTabFieldNameFuncTabN, lnTabFieldNameFuncTab, lnTabFieldNameFuncData, lnTabFieldNamePCTab, lnTabFieldNameTextStart, lnTabFieldNameQuantum, lnTabFieldNameFuncName} {
+			if !lnTabV.FieldByName(fieldName).IsValid() {
+				ei.lnTabDataErr = fmt.Errorf("%w: field %s not found in line table", ErrDecode, fieldName)
+				return
+			}
+		}
+		bytesField := func(fieldName string) []byte {
+			return *(*[]byte)(unsafe.Pointer(lnTabV.FieldByName(fieldName).UnsafeAddr()))
+		}
+		data := &lineTableData{
+			nfunctab:    uint32(lnTabV.FieldByName(lnTabFieldNameFuncTabN).Uint()),
+			funcTab:     bytesField(lnTabFieldNameFuncTab),
+			funcData:    bytesField(lnTabFieldNameFuncData),
+			pcTab:       bytesField(lnTabFieldNamePCTab),
+			textStart:   lnTabV.FieldByName(lnTabFieldNameTextStart).Uint(),
+			quantum:     uint32(lnTabV.FieldByName(lnTabFieldNameQuantum).Uint()),
+			funcNameTab: bytesField(lnTabFieldNameFuncName),
+			funcOffsets: make(map[uint64]uint64),
+		}
+		for i := range data.nfunctab {
+			funcTabOff := (2*i + 1) * funcTabFieldSize
+			if int(funcTabOff)+funcTabFieldSize > len(data.funcTab) {
+				ei.lnTabDataErr = fmt.Errorf("%w: functab entry %d out of range", ErrDecode, i)
+				return
+			}
+			funcOff := uint64(ei.byteOrder.Uint32(data.funcTab[funcTabOff:]))
+			if funcOff+funcInfoFieldOffsetFlag >= uint64(len(data.funcData)) {
+				ei.lnTabDataErr = fmt.Errorf("%w: funcdata of functab entry %d out of range", ErrDecode, i)
+				return
+			}
+			entryOff := uint64(ei.byteOrder.Uint32(data.funcData[funcOff:]))
+			data.funcOffsets[data.textStart+entryOff] = funcOff
+		}
+		ei.lnTabData = data
+	})
+	return ei.lnTabData, ei.lnTabDataErr
+}
+
+// functionLines decodes the pcfile, pcln and inline tree index tables of the
+// function at entry into ranges of PCs that map to the same line, in ascending
+// order of PC.
+func (ei *ELFInterpreter) functionLines(entry uint64) ([]lineRange, error) {
+	data, err := ei.loadLineTableData()
+	if err != nil {
+		return nil, err
+	}
+	funcOff, ok := data.funcOffsets[entry]
+	if !ok {
+		return nil, fmt.Errorf("%w: function at 0x%x", ErrSymbolNotFound, entry)
+	}
+	funcInfoData := data.funcData[funcOff:]
+	files, err := data.decodePCValues(ei.byteOrder.Uint32(funcInfoData[funcInfoFieldOffsetPCFile:]), entry)
+	if err != nil {
+		return nil, fmt.Errorf("pcfile table of function at 0x%x: %w", entry, err)
+	}
+	lines, err := data.decodePCValues(ei.byteOrder.Uint32(funcInfoData[funcInfoFieldOffsetPCLn:]), entry)
+	if err != nil {
+		return nil, fmt.Errorf("pcln table of function at 0x%x: %w", entry, err)
+	}
+	// No PC is in an inlined call if nothing is inlined into the function.
+	inlIndices := []pcValue{{end: math.MaxUint64, val: -1}}
+	indexTabOff, _, err := ei.inlineTree(data, entry)
+	if err != nil {
+		return nil, err
+	}
+	if indexTabOff != 0 {
+		inlIndices, err = data.decodePCValues(indexTabOff, entry)
+		if err != nil {
+			return nil, fmt.Errorf("inline tree index table of function at 0x%x: %w", entry, err)
+		}
+	}
+
+	// The tables change values at different PCs, so they are split into the
+	// ranges in which none of them changes.
+	var res []lineRange
+	start := entry
+	for i, j, k := 0, 0, 0; i < len(files) && j < len(lines) && k < len(inlIndices); {
+		end := min(files[i].end, lines[j].end, inlIndices[k].end)
+		if end > start {
+			res = append(res, lineRange{start: start, end: end, file: files[i].val, line: lines[j].val, inlIndex: inlIndices[k].val})
+			start = end
+		}
+		if files[i].end == end {
+			i++
+		}
+		if lines[j].end == end {
+			j++
+		}
+		if inlIndices[k].end == end {
+			k++
+		}
+	}
+	return res, nil
+}
+
+// callSiteLines attributes the PCs of the calls inlined into the function at
+// entry to the lines of the calls in the function, so that the returned
+// ranges only refer to the lines of the function itself.
+func (ei *ELFInterpreter) callSiteLines(entry uint64, lines []lineRange) ([]lineRange, error) {
+	res := slices.Clone(lines)
+	for i, lr := range lines {
+		if lr.inlIndex < 0 {
+			continue
+		}
+		calls, err := ei.inlinedCalls(entry, lr.start)
+		if err != nil {
+			return nil, err
+		}
+		if len(calls) == 0 {
+			continue
+		}
+		callSite := calls[len(calls)-1].parentPC
+		j, found := slices.BinarySearchFunc(lines, callSite, func(lr lineRange, pc uint64) int {
+			if lr.end <= pc {
+				return -1
+			}
+			if lr.start > pc {
+				return 1
+			}
+			return 0
+		})
+		if !found || lines[j].inlIndex >= 0 {
+			return nil, fmt.Errorf("%w: call site of inlined call at 0x%x", ErrDecode, lr.start)
+		}
+		res[i].file, res[i].line, res[i].inlIndex = lines[j].file, lines[j].line, -1
+	}
+	return res, nil
+}
+
+// inlinedCall is a function call inlined at a PC.
+type inlinedCall struct {
+	name string
+	// A PC of the caller whose position is the call site.
+	parentPC uint64
+}
+
+// inlinedCalls decodes the inline tree of the function at entry into the calls
+// inlined at pc, from the innermost one to the one made by the function.
+func (ei *ELFInterpreter) inlinedCalls(entry, pc uint64) ([]inlinedCall, error) {
+	data, err := ei.loadLineTableData()
+	if err != nil {
+		return nil, err
+	}
+	indexTabOff, treeAddr, err := ei.inlineTree(data, entry)
+	if err != nil || indexTabOff == 0 {
+		return nil, err
+	}
+	if treeAddr == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSymbolNotFound, symNameGoFunc)
+	}
+
+	ix, err := data.pcValueAt(indexTabOff, entry, pc)
+	if err != nil {
+		return nil, fmt.Errorf("inline tree index table of function at 0x%x: %w", entry, err)
+	}
+	var res []inlinedCall
+	call := make([]byte, inlinedCallSize)
+	for ix >= 0 {
+		if !ei.readAt(call, treeAddr+uint64(ix)*inlinedCallSize) {
+			return nil, fmt.Errorf("%w: inline tree entry %d of function at 0x%x out of range", ErrDecode, ix, entry)
+		}
+		name, ok := data.funcName(ei.byteOrder.Uint32(call[inlinedCallFieldOffsetNameOff:]))
+		if !ok {
+			return nil, fmt.Errorf("%w: name of inline tree entry %d of function at 0x%x out of range", ErrDecode, ix, entry)
+		}
+		pc = entry + uint64(int32(ei.byteOrder.Uint32(call[inlinedCallFieldOffsetParentPC:])))
+		res = append(res, inlinedCall{name: name, parentPC: pc})
+
+		parentIx, err := data.pcValueAt(indexTabOff, entry, pc)
+		if err != nil {
+			return nil, fmt.Errorf("inline tree index table of function at 0x%x: %w", entry, err)
+		}
+		// Callers precede their inlined callees in the inline tree, which
+		// ensures that the walk terminates.
+		if parentIx >= ix {
+			return nil, fmt.Errorf("%w: cyclic inline tree of function at 0x%x", ErrDecode, entry)
+		}
+		ix = parentIx
+	}
+	return res, nil
+}
+
+// inlineTree locates the inline tree of the function at entry, returning the
+// offset of its inline tree index table in pcTab and the address of the tree.
+// The offset is 0 if nothing is inlined into the function, and the address is 0
+// if the function data of the program is not found.
+func (ei *ELFInterpreter) inlineTree(data *lineTableData, entry uint64) (uint32, uint64, error) {
+	funcOff, ok := data.funcOffsets[entry]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: function at 0x%x", ErrSymbolNotFound, entry)
+	}
+	funcInfoData := data.funcData[funcOff:]
+	npcdata := ei.byteOrder.Uint32(funcInfoData[funcInfoFieldOffsetNPCData:])
+	nfuncdata := uint32(funcInfoData[funcInfoFieldOffsetNFuncData])
+	if npcdata <= pcdataInlTreeIndex || nfuncdata <= funcdataInlTree {
+		return 0, 0, nil
+	}
+	if funcInfoFieldOffsetPCData+4*uint64(npcdata+nfuncdata) > uint64(len(funcInfoData)) {
+		return 0, 0, fmt.Errorf("%w: pcdata of function at 0x%x out of range", ErrDecode, entry)
+	}
+	indexTabOff := ei.byteOrder.Uint32(funcInfoData[funcInfoFieldOffsetPCData+4*pcdataInlTreeIndex:])
+	inlTreeOff := ei.byteOrder.Uint32(funcInfoData[funcInfoFieldOffsetPCData+4*(npcdata+funcdataInlTree):])
+	if indexTabOff == 0 || inlTreeOff == ^uint32(0) {
+		return 0, 0, nil
+	}
+	if ei.goFuncBase == 0 {
+		return indexTabOff, 0, nil
+	}
+	return indexTabOff, ei.goFuncBase + uint64(inlTreeOff), nil
+}
+
+// funcName returns the function name at off in the function name table.
+func (data *lineTableData) funcName(off uint32) (string, bool) {
+	if int(off) >= len(data.funcNameTab) {
+		return "", false
+	}
+	name := data.funcNameTab[off:]
+	end := bytes.IndexByte(name, 0)
+	if end < 0 {
+		return "", false
+	}
+	return string(name[:end]), true
+}
+
+// decodePCValues decodes the pc-value table at off in pcTab for the function
+// at entry.
+func (data *lineTableData) decodePCValues(off uint32, entry uint64) ([]pcValue, error) {
+	var res []pcValue
+	r, err := data.newPCValueReader(off, entry)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		ok, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return res, nil
+		}
+		res = append(res, r.pcValue)
+	}
+}
+
+// pcValueAt returns the value of the pc-value table at off in pcTab for pc in
+// the function at entry, which is -1 if the table does not cover pc.
+func (data *lineTableData) pcValueAt(off uint32, entry, pc uint64) (int32, error) {
+	r, err := data.newPCValueReader(off, entry)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		ok, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return -1, nil
+		}
+		if pc < r.end {
+			return r.val, nil
+		}
+	}
+}
+
+// pcValueReader reads the entries of a pc-value table one by one. The encoding
+// is described in
+// https://github.com/golang/go/blob/go1.22.5/src/runtime/symtab.go#L1112.
+type pcValueReader struct {
+	pcValue
+	p       []byte
+	off     uint32
+	quantum uint32
+	first   bool
+}
+
+func (data *lineTableData) newPCValueReader(off uint32, entry uint64) (*pcValueReader, error) {
+	if off == 0 || int(off) >= len(data.pcTab) {
+		return nil, fmt.Errorf("%w: pc-value table at offset %d out of range", ErrDecode, off)
+	}
+	return &pcValueReader{
+		pcValue: pcValue{end: entry, val: -1},
+		p:       data.pcTab[off:],
+		off:     off,
+		quantum: data.quantum,
+		first:   true,
+	}, nil
+}
+
+// next decodes the next entry into r.pcValue, or returns false at the end of
+// the table.
+func (r *pcValueReader) next() (bool, error) {
+	uvdelta, n := binary.Uvarint(r.p)
+	if n <= 0 {
+		return false, fmt.Errorf("%w: truncated pc-value table at offset %d", ErrDecode, r.off)
+	}
+	if uvdelta == 0 && !r.first {
+		return false, nil
+	}
+	r.first = false
+	r.p = r.p[n:]
+	pcdelta, n := binary.Uvarint(r.p)
+	if n <= 0 {
+		return false, fmt.Errorf("%w: truncated pc-value table at offset %d", ErrDecode, r.off)
+	}
+	r.p = r.p[n:]
+	// Value deltas are zigzag-encoded.
+	vdelta := uint32(uvdelta)
+	if vdelta&1 != 0 {
+		r.val += int32(^(vdelta >> 1))
+	} else {
+		r.val += int32(vdelta >> 1)
+	}
+	r.end += pcdelta * uint64(r.quantum)
+	return true, nil
+}
@@ -0,0 +1,128 @@
+package instrumentation
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+const (
+	// Offset of the offset of funcnametab in the header of the line table
+	// (runtime.pcHeader), and of funcnametab in runtime.moduledata, whose
+	// first field points to the header.
+	pcHeaderFieldOffsetFuncNameOffset = 32
+	moduleDataFieldOffsetFuncNameTab  = 8
+)
+
+// runtimeGlobalAnchor locates a runtime global variable of a program stripped
+// of both the symbol table and DWARF data (e.g. built with -ldflags="-s -w")
+// by runtime function fn, whose first reference to the program data is to the
+// variable.
+type runtimeGlobalAnchor struct {
+	fn string
+	// field is the name of the offset of the referenced field in
+	// RuntimeOffsets, or empty if the start of the variable is referenced.
+	field string
+}
+
+// Anchors of each runtime global variable, which are tried in order until one
+// is linked into the program.
+var runtimeGlobalAnchors = map[string][]runtimeGlobalAnchor{
+	// wakep starts by checking sched.nmspinning.
+	"runtime.sched": {{fn: "runtime.wakep", field: "runtime_schedt_nmspinning_offset"}},
+	// preemptall starts by ranging over allp.
+	"runtime.allp":              {{fn: "runtime.preemptall"}},
+	"runtime.waitReasonStrings": {{fn: "runtime.waitReason.String"}},
+	// stwReason.String is inlined into its callers in optimized code.
+	"runtime.stwReasonStrings": {{fn: "runtime.stwReason.String"}, {fn: "runtime.traceLocker.STWStart"}},
+	// semrelease1 starts by looking up the semaRoot of the semaphore.
+	"runtime.semtable": {{fn: "runtime.semrelease1"}},
+	// queuefinalizer starts by checking that GC is off.
+	"runtime.gcphase": {{fn: "runtime.queuefinalizer"}},
+	// The default gomaxprocs stub of the scavenger, which only reads
+	// gomaxprocs.
+	"runtime.gomaxprocs": {{fn: "runtime.(*scavengerState).init.func4"}},
+}
+
+// Sections holding the global variables of a go program.
+var programDataSections = []string{".noptrdata", ".data", ".bss", ".noptrbss"}
+
+// findRuntimeGlobal returns the address of runtime global variable varName in
+// a program stripped of both the symbol table and DWARF data.
+func (ei *ELFInterpreter) findRuntimeGlobal(varName string) (uint64, error) {
+	if varName == varNameFirstModuleData {
+		return ei.findFirstModuleData()
+	}
+	for _, anchor := range runtimeGlobalAnchors[varName] {
+		entry, _, ok := ei.lookupFunction(anchor.fn)
+		if !ok {
+			continue
+		}
+		buf, err := ei.getInstsFromTextSection(anchor.fn)
+		if err != nil {
+			return 0, fmt.Errorf("%w: instructions of function %s: %v", ErrDecode, anchor.fn, err)
+		}
+		for _, ref := range ei.arch.dataRefs(buf, entry) {
+			if !ei.inProgramData(ref) {
+				continue
+			}
+			if anchor.field == "" {
+				return ref, nil
+			}
+			offsets, err := ei.RuntimeOffsets()
+			if err != nil {
+				return 0, err
+			}
+			return ref - offsets[anchor.field], nil
+		}
+		return 0, fmt.Errorf("%w: reference to global variable %s in function %s", ErrDecode, varName, anchor.fn)
+	}
+	return 0, fmt.Errorf("%w: global variable %s", ErrSymbolNotFound, varName)
+}
+
+// findFirstModuleData finds the module data of the program by its first field,
+// which points to the header of the line table, i.e. the start of .gopclntab.
+func (ei *ELFInterpreter) findFirstModuleData() (uint64, error) {
+	var lnTab *elf.Section
+	for _, sec := range ei.sections {
+		if sec.Name == ".gopclntab" {
+			lnTab = sec
+		}
+	}
+	if lnTab == nil {
+		return 0, fmt.Errorf("%w: section .gopclntab", ErrSymbolNotFound)
+	}
+	header := make([]byte, pcHeaderFieldOffsetFuncNameOffset+8)
+	if _, err := lnTab.ReadAt(header, 0); err != nil {
+		return 0, fmt.Errorf("%w: read line table header: %v", ErrDecode, err)
+	}
+	funcNameTab := lnTab.Addr + ei.byteOrder.Uint64(header[pcHeaderFieldOffsetFuncNameOffset:])
+	for _, sec := range ei.sections {
+		if sec.Type != elf.SHT_PROGBITS || sec.Flags&elf.SHF_WRITE == 0 {
+			continue
+		}
+		data, err := sec.Data()
+		if err != nil {
+			continue
+		}
+		// Other pointers to the header are told apart by the pointer to
+		// funcnametab that follows in the module data.
+		for off := 0; off+moduleDataFieldOffsetFuncNameTab+8 <= len(data); off += 8 {
+			if ei.byteOrder.Uint64(data[off:]) == lnTab.Addr && ei.byteOrder.Uint64(data[off+moduleDataFieldOffsetFuncNameTab:]) == funcNameTab {
+				return sec.Addr + uint64(off), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: global variable %s", ErrSymbolNotFound, varNameFirstModuleData)
+}
+
+// inProgramData tells if addr is in the global variables of the program.
+func (ei *ELFInterpreter) inProgramData(addr uint64) bool {
+	for _, sec := range ei.sections {
+		for _, name := range programDataSections {
+			if sec.Name == name && addr >= sec.Addr && addr < sec.Addr+sec.Size {
+				return true
+			}
+		}
+	}
+	return false
+}
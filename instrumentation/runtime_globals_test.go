@@ -0,0 +1,33 @@
+package instrumentation
+
+import (
+	"testing"
+)
+
+func TestELFInterpreter_FindRuntimeGlobal(t *testing.T) {
+	varNames := []string{varNameFirstModuleData}
+	for varName := range runtimeGlobalAnchors {
+		varNames = append(varNames, varName)
+	}
+	for _, prog := range []string{"greet_go1_25", "greet_inlined", "greet_arm64", "greet"} {
+		interpreter, err := NewELFInterpreter("./testdata/" + prog)
+		if err != nil {
+			t.Fatalf("Create interpreter for %s: %v", prog, err)
+		}
+		// Anchors referring to a field of the variable need the built-in
+		// runtime offsets, which are not available for go1.22.
+		noOffsets := prog == "greet"
+		for _, varName := range varNames {
+			sym, ok := interpreter.symbols[varName]
+			if !ok {
+				t.Fatalf("Symbol %s not found in %s", varName, prog)
+			}
+			if noOffsets && varName == "runtime.sched" {
+				continue
+			}
+			if addr, err := interpreter.findRuntimeGlobal(varName); err != nil || addr != sym.Value {
+				t.Errorf("Expected %s at 0x%x in %s, got 0x%x (err: %v)", varName, sym.Value, prog, addr, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package instrumentation
+
+import (
+	"debug/dwarf"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// The same targets are declared as BPF global variables in instrumentor.h by
+// tools/target_finder.go.
+//
+//go:embed tools/targets_to_find.json
+var runtimeTargetsJSON []byte
+
+type targetOffset struct {
+	Struct string   `json:"struct"`
+	Fields []string `json:"fields"`
+	// Optional marks a struct of a package that might not be linked into the
+	// target program (e.g. sync), whose field offsets are left unresolved.
+	Optional bool `json:"optional"`
+}
+
+type targetsForPackage struct {
+	Package         string         `json:"package"`
+	TargetOffsets   []targetOffset `json:"target_offsets"`
+	TargetArrayVars []string       `json:"target_arrays"`
+}
+
+// Offsets resolved from DWARF data of programs built by each supported go
+// release, which are used for target programs built without DWARF data (e.g.
+// with -ldflags="-s -w"). It's keyed by the go release (e.g. go1.25) and then
+// the architecture, and generated by tools/offsets_table.go.
+//
+//go:embed tools/runtime_offsets_table.json
+var runtimeOffsetsTableJSON []byte
+
+// RuntimeOffsets finds the offsets of struct fields and the lengths and element
+// sizes of arrays listed in targets_to_find.json from DWARF data of the target
+// program, or from the offsets built into the package for the go release of
+// the target program if it's built without DWARF data. The result is keyed by
+// the name of the corresponding global variable in instrumentor.h (e.g.
+// runtime_g_goid_offset).
+func (ei *ELFInterpreter) RuntimeOffsets() (map[string]uint64, error) {
+	var targets []targetsForPackage
+	if err := json.Unmarshal(runtimeTargetsJSON, &targets); err != nil {
+		return nil, fmt.Errorf("parse target offsets json: %w", err)
+	}
+	return ei.resolveTargetOffsets(targets)
+}
+
+func (ei *ELFInterpreter) resolveTargetOffsets(targets []targetsForPackage) (map[string]uint64, error) {
+	// Struct name -> global variable name of each field.
+	structFields := make(map[string]map[string]string)
+	optionalStructs := make(map[string]bool)
+	// Array variable name -> prefix of the global variable names of its length
+	// and element size.
+	arrayVars := make(map[string]string)
+	for _, pkgTarget := range targets {
+		// Package paths (e.g. internal/sync) are not valid in C identifiers.
+		varPrefix := strings.ReplaceAll(pkgTarget.Package, "/", "_")
+		for _, structTarget := range pkgTarget.TargetOffsets {
+			fields := make(map[string]string)
+			for _, field := range structTarget.Fields {
+				fields[field] = strings.ToLower(fmt.Sprintf("%s_%s_%s_offset", varPrefix, structTarget.Struct, field))
+			}
+			structName := fmt.Sprintf("%s.%s", pkgTarget.Package, structTarget.Struct)
+			structFields[structName] = fields
+			optionalStructs[structName] = structTarget.Optional
+		}
+		for _, arrVar := range pkgTarget.TargetArrayVars {
+			arrayVars[fmt.Sprintf("%s.%s", pkgTarget.Package, arrVar)] = strings.ToLower(fmt.Sprintf("%s_%s", varPrefix, arrVar))
+		}
+	}
+	if ei.dwarfData == nil {
+		return ei.builtinTargetOffsets(structFields, optionalStructs, arrayVars)
+	}
+
+	res := make(map[string]uint64)
+	reader := ei.dwarfData.Reader()
+	for len(structFields)+len(arrayVars) > 0 {
+		entry, err := reader.Next()
+		if err != nil {
+			return nil, fmt.Errorf("read DWARF entry: %w", err)
+		}
+		if entry == nil {
+			break
+		}
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		switch entry.Tag {
+		case dwarf.TagCompileUnit:
+			continue
+		case dwarf.TagStructType:
+			if fields, ok := structFields[name]; ok {
+				if err := ei.resolveFieldOffsets(entry, fields, res); err != nil {
+					return nil, fmt.Errorf("struct %s: %w", name, err)
+				}
+				delete(structFields, name)
+			}
+		case dwarf.TagVariable:
+			if globalPrefix, ok := arrayVars[name]; ok {
+				length, elemSize, err := ei.resolveArrayType(entry)
+				if err != nil {
+					return nil, fmt.Errorf("array variable %s: %w", name, err)
+				}
+				res[globalPrefix+"_length"] = length
+				res[globalPrefix+"_elem_size"] = elemSize
+				delete(arrayVars, name)
+			}
+		}
+		if entry.Children {
+			reader.SkipChildren()
+		}
+	}
+	for name := range structFields {
+		if !optionalStructs[name] {
+			return nil, fmt.Errorf("%w: DWARF entry for struct %s", ErrSymbolNotFound, name)
+		}
+	}
+	for name := range arrayVars {
+		return nil, fmt.Errorf("%w: DWARF entry for array variable %s", ErrSymbolNotFound, name)
+	}
+	return res, nil
+}
+
+// builtinTargetOffsets looks up the targets in the offsets built into the
+// package for the go release and the architecture of the target program.
+func (ei *ELFInterpreter) builtinTargetOffsets(structFields map[string]map[string]string, optionalStructs map[string]bool, arrayVars map[string]string) (map[string]uint64, error) {
+	var table map[string]map[string]map[string]uint64
+	if err := json.Unmarshal(runtimeOffsetsTableJSON, &table); err != nil {
+		return nil, fmt.Errorf("parse runtime offsets table json: %w", err)
+	}
+	release := goRelease(ei.goVersion)
+	offsets, ok := table[release][ei.arch.String()]
+	if !ok {
+		return nil, fmt.Errorf("%w: no built-in runtime offsets for %s/%s", ErrDWARFNotFound, release, ei.arch)
+	}
+
+	res := make(map[string]uint64)
+	for name, fields := range structFields {
+		structRes := make(map[string]uint64, len(fields))
+		for _, globalName := range fields {
+			if offset, ok := offsets[globalName]; ok {
+				structRes[globalName] = offset
+			}
+		}
+		// Optional structs are left out of the table as a whole if they are
+		// not linked into the program built by the release.
+		if len(structRes) < len(fields) {
+			if optionalStructs[name] && len(structRes) == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("%w: built-in offsets of struct %s for %s/%s", ErrSymbolNotFound, name, release, ei.arch)
+		}
+		maps.Copy(res, structRes)
+	}
+	for name, globalPrefix := range arrayVars {
+		length, okLength := offsets[globalPrefix+"_length"]
+		elemSize, okElemSize := offsets[globalPrefix+"_elem_size"]
+		if !okLength || !okElemSize {
+			return nil, fmt.Errorf("%w: built-in layout of array variable %s for %s/%s", ErrSymbolNotFound, name, release, ei.arch)
+		}
+		res[globalPrefix+"_length"] = length
+		res[globalPrefix+"_elem_size"] = elemSize
+	}
+	return res, nil
+}
+
+// goRelease returns the release of a go version (e.g. go1.25 of go1.25.4),
+// whose patch versions share the runtime struct layouts.
+func goRelease(version string) string {
+	// Experiments enabled at build time are listed after the version.
+	version, _, _ = strings.Cut(version, " ")
+	if major, rest, ok := strings.Cut(version, "."); ok {
+		minor, _, _ := strings.Cut(rest, ".")
+		return major + "." + minor
+	}
+	return version
+}
+
+func (ei *ELFInterpreter) resolveFieldOffsets(entry *dwarf.Entry, fields map[string]string, res map[string]uint64) error {
+	typ, err := ei.dwarfData.Type(entry.Offset)
+	if err != nil {
+		return err
+	}
+	structType, ok := typ.(*dwarf.StructType)
+	if !ok {
+		return fmt.Errorf("unexpected type %T", typ)
+	}
+	found := make(map[string]struct{})
+	for _, field := range structType.Field {
+		if globalName, ok := fields[field.Name]; ok {
+			res[globalName] = uint64(field.ByteOffset)
+			found[field.Name] = struct{}{}
+		}
+	}
+	for field := range fields {
+		if _, ok := found[field]; !ok {
+			return fmt.Errorf("%w: offset for field %s", ErrSymbolNotFound, field)
+		}
+	}
+	return nil
+}
+
+// resolveArrayType returns the length and the element size of an array
+// variable. It only works for 1-d array for now.
+func (ei *ELFInterpreter) resolveArrayType(entry *dwarf.Entry) (uint64, uint64, error) {
+	typeOffset, ok := entry.Val(dwarf.AttrType).(dwarf.Offset)
+	if !ok {
+		return 0, 0, fmt.Errorf("cannot determine type of variable")
+	}
+	typ, err := ei.dwarfData.Type(typeOffset)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Named array types (e.g. runtime.semTable) are typedefs.
+	for {
+		typedef, ok := typ.(*dwarf.TypedefType)
+		if !ok {
+			break
+		}
+		typ = typedef.Type
+	}
+	arrType, ok := typ.(*dwarf.ArrayType)
+	if !ok || arrType.Count < 0 {
+		return 0, 0, fmt.Errorf("cannot determine length of array type")
+	}
+	// The stride is only recorded if it differs from the element size.
+	elemSize := arrType.StrideBitSize / 8
+	if elemSize <= 0 {
+		elemSize = arrType.Type.Size()
+	}
+	if elemSize <= 0 {
+		return 0, 0, fmt.Errorf("cannot determine element size of array type")
+	}
+	return uint64(arrType.Count), uint64(elemSize), nil
+}
@@ -0,0 +1,128 @@
+package instrumentation
+
+import (
+	"errors"
+	"maps"
+	"testing"
+)
+
+func TestELFInterpreter_RuntimeOffsets(t *testing.T) {
+	interpreter, err := NewELFInterpreter("./testdata/greet_go1_25")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+
+	offsets, err := interpreter.RuntimeOffsets()
+	if err != nil {
+		t.Fatalf("Resolve runtime offsets: %v", err)
+	}
+	expectedOffsets := map[string]uint64{
+		"runtime_g_goid_offset":            152,
+		"runtime_g_m_offset":               48,
+		"runtime_g__defer_offset":          40,
+		"runtime__defer_fn_offset":         24,
+		"runtime__defer_link_offset":       32,
+		"runtime_m_id_offset":              224,
+		"runtime_m_p_offset":               200,
+		"runtime_p_runq_offset":            400,
+		"runtime_p_runnext_offset":         2448,
+		"runtime_hchan_recvq_offset":       64,
+		"runtime_timer_ts_offset":          72,
+		"runtime_waitreasonstrings_length": 47,
+		"runtime_semtable_length":          251,
+		"runtime_semtable_elem_size":       64,
+		"sync_mutex_mu_offset":             0,
+		"internal_sync_mutex_state_offset": 0,
+		"internal_sync_mutex_sema_offset":  4,
+	}
+	for name, expected := range expectedOffsets {
+		if offset, ok := offsets[name]; !ok {
+			t.Errorf("Offset %s not resolved", name)
+		} else if offset != expected {
+			t.Errorf("Expected %d for offset %s, got %d", expected, name, offset)
+		}
+	}
+
+	_, err = interpreter.resolveTargetOffsets([]targetsForPackage{
+		{
+			Package:       "runtime",
+			TargetOffsets: []targetOffset{{Struct: "timer", Fields: []string{"when", "nonexistent"}}},
+		},
+	})
+	if !errors.Is(err, ErrSymbolNotFound) {
+		t.Errorf("Expected ErrSymbolNotFound for field missing in target program, got %v", err)
+	}
+
+	// Optional structs missing in the target program are left unresolved.
+	offsets, err = interpreter.resolveTargetOffsets([]targetsForPackage{
+		{
+			Package:       "net/http",
+			TargetOffsets: []targetOffset{{Struct: "Server", Fields: []string{"Addr"}, Optional: true}},
+		},
+	})
+	if err != nil || len(offsets) != 0 {
+		t.Errorf("Expected no offsets for optional struct missing in target program, got %v (err: %v)", offsets, err)
+	}
+}
+
+func TestELFInterpreter_RuntimeOffsetsARM64(t *testing.T) {
+	interpreter, err := NewELFInterpreter("./testdata/greet_arm64")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+
+	offsets, err := interpreter.RuntimeOffsets()
+	if err != nil {
+		t.Fatalf("Resolve runtime offsets: %v", err)
+	}
+	// semTable entries are padded to the cache line size of arm64.
+	if size := offsets["runtime_semtable_elem_size"]; size != 128 {
+		t.Errorf("Expected 128 for semTable element size, got %d", size)
+	}
+}
+
+func TestELFInterpreter_BuiltinRuntimeOffsets(t *testing.T) {
+	for _, prog := range []string{"greet_go1_25", "greet_inlined", "greet_arm64"} {
+		interpreter, err := NewELFInterpreter("./testdata/" + prog)
+		if err != nil {
+			t.Fatalf("Create interpreter for %s: %v", prog, err)
+		}
+		expectedOffsets, err := interpreter.RuntimeOffsets()
+		if err != nil {
+			t.Fatalf("Resolve runtime offsets of %s: %v", prog, err)
+		}
+		// The offsets built in for the go release of the program are used
+		// once DWARF data is gone.
+		interpreter.dwarfData = nil
+		offsets, err := interpreter.RuntimeOffsets()
+		if err != nil {
+			t.Fatalf("Resolve built-in runtime offsets for %s: %v", prog, err)
+		}
+		if !maps.Equal(offsets, expectedOffsets) {
+			t.Errorf("Expected built-in runtime offsets for %s to match DWARF data %v, got %v", prog, expectedOffsets, offsets)
+		}
+	}
+
+	interpreter, err := NewELFInterpreter("./testdata/greet")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+	interpreter.dwarfData = nil
+	if _, err := interpreter.RuntimeOffsets(); !errors.Is(err, ErrDWARFNotFound) {
+		t.Errorf("Expected ErrDWARFNotFound for go release without built-in runtime offsets, got %v", err)
+	}
+}
+
+func TestGoRelease(t *testing.T) {
+	inputs := map[string]string{
+		"go1.25.4":                  "go1.25",
+		"go1.26.0 X:greenteagc":     "go1.26",
+		"go1.27rc1":                 "go1.27rc1",
+		"devel go1.28-abcdef +0000": "devel",
+	}
+	for version, expected := range inputs {
+		if release := goRelease(version); release != expected {
+			t.Errorf("Expected release %s for %s, got %s", expected, version, release)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Source of greet_arm64, built with:
+//
+//	GOOS=linux GOARCH=arm64 go build -gcflags="all=-N -l" -o greet_arm64 greet_arm64.go
+
+package main
+
+import "fmt"
+
+func Greet(name string) string {
+	return "Hello, " + name
+}
+
+func main() {
+	done := make(chan struct{})
+	go func() {
+		fmt.Println(Greet("slowmo"))
+		close(done)
+	}()
+	<-done
+}
@@ -0,0 +1,16 @@
+// Source of greet_go1_25, built with the oldest go release supported by the
+// runtime probes:
+//
+//	GOTOOLCHAIN=go1.25.4 go build -o greet_go1_25 greet_go1_25.go
+
+package main
+
+import "fmt"
+
+func Greet(name string) string {
+	return "Hello, " + name + "!"
+}
+
+func main() {
+	fmt.Println(Greet("slowmo"))
+}
@@ -0,0 +1,19 @@
+// Source of greet_inlined, built with inlining enabled:
+//
+//	go build -o greet_inlined greet_inlined.go
+
+package main
+
+import "fmt"
+
+func salutation(name string) string {
+	return "Hello, " + name
+}
+
+func Greet(name string) string {
+	return salutation(name) + "!"
+}
+
+func main() {
+	fmt.Println(Greet("slowmo"))
+}
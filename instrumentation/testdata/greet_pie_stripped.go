@@ -0,0 +1,20 @@
+// Source of greet_pie_stripped, built with:
+//
+//	go build -buildmode=pie -gcflags="all=-N -l" -ldflags="-s -w" -o greet_pie_stripped greet_pie_stripped.go
+
+package main
+
+import "fmt"
+
+func Greet(name string) string {
+	return "Hello, " + name
+}
+
+func main() {
+	done := make(chan struct{})
+	go func() {
+		fmt.Println(Greet("slowmo"))
+		close(done)
+	}()
+	<-done
+}
@@ -0,0 +1,92 @@
+//go:build ignore
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/kailun2047/slowmo/instrumentation"
+	"github.com/kailun2047/slowmo/logging"
+)
+
+var (
+	goVersions = flag.String("go_versions", "go1.25.4,go1.26.0,go1.27.1", "comma-separated go versions to build the probe program with, one for each supported release")
+	archs      = flag.String("archs", "amd64,arm64", "comma-separated architectures to build the probe program for")
+	resultFile = flag.String("result", "./runtime_offsets_table.json", "json file to write the runtime offsets to")
+)
+
+// The probe program links the packages whose structs are listed in
+// targets_to_find.json.
+const probeProgram = `package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+func main() {
+	var mu sync.Mutex
+	mu.Lock()
+	fmt.Println("hello")
+	mu.Unlock()
+}
+`
+
+// The runtime offsets of a program built without DWARF data cannot be read
+// from the program itself. Instead, they are taken from a program built by the
+// same go release, which this tool builds with each of the given go versions
+// (downloaded as toolchains by the go command) and resolves the offsets of.
+func main() {
+	flag.Parse()
+	logging.InitZapLogger("production")
+	dir, err := os.MkdirTemp("", "offsets-table")
+	if err != nil {
+		log.Fatalf("Create build directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(src, []byte(probeProgram), 0644); err != nil {
+		log.Fatalf("Write probe program: %v", err)
+	}
+
+	// Go release (e.g. go1.25) -> architecture -> offsets.
+	table := make(map[string]map[string]map[string]uint64)
+	for _, version := range strings.Split(*goVersions, ",") {
+		for _, arch := range strings.Split(*archs, ",") {
+			prog := filepath.Join(dir, version+"_"+arch)
+			cmd := exec.Command("go", "build", "-o", prog, src)
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), "GOTOOLCHAIN="+version, "GOOS=linux", "GOARCH="+arch, "CGO_ENABLED=0", "GOFLAGS=")
+			if out, err := cmd.CombinedOutput(); err != nil {
+				log.Fatalf("Build probe program with %s for %s: %v\n%s", version, arch, err, out)
+			}
+			interpreter, err := instrumentation.NewELFInterpreter(prog)
+			if err != nil {
+				log.Fatalf("Create interpreter for %s: %v", prog, err)
+			}
+			offsets, err := interpreter.RuntimeOffsets()
+			if err != nil {
+				log.Fatalf("Resolve runtime offsets of %s: %v", prog, err)
+			}
+			release := strings.Join(strings.SplitN(version, ".", 3)[:2], ".")
+			if table[release] == nil {
+				table[release] = make(map[string]map[string]uint64)
+			}
+			table[release][arch] = offsets
+		}
+	}
+
+	res, err := json.MarshalIndent(table, "", "    ")
+	if err != nil {
+		log.Fatalf("Encode runtime offsets table: %v", err)
+	}
+	if err := os.WriteFile(*resultFile, append(res, '\n'), 0644); err != nil {
+		log.Fatalf("Write runtime offsets table: %v", err)
+	}
+}
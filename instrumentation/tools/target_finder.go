@@ -3,27 +3,24 @@
 package main
 
 import (
-	"debug/dwarf"
-	"debug/elf"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"slices"
 	"strings"
 )
 
 var (
-	targetProg  = flag.String("target_prog", "./hello", "target program to analyze")
-	targetsFile = flag.String("targets_json", "./targets_to_find.json", "target offsets to find from target program")
-	resultFile  = flag.String("result", "../instrumentor.h", "offsets result file to write to")
+	targetsFile = flag.String("targets_json", "./targets_to_find.json", "target offsets to declare for BPF program")
+	resultFile  = flag.String("result", "../instrumentor.h", "header file to write declarations to")
 )
 
 type targetOffset struct {
-	Struct string   `json:"struct"`
-	Fields []string `json:"fields"`
+	Struct   string   `json:"struct"`
+	Fields   []string `json:"fields"`
+	Optional bool     `json:"optional"`
 }
 
 type targetsForPackage struct {
@@ -32,25 +29,21 @@ type targetsForPackage struct {
 	TargetArrayVars []string       `json:"target_arrays"`
 }
 
+// The offsets, array lengths and array element sizes are declared as BPF global
+// variables, whose values are resolved from DWARF data of the target program
+// and set by the instrumentation package before the BPF program is loaded. This
+// way a single BPF program works for all go versions.
 func main() {
-	exe, err := elf.Open(*targetProg)
-	if err != nil {
-		log.Fatalf("Open target program: %v", err)
-	}
-	dwarf, err := exe.DWARF()
-	if err != nil {
-		log.Fatalf("Parse DWARF sections: %v", err)
-	}
-	reader := dwarf.Reader()
-
+	flag.Parse()
 	fIn, err := os.Open(*targetsFile)
 	if err != nil {
 		log.Fatalf("Open target offsets file: %v", err)
 	}
-	fOut, err := os.OpenFile(*resultFile, os.O_WRONLY|os.O_CREATE, 0644)
+	fOut, err := os.OpenFile(*resultFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		log.Fatalf("Open offsets result file: %v", err)
 	}
+	defer fOut.Close()
 	targetOffsetsJSONBytes, err := io.ReadAll(fIn)
 	if err != nil {
 		log.Fatalf("Read target offsets file: %v", err)
@@ -62,165 +55,23 @@ func main() {
 	}
 
 	for _, pkgTarget := range targets {
+		// Package paths (e.g. internal/sync) are not valid in C identifiers.
+		prefix := strings.ReplaceAll(pkgTarget.Package, "/", "_")
 		for _, structTarget := range pkgTarget.TargetOffsets {
-			reader.Seek(0)
-			structName := fmt.Sprintf("%s.%s", pkgTarget.Package, structTarget.Struct)
-			_, err = findEntryForStruct(reader, structName)
-			if err != nil {
-				log.Fatalf("Error finding struct %s: %v", structName, err)
-			}
-			fieldSet := make(map[string]struct{})
 			for _, field := range structTarget.Fields {
-				fieldSet[field] = struct{}{}
-			}
-			fieldOffsets, err := findFieldOffsets(reader, fieldSet)
-			if err != nil {
-				log.Fatalf("Error finding field offsets for struct %s: %v", structName, err)
-			}
-			for _, fieldOffset := range fieldOffsets {
-				fmt.Fprintf(fOut, "#define %s_%s_%s_OFFSET %d\n", strings.ToUpper(pkgTarget.Package), strings.ToUpper(structTarget.Struct), strings.ToUpper(fieldOffset.field), fieldOffset.offset)
+				declare(fOut, fmt.Sprintf("%s_%s_%s_OFFSET", prefix, structTarget.Struct, field))
 			}
 		}
 		for _, targetArrVar := range pkgTarget.TargetArrayVars {
-			reader.Seek(0)
-			arrVarName := fmt.Sprintf("%s.%s", pkgTarget.Package, targetArrVar)
-			_, err = findEntryForVariable(reader, arrVarName)
-			if err != nil {
-				log.Fatalf("Error finding array variable %s: %v", arrVarName, err)
-			}
-			arrTypeOffset, err := findVariableTypeOffset(reader)
-			if err != nil {
-				log.Fatalf("Error finding type of array variable %s: %v", arrVarName, err)
-			}
-			reader.Seek(arrTypeOffset)
-			arrLen, err := findArrayLength(reader)
-			if err != nil {
-				log.Fatalf("Error finding length of array %s: %v", arrVarName, err)
-			}
-			fmt.Fprintf(fOut, "#define %s_%s_LENGTH %d\n", strings.ToUpper(pkgTarget.Package), strings.ToUpper(targetArrVar), arrLen)
-		}
-	}
-}
-
-func findEntryForStruct(reader *dwarf.Reader, structName string) (*dwarf.Entry, error) {
-	for {
-		entry, err := reader.Next()
-		if err != nil {
-			log.Fatalf("Error decoding DWARF entry: %v", err)
-		}
-		if entry == nil {
-			break
-		}
-		if entry.Tag == dwarf.TagStructType {
-			nameAttrIdx := slices.IndexFunc(entry.Field, func(field dwarf.Field) bool {
-				return field.Attr == dwarf.AttrName
-			})
-			if nameAttrIdx >= 0 && entry.Field[nameAttrIdx].Val.(string) == structName {
-				return entry, nil
-			}
-		}
-	}
-	return nil, fmt.Errorf("cannot find DWARF entry for struct")
-}
-
-type fieldOffset struct {
-	field  string
-	offset int64
-}
-
-func findFieldOffsets(reader *dwarf.Reader, fieldSet map[string]struct{}) ([]fieldOffset, error) {
-	var res []fieldOffset
-	for {
-		entry, err := reader.Next()
-		if err != nil {
-			log.Fatalf("Error decoding DWARF entry: %v", err)
-		}
-		if entry == nil || len(fieldSet) == 0 {
-			break
-		}
-		if entry.Tag == dwarf.TagMember {
-			nameAttrIdx := slices.IndexFunc(entry.Field, func(field dwarf.Field) bool {
-				return field.Attr == dwarf.AttrName
-			})
-			locAttrIdx := slices.IndexFunc(entry.Field, func(field dwarf.Field) bool {
-				return field.Attr == dwarf.AttrDataMemberLoc
-			})
-			if nameAttrIdx >= 0 && locAttrIdx >= 0 {
-				fieldName := entry.Field[nameAttrIdx].Val.(string)
-				if _, ok := fieldSet[fieldName]; ok {
-					res = append(res, fieldOffset{
-						field:  fieldName,
-						offset: entry.Field[locAttrIdx].Val.(int64),
-					})
-					delete(fieldSet, fieldName)
-				}
-			}
-		}
-	}
-	if len(fieldSet) > 0 {
-		return nil, fmt.Errorf("cannot find offset for fields %v", fieldSet)
-	}
-	return res, nil
-}
-
-func findEntryForVariable(reader *dwarf.Reader, varName string) (*dwarf.Entry, error) {
-	for {
-		entry, err := reader.Next()
-		if err != nil {
-			log.Fatalf("Error decoding DWARF entry: %v", err)
-		}
-		if entry == nil {
-			break
-		}
-		if entry.Tag == dwarf.TagVariable {
-			nameAttrIdx := slices.IndexFunc(entry.Field, func(field dwarf.Field) bool {
-				return field.Attr == dwarf.AttrName
-			})
-			if nameAttrIdx >= 0 && entry.Field[nameAttrIdx].Val.(string) == varName {
-				return entry, nil
-			}
+			declare(fOut, fmt.Sprintf("%s_%s_LENGTH", prefix, targetArrVar))
+			declare(fOut, fmt.Sprintf("%s_%s_ELEM_SIZE", prefix, targetArrVar))
 		}
 	}
-	return nil, fmt.Errorf("cannot find DWARF entry for variable")
 }
 
-func findVariableTypeOffset(reader *dwarf.Reader) (dwarf.Offset, error) {
-	for {
-		entry, err := reader.Next()
-		if err != nil {
-			log.Fatalf("Error decoding DWARF entry: %v", err)
-		}
-		if entry == nil {
-			break
-		}
-		typeIdx := slices.IndexFunc(entry.Field, func(field dwarf.Field) bool {
-			return field.Attr == dwarf.AttrType
-		})
-		if typeIdx >= 0 {
-			return entry.Field[typeIdx].Val.(dwarf.Offset), nil
-		}
-	}
-	return 0, fmt.Errorf("cannot determine type of variable")
-}
-
-// findArrayLength only works for 1-d array for now.
-func findArrayLength(reader *dwarf.Reader) (int64, error) {
-	for {
-		entry, err := reader.Next()
-		if err != nil {
-			log.Fatalf("Error decoding DWARF entry: %v", err)
-		}
-		if entry == nil {
-			break
-		}
-		if entry.Tag == dwarf.TagSubrangeType {
-			countIdx := slices.IndexFunc(entry.Field, func(field dwarf.Field) bool {
-				return field.Attr == dwarf.AttrCount
-			})
-			if countIdx >= 0 {
-				return entry.Field[countIdx].Val.(int64), nil
-			}
-		}
-	}
-	return 0, fmt.Errorf("cannot determine length of array type")
+// declare writes a global variable and a macro with the upper-cased name
+// referring to it, so that the BPF program can keep using the macro names.
+func declare(w io.Writer, name string) {
+	fmt.Fprintf(w, "volatile const uint64_t %s;\n", strings.ToLower(name))
+	fmt.Fprintf(w, "#define %s %s\n", strings.ToUpper(name), strings.ToLower(name))
 }
@@ -38,9 +38,11 @@ func main() {
 		logMode = flags.String("log_mode", "production", "logging mode (development or production)")
 		execServerAddr := flags.String("exec_server_addr", "exec-server:50052", "exec server address")
 		execTimeLimitSec := flags.Int("exec_time_limit", 70, "max time in second the tracee program can execute")
+		analysisCacheDir := flags.String("analysis_cache_dir", "", "directory to cache the analysis of tracee programs in, which grows without bound (caching is disabled if empty)")
+		enableAttachProcess := flags.Bool("enable_attach_process", false, "serve AttachProcess, which instruments any process on the host the server can trace (only for servers whose clients are trusted with the host)")
 
 		flags.Parse(args)
-		slowmoServer = server.NewSlowmoServer(*execServerAddr, *execTimeLimitSec)
+		slowmoServer = server.NewSlowmoServer(*execServerAddr, *execTimeLimitSec, *analysisCacheDir, *enableAttachProcess)
 	}
 	if len(os.Args) > 1 && os.Args[1] == "-wrapped" {
 		initWrappedServer(os.Args[2:])
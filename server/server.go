@@ -3,13 +3,16 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/cilium/ebpf"
@@ -25,18 +28,60 @@ import (
 
 const (
 	buildDir = "/tmp/slowmo-builds"
+	// The instrumentor works with programs built by any supported go version,
+	// as runtime offsets are resolved from the program at instrumentation.
+	instrumentorProg = "./instrumentor.o"
 )
 
-func startInstrumentation(bpfProg, targetPath string) (*instrumentation.Instrumentor, *instrumentation.EventReader) {
-	interpreter := instrumentation.NewELFInterpreter(targetPath)
+// instrumentationConfig holds per-request switches for the optional probes.
+type instrumentationConfig struct {
+	// When preemption is enabled, sysmon is allowed to preempt long-running
+	// goroutines and the preemption is reported as events. Otherwise
+	// preemption is suppressed to keep the visualization deterministic.
+	preemption bool
+	// Max number of frames to unwind for the user goroutine on delay and
+	// gopark events, where 0 disables unwinding.
+	stackTraceDepth uint64
+	// The already running process to attach to, or 0 if the target program is
+	// yet to be started by the exec server.
+	pid int
+}
 
-	runtimeSchedAddr := interpreter.GetGlobalVariableAddr("runtime.sched")
-	allpSliceAddr := interpreter.GetGlobalVariableAddr("runtime.allp")
-	waitReasonStringsAddr := interpreter.GetGlobalVariableAddr("runtime.waitReasonStrings")
-	instrumentor := instrumentation.NewInstrumentor(
-		interpreter,
-		bpfProg,
-		targetPath,
+func startInstrumentation(bpfProg string, interpreter *instrumentation.ELFInterpreter, targetPath string, config instrumentationConfig) (*instrumentation.Instrumentor, *instrumentation.EventReader, error) {
+	runtimeSchedAddr, err := interpreter.GetGlobalVariableAddr("runtime.sched")
+	if err != nil {
+		return nil, nil, err
+	}
+	allpSliceAddr, err := interpreter.GetGlobalVariableAddr("runtime.allp")
+	if err != nil {
+		return nil, nil, err
+	}
+	waitReasonStringsAddr, err := interpreter.GetGlobalVariableAddr("runtime.waitReasonStrings")
+	if err != nil {
+		return nil, nil, err
+	}
+	semtableAddr, err := interpreter.GetGlobalVariableAddr("runtime.semtable")
+	if err != nil {
+		return nil, nil, err
+	}
+	findRunnableEntryPC, findRunnableEndPC, _ := interpreter.GetFunctionRange("runtime.findRunnable")
+	gcphaseAddr, err := interpreter.GetGlobalVariableAddr("runtime.gcphase")
+	if err != nil {
+		return nil, nil, err
+	}
+	stwReasonStringsAddr, err := interpreter.GetGlobalVariableAddr("runtime.stwReasonStrings")
+	if err != nil {
+		return nil, nil, err
+	}
+	// Left as 0 if time.Sleep is never used by the target program.
+	goroutineReadyPC, _ := interpreter.GetFunctionEntry("runtime.goroutineReady")
+	newInstrumentor := func(opts ...instrumentation.InstrumentorOption) (*instrumentation.Instrumentor, error) {
+		if config.pid != 0 {
+			return instrumentation.NewProcessInstrumentor(interpreter, bpfProg, config.pid, opts...)
+		}
+		return instrumentation.NewInstrumentor(interpreter, bpfProg, targetPath, opts...)
+	}
+	instrumentor, err := newInstrumentor(
 		instrumentation.WithGlobalVariable(instrumentation.GlobalVariable[uint64]{
 			NameInBPFProg: "runtime_sched_addr",
 			Value:         runtimeSchedAddr,
@@ -49,117 +94,701 @@ func startInstrumentation(bpfProg, targetPath string) (*instrumentation.Instrume
 			NameInBPFProg: "waitreason_strings_addr",
 			Value:         waitReasonStringsAddr,
 		}),
+		instrumentation.WithGlobalVariable(instrumentation.GlobalVariable[uint64]{
+			NameInBPFProg: "semtable_addr",
+			Value:         semtableAddr,
+		}),
+		instrumentation.WithGlobalVariable(instrumentation.GlobalVariable[uint64]{
+			NameInBPFProg: "goroutine_ready_pc",
+			Value:         goroutineReadyPC,
+		}),
+		instrumentation.WithGlobalVariable(instrumentation.GlobalVariable[uint64]{
+			NameInBPFProg: "find_runnable_entry_pc",
+			Value:         findRunnableEntryPC,
+		}),
+		instrumentation.WithGlobalVariable(instrumentation.GlobalVariable[uint64]{
+			NameInBPFProg: "find_runnable_end_pc",
+			Value:         findRunnableEndPC,
+		}),
+		instrumentation.WithGlobalVariable(instrumentation.GlobalVariable[uint64]{
+			NameInBPFProg: "stack_trace_depth",
+			Value:         config.stackTraceDepth,
+		}),
+		instrumentation.WithGlobalVariable(instrumentation.GlobalVariable[uint64]{
+			NameInBPFProg: "gcphase_addr",
+			Value:         gcphaseAddr,
+		}),
+		instrumentation.WithGlobalVariable(instrumentation.GlobalVariable[uint64]{
+			NameInBPFProg: "stwreason_strings_addr",
+			Value:         stwReasonStringsAddr,
+		}),
+		instrumentation.WithGlobalVariable(instrumentation.GlobalVariable[uint64]{
+			NameInBPFProg: "entry_point_addr",
+			Value:         interpreter.EntryPoint(),
+		}),
 	)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Parse go functab and write the parsing result into a map to make it
 	// available in ebpf program, so that the ebpf program can perform things
 	// like callstack unwinding.
 	functabMap := instrumentor.GetMap("go_functab")
-	funcTab := interpreter.ParseFuncTab()
+	funcTab, err := interpreter.ParseFuncTab()
+	if err != nil {
+		instrumentor.Close()
+		return nil, nil, err
+	}
 	for i, funcInfo := range funcTab {
 		// Note that for BPF map of array type, there will be max_entry of
 		// key-value pairs upon creation of the map. Therefore manipulation of
 		// any KV acts as updating an existing entry.
 		err := functabMap.Update(uint32(i), funcInfo, ebpf.UpdateExist)
 		if err != nil {
-			logging.Logger().Fatalf("error writing function info into go_functab map; key: %d, value %+v, error: %v", i, funcInfo, err)
+			instrumentor.Close()
+			return nil, nil, fmt.Errorf("write function info into go_functab map (key: %d, value %+v): %w", i, funcInfo, err)
+		}
+	}
+
+	// Addresses taken from the ELF file are relocated by the load base of the
+	// target program, which is only nonzero for position-independent
+	// executables. It's reported by the entry point probe once the program
+	// starts, or read from the memory mappings of an already running process.
+	if config.pid != 0 {
+		loadBase, err := interpreter.ProcessLoadBase(config.pid)
+		if err != nil {
+			instrumentor.Close()
+			return nil, nil, err
 		}
+		interpreter.SetLoadBase(loadBase)
+		if err := instrumentor.GetMap("load_base").Update(uint32(0), loadBase, ebpf.UpdateExist); err != nil {
+			instrumentor.Close()
+			return nil, nil, fmt.Errorf("write load base into load_base map: %w", err)
+		}
+	} else if err := instrumentor.InstrumentEntryPoint([]string{"go_entry_point"}); err != nil {
+		instrumentor.Close()
+		return nil, nil, err
 	}
 
+	// Only the first error is kept, and later attachments are skipped once an
+	// error occurs.
+	var instrumentErr error
+	for _, spec := range functionSpecs(config) {
+		if instrumentErr = instrumentor.InstrumentFunction(spec); instrumentErr != nil {
+			break
+		}
+	}
+	if instrumentErr == nil {
+		instrumentErr = instrumentor.InstrumentPackage(instrumentation.PackageSpec{
+			TargetPkg: "main",
+			BpfFns:    []string{"delay"},
+		})
+	}
+	if instrumentErr == nil && config.pid != 0 {
+		// runtime.main has already run in a process being attached to.
+		instrumentErr = loadReasonStrings(instrumentor, interpreter)
+	}
+
+	if instrumentErr != nil {
+		instrumentor.Close()
+		return nil, nil, instrumentErr
+	}
+	if err := interpreter.SaveAnalysis(); err != nil {
+		logging.Logger().Warnf("Failed to save analysis of target program: %v", err)
+	}
+
+	ringbufReader, err := ringbuf.NewReader(instrumentor.GetMap("instrumentor_event"))
+	if err != nil {
+		instrumentor.Close()
+		return nil, nil, fmt.Errorf("create ring buffer reader: %w", err)
+	}
+	eventReader := instrumentation.NewEventReader(interpreter, ringbufReader)
+	eventReader.Start()
+	return instrumentor, eventReader, nil
+}
+
+// functionSpecs lists the functions of the target program to instrument.
+func functionSpecs(config instrumentationConfig) []instrumentation.FunctionSpec {
+	var specs []instrumentation.FunctionSpec
+
 	/* Capturing key events. */
-	instrumentor.InstrumentFunction(instrumentation.FunctionSpec{
+	specs = append(specs, instrumentation.FunctionSpec{
 		TargetPkg:    "runtime",
 		TargetFn:     "newproc",
 		AttachOffset: instrumentation.AttachOffsetEntry,
 		BpfFns:       []string{"go_newproc"},
 	})
-	instrumentor.InstrumentFunction(instrumentation.FunctionSpec{
+	specs = append(specs, instrumentation.FunctionSpec{
 		TargetPkg:    "runtime",
 		TargetFn:     "schedule",
 		AttachOffset: instrumentation.AttachOffsetEntry,
 		BpfFns:       []string{"go_schedule"},
 	})
-	instrumentor.InstrumentFunction(instrumentation.FunctionSpec{
+	specs = append(specs, instrumentation.FunctionSpec{
 		TargetPkg:    "runtime",
 		TargetFn:     "gopark",
 		AttachOffset: instrumentation.AttachOffsetEntry,
 		BpfFns:       []string{"go_gopark"},
 	})
-	instrumentor.InstrumentFunction(instrumentation.FunctionSpec{
+	specs = append(specs, instrumentation.FunctionSpec{
 		TargetPkg:    "runtime",
 		TargetFn:     "ready",
 		AttachOffset: instrumentation.AttachOffsetEntry,
 		BpfFns:       []string{"go_goready"},
 	})
+	if config.preemption {
+		specs = append(specs, instrumentation.FunctionSpec{
+			TargetPkg:    "runtime",
+			TargetFn:     "preemptone",
+			AttachOffset: instrumentation.AttachOffsetEntry,
+			BpfFns:       []string{"go_preemptone"},
+		})
+		specs = append(specs, instrumentation.FunctionSpec{
+			TargetPkg:    "runtime",
+			TargetFn:     "asyncPreempt",
+			AttachOffset: instrumentation.AttachOffsetRawEntry,
+			BpfFns:       []string{"go_async_preempt"},
+		})
+		specs = append(specs, instrumentation.FunctionSpec{
+			TargetPkg:    "runtime",
+			TargetFn:     "gopreempt_m",
+			AttachOffset: instrumentation.AttachOffsetEntry,
+			BpfFns:       []string{"go_gopreempt_m"},
+		})
+		specs = append(specs, instrumentation.FunctionSpec{
+			TargetPkg:    "runtime",
+			TargetFn:     "preemptPark",
+			AttachOffset: instrumentation.AttachOffsetEntry,
+			BpfFns:       []string{"go_preempt_park"},
+		})
+	}
+	// entersyscall, entersyscallblock and exitsyscallfast are nosplit and
+	// thus have no stack-splitting prologue to skip.
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "entersyscall",
+		AttachOffset: instrumentation.AttachOffsetRawEntry,
+		BpfFns:       []string{"go_entersyscall"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "entersyscallblock",
+		AttachOffset: instrumentation.AttachOffsetRawEntry,
+		BpfFns:       []string{"go_entersyscallblock"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "exitsyscallfast",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_exitsyscallfast_return"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "exitsyscall0",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_exitsyscall0"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "handoffp",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_handoffp"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "handoffp",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_handoffp_return"},
+	})
+	// startm wakes the idle M to receive the P handed off.
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "notewakeup",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_notewakeup"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "netpollblock",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_netpollblock"},
+		Optional:     true,
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "netpollready",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_netpollready"},
+		Optional:     true,
+	})
+	// Covers both findRunnable's and sysmon's netpoll path, right before the
+	// readied goroutines are injected back into runqs.
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "netpoll",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_netpoll_return"},
+	})
 
 	/* Inspecting goroutine-storing structures. */
-	instrumentor.InstrumentFunction(instrumentation.FunctionSpec{
+	specs = append(specs, instrumentation.FunctionSpec{
 		TargetPkg:    "runtime",
 		TargetFn:     "newproc",
 		AttachOffset: instrumentation.AttachOffsetReturns,
 		BpfFns:       []string{"go_runq_status"},
 	})
-	instrumentor.InstrumentFunction(instrumentation.FunctionSpec{
+	specs = append(specs, instrumentation.FunctionSpec{
 		TargetPkg:    "runtime",
 		TargetFn:     "execute",
 		AttachOffset: instrumentation.AttachOffsetEntry,
 		BpfFns:       []string{"go_execute"},
 	})
-	instrumentor.InstrumentFunction(instrumentation.FunctionSpec{
+	specs = append(specs, instrumentation.FunctionSpec{
 		TargetPkg:    "runtime",
 		TargetFn:     "goready",
 		AttachOffset: instrumentation.AttachOffsetReturns,
 		BpfFns:       []string{"go_goready_runq_status"},
 	})
-	// TODO: inspect globrunq when entering runtime.execute.
-
-	/* Helpers. */
-	instrumentor.InstrumentPackage(instrumentation.PackageSpec{
-		TargetPkg: "main",
-		BpfFns:    []string{"delay"},
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "runqsteal",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_runqsteal"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "runqgrab",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_runqgrab_return"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "runqsteal",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_runqsteal_return"},
+	})
+	// Globrunq is also inspected as part of go_execute.
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "globrunqput",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_globrunq_status"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "globrunqget",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_globrunq_status"},
+	})
+	// makechan records where each channel is made, so that the channel can be
+	// identified by its declaration site in later channel operations.
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "makechan",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_makechan_return"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "chansend",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_chansend"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "chanrecv",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_chanrecv"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "closechan",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_closechan"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "selectgo",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_selectgo"},
+		Optional:     true,
+	})
+	// sync.Mutex is only linked into programs using it, while semacquire1 and
+	// semrelease1 also back other primitives (e.g. sync.WaitGroup).
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "sync",
+		TargetFn:     "(*Mutex).Lock",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_mutex_lock"},
+		Optional:     true,
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "sync",
+		TargetFn:     "(*Mutex).Unlock",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_mutex_unlock"},
+		Optional:     true,
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "semacquire1",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_semacquire1"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "semrelease1",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_semrelease1"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "(*timers).addHeap",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_timers_add_heap"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "(*timer).unlockAndRun",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_timer_run"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "(*timers).adjust",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_timers_adjust"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "(*timers).adjust",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_timers_adjust_return"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "goexit1",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_goexit1"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "goexit0",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_goexit0"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "gopanic",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_gopanic"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "gorecover",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_gorecover_return"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "deferreturn",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_deferreturn"},
+	})
+	// fatalpanic is nosplit.
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "fatalpanic",
+		AttachOffset: instrumentation.AttachOffsetRawEntry,
+		BpfFns:       []string{"go_fatalpanic"},
+	})
+	// Only linked into programs built with the race detector, whose runtime
+	// symbolizes each frame of a race report and then calls __tsan_on_report
+	// once the report is printed.
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "raceSymbolizeCode",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_race_symbolize_code"},
+		Optional:     true,
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetFn:     "__tsan_on_report",
+		AttachOffset: instrumentation.AttachOffsetRawEntry,
+		BpfFns:       []string{"go_race_on_report"},
+		Optional:     true,
+	})
+	for _, target := range []struct {
+		fn     string
+		bpfFns []string
+	}{
+		{"newm", []string{"go_newm"}},
+		{"startm", []string{"go_startm"}},
+		{"stopm", []string{"go_stopm", "go_find_runnable_stopm"}},
+		{"wakep", []string{"go_wakep"}},
+		{"resetspinning", []string{"go_resetspinning"}},
+		// Schedule reasons not inferable from the callstack of schedule.
+		{"goschedImpl", []string{"go_gosched_impl"}},
+		{"startlockedm", []string{"go_startlockedm"}},
+		{"stoplockedm", []string{"go_stoplockedm"}},
+		{"gcstopm", []string{"go_gcstopm"}},
+	} {
+		specs = append(specs, instrumentation.FunctionSpec{
+			TargetPkg:    "runtime",
+			TargetFn:     target.fn,
+			AttachOffset: instrumentation.AttachOffsetEntry,
+			BpfFns:       target.bpfFns,
+		})
+	}
+	// mspinning is small enough to be built without the stack-splitting
+	// prologue, and dolockOSThread is nosplit.
+	for _, target := range []struct {
+		fn     string
+		bpfFns []string
+	}{
+		{"mspinning", []string{"go_mspinning"}},
+		// Called by both LockOSThread and the runtime-internal lockOSThread.
+		{"dolockOSThread", []string{"go_dolockosthread"}},
+	} {
+		specs = append(specs, instrumentation.FunctionSpec{
+			TargetPkg:    "runtime",
+			TargetFn:     target.fn,
+			AttachOffset: instrumentation.AttachOffsetRawEntry,
+			BpfFns:       target.bpfFns,
+		})
+	}
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "gcStart",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_gc_start"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "gcMarkDone",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_gc_mark_done"},
 	})
-	instrumentor.InstrumentFunction(instrumentation.FunctionSpec{
+	// gcBgMarkWorker drains mark work through one of the following functions
+	// depending on the worker mode of the P it runs on.
+	for _, drainFn := range []string{"gcDrainMarkWorkerDedicated", "gcDrainMarkWorkerFractional", "gcDrainMarkWorkerIdle"} {
+		specs = append(specs, instrumentation.FunctionSpec{
+			TargetPkg:    "runtime",
+			TargetFn:     drainFn,
+			AttachOffset: instrumentation.AttachOffsetEntry,
+			BpfFns:       []string{"go_gc_mark_worker_start"},
+		})
+		specs = append(specs, instrumentation.FunctionSpec{
+			TargetPkg:    "runtime",
+			TargetFn:     drainFn,
+			AttachOffset: instrumentation.AttachOffsetReturns,
+			BpfFns:       []string{"go_gc_mark_worker_stop"},
+		})
+	}
+	specs = append(specs, instrumentation.FunctionSpec{
 		TargetPkg:    "runtime",
-		TargetFn:     "retake",
+		TargetFn:     "gcAssistAlloc",
 		AttachOffset: instrumentation.AttachOffsetEntry,
-		BpfFns:       []string{"avoid_preempt"},
+		BpfFns:       []string{"go_gc_assist_alloc"},
 	})
-	instrumentor.InstrumentFunction(instrumentation.FunctionSpec{
+	specs = append(specs, instrumentation.FunctionSpec{
 		TargetPkg:    "runtime",
-		TargetFn:     "main",
+		TargetFn:     "stopTheWorldWithSema",
 		AttachOffset: instrumentation.AttachOffsetEntry,
-		BpfFns:       []string{"get_waitreason_strings"},
+		BpfFns:       []string{"go_stop_the_world"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "stopTheWorldWithSema",
+		AttachOffset: instrumentation.AttachOffsetReturns,
+		BpfFns:       []string{"go_stop_the_world_return"},
+	})
+	specs = append(specs, instrumentation.FunctionSpec{
+		TargetPkg:    "runtime",
+		TargetFn:     "startTheWorldWithSema",
+		AttachOffset: instrumentation.AttachOffsetEntry,
+		BpfFns:       []string{"go_start_the_world"},
 	})
 
-	ringbufReader, err := ringbuf.NewReader(instrumentor.GetMap("instrumentor_event"))
+	/* Helpers. */
+	if !config.preemption {
+		specs = append(specs, instrumentation.FunctionSpec{
+			TargetPkg:    "runtime",
+			TargetFn:     "retake",
+			AttachOffset: instrumentation.AttachOffsetEntry,
+			BpfFns:       []string{"avoid_preempt"},
+		})
+	}
+	if config.pid == 0 {
+		specs = append(specs, instrumentation.FunctionSpec{
+			TargetPkg:    "runtime",
+			TargetFn:     "main",
+			AttachOffset: instrumentation.AttachOffsetEntry,
+			BpfFns:       []string{"get_waitreason_strings", "get_stwreason_strings"},
+		})
+	}
+	return specs
+}
+
+// reasonStringMaxLen is the same as WAITREASON_STRING_MAX_LEN in
+// instrumentor.bpf.c.
+const reasonStringMaxLen = 40
+
+// loadReasonStrings fills the wait reason and stw reason string maps of the BPF
+// program from the target program, which is otherwise done by the probes on
+// runtime.main.
+func loadReasonStrings(instrumentor *instrumentation.Instrumentor, interpreter *instrumentation.ELFInterpreter) error {
+	runtimeOffsets, err := interpreter.RuntimeOffsets()
 	if err != nil {
-		logging.Logger().Fatal("Create ring buffer reader: ", err)
+		return fmt.Errorf("resolve runtime offsets: %w", err)
 	}
-	eventReader := instrumentation.NewEventReader(interpreter, ringbufReader)
-	eventReader.Start()
-	return instrumentor, eventReader
+	for _, target := range []struct {
+		varName, lengthName, mapName string
+	}{
+		{varName: "runtime.waitReasonStrings", lengthName: "runtime_waitreasonstrings_length", mapName: "waitreason_strings"},
+		{varName: "runtime.stwReasonStrings", lengthName: "runtime_stwreasonstrings_length", mapName: "stwreason_strings"},
+	} {
+		reasons, err := interpreter.ReadStringArray(target.varName, runtimeOffsets[target.lengthName])
+		if err != nil {
+			return err
+		}
+		reasonMap := instrumentor.GetMap(target.mapName)
+		for i, reason := range reasons {
+			if i >= int(reasonMap.MaxEntries()) {
+				break
+			}
+			// Truncated in the same way as by the BPF program, leaving room
+			// for the NUL byte.
+			var value [reasonStringMaxLen]byte
+			copy(value[:reasonStringMaxLen-1], reason)
+			if err := reasonMap.Update(uint32(i), value, ebpf.UpdateExist); err != nil {
+				return fmt.Errorf("write %s[%d] into %s map: %w", target.varName, i, target.mapName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isTargetProgramErr reports whether err is caused by the target program
+// being unusual, in which case it's reported to the user as a runtime result
+// instead of an internal error.
+func isTargetProgramErr(err error) bool {
+	return errors.Is(err, instrumentation.ErrSymbolNotFound) ||
+		errors.Is(err, instrumentation.ErrPrologueNotFound) ||
+		errors.Is(err, instrumentation.ErrUnknownPC) ||
+		errors.Is(err, instrumentation.ErrDecode) ||
+		errors.Is(err, instrumentation.ErrDWARFNotFound)
+}
+
+// raceReportPairer pairs the race reports printed by the program with the
+// probe events of the races, whichever comes first, so that each report is
+// sent right after the event of its race.
+type raceReportPairer struct {
+	// Reports received ahead of the events of their races.
+	pending []*proto.RaceReport
+	// Goroutines of the races detected whose reports are not received yet.
+	awaiting []int64
+}
+
+// raceDetected returns the report of a race detected on goroutine goID if it's
+// received, or nil if the report is to be sent once received.
+func (p *raceReportPairer) raceDetected(goID int64) *proto.RaceReport {
+	for i, report := range p.pending {
+		if report.GetCurrent().GetGoId() == goID {
+			p.pending = slices.Delete(p.pending, i, i+1)
+			return report
+		}
+	}
+	p.awaiting = append(p.awaiting, goID)
+	if len(p.awaiting) > raceReportBufferSize {
+		logging.Logger().Warnf("No race report received for race detected on goroutine %d", p.awaiting[0])
+		p.awaiting = p.awaiting[1:]
+	}
+	return nil
+}
+
+// reportReceived returns the reports to be sent as report is received, which
+// are report itself if its race is detected, or the oldest pending report if
+// too many are pending, e.g. when races are detected without the probe.
+func (p *raceReportPairer) reportReceived(report *proto.RaceReport) []*proto.RaceReport {
+	if i := slices.Index(p.awaiting, report.GetCurrent().GetGoId()); i >= 0 {
+		p.awaiting = slices.Delete(p.awaiting, i, i+1)
+		return []*proto.RaceReport{report}
+	}
+	p.pending = append(p.pending, report)
+	if len(p.pending) > raceReportBufferSize {
+		oldest := p.pending[0]
+		p.pending = p.pending[1:]
+		return []*proto.RaceReport{oldest}
+	}
+	return nil
+}
+
+// flush returns the reports left without a probe event.
+func (p *raceReportPairer) flush() []*proto.RaceReport {
+	for _, goID := range p.awaiting {
+		logging.Logger().Warnf("No race report received for race detected on goroutine %d", goID)
+	}
+	pending := p.pending
+	p.pending, p.awaiting = nil, nil
+	return pending
+}
+
+func sendRaceReport(stream grpc.ServerStreamingServer[proto.CompileAndRunResponse], report *proto.RaceReport) {
+	stream.Send(&proto.CompileAndRunResponse{
+		CompileAndRunOneof: &proto.CompileAndRunResponse_RaceReport{
+			RaceReport: report,
+		},
+	})
+}
+
+func sendRuntimeError(stream grpc.ServerStreamingServer[proto.CompileAndRunResponse], errMsg string) {
+	stream.Send(&proto.CompileAndRunResponse{
+		CompileAndRunOneof: &proto.CompileAndRunResponse_RuntimeResult{
+			RuntimeResult: &proto.RuntimeResult{
+				ErrorMessage: &errMsg,
+			},
+		},
+	})
 }
 
 type SlowmoServer struct {
 	proto.UnimplementedSlowmoServiceServer
 	execServerAddr   string
 	execTimeLimitSec int
+	// Directory to cache the analysis of target programs in, or empty if the
+	// analysis is not cached.
+	analysisCacheDir string
+	// Whether AttachProcess is served. Attaching instruments any process on
+	// the host the server can trace, so it's only meant for servers whose
+	// clients are trusted with the host.
+	attachProcessEnabled bool
 }
 
-func NewSlowmoServer(execServerAddr string, execTimeLimitSec int) proto.SlowmoServiceServer {
+func NewSlowmoServer(execServerAddr string, execTimeLimitSec int, analysisCacheDir string, attachProcessEnabled bool) proto.SlowmoServiceServer {
 	return &SlowmoServer{
-		execServerAddr:   execServerAddr,
-		execTimeLimitSec: execTimeLimitSec,
+		execServerAddr:       execServerAddr,
+		execTimeLimitSec:     execTimeLimitSec,
+		analysisCacheDir:     analysisCacheDir,
+		attachProcessEnabled: attachProcessEnabled,
 	}
 }
 
+// Max number of race reports received from the exec server ahead of the probe
+// events of the races, and of the races detected ahead of their reports.
+const raceReportBufferSize = 16
+
 func (server *SlowmoServer) CompileAndRun(req *proto.CompileAndRunRequest, stream grpc.ServerStreamingServer[proto.CompileAndRunResponse]) (compileAndRunErr error) {
 	var (
-		internalErr      error
-		wg               sync.WaitGroup
-		gomaxprocsSentCh = make(chan struct{})
-		execStream       grpc.ServerStreamingClient[proto.ExecResponse]
-		ctx              = stream.Context()
+		internalErr error
+		execErr     error
+		execStream  grpc.ServerStreamingClient[proto.ExecResponse]
+		// Responses derived from the exec response stream, which are sent
+		// along with the probe events by the handler, the only sender to
+		// the stream.
+		execRespCh = make(chan *proto.CompileAndRunResponse)
+		ctx        = stream.Context()
 	)
 
 	logging.Logger().Debug("Received CompileAndRun request")
@@ -172,7 +801,19 @@ func (server *SlowmoServer) CompileAndRun(req *proto.CompileAndRunRequest, strea
 		}
 	}()
 
-	outName, err := sandboxedBuild(req.GetSource(), *req.GoVersion)
+	if req.GoVersion == nil {
+		compileAndRunErr = fmt.Errorf("missing Go version in request")
+		return
+	}
+	if _, ok := buildModeFlags[req.GetBuildMode()]; !ok {
+		compileAndRunErr = fmt.Errorf("unknown build mode %v in request", req.GetBuildMode())
+		return
+	}
+	if req.GetStackTraceDepth() < 0 {
+		compileAndRunErr = fmt.Errorf("invalid stack trace depth %d in request", req.GetStackTraceDepth())
+		return
+	}
+	outName, err := sandboxedBuild(req.GetSource(), req.GetGoVersion(), req.GetBuildMode())
 	if err != nil {
 		if !errors.Is(err, errCompilation) {
 			internalErr = fmt.Errorf("internal error when building the program: %w", err)
@@ -200,12 +841,25 @@ func (server *SlowmoServer) CompileAndRun(req *proto.CompileAndRunRequest, strea
 		internalErr = fmt.Errorf("failed to connect to exec server at %s (error: %w)", server.execServerAddr, err)
 		return
 	}
+	defer conn.Close()
 
-	if req.GoVersion == nil {
-		compileAndRunErr = fmt.Errorf("missing Go version in request")
+	interpreter, err := instrumentation.NewELFInterpreter(outName, instrumentation.WithAnalysisCacheDir(server.analysisCacheDir))
+	if err != nil {
+		internalErr = fmt.Errorf("failed to interpret the program: %w", err)
+		return
+	}
+	instrumentor, probeEventReader, err := startInstrumentation(instrumentorProg, interpreter, outName, instrumentationConfig{
+		preemption:      req.GetEnablePreemption(),
+		stackTraceDepth: uint64(req.GetStackTraceDepth()),
+	})
+	if err != nil {
+		if isTargetProgramErr(err) {
+			sendRuntimeError(stream, fmt.Sprintf("cannot instrument the program: %v", err))
+		} else {
+			internalErr = fmt.Errorf("failed to instrument the program: %w", err)
+		}
 		return
 	}
-	instrumentor, probeEventReader := startInstrumentation(instrumentorProg(*req.GoVersion), outName)
 	logging.Logger().Debugf("Instrumentor started for program %s", outName)
 	defer instrumentor.Close()
 
@@ -222,12 +876,10 @@ func (server *SlowmoServer) CompileAndRun(req *proto.CompileAndRunRequest, strea
 		internalErr = fmt.Errorf("error requesting exec server at %s (error: %w)", server.execServerAddr, err)
 		return
 	}
-	wg.Add(1)
 	go func() {
 		defer func() {
 			probeEventReader.Close()
-			conn.Close()
-			wg.Done()
+			close(execRespCh)
 		}()
 		for {
 			execResp, err := execStream.Recv()
@@ -240,66 +892,277 @@ func (server *SlowmoServer) CompileAndRun(req *proto.CompileAndRunRequest, strea
 				// downstream exec server is cancelled.
 				errMsg := "execution time exceeds limit"
 				logging.Logger().Warn(errMsg)
-				stream.Send(&proto.CompileAndRunResponse{
+				execRespCh <- &proto.CompileAndRunResponse{
 					CompileAndRunOneof: &proto.CompileAndRunResponse_RuntimeResult{
 						RuntimeResult: &proto.RuntimeResult{
 							ErrorMessage: &errMsg,
 						},
 					},
-				})
+				}
 				return
 			}
 			if err != nil {
-				internalErr = fmt.Errorf("error receiving exec response: %w", err)
+				execErr = fmt.Errorf("error receiving exec response: %w", err)
 				return
 			}
 			if execResp.GetGomaxprocs() != 0 {
-				stream.Send(&proto.CompileAndRunResponse{
+				execRespCh <- &proto.CompileAndRunResponse{
 					CompileAndRunOneof: &proto.CompileAndRunResponse_Gomaxprocs{
 						Gomaxprocs: execResp.GetGomaxprocs(),
 					},
-				})
-				close(gomaxprocsSentCh)
+				}
 			} else if execResp.GetRuntimeOutput() != nil {
 				output := execResp.GetRuntimeOutput().GetOutput()
 				if strings.Contains(output, outName) {
 					output = strings.ReplaceAll(output, outName, "main")
 					execResp.GetRuntimeOutput().Output = &output
 				}
-				stream.Send(&proto.CompileAndRunResponse{
+				execRespCh <- &proto.CompileAndRunResponse{
 					CompileAndRunOneof: &proto.CompileAndRunResponse_RuntimeOutput{
 						RuntimeOutput: execResp.GetRuntimeOutput(),
 					},
-				})
+				}
+			} else if execResp.GetRaceReport() != nil {
+				execRespCh <- &proto.CompileAndRunResponse{
+					CompileAndRunOneof: &proto.CompileAndRunResponse_RaceReport{
+						RaceReport: execResp.GetRaceReport(),
+					},
+				}
 			} else if execResp.GetRuntimeResult() != nil {
-				stream.Send(&proto.CompileAndRunResponse{
+				execRespCh <- &proto.CompileAndRunResponse{
 					CompileAndRunOneof: &proto.CompileAndRunResponse_RuntimeResult{
 						RuntimeResult: execResp.GetRuntimeResult(),
 					},
-				})
+				}
 			}
 		}
 	}()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		// Synchronize to make sure gomaxprocs is the first stream message sent.
-		<-gomaxprocsSentCh
-		for event := range probeEventReader.ProbeEventCh {
+	var (
+		// Probe events are read once gomaxprocs is sent, so that it's the
+		// first stream message sent, or once the exec response stream ends
+		// without it.
+		probeEventCh       <-chan *proto.ProbeEvent
+		probeEventsStarted bool
+		raceReports        raceReportPairer
+		respCh             <-chan *proto.CompileAndRunResponse = execRespCh
+	)
+	startProbeEvents := func() {
+		if !probeEventsStarted {
+			probeEventCh = probeEventReader.ProbeEventCh
+			probeEventsStarted = true
+		}
+	}
+	for respCh != nil || probeEventCh != nil {
+		select {
+		case resp, ok := <-respCh:
+			if !ok {
+				respCh = nil
+				startProbeEvents()
+				continue
+			}
+			if report := resp.GetRaceReport(); report != nil {
+				// The report is sent along with the probe event of the
+				// race.
+				for _, report := range raceReports.reportReceived(report) {
+					sendRaceReport(stream, report)
+				}
+				continue
+			}
+			stream.Send(resp)
+			if resp.GetGomaxprocs() != 0 {
+				startProbeEvents()
+			}
+		case event, ok := <-probeEventCh:
+			if !ok {
+				probeEventCh = nil
+				continue
+			}
 			stream.Send(&proto.CompileAndRunResponse{
 				CompileAndRunOneof: &proto.CompileAndRunResponse_RunEvent{
 					RunEvent: event,
 				},
 			})
+			// Races detected on an M without a user goroutine cannot be
+			// told apart by the reports.
+			if raceDetected := event.GetNotificationEvent().GetRaceDetectedEvent(); raceDetected != nil && raceDetected.GoId != nil {
+				if report := raceReports.raceDetected(raceDetected.GetGoId()); report != nil {
+					sendRaceReport(stream, report)
+				}
+			}
+		}
+	}
+	// Reports left without a probe event are sent at the end.
+	for _, report := range raceReports.flush() {
+		sendRaceReport(stream, report)
+	}
+	if execErr != nil {
+		internalErr = errors.Join(internalErr, execErr)
+	}
+	if err := probeEventReader.Err(); err != nil {
+		if isTargetProgramErr(err) {
+			sendRuntimeError(stream, fmt.Sprintf("cannot interpret events of the program: %v", err))
+		} else {
+			internalErr = errors.Join(internalErr, fmt.Errorf("failed to read events: %w", err))
+		}
+	}
+	stream.Send(&proto.CompileAndRunResponse{
+		CompileAndRunOneof: &proto.CompileAndRunResponse_RunEvent{
+			RunEvent: probeEventReader.LifetimeSummaryEvent(),
+		},
+	})
+	logging.Logger().Debug("Finished serving CompileAndRun request")
+	return
+}
+
+// processPollInterval is how often AttachProcess checks whether the process
+// being attached to has exited.
+const processPollInterval = 500 * time.Millisecond
+
+func (server *SlowmoServer) AttachProcess(req *proto.AttachProcessRequest, stream grpc.ServerStreamingServer[proto.CompileAndRunResponse]) (attachProcessErr error) {
+	var (
+		internalErr error
+		pid         = int(req.GetPid())
+		ctx         = stream.Context()
+	)
+
+	logging.Logger().Debugf("Received AttachProcess request for pid %d", pid)
+	defer func() {
+		if err := recover(); err != nil {
+			internalErr = errors.Join(internalErr, fmt.Errorf("panic detected: %v", err))
+		}
+		if internalErr != nil {
+			attachProcessErr = fmt.Errorf("%w: unexpected error during AttachProcess (error: %v, pid: %d)", ErrInternalExecution, internalErr, pid)
 		}
 	}()
 
-	wg.Wait()
-	logging.Logger().Debug("Finished serving CompileAndRun request")
+	if !server.attachProcessEnabled {
+		attachProcessErr = status.Error(codes.PermissionDenied, "AttachProcess is disabled on this server")
+		return
+	}
+	if pid <= 0 {
+		attachProcessErr = fmt.Errorf("invalid pid %d in request", pid)
+		return
+	}
+	if req.GetStackTraceDepth() < 0 {
+		attachProcessErr = fmt.Errorf("invalid stack trace depth %d in request", req.GetStackTraceDepth())
+		return
+	}
+	if processExited(pid) {
+		attachProcessErr = fmt.Errorf("process %d not found", pid)
+		return
+	}
+	interpreter, err := instrumentation.NewELFInterpreter(instrumentation.ProcessExePath(pid), instrumentation.WithAnalysisCacheDir(server.analysisCacheDir))
+	if err != nil {
+		sendRuntimeError(stream, fmt.Sprintf("cannot interpret the executable of process %d: %v", pid, err))
+		return
+	}
+	gomaxprocs, err := readGomaxprocs(pid, interpreter)
+	if err != nil {
+		if isTargetProgramErr(err) {
+			sendRuntimeError(stream, fmt.Sprintf("cannot instrument process %d: %v", pid, err))
+		} else {
+			internalErr = fmt.Errorf("failed to read gomaxprocs of process %d: %w", pid, err)
+		}
+		return
+	}
+	instrumentor, probeEventReader, err := startInstrumentation(instrumentorProg, interpreter, instrumentation.ProcessExePath(pid), instrumentationConfig{
+		preemption:      req.GetEnablePreemption(),
+		stackTraceDepth: uint64(req.GetStackTraceDepth()),
+		pid:             pid,
+	})
+	if err != nil {
+		if isTargetProgramErr(err) {
+			sendRuntimeError(stream, fmt.Sprintf("cannot instrument process %d: %v", pid, err))
+		} else {
+			internalErr = fmt.Errorf("failed to instrument process %d: %w", pid, err)
+		}
+		return
+	}
+	logging.Logger().Debugf("Instrumentor attached to process %d", pid)
+	defer instrumentor.Close()
+
+	stream.Send(&proto.CompileAndRunResponse{
+		CompileAndRunOneof: &proto.CompileAndRunResponse_Gomaxprocs{
+			Gomaxprocs: gomaxprocs,
+		},
+	})
+	// Stop reading events once the process exits or the client goes away,
+	// which closes ProbeEventCh. The stream is only sent to by this goroutine,
+	// so the exit is reported after the events are drained.
+	var exited atomic.Bool
+	go func() {
+		defer probeEventReader.Close()
+		ticker := time.NewTicker(processPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if processExited(pid) {
+					exited.Store(true)
+					return
+				}
+			}
+		}
+	}()
+
+	for event := range probeEventReader.ProbeEventCh {
+		stream.Send(&proto.CompileAndRunResponse{
+			CompileAndRunOneof: &proto.CompileAndRunResponse_RunEvent{
+				RunEvent: event,
+			},
+		})
+	}
+	if err := probeEventReader.Err(); err != nil {
+		if isTargetProgramErr(err) {
+			sendRuntimeError(stream, fmt.Sprintf("cannot interpret events of process %d: %v", pid, err))
+		} else {
+			internalErr = fmt.Errorf("failed to read events: %w", err)
+		}
+	}
+	if exited.Load() {
+		sendRuntimeError(stream, fmt.Sprintf("process %d exited", pid))
+	}
+	stream.Send(&proto.CompileAndRunResponse{
+		CompileAndRunOneof: &proto.CompileAndRunResponse_RunEvent{
+			RunEvent: probeEventReader.LifetimeSummaryEvent(),
+		},
+	})
+	logging.Logger().Debugf("Finished serving AttachProcess request for pid %d", pid)
 	return
 }
 
+// processExited reports whether the process of pid no longer exists.
+func processExited(pid int) bool {
+	return errors.Is(syscall.Kill(pid, 0), syscall.ESRCH)
+}
+
+// readGomaxprocs reads runtime.gomaxprocs from the memory of the process of
+// pid, which is sent by the exec server for programs it runs.
+func readGomaxprocs(pid int, interpreter *instrumentation.ELFInterpreter) (int32, error) {
+	addr, err := interpreter.GetGlobalVariableAddr("runtime.gomaxprocs")
+	if err != nil {
+		return 0, err
+	}
+	base, err := interpreter.ProcessLoadBase(pid)
+	if err != nil {
+		return 0, err
+	}
+	addr += base
+	mem, err := os.Open(fmt.Sprintf("/proc/%d/mem", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer mem.Close()
+	buf := make([]byte, 4)
+	if _, err := mem.ReadAt(buf, int64(addr)); err != nil {
+		return 0, fmt.Errorf("read process memory at 0x%x: %w", addr, err)
+	}
+	return int32(binary.NativeEndian.Uint32(buf)), nil
+}
+
 var (
 	errCompilation = fmt.Errorf("")
 )
@@ -316,7 +1179,19 @@ func (ce compileError) Is(target error) bool {
 	return target == errCompilation
 }
 
-func sandboxedBuild(source, goVersion string) (string, error) {
+// buildModeFlags are the flags passed to go build in each build mode. The debug
+// build keeps the code of each line in place, while the optimized build shows
+// the scheduling of the code that runs in production, where e.g. inlining
+// changes where goroutines block. The runtime is never built with inlining,
+// which would leave no function to attach some of the probes to (e.g.
+// runqgrab inlined into runqsteal).
+var buildModeFlags = map[proto.BuildMode][]string{
+	proto.BuildMode_BUILD_DEBUG:     {"-gcflags=all=-N -l"},
+	proto.BuildMode_BUILD_OPTIMIZED: {"-gcflags=runtime=-l"},
+	proto.BuildMode_BUILD_RACE:      {"-race", "-gcflags=all=-N -l"},
+}
+
+func sandboxedBuild(source, goVersion string, buildMode proto.BuildMode) (string, error) {
 	tempFile, err := os.CreateTemp(buildDir, "target-*.go")
 	if err != nil {
 		logging.Logger().Errorf("Failed to create temp file: %v", err)
@@ -332,7 +1207,13 @@ func sandboxedBuild(source, goVersion string) (string, error) {
 	}()
 
 	outName := strings.TrimSuffix(tempFile.Name(), ".go")
-	goBuildCmd := exec.Command("/usr/bin/env", goBin(goVersion), "build", "-gcflags=all=-N -l", "-o", outName, tempFile.Name())
+	args := append([]string{goBin(goVersion), "build"}, buildModeFlags[buildMode]...)
+	args = append(args, "-o", outName, tempFile.Name())
+	goBuildCmd := exec.Command("/usr/bin/env", args...)
+	if buildMode == proto.BuildMode_BUILD_RACE {
+		// The race detector runtime requires cgo.
+		goBuildCmd.Env = append(os.Environ(), "CGO_ENABLED=1")
+	}
 	buf := bytes.Buffer{}
 	goBuildCmd.Stdout = &buf
 	goBuildCmd.Stderr = &buf
@@ -345,10 +1226,6 @@ func sandboxedBuild(source, goVersion string) (string, error) {
 	return outName, nil
 }
 
-func instrumentorProg(goVersion string) string {
-	return fmt.Sprintf("./instrumentor%s.o", goVersion)
-}
-
 func goBin(goVersion string) string {
 	return fmt.Sprintf("go%s", goVersion)
 }
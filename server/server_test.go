@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/kailun2047/slowmo/instrumentation"
+	"github.com/kailun2047/slowmo/logging"
+	"github.com/kailun2047/slowmo/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFunctionSpecs_OptimizedBuild(t *testing.T) {
+	logging.InitZapLogger("production")
+	interpreter, err := instrumentation.NewELFInterpreter("./testdata/optimized")
+	if err != nil {
+		t.Fatalf("Create interpreter: %v", err)
+	}
+
+	for _, config := range []instrumentationConfig{
+		{preemption: false},
+		{preemption: true},
+		{preemption: true, pid: 1},
+	} {
+		for _, spec := range functionSpecs(config) {
+			if spec.Optional {
+				continue
+			}
+			if _, offsets, err := interpreter.ResolveFunctionSpec(spec); err != nil || len(offsets) == 0 {
+				t.Errorf("Function %s.%s (attach offset %d) cannot be instrumented (offsets: %v, err: %v)", spec.TargetPkg, spec.TargetFn, spec.AttachOffset, offsets, err)
+			}
+		}
+	}
+}
+
+func TestFunctionSpecs_Order(t *testing.T) {
+	config := instrumentationConfig{preemption: true}
+	specs := functionSpecs(config)
+	for range 10 {
+		if again := functionSpecs(config); !reflect.DeepEqual(specs, again) {
+			t.Fatalf("Expected the same function specs in the same order, got %v and %v", specs, again)
+		}
+	}
+}
+
+func TestRaceReportPairer(t *testing.T) {
+	logging.InitZapLogger("production")
+	reportOn := func(goID int64) *proto.RaceReport {
+		return &proto.RaceReport{Current: &proto.RaceAccess{GoId: &goID}}
+	}
+	var pairer raceReportPairer
+
+	if reports := pairer.reportReceived(reportOn(7)); len(reports) != 0 {
+		t.Errorf("Expected report of goroutine 7 to be pending, got %v", reports)
+	}
+	if report := pairer.raceDetected(8); report != nil {
+		t.Errorf("Expected no report of goroutine 8 yet, got %v", report)
+	}
+	if reports := pairer.reportReceived(reportOn(8)); len(reports) != 1 || reports[0].GetCurrent().GetGoId() != 8 {
+		t.Errorf("Expected report of goroutine 8 to be sent once received, got %v", reports)
+	}
+	if report := pairer.raceDetected(7); report.GetCurrent().GetGoId() != 7 {
+		t.Errorf("Expected pending report of goroutine 7, got %v", report)
+	}
+	for goID := range int64(raceReportBufferSize) {
+		pairer.reportReceived(reportOn(100 + goID))
+	}
+	if reports := pairer.reportReceived(reportOn(9)); len(reports) != 1 || reports[0].GetCurrent().GetGoId() != 100 {
+		t.Errorf("Expected oldest pending report of goroutine 100 to be sent, got %v", reports)
+	}
+	if reports := pairer.flush(); len(reports) != raceReportBufferSize || reports[len(reports)-1].GetCurrent().GetGoId() != 9 {
+		t.Errorf("Expected %d pending reports ending with goroutine 9, got %v", raceReportBufferSize, reports)
+	}
+}
+
+// fakeStream records the responses sent by a handler.
+type fakeStream struct {
+	grpc.ServerStream
+	responses []*proto.CompileAndRunResponse
+}
+
+func (s *fakeStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *fakeStream) Send(resp *proto.CompileAndRunResponse) error {
+	s.responses = append(s.responses, resp)
+	return nil
+}
+
+func TestCompileAndRun_InvalidRequest(t *testing.T) {
+	logging.InitZapLogger("production")
+	goVersion := "go1.25.4"
+	buildMode := proto.BuildMode(-1)
+	stackTraceDepth := int32(-1)
+	server := NewSlowmoServer("localhost:0", 0, "", false)
+
+	for name, req := range map[string]*proto.CompileAndRunRequest{
+		"MissingGoVersion":   {},
+		"UnknownBuildMode":   {GoVersion: &goVersion, BuildMode: buildMode},
+		"NegativeStackDepth": {GoVersion: &goVersion, StackTraceDepth: &stackTraceDepth},
+	} {
+		stream := &fakeStream{}
+		err := server.CompileAndRun(req, stream)
+		if err == nil || errors.Is(err, ErrInternalExecution) {
+			t.Errorf("%s: expected the request to be rejected, got %v", name, err)
+		}
+		if len(stream.responses) != 0 {
+			t.Errorf("%s: expected no response sent, got %v", name, stream.responses)
+		}
+	}
+}
+
+func TestAttachProcess_Disabled(t *testing.T) {
+	logging.InitZapLogger("production")
+	server := NewSlowmoServer("localhost:0", 0, "", false)
+
+	pid := int32(os.Getpid())
+	stream := &fakeStream{}
+	err := server.AttachProcess(&proto.AttachProcessRequest{Pid: &pid}, stream)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected AttachProcess to be denied, got %v", err)
+	}
+	if len(stream.responses) != 0 {
+		t.Errorf("Expected no response sent, got %v", stream.responses)
+	}
+}
@@ -0,0 +1,42 @@
+// Source of optimized, built in the optimized build mode with the oldest go
+// release supported by the runtime probes:
+//
+//	GOTOOLCHAIN=go1.25.4 go build -gcflags=runtime=-l -o optimized optimized.go
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+func main() {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		count int
+	)
+	ch := make(chan int)
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.Lock()
+			count += i
+			mu.Unlock()
+			select {
+			case ch <- i:
+			case <-time.After(time.Millisecond):
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	for i := range ch {
+		fmt.Println(i)
+	}
+	fmt.Println(count)
+}